@@ -0,0 +1,294 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// ArchiveManifest is an entry of the manifest.json written by `docker save`, describing one
+// image in the archive by paths relative to the archive's root
+type ArchiveManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// loadCommand imports every image of a `docker save` tarball into the layer store and the
+// local image index, so that run can use them by tag without contacting a registry.
+//
+// Usage: your_docker.sh load <tarfile>
+func loadCommand(arguments []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+	archivePath := flags.Arg(0)
+
+	f, err := os.Open(archivePath)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	defer f.Close()
+
+	manifests, links, err := readArchiveManifests(f)
+	if err != nil {
+		fmt.Printf("could not read archive %s: %s\n", archivePath, err)
+		os.Exit(1)
+	}
+	if len(manifests) == 0 {
+		fmt.Printf("archive %s has no manifest.json describing its images; is it the output of docker save?\n", archivePath)
+		os.Exit(1)
+	}
+
+	for i := range manifests {
+		image, err := readArchiveImage(f, &manifests[i], links)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		if len(manifests[i].RepoTags) == 0 {
+			// Without a tag the image has no name to run it by
+			fmt.Printf("Loaded image ID: %s\n", image.Digest)
+			continue
+		}
+		for _, tag := range manifests[i].RepoTags {
+			if err := storeImage(tag, image); err != nil {
+				fmt.Printf("could not record image %s: %s\n", tag, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Loaded image: %s\n", tag)
+		}
+	}
+}
+
+// loadArchive reads an image from a `docker save` tarball without contacting a registry. Its
+// layers are copied into the layer store so that they can be extracted like pulled layers.
+// When the archive holds several images, ref selects one of them by its repository tag.
+func loadArchive(archivePath, ref string) (*[]ImageLayer, *DockerImageConfig, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	manifests, links, err := readArchiveManifests(f)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read archive %s: %w", archivePath, err)
+	}
+	manifest, err := selectArchiveImage(manifests, ref)
+	if err != nil {
+		return nil, nil, err
+	}
+	image, err := readArchiveImage(f, manifest, links)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &image.Layers, image.Config, nil
+}
+
+// readArchiveManifests reads the manifest.json of an archive along with the links between its
+// entries. The manifest may come after the files it refers to, so this is a pass of its own.
+func readArchiveManifests(f *os.File) ([]ArchiveManifest, map[string]string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, nil, err
+	}
+	var manifests []ArchiveManifest
+	links := make(map[string]string)
+	err := walkArchive(f, func(header *tar.Header, r io.Reader) error {
+		name := path.Clean(header.Name)
+		switch {
+		case header.Typeflag == tar.TypeSymlink:
+			links[name] = path.Join(path.Dir(name), header.Linkname)
+		case header.Typeflag == tar.TypeLink:
+			links[name] = path.Clean(header.Linkname)
+		case name == "manifest.json":
+			return json.NewDecoder(r).Decode(&manifests)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return manifests, links, nil
+}
+
+// readArchiveImage copies the layers of the image described by manifest into the layer store
+// and decodes its configuration. As an archive has no image manifest, the image is identified
+// by the digest of its configuration, as docker does for image IDs.
+func readArchiveImage(f *os.File, manifest *ArchiveManifest, links map[string]string) (*ResolvedImage, error) {
+	// Identical layers may be stored once and linked to from elsewhere in the archive
+	resolve := func(name string) string {
+		name = path.Clean(name)
+		for i := 0; i < 16; i++ {
+			target, ok := links[name]
+			if !ok {
+				break
+			}
+			name = target
+		}
+		return name
+	}
+
+	wanted := make(map[string]bool)
+	configPath := resolve(manifest.Config)
+	wanted[configPath] = true
+	for _, layer := range manifest.Layers {
+		wanted[resolve(layer)] = true
+	}
+
+	var config *DockerImageConfig
+	var configDigest string
+	stored := make(map[string]*ImageLayer)
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	err := walkArchive(f, func(header *tar.Header, r io.Reader) error {
+		name := path.Clean(header.Name)
+		if header.Typeflag != tar.TypeReg || !wanted[name] {
+			return nil
+		}
+		if name == configPath {
+			hash := sha256.New()
+			config = &DockerImageConfig{}
+			if err := json.NewDecoder(io.TeeReader(r, hash)).Decode(config); err != nil {
+				return err
+			}
+			// The decoder may stop short of trailing whitespace, which is part of the digest
+			if _, err := io.Copy(hash, r); err != nil {
+				return err
+			}
+			configDigest = fmt.Sprintf("sha256:%x", hash.Sum(nil))
+			return nil
+		}
+		layer, err := storeArchiveLayer(r)
+		if err != nil {
+			return fmt.Errorf("could not store layer %s: %w", name, err)
+		}
+		stored[name] = layer
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read archive %s: %w", f.Name(), err)
+	}
+
+	if config == nil {
+		return nil, fmt.Errorf("archive %s is missing the image configuration %s", f.Name(), manifest.Config)
+	}
+	layers := make([]ImageLayer, 0, len(manifest.Layers))
+	for _, name := range manifest.Layers {
+		layer, ok := stored[resolve(name)]
+		if !ok {
+			return nil, fmt.Errorf("archive %s is missing the layer %s", f.Name(), name)
+		}
+		layers = append(layers, ImageLayer{Manifest: layer.Manifest, Sha256Sum: layer.Sha256Sum})
+	}
+	image := &ResolvedImage{
+		Digest:   configDigest,
+		Platform: config.platform(),
+		Layers:   layers,
+		Config:   config,
+	}
+	if len(manifest.RepoTags) > 0 {
+		image.Reference = canonicalReference(manifest.RepoTags[0])
+	}
+	return image, nil
+}
+
+// walkArchive calls fn with each entry of the tar archive read from r
+func walkArchive(r io.Reader, fn func(header *tar.Header, r io.Reader) error) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(header, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// selectArchiveImage picks the image to run from an archive's manifest. An archive holding a
+// single image needs no reference, but with several one must be given to choose between them.
+func selectArchiveImage(manifests []ArchiveManifest, ref string) (*ArchiveManifest, error) {
+	if len(manifests) == 0 {
+		return nil, errors.New("archive has no manifest.json describing its images; is it the output of docker save?")
+	}
+	if ref == "" {
+		if len(manifests) > 1 {
+			return nil, fmt.Errorf("archive contains %d images, select one with --ref", len(manifests))
+		}
+		return &manifests[0], nil
+	}
+
+	for i, manifest := range manifests {
+		for _, tag := range manifest.RepoTags {
+			if canonicalReference(tag) == canonicalReference(ref) {
+				return &manifests[i], nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("archive does not contain an image tagged %s", ref)
+}
+
+// storeArchiveLayer copies a layer from an archive into the layer store, keyed by its digest.
+// Layers saved by docker are usually uncompressed tars, so the media type is chosen from the content.
+func storeArchiveLayer(r io.Reader) (*ImageLayer, error) {
+	if err := os.MkdirAll(ImageLayersPath, 0600); err != nil {
+		return nil, errors.New("could not create directory for this image")
+	}
+	f, err := os.CreateTemp(ImageLayersPath, "archive.*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	br := bufio.NewReader(r)
+	mediaType := string(OCIImageTypeLayer)
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && bytes.Equal(magic, gzipMagic) {
+		mediaType = string(DockerImageTypeRootFs)
+	}
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	if _, err := io.Copy(io.MultiWriter(f, hash, counter), br); err != nil {
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	sum := fmt.Sprintf("%x", hash.Sum(nil))
+	if err := os.Rename(f.Name(), filepath.Join(ImageLayersPath, sum+".tar.gz")); err != nil {
+		return nil, err
+	}
+	return &ImageLayer{
+		Manifest: Manifest{
+			Digest:    "sha256:" + sum,
+			MediaType: mediaType,
+			Size:      int(counter.n),
+		},
+		Sha256Sum: sum,
+	}, nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveImage is an image to write into a docker save archive under tags
+type archiveImage struct {
+	tags  []string
+	image *fakeImage
+}
+
+// archiveEntries lays images out as docker save does, with each layer at <digest>/layer.tar and
+// the configurations and manifest.json at the top level
+func archiveEntries(t *testing.T, images ...archiveImage) []tarEntry {
+	t.Helper()
+	var entries []tarEntry
+	var manifests []ArchiveManifest
+	for _, image := range images {
+		config := strings.TrimPrefix(digestOf(image.image.config), "sha256:") + ".json"
+		manifest := ArchiveManifest{Config: config, RepoTags: image.tags}
+		entries = append(entries, tarFile(config, string(image.image.config)))
+		for _, layer := range image.image.layers {
+			dir := strings.TrimPrefix(digestOf(layer), "sha256:")
+			entries = append(entries, tarDir(dir+"/"), tarFile(dir+"/layer.tar", string(layer)))
+			manifest.Layers = append(manifest.Layers, dir+"/layer.tar")
+		}
+		manifests = append(manifests, manifest)
+	}
+	data, err := json.Marshal(manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return append(entries, tarFile("manifest.json", string(data)))
+}
+
+// writeArchive writes a tar of entries, returning its path
+func writeArchive(t *testing.T, entries []tarEntry) string {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(name, buildTar(t, entries), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+func TestSelectArchiveImage(t *testing.T) {
+	one := ArchiveManifest{RepoTags: []string{"one:latest"}}
+	two := ArchiveManifest{RepoTags: []string{"docker.io/library/two:1.0", "two:latest"}}
+	tests := []struct {
+		name      string
+		manifests []ArchiveManifest
+		ref       string
+		want      string
+		wantErr   string
+	}{
+		{name: "only image", manifests: []ArchiveManifest{one}, want: "one:latest"},
+		{name: "only image by tag", manifests: []ArchiveManifest{one}, ref: "one", want: "one:latest"},
+		{name: "by tag", manifests: []ArchiveManifest{one, two}, ref: "two:latest", want: "docker.io/library/two:1.0"},
+		{name: "by normalized tag", manifests: []ArchiveManifest{one, two}, ref: "library/two:1.0", want: "docker.io/library/two:1.0"},
+		{name: "several without tag", manifests: []ArchiveManifest{one, two}, wantErr: "archive contains 2 images, select one with --ref"},
+		{name: "unknown tag", manifests: []ArchiveManifest{one, two}, ref: "three", wantErr: "archive does not contain an image tagged three"},
+		{name: "no manifests", wantErr: "archive has no manifest.json describing its images"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectArchiveImage(tt.manifests, tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("selectArchiveImage returned error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("selectArchiveImage: %v", err)
+			}
+			if got.RepoTags[0] != tt.want {
+				t.Errorf("selectArchiveImage picked %q, want %q", got.RepoTags, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadArchive(t *testing.T) {
+	compressed := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	uncompressed := buildTar(t, []tarEntry{tarFile("b", "b")})
+	first := newFakeImageWith(t, OCIImageConfig{Cmd: []string{"first"}}, compressed, uncompressed)
+	second := newFakeImageWith(t, OCIImageConfig{Cmd: []string{"second"}}, compressed)
+	both := archiveEntries(t, archiveImage{[]string{"first:latest"}, first}, archiveImage{[]string{"second:latest"}, second})
+
+	// linked holds the files of first, with the second image's layer a symlink to the one they share
+	secondConfig := strings.TrimPrefix(digestOf(second.config), "sha256:") + ".json"
+	linkedManifest, err := json.Marshal([]ArchiveManifest{{Config: secondConfig, RepoTags: []string{"second:latest"}, Layers: []string{"shared/layer.tar"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstOnly := archiveEntries(t, archiveImage{[]string{"first:latest"}, first})
+	linked := append(firstOnly[:len(firstOnly)-1:len(firstOnly)-1],
+		tarFile(secondConfig, string(second.config)),
+		tarDir("shared/"),
+		tarSymlink("shared/layer.tar", "../"+strings.TrimPrefix(digestOf(compressed), "sha256:")+"/layer.tar"),
+		tarFile("manifest.json", string(linkedManifest)),
+	)
+
+	// The entries of first are its configuration, then a directory and file for each layer
+	withoutLayer := append(firstOnly[:1:1], firstOnly[3:]...)
+
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		ref     string
+		wantCmd string
+		// wantLayers are the layers loaded, each with its media type
+		wantLayers [][2]string
+		wantErr    string
+	}{
+		{
+			name:       "single image",
+			entries:    archiveEntries(t, archiveImage{[]string{"first:latest"}, first}),
+			wantCmd:    "first",
+			wantLayers: [][2]string{{digestOf(compressed), string(DockerImageTypeRootFs)}, {digestOf(uncompressed), string(OCIImageTypeLayer)}},
+		},
+		{
+			name:       "untagged image",
+			entries:    archiveEntries(t, archiveImage{nil, first}),
+			wantCmd:    "first",
+			wantLayers: [][2]string{{digestOf(compressed), string(DockerImageTypeRootFs)}, {digestOf(uncompressed), string(OCIImageTypeLayer)}},
+		},
+		{
+			name:       "selected image",
+			entries:    both,
+			ref:        "second",
+			wantCmd:    "second",
+			wantLayers: [][2]string{{digestOf(compressed), string(DockerImageTypeRootFs)}},
+		},
+		{
+			name:       "linked layer",
+			entries:    linked,
+			ref:        "second",
+			wantCmd:    "second",
+			wantLayers: [][2]string{{digestOf(compressed), string(DockerImageTypeRootFs)}},
+		},
+		{
+			name:    "several images",
+			entries: both,
+			wantErr: "archive contains 2 images, select one with --ref",
+		},
+		{
+			name:    "no manifest",
+			entries: []tarEntry{tarFile("layer.tar", string(uncompressed))},
+			wantErr: "archive has no manifest.json",
+		},
+		{
+			name:    "missing layer",
+			entries: withoutLayer,
+			wantErr: "is missing the layer",
+		},
+		{
+			name:    "missing config",
+			entries: firstOnly[1:],
+			wantErr: "is missing the image configuration",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			layers, config, err := loadArchive(writeArchive(t, tt.entries), tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadArchive returned error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadArchive: %v", err)
+			}
+			if got := strings.Join(config.Config.Cmd, " "); got != tt.wantCmd {
+				t.Errorf("loaded configuration has Cmd %q, want %q", got, tt.wantCmd)
+			}
+			var got [][2]string
+			for _, layer := range *layers {
+				got = append(got, [2]string{layer.Digest, layer.MediaType})
+				if _, err := os.Stat(filepath.Join(ImageLayersPath, layer.Sha256Sum+".tar.gz")); err != nil {
+					t.Errorf("layer %s is not in the layer store: %v", layer.Digest, err)
+				}
+			}
+			if len(got) != len(tt.wantLayers) {
+				t.Fatalf("loaded layers %q, want %q", got, tt.wantLayers)
+			}
+			for i := range got {
+				if got[i] != tt.wantLayers[i] {
+					t.Errorf("layer %d is %q, want %q", i, got[i], tt.wantLayers[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCapabilitySet(t *testing.T) {
+	base := []string{"CAP_CHOWN", "CAP_KILL", "CAP_NET_RAW"}
+	tests := []struct {
+		name    string
+		add     []string
+		drop    []string
+		want    []string
+		wantErr string
+	}{
+		{name: "base", want: base},
+		{name: "add", add: []string{"CAP_SYS_ADMIN"}, want: []string{"CAP_CHOWN", "CAP_KILL", "CAP_NET_RAW", "CAP_SYS_ADMIN"}},
+		{name: "drop", drop: []string{"CAP_KILL"}, want: []string{"CAP_CHOWN", "CAP_NET_RAW"}},
+		{name: "without prefix", add: []string{"sys_admin"}, drop: []string{"net_raw"}, want: []string{"CAP_CHOWN", "CAP_KILL", "CAP_SYS_ADMIN"}},
+		{name: "mixed case", drop: []string{" Cap_Chown "}, want: []string{"CAP_KILL", "CAP_NET_RAW"}},
+		{name: "drop all", drop: []string{"ALL"}, want: []string{}},
+		{name: "drop all then add", drop: []string{"all"}, add: []string{"NET_BIND_SERVICE"}, want: []string{"CAP_NET_BIND_SERVICE"}},
+		{name: "add wins over drop", add: []string{"KILL"}, drop: []string{"KILL"}, want: base},
+		{name: "drop missing", drop: []string{"SYS_ADMIN"}, want: base},
+		{name: "unknown add", add: []string{"bogus"}, wantErr: "unknown capability: CAP_BOGUS"},
+		{name: "unknown drop", drop: []string{"CAP_BOGUS"}, wantErr: "unknown capability: CAP_BOGUS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := capabilitySet(base, tt.add, tt.drop)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("capabilitySet returned error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("capabilitySet: %v", err)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("capabilitySet = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	all, err := capabilitySet(nil, []string{"ALL"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != len(capabilities) {
+		t.Errorf("capabilitySet with ALL added holds %d capabilities, want %d", len(all), len(capabilities))
+	}
+}
+
+func TestRunCapabilities(t *testing.T) {
+	requireContainers(t)
+	last, err := lastCapability()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// mask is the bounding set expected in the container when it keeps names
+	mask := func(names ...string) uint64 {
+		var mask uint64
+		for _, name := range names {
+			if capability := capabilities[name]; capability <= last {
+				mask |= 1 << uint(capability)
+			}
+		}
+		return mask
+	}
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantCode   int
+		wantBnd    uint64
+		wantStdout string
+	}{
+		{name: "default", wantBnd: mask(defaultCapabilities...)},
+		{name: "drop all", flags: []string{"--cap-drop", "ALL"}, wantBnd: 0},
+		{name: "drop all add one", flags: []string{"--cap-drop", "ALL", "--cap-add", "chown"}, wantBnd: mask("CAP_CHOWN")},
+		{name: "add", flags: []string{"--cap-add", "SYS_ADMIN"}, wantBnd: mask(append([]string{"CAP_SYS_ADMIN"}, defaultCapabilities...)...)},
+		{name: "unknown", flags: []string{"--cap-add", "bogus"}, wantCode: 1, wantStdout: "unknown capability: CAP_BOGUS\n"},
+	}
+
+	capBnd := regexp.MustCompile(`(?m)^CapBnd:\s*([0-9a-f]+)$`)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "cat", "/proc/self/status")
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if tt.wantCode != 0 {
+				if stdout != tt.wantStdout {
+					t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+				}
+				return
+			}
+			match := capBnd.FindStringSubmatch(stdout)
+			if match == nil {
+				t.Fatalf("no CapBnd in the container's /proc/self/status:\n%s", stdout)
+			}
+			got, err := strconv.ParseUint(match[1], 16, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.wantBnd {
+				t.Errorf("bounding set in the container is %#x, want %#x", got, tt.wantBnd)
+			}
+		})
+	}
+}
+
+func TestDefaultCapabilities(t *testing.T) {
+	tests := []struct {
+		capability string
+		want       bool
+	}{
+		{capability: "CAP_CHOWN", want: true},
+		{capability: "CAP_DAC_OVERRIDE", want: true},
+		{capability: "CAP_KILL", want: true},
+		{capability: "CAP_NET_BIND_SERVICE", want: true},
+		{capability: "CAP_SETUID", want: true},
+		{capability: "CAP_SYS_CHROOT", want: true},
+		{capability: "CAP_SYS_ADMIN"},
+		{capability: "CAP_NET_ADMIN"},
+		{capability: "CAP_SYS_MODULE"},
+		{capability: "CAP_SYS_PTRACE"},
+		{capability: "CAP_SYS_TIME"},
+		{capability: "CAP_DAC_READ_SEARCH"},
+		{capability: "CAP_BPF"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.capability, func(t *testing.T) {
+			if _, ok := capabilities[tt.capability]; !ok {
+				t.Fatalf("%s is not a known capability", tt.capability)
+			}
+			set, err := capabilitySet(defaultCapabilities, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := containsString(set, tt.capability); got != tt.want {
+				t.Errorf("default capabilities include %s: %t, want %t", tt.capability, got, tt.want)
+			}
+		})
+	}
+
+	for _, name := range defaultCapabilities {
+		if _, ok := capabilities[name]; !ok {
+			t.Errorf("default capability %s is not a known capability", name)
+		}
+	}
+}
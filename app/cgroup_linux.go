@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	cgroupRoot = "/sys/fs/cgroup"
+	// cgroupParent groups every container's cgroup beneath the cgroup root
+	cgroupParent = "mydocker"
+	// cpuPeriod is the cpu.max accounting period in microseconds
+	cpuPeriod = 100000
+	// freezeTimeout bounds how long freezing or thawing a cgroup may take to complete
+	freezeTimeout = 5 * time.Second
+)
+
+// CgroupLimits are the resource limits applied to a container. Zero values are unlimited.
+type CgroupLimits struct {
+	MemoryBytes int64
+	CPUs        float64
+}
+
+// Cgroup is a cgroup v2 group holding a single container's processes
+type Cgroup struct {
+	Path string
+}
+
+// cgroupsAvailable reports whether the cgroup v2 unified hierarchy is mounted at cgroupRoot
+func cgroupsAvailable() bool {
+	_, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+// createCgroup creates a cgroup for the container with the memory and CPU limits applied
+func createCgroup(containerID string, limits CgroupLimits) (*Cgroup, error) {
+	if !cgroupsAvailable() {
+		return nil, errors.New("resource limits require the cgroup v2 unified hierarchy mounted at " + cgroupRoot)
+	}
+
+	parent := filepath.Join(cgroupRoot, cgroupParent)
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return nil, err
+	}
+	// Controllers must be enabled at each level above the container's cgroup
+	for _, dir := range []string{cgroupRoot, parent} {
+		if err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644); err != nil {
+			return nil, fmt.Errorf("could not enable cgroup controllers in %s: %w", dir, err)
+		}
+	}
+
+	cgroup := &Cgroup{Path: filepath.Join(parent, containerID)}
+	if err := os.Mkdir(cgroup.Path, 0755); err != nil {
+		return nil, err
+	}
+
+	if limits.MemoryBytes > 0 {
+		if err := cgroup.write("memory.max", strconv.FormatInt(limits.MemoryBytes, 10)); err != nil {
+			cgroup.remove()
+			return nil, err
+		}
+	}
+	if limits.CPUs > 0 {
+		quota := int64(limits.CPUs * cpuPeriod)
+		if err := cgroup.write("cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod)); err != nil {
+			cgroup.remove()
+			return nil, err
+		}
+	}
+	return cgroup, nil
+}
+
+func (cgroup *Cgroup) write(file, value string) error {
+	if err := os.WriteFile(filepath.Join(cgroup.Path, file), []byte(value), 0644); err != nil {
+		return fmt.Errorf("could not set %s: %w", file, err)
+	}
+	return nil
+}
+
+// addProcess moves a process, and so all of its future children, into the cgroup
+func (cgroup *Cgroup) addProcess(pid int) error {
+	return cgroup.write("cgroup.procs", strconv.Itoa(pid))
+}
+
+// findCgroup finds the cgroup of a running container from its ID, or an unambiguous prefix of it
+func findCgroup(id string) (*Cgroup, error) {
+	entries, err := os.ReadDir(filepath.Join(cgroupRoot, cgroupParent))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var matches []string
+	for _, entry := range entries {
+		if entry.IsDir() && id != "" && strings.HasPrefix(entry.Name(), id) {
+			matches = append(matches, entry.Name())
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", id)
+	case 1:
+		return &Cgroup{Path: filepath.Join(cgroupRoot, cgroupParent, matches[0])}, nil
+	default:
+		return nil, fmt.Errorf("container ID %s is ambiguous, it matches %d containers", id, len(matches))
+	}
+}
+
+// freeze suspends every process in the cgroup, or resumes them, and waits for the kernel to
+// report that it has done so. Freezing is asynchronous, as each task must reach a point where
+// it can be stopped.
+func (cgroup *Cgroup) freeze(frozen bool) error {
+	state := "0"
+	if frozen {
+		state = "1"
+	}
+	if err := cgroup.write("cgroup.freeze", state); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(freezeTimeout)
+	for {
+		events, err := os.ReadFile(filepath.Join(cgroup.Path, "cgroup.events"))
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(events), "\n") {
+			if line == "frozen "+state {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("cgroup %s did not reach frozen state %s within %s", cgroup.Path, state, freezeTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// remove deletes the cgroup, which must no longer contain any processes
+func (cgroup *Cgroup) remove() error {
+	return os.Remove(cgroup.Path)
+}
+
+// parseMemory parses a memory size given in bytes or with a b, k, m or g suffix
+func parseMemory(value string) (int64, error) {
+	multipliers := map[string]int64{"b": 1, "k": 1 << 10, "m": 1 << 20, "g": 1 << 30}
+
+	number, multiplier := strings.ToLower(value), int64(1)
+	if len(number) > 0 {
+		if m, ok := multipliers[number[len(number)-1:]]; ok {
+			number, multiplier = number[:len(number)-1], m
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid memory size %q", value)
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseMemory(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int64
+		wantErr bool
+	}{
+		{value: "1024", want: 1024},
+		{value: "10b", want: 10},
+		{value: "4k", want: 4 << 10},
+		{value: "512m", want: 512 << 20},
+		{value: "512M", want: 512 << 20},
+		{value: "2g", want: 2 << 30},
+		{value: "", wantErr: true},
+		{value: "m", wantErr: true},
+		{value: "0", wantErr: true},
+		{value: "-1m", wantErr: true},
+		{value: "1.5g", wantErr: true},
+		{value: "1t", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, err := parseMemory(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMemory(%q) returned error %v, want error: %t", tt.value, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseMemory(%q) = %d, want %d", tt.value, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateCgroup(t *testing.T) {
+	requireContainers(t)
+	if !cgroupsAvailable() {
+		t.Skip("cgroup v2 unified hierarchy not mounted at " + cgroupRoot)
+	}
+
+	tests := []struct {
+		name       string
+		limits     CgroupLimits
+		wantMemory string
+		wantCPU    string
+	}{
+		{name: "unlimited", wantMemory: "max", wantCPU: "max 100000"},
+		{name: "memory", limits: CgroupLimits{MemoryBytes: 64 << 20}, wantMemory: "67108864", wantCPU: "max 100000"},
+		{name: "cpus", limits: CgroupLimits{CPUs: 1.5}, wantMemory: "max", wantCPU: "150000 100000"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cgroup, err := createCgroup("test-"+strings.ReplaceAll(tt.name, " ", "-"), tt.limits)
+			if err != nil {
+				t.Fatalf("createCgroup: %v", err)
+			}
+			defer cgroup.remove()
+			for file, want := range map[string]string{"memory.max": tt.wantMemory, "cpu.max": tt.wantCPU} {
+				data, err := os.ReadFile(filepath.Join(cgroup.Path, file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := strings.TrimSpace(string(data)); got != want {
+					t.Errorf("%s = %q, want %q", file, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestRunResourceLimits(t *testing.T) {
+	requireContainers(t)
+	// Without cgroup v2, asking for limits is an error rather than running without them
+	wantLimited, wantLimitedCode := "0::/"+cgroupParent+"/", 0
+	if !cgroupsAvailable() {
+		wantLimited, wantLimitedCode = "could not create cgroup: resource limits require the cgroup v2 unified hierarchy", 1
+	}
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "memory", flags: []string{"--memory", "64m"}, wantCode: wantLimitedCode, wantStdout: wantLimited},
+		{name: "cpus", flags: []string{"--cpus", "0.5"}, wantCode: wantLimitedCode, wantStdout: wantLimited},
+		{name: "invalid memory", flags: []string{"--memory", "lots"}, wantCode: 1, wantStdout: "invalid memory size \"lots\"\n"},
+		{name: "negative cpus", flags: []string{"--cpus", "-1"}, wantCode: 1, wantStdout: "--cpus must not be negative\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "cat", "/proc/self/cgroup")
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
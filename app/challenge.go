@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// AuthChallenge is one of the challenges of a Www-Authenticate header, naming an authentication
+// scheme and its parameters. Parameter names are case-insensitive, so are held in lower case.
+type AuthChallenge struct {
+	Scheme string
+	Params map[string]string
+}
+
+// parseWWWAuthenticate parses the challenges of a Www-Authenticate header value as described
+// by RFC 7235. Parameters may come in any order, values may be tokens or quoted strings with
+// escapes, and a header may hold several comma separated challenges.
+func parseWWWAuthenticate(header string) ([]AuthChallenge, error) {
+	p := &challengeParser{s: header}
+	var challenges []AuthChallenge
+	for {
+		p.skip(", \t")
+		if p.done() {
+			break
+		}
+		scheme := p.token()
+		if scheme == "" {
+			return nil, fmt.Errorf("expected an authentication scheme at offset %d", p.i)
+		}
+		challenge := AuthChallenge{Scheme: scheme, Params: make(map[string]string)}
+		p.skip(" \t")
+
+		// A challenge carries either a single token68, as Basic credentials do, or parameters
+		separated := false
+		if !p.token68() {
+			for {
+				// A parameter is a name followed by '=', while a lone token begins the next challenge
+				start := p.i
+				name := p.token()
+				p.skip(" \t")
+				if name == "" || !p.consume('=') {
+					p.i = start
+					break
+				}
+				p.skip(" \t")
+				value, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				challenge.Params[strings.ToLower(name)] = value
+
+				p.skip(" \t")
+				if separated = p.consume(','); !separated {
+					break
+				}
+				p.skip(", \t")
+			}
+		}
+		challenges = append(challenges, challenge)
+
+		p.skip(" \t")
+		if !p.done() && !separated && !p.consume(',') {
+			return nil, fmt.Errorf("unexpected %q at offset %d", p.s[p.i], p.i)
+		}
+	}
+	if len(challenges) == 0 {
+		return nil, errors.New("no challenges present")
+	}
+	return challenges, nil
+}
+
+// challengeParser reads a Www-Authenticate header value from left to right
+type challengeParser struct {
+	s string
+	i int
+}
+
+func (p *challengeParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *challengeParser) skip(chars string) {
+	for !p.done() && strings.IndexByte(chars, p.s[p.i]) != -1 {
+		p.i++
+	}
+}
+
+func (p *challengeParser) consume(c byte) bool {
+	if !p.done() && p.s[p.i] == c {
+		p.i++
+		return true
+	}
+	return false
+}
+
+// token reads an RFC 7230 token, returning the empty string if there is none
+func (p *challengeParser) token() string {
+	start := p.i
+	for !p.done() && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+	return p.s[start:p.i]
+}
+
+// token68 skips over a token68, such as base64 encoded data, if one comes next and is all
+// that the challenge holds
+func (p *challengeParser) token68() bool {
+	start := p.i
+	for !p.done() && (isTokenChar(p.s[p.i]) || strings.IndexByte("/+", p.s[p.i]) != -1) && p.s[p.i] != '=' {
+		p.i++
+	}
+	if p.i == start {
+		return false
+	}
+	for p.consume('=') {
+	}
+	p.skip(" \t")
+	if p.done() || p.s[p.i] == ',' {
+		return true
+	}
+	p.i = start
+	return false
+}
+
+// value reads a parameter value, either a token or a quoted string
+func (p *challengeParser) value() (string, error) {
+	if !p.consume('"') {
+		return p.token(), nil
+	}
+	var value strings.Builder
+	for !p.done() {
+		c := p.s[p.i]
+		p.i++
+		switch c {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if p.done() {
+				return "", errors.New("unterminated escape in quoted string")
+			}
+			value.WriteByte(p.s[p.i])
+			p.i++
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted string")
+}
+
+func isTokenChar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+// bearerChallenge finds the Bearer challenge amongst the Www-Authenticate headers of a response
+// and returns the token service it points at
+func bearerChallenge(headers []string) (*Auth, error) {
+	var schemes []string
+	for _, header := range headers {
+		challenges, err := parseWWWAuthenticate(header)
+		if err != nil {
+			return nil, fmt.Errorf("malformed Www-Authenticate header %q: %w", header, err)
+		}
+		for _, challenge := range challenges {
+			if !strings.EqualFold(challenge.Scheme, "Bearer") {
+				schemes = append(schemes, challenge.Scheme)
+				continue
+			}
+			realm := challenge.Params["realm"]
+			if realm == "" {
+				return nil, errors.New("Www-Authenticate Bearer challenge has no realm; cannot perform authentication")
+			}
+			return &Auth{
+				Bearer:  realm,
+				Service: challenge.Params["service"],
+				Scope:   challenge.Params["scope"],
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("registry offered no Bearer challenge (only %s); cannot perform authentication", strings.Join(schemes, ", "))
+}
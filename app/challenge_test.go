@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseWWWAuthenticate(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    []AuthChallenge
+		wantErr string
+	}{
+		{
+			name:   "quoted parameters",
+			header: `Bearer realm="https://auth.example.com/token",service="registry"`,
+			want:   []AuthChallenge{{Scheme: "Bearer", Params: map[string]string{"realm": "https://auth.example.com/token", "service": "registry"}}},
+		},
+		{
+			name:   "token values and spacing",
+			header: `Bearer  realm = auth , service=registry`,
+			want:   []AuthChallenge{{Scheme: "Bearer", Params: map[string]string{"realm": "auth", "service": "registry"}}},
+		},
+		{
+			name:   "case-insensitive names",
+			header: `bearer Realm="r",SCOPE="s"`,
+			want:   []AuthChallenge{{Scheme: "bearer", Params: map[string]string{"realm": "r", "scope": "s"}}},
+		},
+		{
+			name:   "escapes",
+			header: `Bearer realm="a \"quoted\" \\ realm"`,
+			want:   []AuthChallenge{{Scheme: "Bearer", Params: map[string]string{"realm": `a "quoted" \ realm`}}},
+		},
+		{
+			name:   "commas in quoted strings",
+			header: `Bearer realm="r",scope="repository:a:pull,push repository:b:pull"`,
+			want:   []AuthChallenge{{Scheme: "Bearer", Params: map[string]string{"realm": "r", "scope": "repository:a:pull,push repository:b:pull"}}},
+		},
+		{
+			name:   "several challenges",
+			header: `Basic realm="basic", Bearer realm="bearer",service="s"`,
+			want: []AuthChallenge{
+				{Scheme: "Basic", Params: map[string]string{"realm": "basic"}},
+				{Scheme: "Bearer", Params: map[string]string{"realm": "bearer", "service": "s"}},
+			},
+		},
+		{
+			name:   "token68",
+			header: `Negotiate YWJjZA==, Bearer realm="r"`,
+			want: []AuthChallenge{
+				{Scheme: "Negotiate", Params: map[string]string{}},
+				{Scheme: "Bearer", Params: map[string]string{"realm": "r"}},
+			},
+		},
+		{
+			name:   "no parameters",
+			header: `Basic`,
+			want:   []AuthChallenge{{Scheme: "Basic", Params: map[string]string{}}},
+		},
+		{name: "empty", header: "", wantErr: "no challenges present"},
+		{name: "unterminated string", header: `Bearer realm="r`, wantErr: "unterminated quoted string"},
+		{name: "unterminated escape", header: `Bearer realm="r\`, wantErr: "unterminated escape"},
+		{name: "no scheme", header: `="r"`, wantErr: "expected an authentication scheme at offset 0"},
+		{name: "stray characters", header: `Bearer realm="r" "x"`, wantErr: `unexpected '"' at offset 17`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseWWWAuthenticate(tt.header)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseWWWAuthenticate(%q) returned %v, want %q", tt.header, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseWWWAuthenticate(%q): %v", tt.header, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseWWWAuthenticate(%q) = %+v, want %+v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBearerChallenge(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers []string
+		want    Auth
+		wantErr string
+	}{
+		{
+			name:    "Docker Hub",
+			headers: []string{`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`},
+			want:    Auth{Bearer: "https://auth.docker.io/token", Service: "registry.docker.io", Scope: "repository:library/alpine:pull"},
+		},
+		{
+			name:    "GHCR",
+			headers: []string{`Bearer realm="https://ghcr.io/token",service="ghcr.io",scope="repository:owner/app:pull"`},
+			want:    Auth{Bearer: "https://ghcr.io/token", Service: "ghcr.io", Scope: "repository:owner/app:pull"},
+		},
+		{
+			// Quay leaves the scope out of the challenge to /v2/
+			name:    "Quay",
+			headers: []string{`Bearer realm="https://quay.io/v2/auth",service="quay.io"`},
+			want:    Auth{Bearer: "https://quay.io/v2/auth", Service: "quay.io"},
+		},
+		{
+			name:    "parameters in another order",
+			headers: []string{`Bearer scope="repository:app:pull",service="registry",realm="https://auth.example.com/token"`},
+			want:    Auth{Bearer: "https://auth.example.com/token", Service: "registry", Scope: "repository:app:pull"},
+		},
+		{
+			name:    "after another scheme",
+			headers: []string{`Basic realm="Harbor"`, `Bearer realm="https://harbor.example.com/service/token",service="harbor-registry"`},
+			want:    Auth{Bearer: "https://harbor.example.com/service/token", Service: "harbor-registry"},
+		},
+		{
+			name:    "only basic",
+			headers: []string{`Basic realm="https://012345678901.dkr.ecr.us-east-1.amazonaws.com/",service="ecr.amazonaws.com"`},
+			wantErr: "registry offered no Bearer challenge (only Basic); cannot perform authentication",
+		},
+		{
+			name:    "no realm",
+			headers: []string{`Bearer service="registry"`},
+			wantErr: "Www-Authenticate Bearer challenge has no realm",
+		},
+		{
+			name:    "malformed",
+			headers: []string{`Bearer realm="https://auth.example.com`},
+			wantErr: "malformed Www-Authenticate header",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bearerChallenge(tt.headers)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("bearerChallenge returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("bearerChallenge: %v", err)
+			}
+			if *got != tt.want {
+				t.Errorf("bearerChallenge = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImageWithChallenges(t *testing.T) {
+	tests := []struct {
+		name string
+		// challenge is the Www-Authenticate header of unauthenticated requests, given the
+		// registry's URL and the repository requested
+		challenge func(url, repository string) string
+		// wantQuery is the query the token is requested with
+		wantQuery string
+	}{
+		{
+			name: "Docker Hub",
+			challenge: func(url, repository string) string {
+				return fmt.Sprintf(`Bearer realm="%s/token",service="registry.docker.io",scope="repository:%s:pull"`, url, repository)
+			},
+			wantQuery: "scope=repository%3Aapp%3Apull&service=registry.docker.io",
+		},
+		{
+			name: "GHCR",
+			challenge: func(url, repository string) string {
+				return fmt.Sprintf(`Bearer realm="%s/token",service="ghcr.io",scope="repository:%s:pull"`, url, repository)
+			},
+			wantQuery: "scope=repository%3Aapp%3Apull&service=ghcr.io",
+		},
+		{
+			name: "Quay",
+			challenge: func(url, repository string) string {
+				return fmt.Sprintf(`Bearer realm="%s/token",service="quay.io"`, url)
+			},
+			wantQuery: "service=quay.io",
+		},
+		{
+			name: "realm with a query",
+			challenge: func(url, repository string) string {
+				return fmt.Sprintf(`Bearer realm="%s/token?account=anonymous",service="registry"`, url)
+			},
+			wantQuery: "account=anonymous&service=registry",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "app", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+			var (
+				mu      sync.Mutex
+				queries []string
+			)
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.URL.Path == "/token" {
+					mu.Lock()
+					queries = append(queries, r.URL.RawQuery)
+					mu.Unlock()
+					fmt.Fprint(w, `{"token":"granted"}`)
+					return true
+				}
+				if r.Header.Get("Authorization") == "Bearer granted" {
+					return false
+				}
+				w.Header().Set("Www-Authenticate", tt.challenge(registry.server.URL, "app"))
+				w.WriteHeader(http.StatusUnauthorized)
+				return true
+			}
+
+			if _, err := resolveImage(context.Background(), ref, nil, nil); err != nil {
+				t.Fatalf("resolveImage: %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(queries) == 0 || queries[0] != tt.wantQuery {
+				t.Errorf("token requested with %q, want %q", queries, tt.wantQuery)
+			}
+		})
+	}
+}
+
+func TestTokenServiceResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		// wantErr is part of the error resolving the image, and wantTokens how many tokens were
+		// requested
+		wantErr    string
+		wantTokens int
+	}{
+		{name: "token", status: http.StatusOK, body: `{"token":"granted"}`, wantTokens: 1},
+		{name: "access token", status: http.StatusOK, body: `{"access_token":"granted"}`, wantTokens: 1},
+		{name: "token preferred", status: http.StatusOK, body: `{"token":"granted","access_token":"other"}`, wantTokens: 1},
+		{name: "empty token", status: http.StatusOK, body: `{"token":"","access_token":"granted"}`, wantTokens: 1},
+		// A body without a token is retried as other failures to fetch one are, as it may come
+		// from a proxy in front of the token service
+		{name: "no token", status: http.StatusOK, body: `{"expires_in":300}`, wantErr: "returned no token", wantTokens: maxRetries},
+		{name: "not JSON", status: http.StatusOK, body: `<html>login</html>`, wantErr: `returned an unexpected body: "<html>login</html>"`, wantTokens: maxRetries},
+		{
+			name:       "credentials refused",
+			status:     http.StatusUnauthorized,
+			body:       `{"errors":[{"code":"UNAUTHORIZED","message":"incorrect username or password"}]}`,
+			wantErr:    "incorrect username or password",
+			wantTokens: 1,
+		},
+		{name: "forbidden", status: http.StatusForbidden, body: `{"details":"denied"}`, wantErr: "token service", wantTokens: 1},
+		// Failures the token service may recover from are retried
+		{name: "unavailable", status: http.StatusServiceUnavailable, body: "down for maintenance", wantErr: "token service", wantTokens: maxRetries},
+		{name: "rate limited", status: http.StatusTooManyRequests, body: "slow down", wantErr: "token service", wantTokens: maxRetries},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			registry := newFakeRegistry(t)
+			ref := registry.push("private", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+			registry.requireToken("granted", func(r *http.Request) (int, string) { return tt.status, tt.body })
+
+			_, err := resolveImage(context.Background(), ref, nil, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("resolveImage: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("resolveImage returned %v, want %q", err, tt.wantErr)
+			}
+			if got := registry.count("/token"); got != tt.wantTokens {
+				t.Errorf("requested %d tokens, want %d", got, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestConstructAuth(t *testing.T) {
+	tests := []struct {
+		name string
+		// previous is the token auth held before, which the registry refused
+		previous string
+		body     string
+		want     string
+	}{
+		{name: "token", body: `{"token":"fresh"}`, want: "fresh"},
+		{name: "access token", body: `{"access_token":"fresh"}`, want: "fresh"},
+		{name: "both", body: `{"token":"fresh","access_token":"other"}`, want: "fresh"},
+		{name: "token replaced", previous: "expired", body: `{"token":"fresh"}`, want: "fresh"},
+		{name: "token replaced by access token", previous: "expired", body: `{"access_token":"fresh"}`, want: "fresh"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.body)
+			}))
+			defer server.Close()
+			auth := &Auth{Bearer: server.URL + "/token", Token: tt.previous, AccessToken: tt.previous}
+
+			if err := (&ContainerRegistryDetails{}).constructAuth(context.Background(), auth); err != nil {
+				t.Fatalf("constructAuth: %v", err)
+			}
+			if auth.Token != tt.want {
+				t.Errorf("constructAuth gave token %q, want %q", auth.Token, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// signalGracePeriod is how long the container has to exit after a forwarded signal before it is killed
+const signalGracePeriod = 10 * time.Second
+
+// runCleanup tears down what run sets up on the host, both when the container exits and when run
+// is interrupted by a signal, so that extracted root filesystems do not pile up in /tmp
+type runCleanup struct {
+	mu      sync.Mutex
+	once    sync.Once
+	rootfs  string
+	cgroup  *Cgroup
+	lease   *NetworkLease
+	ports   *PublishedPorts
+	stateID string
+	name    *NameReservation
+	process *os.Process
+	// signal is the first signal run was interrupted by, if any
+	signal syscall.Signal
+	// killed is set once the container is killed for not exiting after a forwarded signal
+	killed bool
+	// restoreTerminal, if set, takes the host terminal back out of raw mode
+	restoreTerminal func()
+}
+
+// handleSignals relays SIGINT, SIGTERM and SIGHUP to the container. As the command runs as pid 1
+// of its namespace, it ignores signals it has no handler for, so it is killed if still running
+// after signalGracePeriod. Before the container starts, a signal tears everything down instead.
+func (c *runCleanup) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			c.mu.Lock()
+			first := c.signal == 0
+			if first {
+				c.signal = sig.(syscall.Signal)
+			}
+			process := c.process
+			c.mu.Unlock()
+
+			if process == nil {
+				c.exit(128 + int(sig.(syscall.Signal)))
+			}
+			process.Signal(sig)
+			if first {
+				time.AfterFunc(signalGracePeriod, c.kill)
+			}
+		}
+	}()
+}
+
+// kill forcibly stops the container if it is still running
+func (c *runCleanup) kill() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.process != nil {
+		c.killed = true
+		c.process.Kill()
+	}
+}
+
+// started records the container's process once it is running, killing it straight away if run
+// has already been interrupted
+func (c *runCleanup) started(process *os.Process) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.process = process
+	if c.signal != 0 {
+		c.killed = true
+		process.Kill()
+	}
+}
+
+// exitCode is the status run exits with once the container has exited with state. A container
+// killed for ignoring a forwarded signal is reported as terminated by that signal.
+func (c *runCleanup) exitCode(state *os.ProcessState) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.killed {
+		return 128 + int(c.signal)
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return state.ExitCode()
+}
+
+// setTerminal records how to restore the host terminal on exit
+func (c *runCleanup) setTerminal(restore func()) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.restoreTerminal = restore
+}
+
+// setCgroup records the container's cgroup so that it is removed on exit
+func (c *runCleanup) setCgroup(cgroup *Cgroup) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cgroup = cgroup
+}
+
+// setLease records the container's address on the bridge network so that it is released on exit
+func (c *runCleanup) setLease(lease *NetworkLease) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lease = lease
+}
+
+// setPorts records the container's published ports so that they are unpublished on exit
+func (c *runCleanup) setPorts(ports *PublishedPorts) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ports = ports
+}
+
+// setName records the name reserved for the container, to be released on exit
+func (c *runCleanup) setName(name *NameReservation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.name = name
+}
+
+// setState records that the container's state was saved so that its exit is recorded too
+func (c *runCleanup) setState(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stateID = id
+}
+
+// exited forgets the container's process once it has been waited on
+func (c *runCleanup) exited() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.process = nil
+}
+
+// exit tears everything down and exits with code
+func (c *runCleanup) exit(code int) {
+	c.once.Do(func() { c.teardown(code) })
+	os.Exit(code)
+}
+
+func (c *runCleanup) teardown(code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.restoreTerminal != nil {
+		c.restoreTerminal()
+	}
+	if c.stateID != "" {
+		if err := markContainerExited(c.stateID, code); err != nil {
+			fmt.Printf("could not record container exit: %s\n", err)
+		}
+	}
+	if c.rootfs != "" {
+		if err := unmountBeneath(c.rootfs); err != nil {
+			fmt.Printf("could not unmount container filesystems: %s\n", err)
+		}
+		if err := os.RemoveAll(c.rootfs); err != nil {
+			fmt.Printf("could not remove container root filesystem: %s\n", err)
+		}
+	}
+	if c.cgroup != nil {
+		if err := c.cgroup.remove(); err != nil {
+			fmt.Printf("could not remove cgroup: %s\n", err)
+		}
+	}
+	if c.ports != nil {
+		if err := c.ports.close(); err != nil {
+			fmt.Printf("could not unpublish ports: %s\n", err)
+		}
+	}
+	if c.lease != nil {
+		if err := c.lease.release(); err != nil {
+			fmt.Printf("could not release network address: %s\n", err)
+		}
+	}
+	if c.name != nil {
+		if err := c.name.release(); err != nil {
+			fmt.Printf("could not release container name: %s\n", err)
+		}
+	}
+}
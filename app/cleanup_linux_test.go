@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestUnescapeMountinfo(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{path: "/tmp/plain", want: "/tmp/plain"},
+		{path: `/tmp/with\040space`, want: "/tmp/with space"},
+		{path: `/tmp/tab\011and\012newline`, want: "/tmp/tab\tand\nnewline"},
+		{path: `/tmp/back\134slash`, want: `/tmp/back\slash`},
+		{path: `/tmp/end\040`, want: "/tmp/end "},
+		{path: `/tmp/short\04`, want: `/tmp/short\04`},
+		{path: `/tmp/not\08octal`, want: `/tmp/not\08octal`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			if got := unescapeMountinfo(tt.path); got != tt.want {
+				t.Errorf("unescapeMountinfo(%q) = %q, want %q", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnmountBeneath(t *testing.T) {
+	requireContainers(t)
+	dir := t.TempDir()
+	outer := filepath.Join(dir, "with space")
+	inner := filepath.Join(outer, "inner")
+	beside := dir + "-beside"
+	for _, mountpoint := range []string{outer, inner, beside} {
+		if err := os.MkdirAll(mountpoint, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := syscall.Mount("tmpfs", mountpoint, "tmpfs", 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() {
+		syscall.Unmount(beside, syscall.MNT_DETACH)
+		os.Remove(beside)
+	})
+
+	if err := unmountBeneath(dir); err != nil {
+		t.Fatalf("unmountBeneath: %v", err)
+	}
+	mountinfo, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mounted := make(map[string]bool)
+	for _, line := range strings.Split(string(mountinfo), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 5 {
+			mounted[unescapeMountinfo(fields[4])] = true
+		}
+	}
+	for _, mountpoint := range []string{outer, inner} {
+		if mounted[mountpoint] {
+			t.Errorf("%s is still mounted", mountpoint)
+		}
+	}
+	if !mounted[beside] {
+		t.Errorf("%s, which is not beneath %s, was unmounted", beside, dir)
+	}
+}
+
+// startTrap starts run with args, which runs the probe in trap or ignore mode, and waits for the
+// probe to be ready for signals, returning the run and a reader of what it prints from then on
+func startTrap(t *testing.T, dir string, args ...string) (*exec.Cmd, *bufio.Reader) {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { r.Close() })
+	cmd := startTool(t, dir, w, args...)
+	w.Close()
+
+	output := bufio.NewReader(r)
+	if line, err := output.ReadString('\n'); line != "ready\n" {
+		t.Fatalf("container printed %q before handling signals: %v", line, err)
+	}
+	return cmd, output
+}
+
+// waitExit waits for cmd to exit, returning what it printed to output meanwhile
+func waitExit(t *testing.T, cmd *exec.Cmd, output io.Reader) string {
+	t.Helper()
+	rest, err := io.ReadAll(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		if _, ok := err.(*exec.ExitError); !ok {
+			t.Fatal(err)
+		}
+	}
+	return string(rest)
+}
+
+func TestRunCleansUpOnSignal(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+
+	tests := []struct {
+		name   string
+		signal syscall.Signal
+	}{
+		{name: "SIGINT", signal: syscall.SIGINT},
+		{name: "SIGTERM", signal: syscall.SIGTERM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := filepath.Glob("/tmp/container.*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			dir, volume := t.TempDir(), t.TempDir()
+			cmd, output := startTrap(t, dir, "--insecure-registry", registry.host, "run",
+				"-v", volume+":/data", ref, "/bin/probe", "trap")
+			if err := cmd.Process.Signal(tt.signal); err != nil {
+				t.Fatal(err)
+			}
+			if rest := waitExit(t, cmd, output); cmd.ProcessState.ExitCode() != 0 {
+				t.Errorf("run exited with %d: %s", cmd.ProcessState.ExitCode(), rest)
+			}
+
+			after, err := filepath.Glob("/tmp/container.*")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) > len(before) {
+				t.Errorf("root filesystems were left behind: %q, before the run %q", after, before)
+			}
+			states, err := filepath.Glob(filepath.Join(dir, "state", "*.json"))
+			if err != nil || len(states) != 1 {
+				t.Fatalf("container records: %q, %v", states, err)
+			}
+			state, err := os.ReadFile(states[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Contains(state, []byte(`"finishedAt"`)) {
+				t.Errorf("container exit was not recorded: %s", state)
+			}
+		})
+	}
+}
+
+func TestRunForwardsSignals(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+
+	tests := []struct {
+		name   string
+		mode   string
+		signal syscall.Signal
+		// wantOutput is what the container prints after ready
+		wantOutput string
+		wantCode   int
+	}{
+		{name: "SIGINT", mode: "trap", signal: syscall.SIGINT, wantOutput: "interrupt\n"},
+		{name: "SIGTERM", mode: "trap", signal: syscall.SIGTERM, wantOutput: "terminated\n"},
+		{name: "SIGHUP", mode: "trap", signal: syscall.SIGHUP, wantOutput: "hangup\n"},
+		// A command ignoring the signal is killed once the grace period is up
+		{name: "ignored", mode: "ignore", signal: syscall.SIGTERM, wantCode: 128 + int(syscall.SIGTERM)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, output := startTrap(t, t.TempDir(), "--insecure-registry", registry.host, "run", ref, "/bin/probe", tt.mode)
+			if err := cmd.Process.Signal(tt.signal); err != nil {
+				t.Fatal(err)
+			}
+			rest := waitExit(t, cmd, output)
+			if code := cmd.ProcessState.ExitCode(); code != tt.wantCode {
+				t.Errorf("run exited with %d, want %d: %s", code, tt.wantCode, rest)
+			}
+			if tt.wantOutput != "" && rest != tt.wantOutput {
+				t.Errorf("container printed %q after the signal, want %q", rest, tt.wantOutput)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// InitConfig is handed from run to the init process started inside the container's namespaces.
+// The init process prepares the container from within before replacing itself with the command.
+type InitConfig struct {
+	RootFS     string
+	Command    string
+	Args       []string
+	Hostname   string
+	WorkingDir string
+	User       string
+	Mounts     []BindMount
+	// Capabilities are the names of the capabilities the command may hold
+	Capabilities []string
+	// DeathSignal is sent to the command when run dies, if set
+	DeathSignal syscall.Signal
+	// MountNamespace is set when the container has its own mount namespace, so that pivot_root
+	// can be used and mounts made by init stay private to the container
+	MountNamespace bool
+	// NetworkNamespace is set when the container has its own network namespace, whose loopback
+	// interface init brings up
+	NetworkNamespace bool
+	// Interface connects the container to the bridge network, if set
+	Interface *NetworkInterface
+	// ReadOnly mounts the root filesystem read-only, leaving writable tmpfs mounts at /tmp and /run
+	ReadOnly bool
+	// Seccomp is the compiled seccomp filter installed before the command is executed, if any
+	Seccomp []unix.SockFilter
+	// NoNewPrivileges sets no_new_privs, so the command cannot gain privileges through execve
+	NoNewPrivileges bool
+}
+
+// newContainerID generates a random identifier for a container in the same form as docker
+func newContainerID() (string, error) {
+	id := make([]byte, 32)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// shortContainerID abbreviates a container ID for display and default hostnames
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
+
+// containerInitFd is the file descriptor the init process reads its InitConfig from
+const containerInitFd = 3
+
+// startContainer starts cmd, which must re-execute this binary as "init", and sends it the InitConfig.
+// If set, started is called with the pid of init before it is configured, while it is still
+// waiting for the InitConfig and so has not yet run the container command.
+func startContainer(cmd *exec.Cmd, config *InitConfig, started func(pid int) error) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	cmd.ExtraFiles = append([]*os.File{r}, cmd.ExtraFiles...)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	if started != nil {
+		if err := started(cmd.Process.Pid); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return err
+		}
+	}
+
+	if err := json.NewEncoder(w).Encode(config); err != nil {
+		return fmt.Errorf("could not send configuration to container: %w", err)
+	}
+	return nil
+}
+
+// setupMountNamespace mounts the container's devices, volumes and procfs and pivots into its root filesystem
+func setupMountNamespace(config *InitConfig) error {
+	if err := makeMountsPrivate(); err != nil {
+		return err
+	}
+	// /dev is populated first, so that volumes beneath it are not hidden by its tmpfs
+	if err := setupDev(config.RootFS); err != nil {
+		return err
+	}
+	if err := setupBindMounts(config.RootFS, config.Mounts); err != nil {
+		return err
+	}
+	if err := mountProc(config.RootFS); err != nil {
+		return err
+	}
+	if err := setup_pivot_root(config.RootFS); err != nil {
+		return err
+	}
+	if config.ReadOnly {
+		return makeRootReadOnly(config.Mounts)
+	}
+	return nil
+}
+
+// initCommand runs as the first process inside the container
+func initCommand() {
+	// The capability bounding set is per thread, so init stays on the thread that finally
+	// executes the command rather than dropping capabilities on one it then moves off
+	runtime.LockOSThread()
+
+	var config InitConfig
+	f := os.NewFile(containerInitFd, "init")
+	if err := json.NewDecoder(f).Decode(&config); err != nil {
+		fmt.Printf("could not read container configuration: %s\n", err)
+		os.Exit(1)
+	}
+	f.Close()
+
+	var err error
+	switch {
+	case config.MountNamespace:
+		err = setupMountNamespace(&config)
+	case config.ReadOnly:
+		err = errors.New("a read-only root filesystem requires a mount namespace")
+	default:
+		err = setup_chroot(config.RootFS)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if config.WorkingDir != "" {
+		if err := os.MkdirAll(config.WorkingDir, 0755); err != nil {
+			fmt.Printf("could not create working directory %s in the container: %s\n", config.WorkingDir, err)
+			os.Exit(1)
+		}
+		if err := syscall.Chdir(config.WorkingDir); err != nil {
+			fmt.Printf("could not change to working directory %s: %s\n", config.WorkingDir, err)
+			os.Exit(1)
+		}
+	}
+
+	if config.Hostname != "" {
+		if err := syscall.Sethostname([]byte(config.Hostname)); err != nil {
+			fmt.Printf("could not set hostname: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if config.NetworkNamespace {
+		if err := setupLoopback(); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+	if config.Interface != nil {
+		if err := setupInterface(config.Interface); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	if debugEnabled() {
+		pwd, err := cwd()
+		if err != nil {
+			logger.Debug("could not get working directory", "error", err)
+		}
+		entries, err := lwd()
+		if err != nil {
+			logger.Debug("could not list working directory", "error", err)
+		}
+		logger.Debug("working directory", "path", pwd, "entries", entries)
+	}
+
+	if err := limitCapabilities(config.Capabilities); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Without no_new_privs, the seccomp filter can only be installed while init still holds
+	// CAP_SYS_ADMIN, so the remaining steps must only make syscalls the filter allows. With it,
+	// the filter is installed last, just before the command is executed.
+	if config.NoNewPrivileges {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			fmt.Printf("could not set no_new_privs: %s\n", err)
+			os.Exit(1)
+		}
+	} else if err := installSeccomp(config.Seccomp); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// Switching user comes last, as the steps before it need privileges the user may not have
+	if config.User != "" {
+		if err := switchUser(config.User); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	// Changing credentials clears the parent death signal, so it is set again
+	if config.DeathSignal != 0 {
+		if err := unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(config.DeathSignal), 0, 0, 0); err != nil {
+			fmt.Printf("could not set parent death signal: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	path, err := exec.LookPath(config.Command)
+	if err != nil {
+		fmt.Printf("error executing command: %v\n", err)
+		os.Exit(1)
+	}
+
+	if config.NoNewPrivileges {
+		if err := installSeccomp(config.Seccomp); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	err = syscall.Exec(path, append([]string{config.Command}, config.Args...), os.Environ())
+	fmt.Printf("error executing command: %v\n", err)
+	os.Exit(1)
+}
+
+// switchUser resolves the user inside the container and changes to its identity
+func switchUser(spec string) error {
+	user, err := resolveUser(spec, "/etc/passwd", "/etc/group")
+	if err != nil {
+		return err
+	}
+
+	if err := syscall.Setgroups(user.Groups); err != nil {
+		return fmt.Errorf("could not set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(user.GID); err != nil {
+		return fmt.Errorf("could not set group id: %w", err)
+	}
+	if err := syscall.Setuid(user.UID); err != nil {
+		return fmt.Errorf("could not set user id: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestContainerRootFilesystem(t *testing.T) {
+	requireContainers(t)
+	host := filepath.Join(t.TempDir(), "host")
+	if err := os.WriteFile(host, []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		want     []string
+		wantNot  []string
+	}{
+		{
+			name:    "root holds the image",
+			args:    []string{"ls", "/"},
+			want:    []string{"bin", "proc"},
+			wantNot: []string{".pivot_root"},
+		},
+		{
+			name:     "old root is detached",
+			args:     []string{"ls", "/.pivot_root"},
+			wantCode: 1,
+		},
+		{
+			name:     "host files are out of reach",
+			args:     []string{"cat", host},
+			wantCode: 1,
+		},
+		{
+			name:     "host files are out of reach through ..",
+			args:     []string{"cat", "/../../../../.." + host},
+			wantCode: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, nil, tt.args...)
+			if code != tt.wantCode {
+				t.Fatalf("probe exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			entries := strings.Fields(stdout)
+			for _, name := range tt.want {
+				if !containsString(entries, name) {
+					t.Errorf("probe printed %q, want %s", entries, name)
+				}
+			}
+			for _, name := range tt.wantNot {
+				if containsString(entries, name) {
+					t.Errorf("probe printed %q, want no %s", entries, name)
+				}
+			}
+		})
+	}
+}
+
+func TestRunHostname(t *testing.T) {
+	requireContainers(t)
+	shortID := regexp.MustCompile(`^[0-9a-f]{12}$`)
+
+	tests := []struct {
+		name     string
+		flags    []string
+		want     *regexp.Regexp
+		wantCode int
+	}{
+		{name: "default", want: shortID},
+		{name: "given", flags: []string{"--hostname", "web-1"}, want: regexp.MustCompile(`^web-1$`)},
+		{name: "too long", flags: []string{"--hostname", strings.Repeat("h", 65)}, wantCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "hostname")
+			if code != tt.wantCode {
+				t.Fatalf("probe exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if tt.want != nil && !tt.want.MatchString(strings.TrimSpace(stdout)) {
+				t.Errorf("hostname is %q, want it to match %s", strings.TrimSpace(stdout), tt.want)
+			}
+		})
+	}
+}
+
+func TestRunWorkingDirectory(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	probe := probeLayer(t)
+	plain := registry.push("plain", "latest", newFakeImage(t, probe))
+	withWorkdir := registry.push("workdir", "latest", newFakeImageWith(t, OCIImageConfig{WorkingDir: "/srv/app"}, probe))
+
+	tests := []struct {
+		name  string
+		flags []string
+		ref   string
+		want  string
+	}{
+		{name: "root by default", ref: plain, want: "/"},
+		{name: "image working directory", ref: withWorkdir, want: "/srv/app"},
+		{name: "given working directory", ref: withWorkdir, flags: []string{"--workdir", "/tmp/work"}, want: "/tmp/work"},
+		{name: "existing directory", ref: plain, flags: []string{"--workdir", "/bin"}, want: "/bin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--insecure-registry", registry.host, "run"}, tt.flags...)
+			stdout, stderr, code := tool(t, t.TempDir(), append(args, tt.ref, "/bin/probe", "pwd")...)
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			if got := strings.TrimSpace(stdout); got != tt.want {
+				t.Errorf("working directory is %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunUser(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	probe := probeLayer(t)
+	users := buildLayer(t, []tarEntry{
+		tarDir("etc/"),
+		tarFile("etc/passwd", "root:x:0:0::/root:/bin/sh\napp:x:1500:1600::/:/bin/sh\n"),
+		tarFile("etc/group", "root:x:0:\napp:x:1600:\n"),
+	})
+	plain := registry.push("plain", "latest", newFakeImage(t, probe, users))
+	withUser := registry.push("user", "latest", newFakeImageWith(t, OCIImageConfig{User: "app"}, probe, users))
+
+	tests := []struct {
+		name     string
+		flags    []string
+		ref      string
+		want     string
+		wantCode int
+	}{
+		{name: "root by default", ref: plain, want: "uid=0 gid=0"},
+		{name: "image user", ref: withUser, want: "uid=1500 gid=1600"},
+		{name: "given user", ref: withUser, flags: []string{"--user", "root"}, want: "uid=0 gid=0"},
+		{name: "given ids", ref: plain, flags: []string{"-u", "2000:3000"}, want: "uid=2000 gid=3000"},
+		{name: "unknown user", ref: plain, flags: []string{"--user", "nobody"}, wantCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--insecure-registry", registry.host, "run"}, tt.flags...)
+			stdout, stderr, code := tool(t, t.TempDir(), append(args, tt.ref, "/bin/probe", "id")...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.want) {
+				t.Errorf("probe printed %q, want %q", stdout, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"strings"
+)
+
+// RegistryCredentials authenticate requests for registry tokens in place of anonymous access
+type RegistryCredentials struct {
+	Username string
+	Password string
+}
+
+// registryTokenEnvPrefix prefixes the environment variables holding bearer tokens obtained
+// elsewhere, such as by a CI system, which are sent as they are instead of requesting a token
+const registryTokenEnvPrefix = "MYDOCKER_REGISTRY_TOKEN_"
+
+// credentialsEnvPrefix returns the prefix of the environment variables holding credentials for
+// host, upper-casing it and replacing anything other than letters and digits with underscores,
+// so that registry.example.com:5000 is read from REGISTRY_REGISTRY_EXAMPLE_COM_5000_USERNAME
+func credentialsEnvPrefix(host string) string {
+	return "REGISTRY_" + envHostName(host) + "_"
+}
+
+// envHostName is host as it appears in the name of an environment variable
+func envHostName(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// credentials looks up credentials for the registry in the environment, under either the name
+// used in image references or the host requests are sent to. Both a username and password must be set.
+func (registry *ContainerRegistryDetails) credentials() *RegistryCredentials {
+	for _, host := range []string{registry.Alias, registry.FQDN} {
+		if host == "" {
+			continue
+		}
+		prefix := credentialsEnvPrefix(host)
+		username, password := os.Getenv(prefix+"USERNAME"), os.Getenv(prefix+"PASSWORD")
+		if username != "" && password != "" {
+			return &RegistryCredentials{Username: username, Password: password}
+		}
+	}
+	return nil
+}
+
+// presetToken looks up a bearer token for the registry in the environment, named for the
+// registry as credentials are, so that MYDOCKER_REGISTRY_TOKEN_GHCR_IO is sent to ghcr.io.
+func (registry *ContainerRegistryDetails) presetToken() *Auth {
+	for _, host := range []string{registry.Alias, registry.FQDN} {
+		if host == "" {
+			continue
+		}
+		if token := os.Getenv(registryTokenEnvPrefix + envHostName(host)); token != "" {
+			return &Auth{Token: token}
+		}
+	}
+	return nil
+}
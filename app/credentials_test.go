@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestCredentialsEnvPrefix(t *testing.T) {
+	tests := []struct {
+		host string
+		want string
+	}{
+		{host: "docker.io", want: "REGISTRY_DOCKER_IO_"},
+		{host: "ghcr.io", want: "REGISTRY_GHCR_IO_"},
+		{host: "registry.example.com:5000", want: "REGISTRY_REGISTRY_EXAMPLE_COM_5000_"},
+		{host: "My-Registry.local", want: "REGISTRY_MY_REGISTRY_LOCAL_"},
+		{host: "[::1]:5000", want: "REGISTRY____1__5000_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			if got := credentialsEnvPrefix(tt.host); got != tt.want {
+				t.Errorf("credentialsEnvPrefix(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRegistryCredentials(t *testing.T) {
+	registry := &ContainerRegistryDetails{Alias: "docker.io", FQDN: "registry-1.docker.io"}
+	tests := []struct {
+		name string
+		env  map[string]string
+		want *RegistryCredentials
+	}{
+		{name: "none"},
+		{
+			name: "by alias",
+			env:  map[string]string{"REGISTRY_DOCKER_IO_USERNAME": "user", "REGISTRY_DOCKER_IO_PASSWORD": "secret"},
+			want: &RegistryCredentials{Username: "user", Password: "secret"},
+		},
+		{
+			name: "by host",
+			env:  map[string]string{"REGISTRY_REGISTRY_1_DOCKER_IO_USERNAME": "user", "REGISTRY_REGISTRY_1_DOCKER_IO_PASSWORD": "secret"},
+			want: &RegistryCredentials{Username: "user", Password: "secret"},
+		},
+		{
+			name: "alias first",
+			env: map[string]string{
+				"REGISTRY_DOCKER_IO_USERNAME": "alias", "REGISTRY_DOCKER_IO_PASSWORD": "secret",
+				"REGISTRY_REGISTRY_1_DOCKER_IO_USERNAME": "host", "REGISTRY_REGISTRY_1_DOCKER_IO_PASSWORD": "secret",
+			},
+			want: &RegistryCredentials{Username: "alias", Password: "secret"},
+		},
+		{name: "username only", env: map[string]string{"REGISTRY_DOCKER_IO_USERNAME": "user"}},
+		{name: "password only", env: map[string]string{"REGISTRY_DOCKER_IO_PASSWORD": "secret"}},
+		{
+			name: "split across names",
+			env:  map[string]string{"REGISTRY_DOCKER_IO_USERNAME": "user", "REGISTRY_REGISTRY_1_DOCKER_IO_PASSWORD": "secret"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"REGISTRY_DOCKER_IO_USERNAME", "REGISTRY_DOCKER_IO_PASSWORD", "REGISTRY_REGISTRY_1_DOCKER_IO_USERNAME", "REGISTRY_REGISTRY_1_DOCKER_IO_PASSWORD"} {
+				t.Setenv(name, tt.env[name])
+			}
+			got := registry.credentials()
+			if (got == nil) != (tt.want == nil) || got != nil && *got != *tt.want {
+				t.Errorf("credentials() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImageWithCredentials(t *testing.T) {
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  string
+	}{
+		{name: "credentials", username: "user", password: "secret"},
+		{name: "wrong password", username: "user", password: "wrong", wantErr: "token service"},
+		{name: "anonymous", wantErr: "token service"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "private", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+			registry.requireToken("granted", func(r *http.Request) (int, string) {
+				if username, password, ok := r.BasicAuth(); !ok || username != "user" || password != "secret" {
+					return http.StatusUnauthorized, `{"errors":[{"code":"UNAUTHORIZED","message":"incorrect username or password"}]}`
+				}
+				if r.URL.Query().Get("scope") != "repository:private:pull" || r.URL.Query().Get("service") != "fake" {
+					return http.StatusBadRequest, "unexpected query " + r.URL.RawQuery
+				}
+				return http.StatusOK, `{"token":"granted"}`
+			})
+			prefix := credentialsEnvPrefix(registry.host)
+			t.Setenv(prefix+"USERNAME", tt.username)
+			t.Setenv(prefix+"PASSWORD", tt.password)
+
+			_, err := resolveImage(context.Background(), ref, nil, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("resolveImage: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("resolveImage returned %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPresetToken(t *testing.T) {
+	registry := &ContainerRegistryDetails{Alias: "docker.io", FQDN: "registry-1.docker.io"}
+	tests := []struct {
+		name string
+		env  map[string]string
+		want *Auth
+	}{
+		{name: "none"},
+		{name: "by alias", env: map[string]string{"MYDOCKER_REGISTRY_TOKEN_DOCKER_IO": "alias"}, want: &Auth{Token: "alias"}},
+		{name: "by host", env: map[string]string{"MYDOCKER_REGISTRY_TOKEN_REGISTRY_1_DOCKER_IO": "host"}, want: &Auth{Token: "host"}},
+		{
+			name: "alias first",
+			env:  map[string]string{"MYDOCKER_REGISTRY_TOKEN_DOCKER_IO": "alias", "MYDOCKER_REGISTRY_TOKEN_REGISTRY_1_DOCKER_IO": "host"},
+			want: &Auth{Token: "alias"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{"MYDOCKER_REGISTRY_TOKEN_DOCKER_IO", "MYDOCKER_REGISTRY_TOKEN_REGISTRY_1_DOCKER_IO"} {
+				t.Setenv(name, tt.env[name])
+			}
+			got := registry.presetToken()
+			if (got == nil) != (tt.want == nil) || got != nil && got.Token != tt.want.Token {
+				t.Errorf("presetToken() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImageWithPresetToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		preset string
+		// wantTokens is how many tokens are requested from the token service
+		wantTokens int
+	}{
+		{name: "accepted", preset: "granted", wantTokens: 0},
+		{name: "refused", preset: "expired", wantTokens: 1},
+		{name: "none", wantTokens: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "private", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+			registry.requireToken("granted", func(r *http.Request) (int, string) { return http.StatusOK, `{"token":"granted"}` })
+			t.Setenv(registryTokenEnvPrefix+envHostName(registry.host), tt.preset)
+
+			if _, err := resolveImage(context.Background(), ref, nil, nil); err != nil {
+				t.Fatalf("resolveImage: %v", err)
+			}
+			if got := registry.count("/token"); got != tt.wantTokens {
+				t.Errorf("requested %d tokens, want %d", got, tt.wantTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Decompressor wraps a compressed layer stream in a reader producing the uncompressed tar archive
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	decompressorsMu sync.RWMutex
+	// decompressors maps layer media types to the decompressor able to read them
+	decompressors = map[string]Decompressor{}
+)
+
+var (
+	// gzipMagic prefixes gzip compressed layers, which some tools write to archives in place of plain tars
+	gzipMagic = []byte{0x1f, 0x8b}
+	// zstdMagic prefixes zstd compressed layers
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressionMagic maps the leading bytes of a compressed layer to the media type describing
+// it. Layers are not always labelled correctly, so their content decides how they are read.
+var compressionMagic = []struct {
+	magic     []byte
+	mediaType string
+}{
+	{gzipMagic, string(OCIImageTypeLayerGzip)},
+	{zstdMagic, string(OCIImageTypeLayerZstd)},
+}
+
+// ErrZstdUnsupported is returned for zstd compressed layers when no decompressor is registered
+// for them
+var ErrZstdUnsupported = errors.New("zstd compressed layers are not supported")
+
+func init() {
+	registerDecompressor(string(DockerImageTypeRootFs), gzipDecompressor)
+	registerDecompressor(string(OCIImageTypeLayerGzip), gzipDecompressor)
+	registerDecompressor(string(OCIImageTypeLayer), uncompressedDecompressor)
+	registerDecompressor(string(DockerImageTypeRootFsForeign), gzipDecompressor)
+	registerDecompressor(string(OCIImageTypeLayerNondistributableGzip), gzipDecompressor)
+	registerDecompressor(string(OCIImageTypeLayerNondistributable), uncompressedDecompressor)
+}
+
+// registerDecompressor makes layers of the given media type extractable with d
+func registerDecompressor(mediaType string, d Decompressor) {
+	decompressorsMu.Lock()
+	defer decompressorsMu.Unlock()
+	decompressors[mediaType] = d
+}
+
+// decompress returns the uncompressed tar stream for a layer of the given media type. The
+// layer's first bytes are sniffed, so a compressed layer is read with the decompressor for its
+// compression and an uncompressed one as a plain tar, whatever its media type claims.
+func decompress(r io.Reader, mediaType string) (io.ReadCloser, error) {
+	if _, err := findDecompressor(mediaType); err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	detected := string(OCIImageTypeLayer)
+	for _, compression := range compressionMagic {
+		if bytes.HasPrefix(head, compression.magic) {
+			detected = compression.mediaType
+			break
+		}
+	}
+
+	d, err := findDecompressor(detected)
+	if err != nil {
+		return nil, err
+	}
+	return d(br)
+}
+
+// findDecompressor returns the decompressor registered for mediaType
+func findDecompressor(mediaType string) (Decompressor, error) {
+	decompressorsMu.RLock()
+	d, ok := decompressors[mediaType]
+	decompressorsMu.RUnlock()
+	switch {
+	case ok:
+		return d, nil
+	case mediaType == string(OCIImageTypeLayerZstd), mediaType == string(OCIImageTypeLayerNondistributableZstd):
+		return nil, ErrZstdUnsupported
+	}
+	return nil, fmt.Errorf("unsupported layer media type: %s", mediaType)
+}
+
+func gzipDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+func uncompressedDecompressor(r io.Reader) (io.ReadCloser, error) {
+	return io.NopCloser(r), nil
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecompress(t *testing.T) {
+	archive := buildTar(t, []tarEntry{tarFile("a", "a")})
+	compressed := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	_, zstdErr := findDecompressor(string(OCIImageTypeLayerZstd))
+
+	tests := []struct {
+		name      string
+		mediaType RegistrySchema
+		layer     []byte
+		// wantErr is part of the error expected, if any
+		wantErr string
+		// withoutZstd cases only apply when zstd support is not built in
+		withoutZstd bool
+	}{
+		{name: "docker gzip", mediaType: DockerImageTypeRootFs, layer: compressed},
+		{name: "OCI gzip", mediaType: OCIImageTypeLayerGzip, layer: compressed},
+		{name: "OCI uncompressed", mediaType: OCIImageTypeLayer, layer: archive},
+		{name: "foreign gzip", mediaType: DockerImageTypeRootFsForeign, layer: compressed},
+		{name: "nondistributable gzip", mediaType: OCIImageTypeLayerNondistributableGzip, layer: compressed},
+		{name: "nondistributable uncompressed", mediaType: OCIImageTypeLayerNondistributable, layer: archive},
+		{name: "gzip labelled uncompressed", mediaType: OCIImageTypeLayer, layer: compressed},
+		{name: "uncompressed labelled gzip", mediaType: DockerImageTypeRootFs, layer: archive},
+		{name: "unknown media type", mediaType: "application/x-unknown", layer: compressed, wantErr: "unsupported layer media type"},
+		{name: "empty layer", mediaType: OCIImageTypeLayer, layer: nil},
+		{name: "zstd", mediaType: OCIImageTypeLayerZstd, layer: compressed, wantErr: ErrZstdUnsupported.Error(), withoutZstd: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.withoutZstd && zstdErr == nil {
+				t.Skip("zstd support is built in")
+			}
+			r, err := decompress(bytes.NewReader(tt.layer), string(tt.mediaType))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("decompress gave %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer r.Close()
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(tt.layer) > 0 && !bytes.Equal(got, archive) {
+				t.Errorf("decompressed %d bytes, want the %d byte archive", len(got), len(archive))
+			}
+		})
+	}
+}
+
+func TestRegisterDecompressor(t *testing.T) {
+	const mediaType = "application/vnd.example.layer.v1.tar+reversed"
+	registerDecompressor(mediaType, uncompressedDecompressor)
+	t.Cleanup(func() {
+		decompressorsMu.Lock()
+		delete(decompressors, mediaType)
+		decompressorsMu.Unlock()
+	})
+
+	if _, err := findDecompressor(mediaType); err != nil {
+		t.Errorf("registered decompressor was not found: %v", err)
+	}
+	// The media type only decides whether the layer is supported, its content how it is read
+	r, err := decompress(bytes.NewReader(buildTar(t, nil)), mediaType)
+	if err != nil {
+		t.Fatalf("decompressing a plain archive of a registered type gave %v", err)
+	}
+	r.Close()
+}
+
+func TestExtractPulledLayerByContent(t *testing.T) {
+	_, zstdErr := findDecompressor(string(OCIImageTypeLayerZstd))
+	// Every layer of a fake image is labelled as gzip compressed, whatever it holds
+	tests := []struct {
+		name    string
+		layer   []byte
+		wantErr error
+		// withoutZstd cases only apply when zstd support is not built in
+		withoutZstd bool
+	}{
+		{name: "gzip", layer: buildLayer(t, []tarEntry{tarFile("a", "a")})},
+		{name: "uncompressed", layer: buildTar(t, []tarEntry{tarFile("a", "a")})},
+		{name: "zstd", layer: append(append([]byte(nil), zstdMagic...), 0, 0, 0, 0), wantErr: ErrZstdUnsupported, withoutZstd: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.withoutZstd && zstdErr == nil {
+				t.Skip("zstd support is built in")
+			}
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "app", "latest", newFakeImage(t, tt.layer))
+			layers, _, err := pullImage(context.Background(), ref, nil, nil)
+			if err != nil {
+				t.Fatalf("pullImage: %v", err)
+			}
+
+			root := t.TempDir()
+			err = extractLayer(root, &(*layers)[0])
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("extractLayer returned %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extractLayer: %v", err)
+			}
+			if data, err := os.ReadFile(filepath.Join(root, "a")); err != nil || string(data) != "a" {
+				t.Errorf("extracted a holds %q, %v", data, err)
+			}
+		})
+	}
+}
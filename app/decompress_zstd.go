@@ -0,0 +1,29 @@
+//go:build zstd
+// +build zstd
+
+package main
+
+import (
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstd support needs github.com/klauspost/compress, which is only built into the tool with
+// -tags zstd, so that the default build has no dependencies beyond those CodeCrafters provides.
+// go.mod is managed by CodeCrafters, so the requirement is added locally with
+// `go get github.com/klauspost/compress` before building with the tag, and not committed.
+func init() {
+	registerDecompressor(string(OCIImageTypeLayerZstd), zstdDecompressor)
+	registerDecompressor(string(OCIImageTypeLayerNondistributableZstd), zstdDecompressor)
+}
+
+// zstdDecompressor reads zstd compressed layers. The decoder runs goroutines of its own, which
+// only stop once it is closed, so closing the returned reader closes the decoder.
+func zstdDecompressor(r io.Reader) (io.ReadCloser, error) {
+	decoder, err := zstd.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return decoder.IOReadCloser(), nil
+}
@@ -0,0 +1,56 @@
+//go:build zstd
+// +build zstd
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestExtractZstdLayer(t *testing.T) {
+	tests := []struct {
+		name      string
+		mediaType RegistrySchema
+	}{
+		{name: "OCI", mediaType: OCIImageTypeLayerZstd},
+		{name: "nondistributable", mediaType: OCIImageTypeLayerNondistributableZstd},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			var buf bytes.Buffer
+			encoder, err := zstd.NewWriter(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := encoder.Write(buildTar(t, []tarEntry{tarDir("etc/"), tarFile("etc/os-release", "ID=zstd")})); err != nil {
+				t.Fatal(err)
+			}
+			if err := encoder.Close(); err != nil {
+				t.Fatal(err)
+			}
+			sum := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes()))
+			if err := os.WriteFile(filepath.Join(ImageLayersPath, sum+".tar.gz"), buf.Bytes(), 0600); err != nil {
+				t.Fatal(err)
+			}
+			var layer ImageLayer
+			layer.Digest, layer.MediaType, layer.Size, layer.Sha256Sum = "sha256:"+sum, string(tt.mediaType), buf.Len(), sum
+
+			root := t.TempDir()
+			if err := extractLayer(root, &layer); err != nil {
+				t.Fatal(err)
+			}
+			if body, err := os.ReadFile(filepath.Join(root, "etc/os-release")); err != nil || string(body) != "ID=zstd" {
+				t.Errorf("extracted etc/os-release is %q, %v", body, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// containerDevices are the character devices every container is given in /dev
+var containerDevices = []struct {
+	name         string
+	major, minor uint32
+}{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
+
+// containerDevLinks are the symlinks into procfs that programs expect to find in /dev
+var containerDevLinks = map[string]string{
+	"fd":     "/proc/self/fd",
+	"stdin":  "/proc/self/fd/0",
+	"stdout": "/proc/self/fd/1",
+	"stderr": "/proc/self/fd/2",
+}
+
+// setupDev populates a fresh /dev beneath rootfs rather than exposing the host's. Device nodes
+// need CAP_MKNOD, which a user namespace never has, so without it the host's nodes are bind
+// mounted instead. It must run before the root is pivoted, while the host's /dev is reachable.
+func setupDev(rootfs string) error {
+	dev := filepath.Join(rootfs, "dev")
+	if err := os.MkdirAll(dev, 0755); err != nil {
+		return err
+	}
+	if err := syscall.Mount("tmpfs", dev, "tmpfs", syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755"); err != nil {
+		return fmt.Errorf("could not mount /dev: %w", err)
+	}
+
+	for _, dir := range []string{"pts", "shm"} {
+		if err := os.MkdirAll(filepath.Join(dev, dir), 0755); err != nil {
+			return err
+		}
+	}
+
+	for _, device := range containerDevices {
+		target := filepath.Join(dev, device.name)
+		err := createCharacterfile(target, device.major, device.minor, 0666)
+		if errors.Is(err, unix.EPERM) {
+			err = bindHostDevice(filepath.Join("/dev", device.name), target)
+		}
+		if err != nil {
+			fmt.Printf("warning: could not create /dev/%s: %s\n", device.name, err)
+		}
+	}
+
+	for name, target := range containerDevLinks {
+		if err := os.Symlink(target, filepath.Join(dev, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bindHostDevice mounts the host's device node at source over target
+func bindHostDevice(source, target string) error {
+	if err := createMountTarget(source, target); err != nil {
+		return err
+	}
+	return syscall.Mount(source, target, "", syscall.MS_BIND, "")
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestRunDev(t *testing.T) {
+	requireContainers(t)
+	var files, want []string
+	for _, device := range containerDevices {
+		name := "/dev/" + device.name
+		files = append(files, name)
+		want = append(want, fmt.Sprintf("%s c %d %d", name, device.major, device.minor))
+	}
+	for name, target := range containerDevLinks {
+		files = append(files, "/dev/"+name)
+		want = append(want, fmt.Sprintf("/dev/%s -> %s", name, target))
+	}
+	files = append(files, "/dev/pts", "/dev/shm")
+	want = append(want, "/dev/pts d", "/dev/shm d")
+
+	tests := []struct {
+		name  string
+		flags []string
+	}{
+		{name: "device nodes"},
+		// Without CAP_MKNOD the host's device nodes are bind mounted instead
+		{name: "rootless", flags: []string{"--rootless"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, append([]string{"stat"}, files...)...)
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			if got := strings.Split(strings.TrimSpace(stdout), "\n"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("/dev in the container holds\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestRunDevIsNotHosts(t *testing.T) {
+	requireContainers(t)
+	// The host's /dev has many more entries than the few a container is given
+	stdout, stderr, code := runProbe(t, nil, "ls", "/dev")
+	if code != 0 {
+		t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+	}
+	got := strings.Fields(stdout)
+	if len(got) != len(containerDevices)+len(containerDevLinks)+2 {
+		t.Errorf("/dev in the container holds %q", got)
+	}
+}
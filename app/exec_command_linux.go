@@ -0,0 +1,112 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+)
+
+// execCommand runs another command in a running container, named by its ID or a unique
+// prefix of it. The command is started in the container's namespaces and root filesystem with
+// its capabilities, seccomp filter and environment, as its own command was.
+//
+// Usage: your_docker.sh exec [options] <container> <command> [arg1] [arg2] ...
+func execCommand(arguments []string) {
+	flags := flag.NewFlagSet("exec", flag.ExitOnError)
+	user := flags.String("user", "", "user to run as, as user[:group] by name or id (defaults to the container's user)")
+	flags.StringVar(user, "u", "", "shorthand for --user")
+	workdir := flags.String("workdir", "", "working directory inside the container (defaults to the container's)")
+	flags.StringVar(workdir, "w", "", "shorthand for --workdir")
+	var envs stringList
+	flags.Var(&envs, "env", "set an environment variable as KEY=VALUE (repeatable)")
+	flags.Var(&envs, "e", "shorthand for --env")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() < 2 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+
+	state, err := findContainer(flags.Arg(0))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if state.Rootless {
+		fmt.Println("exec cannot join containers run with --rootless, as their user namespace cannot be entered")
+		os.Exit(1)
+	}
+
+	config := &InitConfig{
+		// The container's root filesystem, as its init process sees it, is entered by chroot
+		RootFS:          fmt.Sprintf("/proc/%d/root", state.Pid),
+		Command:         flags.Arg(1),
+		Args:            flags.Args()[2:],
+		WorkingDir:      state.Init.WorkingDir,
+		User:            state.Init.User,
+		Capabilities:    state.Init.Capabilities,
+		Seccomp:         state.Init.Seccomp,
+		NoNewPrivileges: state.Init.NoNewPrivileges,
+		// The parent death signal is left to init, as the kernel reports no parent to a process
+		// started in another PID namespace, which os/exec takes as its parent having died
+		DeathSignal: syscall.SIGKILL,
+	}
+	if *user != "" {
+		config.User = *user
+	}
+	if *workdir != "" {
+		config.WorkingDir = *workdir
+	}
+	image := DockerImageConfig{Config: OCIImageConfig{Env: state.Env}}
+
+	// Namespaces are joined by the calling thread, and apply to the processes it starts
+	runtime.LockOSThread()
+	if err := joinNamespaces(state.Pid); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	cmd := exec.Command("/proc/self/exe", append(logFlags(), "init")...)
+	cmd.Env = image.env(envs)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	started := func(pid int) error {
+		if cgroup, err := findCgroup(state.ID); err == nil {
+			return cgroup.addProcess(pid)
+		}
+		return nil
+	}
+	if err := startContainer(cmd, config, started); err != nil {
+		fmt.Printf("could not start process in container: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Signals are relayed to the process, which is not its namespace's init and so is not
+	// protected from those it has no handler for
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range signals {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	if err := cmd.Wait(); err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitError.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+				os.Exit(128 + int(status.Signal()))
+			}
+			os.Exit(exitError.ExitCode())
+		}
+		fmt.Printf("error executing command: %v\n", err)
+		os.Exit(1)
+	}
+}
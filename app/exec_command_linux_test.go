@@ -0,0 +1,46 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExecCommand(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImageWith(t, OCIImageConfig{Env: []string{"PATH=/bin", "FROM_IMAGE=yes"}}, probeLayer(t)))
+	dir := t.TempDir()
+	var output strings.Builder
+	startTool(t, dir, &output, "--insecure-registry", registry.host, "run", "--name", "sleeper", "--hostname", "box", "--workdir", "/bin", ref, "/bin/probe", "sleep")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "hostname", args: []string{"sleeper", "/bin/probe", "hostname"}, wantStdout: "box\n"},
+		{name: "working directory", args: []string{"sleeper", "/bin/probe", "pwd"}, wantStdout: "/bin\n"},
+		{name: "--workdir", args: []string{"-w", "/", "sleeper", "/bin/probe", "pwd"}, wantStdout: "/\n"},
+		{name: "image environment", args: []string{"sleeper", "/bin/probe", "env"}, wantStdout: "FROM_IMAGE=yes"},
+		{name: "--env", args: []string{"-e", "ADDED=1", "sleeper", "/bin/probe", "env"}, wantStdout: "ADDED=1"},
+		{name: "--user", args: []string{"--user", "1000:1000", "sleeper", "/bin/probe", "id"}, wantStdout: "uid=1000 gid=1000"},
+		// The container's root filesystem is entered, where only the probe exists
+		{name: "container's files", args: []string{"sleeper", "/bin/probe", "ls", "/bin"}, wantStdout: "probe\n"},
+		{name: "exit code", args: []string{"sleeper", "/bin/probe", "exit", "3"}, wantCode: 3},
+		{name: "unknown container", args: []string{"missing", "/bin/probe", "pwd"}, wantCode: 1, wantStdout: "no such container: missing\n"},
+		{name: "no command", args: []string{"sleeper"}, wantCode: 1, wantStdout: "Incorrect number of arguments specified.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := tool(t, dir, append([]string{"exec"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Fatalf("exec exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("exec printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// maxArgStrlen is the longest single argument or environment string execve accepts
+	maxArgStrlen = 32 * 4096
+	// minArgMax is the smallest limit execve places on the total size of arguments and environment
+	minArgMax = 128 * 1024
+)
+
+// argMax returns the limit on the combined size of the arguments and environment passed to
+// execve, which Linux derives from the stack size limit
+func argMax() int {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_STACK, &limit); err != nil || limit.Cur == unix.RLIM_INFINITY {
+		return minArgMax
+	}
+	if max := int(limit.Cur / 4); max > minArgMax {
+		return max
+	}
+	return minArgMax
+}
+
+// checkArgvSize reports the container command as too large to execute when its arguments and
+// environment exceed what execve accepts, and warns when they come close
+func checkArgvSize(argv, env []string) error {
+	size := 0
+	for _, list := range [][]string{argv, env} {
+		for _, s := range list {
+			if len(s)+1 > maxArgStrlen {
+				return fmt.Errorf("argument list too long: a single argument or environment variable may be at most %d bytes", maxArgStrlen-1)
+			}
+			// Each string is copied along with its terminator and a pointer to it
+			size += len(s) + 1 + int(unsafe.Sizeof(uintptr(0)))
+		}
+	}
+
+	limit := argMax()
+	if size > limit {
+		return fmt.Errorf("argument list too long: the command and its environment take %d bytes, but at most %d are allowed", size, limit)
+	}
+	if size > limit*9/10 {
+		logger.Warn("the command and its environment are close to the size limit", "bytes", size, "limit", limit)
+	}
+	return nil
+}
+
+// parseSignal parses a signal given by name, with or without its SIG prefix, or by number.
+// "none" parses as 0, meaning no signal.
+func parseSignal(name string) (syscall.Signal, error) {
+	if strings.EqualFold(name, "none") {
+		return 0, nil
+	}
+	if n, err := strconv.Atoi(name); err == nil && n > 0 && n < 65 {
+		return syscall.Signal(n), nil
+	}
+
+	name = strings.ToUpper(name)
+	if !strings.HasPrefix(name, "SIG") {
+		name = "SIG" + name
+	}
+	if sig := unix.SignalNum(name); sig != 0 {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unknown signal: %s", name)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestCheckArgvSize(t *testing.T) {
+	// Each string takes its length, a terminator and a pointer
+	overhead := 1 + int(unsafe.Sizeof(uintptr(0)))
+	limit := argMax()
+	// fill is a list of strings taking about n bytes between them
+	fill := func(n int) []string {
+		var list []string
+		for ; n > maxArgStrlen; n -= maxArgStrlen / 2 {
+			list = append(list, strings.Repeat("a", maxArgStrlen/2-overhead))
+		}
+		return append(list, strings.Repeat("a", n-overhead))
+	}
+
+	tests := []struct {
+		name        string
+		argv        []string
+		env         []string
+		wantErr     string
+		wantWarning bool
+	}{
+		{name: "small", argv: []string{"/bin/sh", "-c", "true"}, env: []string{"PATH=/bin"}},
+		{name: "longest argument", argv: []string{strings.Repeat("a", maxArgStrlen-1)}},
+		{
+			name:    "long argument",
+			argv:    []string{strings.Repeat("a", maxArgStrlen)},
+			wantErr: "argument list too long: a single argument or environment variable may be at most 131071 bytes",
+		},
+		{
+			name:    "long environment variable",
+			env:     []string{"A=" + strings.Repeat("a", maxArgStrlen)},
+			wantErr: "a single argument or environment variable may be at most",
+		},
+		{name: "near limit", argv: fill(limit * 95 / 100), wantWarning: true},
+		{name: "over limit", argv: fill(limit / 2), env: fill(limit/2 + 100), wantErr: "argument list too long: the command and its environment take"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logged := captureLog(t, slog.LevelWarn)
+			var err error
+			stdout := captureStdout(t, func() { err = checkArgvSize(tt.argv, tt.env) })
+			if stdout != "" {
+				t.Errorf("checkArgvSize printed %q to stdout, where the container's output goes", stdout)
+			}
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkArgvSize: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("checkArgvSize returned %v, want %q", err, tt.wantErr)
+			}
+			if warned := strings.Contains(logged.String(), "level=WARN"); warned != tt.wantWarning {
+				t.Errorf("checkArgvSize logged %q, want a warning: %t", logged, tt.wantWarning)
+			}
+		})
+	}
+}
+
+func TestParseSignal(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    syscall.Signal
+		wantErr string
+	}{
+		{name: "SIGKILL", want: syscall.SIGKILL},
+		{name: "TERM", want: syscall.SIGTERM},
+		{name: "sighup", want: syscall.SIGHUP},
+		{name: "usr1", want: syscall.SIGUSR1},
+		{name: "9", want: syscall.SIGKILL},
+		{name: "64", want: syscall.Signal(64)},
+		{name: "none", want: 0},
+		{name: "NONE", want: 0},
+		{name: "0", wantErr: "unknown signal: SIG0"},
+		{name: "65", wantErr: "unknown signal: SIG65"},
+		{name: "bogus", wantErr: "unknown signal: SIGBOGUS"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSignal(tt.name)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("parseSignal(%q) returned %v, want %q", tt.name, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSignal(%q): %v", tt.name, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseSignal(%q) = %v, want %v", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+// running reports whether the process pid exists and has not exited
+func running(pid int) bool {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return false
+	}
+	// The state follows the command name, which is in parentheses
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z" && fields[0] != "X"
+}
+
+func TestRunParentDeathSignal(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+
+	tests := []struct {
+		name  string
+		flags []string
+		// wantSurvives is set when the container should outlive run
+		wantSurvives bool
+	}{
+		{name: "default"},
+		{name: "by name", flags: []string{"--parent-death-signal", "KILL"}},
+		// Switching user clears the parent death signal, so init has to set it again
+		{name: "other user", flags: []string{"--user", "65534"}},
+		{name: "none", flags: []string{"--parent-death-signal", "none"}, wantSurvives: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := append([]string{"--insecure-registry", registry.host, "run"}, tt.flags...)
+			// Output goes straight to a file, as a container outliving run would keep a pipe open
+			devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer devNull.Close()
+			cmd := startTool(t, dir, devNull, append(args, ref, "/bin/probe", "sleep")...)
+			states, err := filepath.Glob(filepath.Join(dir, "state", "*.json"))
+			if err != nil || len(states) != 1 {
+				t.Fatalf("container records: %q, %v", states, err)
+			}
+			data, err := os.ReadFile(states[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			var state ContainerState
+			if err := json.Unmarshal(data, &state); err != nil {
+				t.Fatal(err)
+			}
+			defer syscall.Kill(state.Pid, syscall.SIGKILL)
+
+			// Killing run leaves it no chance to stop the container itself
+			cmd.Process.Kill()
+			cmd.Wait()
+			deadline := time.Now().Add(2 * time.Second)
+			for running(state.Pid) && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if survived := running(state.Pid); survived != tt.wantSurvives {
+				t.Errorf("container outlived run: %t, want %t", survived, tt.wantSurvives)
+			}
+		})
+	}
+}
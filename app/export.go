@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// exportCommand writes the flattened root filesystem of an image as a tar stream, the inverse
+// of extracting its layers. The image is taken from the local image index when it was loaded,
+// and pulled otherwise. As the tar is written to standard output, messages go to stderr.
+//
+// Usage: your_docker.sh export [-o <file>] <image> > rootfs.tar
+func exportCommand(ctx context.Context, arguments []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	output := flags.String("output", "", "write the tar to a file instead of standard output")
+	flags.StringVar(output, "o", "", "shorthand for --output")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+	ref := flags.Arg(0)
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		out = f
+	} else if info, err := os.Stdout.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		fmt.Fprintln(os.Stderr, "refusing to write a tar to the terminal; redirect standard output or use -o")
+		os.Exit(1)
+	}
+
+	if err := exportImage(ctx, ref, out); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if *output != "" {
+			os.Remove(*output)
+		}
+		os.Exit(1)
+	}
+}
+
+// exportImage extracts every layer of the image named by ref into a scratch directory and
+// writes the result to w as a single tar
+func exportImage(ctx context.Context, ref string, w io.Writer) error {
+	var layers *[]ImageLayer
+	stored, err := findImage(ref)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		storedLayers, err := stored.imageLayers()
+		if err != nil {
+			return err
+		}
+		layers = &storedLayers
+	} else {
+		progress := newProgressReporter(os.Stderr)
+		layers, _, err = pullImage(ctx, ref, nil, &PullOptions{Progress: progress.report, Downloading: progress.downloading})
+		progress.finish()
+		if err != nil {
+			return err
+		}
+	}
+
+	rootfs, err := os.MkdirTemp("/tmp/", "export.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rootfs)
+
+	for i := range *layers {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("export cancelled: %w", err)
+		}
+		layer := &(*layers)[i]
+		if err := extractLayer(rootfs, layer); err != nil {
+			return fmt.Errorf("could not extract layer %s - %w", layer.Sha256Sum, err)
+		}
+	}
+	if err := tarDirectory(rootfs, w); err != nil {
+		return fmt.Errorf("could not archive the root filesystem of %s: %w", ref, err)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// tarListing describes each entry of a tar stream, one line each
+func tarListing(t *testing.T, data []byte) []string {
+	t.Helper()
+	var lines []string
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return lines
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch header.Typeflag {
+		case tar.TypeDir:
+			lines = append(lines, header.Name)
+		case tar.TypeSymlink:
+			lines = append(lines, header.Name+" -> "+header.Linkname)
+		case tar.TypeLink:
+			lines = append(lines, header.Name+" => "+header.Linkname)
+		default:
+			lines = append(lines, fmt.Sprintf("%s %q", header.Name, body))
+		}
+	}
+}
+
+func TestExportImage(t *testing.T) {
+	useLayerStore(t)
+	registry := newFakeRegistry(t)
+	base := buildLayer(t, []tarEntry{tarDir("etc/"), tarFile("etc/hostname", "h"), tarFile("etc/passwd", "p")})
+	pulled := registry.pushIndex(t, "app", "latest", newFakeImage(t,
+		base,
+		buildLayer(t, []tarEntry{tarDir("etc/"), tarFile("etc/.wh.hostname", ""), tarSymlink("passwd", "etc/passwd")}),
+	))
+	linked := registry.pushIndex(t, "linked", "latest", newFakeImage(t,
+		buildLayer(t, []tarEntry{tarFile("a", "same"), tarHardlink("b", "a")}),
+	))
+	// Index requests are only made with a token
+	registry.requireToken("token", func(r *http.Request) (int, string) { return http.StatusOK, `{"token":"token"}` })
+	layer := storeLayer(t, []tarEntry{tarFile("loaded", "l")})
+	if err := storeImage("loaded", &ResolvedImage{Digest: "sha256:loaded", Layers: []ImageLayer{layer}, Config: &DockerImageConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    []string
+		wantErr string
+	}{
+		{name: "pulled", ref: pulled, want: []string{"etc/", `etc/passwd "p"`, "passwd -> etc/passwd"}},
+		{name: "loaded", ref: "loaded", want: []string{`loaded "l"`}},
+		{name: "hardlinks", ref: linked, want: []string{`a "same"`, "b => a"}},
+		{name: "missing", ref: registry.host + "/missing", wantErr: "manifest unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := exportImage(context.Background(), tt.ref, &buf)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("exportImage returned error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("exportImage: %v", err)
+			}
+			if got := tarListing(t, buf.Bytes()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("exported\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// extractLayersConcurrently extracts up to limit layers at a time into their own staging
+// directories, then merges them into dst in manifest order so the result is the same as
+// extracting them one after another. Should a layer hardlink to a file from a lower layer, which
+// cannot be resolved while staged, every layer is instead extracted in order.
+func extractLayersConcurrently(dst string, layers *[]ImageLayer, limit int) error {
+	// Staging beside dst keeps it on the same filesystem, so merging is a matter of renaming
+	stagingRoot, err := os.MkdirTemp(filepath.Dir(dst), "staging.")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(stagingRoot)
+
+	var (
+		wg        sync.WaitGroup
+		semaphore = make(chan struct{}, limit)
+		errs      = make([]error, len(*layers))
+	)
+	for i := range *layers {
+		wg.Add(1)
+		go func(i int, l *ImageLayer) {
+			defer wg.Done()
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			errs[i] = extractStagedLayer(filepath.Join(stagingRoot, strconv.Itoa(i)), l)
+		}(i, &(*layers)[i])
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if errors.Is(err, errCrossLayerLink) {
+			for j := range *layers {
+				if err := extractLayer(dst, &(*layers)[j]); err != nil {
+					return fmt.Errorf("could not extract layer %s - %w", (*layers)[j].Sha256Sum, err)
+				}
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("could not extract layer %s - %w", (*layers)[i].Sha256Sum, err)
+		}
+	}
+
+	for i := range *layers {
+		if err := mergeLayer(filepath.Join(stagingRoot, strconv.Itoa(i)), dst); err != nil {
+			return fmt.Errorf("could not merge layer %s - %w", (*layers)[i].Sha256Sum, err)
+		}
+	}
+	return nil
+}
+
+func extractStagedLayer(dst string, layer *ImageLayer) error {
+	f, err := os.Open(fmt.Sprintf("%s/%s.tar.gz", ImageLayersPath, layer.Sha256Sum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return extractTar(dst, f, layer.MediaType, true)
+}
+
+// mergeLayer moves the contents of a staged layer directory into the root filesystem at dst,
+// leaving it as extracting the layer into it with untar would. Paths are resolved within dst
+// as untar resolves them, so a directory in the layer is merged into the directory a lower
+// layer's symlink of the same name points to, such as lib -> usr/lib.
+func mergeLayer(src, dst string) error {
+	return mergeDir(src, dst, "/")
+}
+
+// mergeDir merges the staged directory src into dir, a directory of the root filesystem at root
+func mergeDir(src, root, dir string) error {
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+
+	// Whiteouts only hide what lower layers left in dst, so they are applied before this layer's
+	// own entries are moved in
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == whiteoutOpaqueDir {
+			target, err := resolveDirInRoot(root, dir)
+			if err != nil {
+				return err
+			}
+			if err := removeLowerEntries(target, nil); err != nil {
+				return err
+			}
+		} else if strings.HasPrefix(name, whiteoutPrefix) {
+			target, err := whiteoutTarget(root, dir, name)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasPrefix(name, whiteoutPrefix) {
+			continue
+		}
+		source, path := filepath.Join(src, name), filepath.Join(dir, name)
+
+		if !entry.IsDir() {
+			target, err := resolveInRoot(root, path)
+			if err != nil {
+				return err
+			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Rename(source, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		target, err := resolveDirInRoot(root, path)
+		if err != nil {
+			return err
+		}
+		if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		}
+		if err := mergeDir(source, root, path); err != nil {
+			return err
+		}
+		// The upper layer's directory metadata takes precedence
+		if err := copyDirMetadata(source, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyDirMetadata(src, dst string) error {
+	info, err := os.Lstat(src)
+	if err != nil {
+		return err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("could not read metadata for %s", src)
+	}
+
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(dst, int(stat.Uid), int(stat.Gid)); err != nil {
+			return err
+		}
+	}
+	if err := os.Chmod(dst, info.Mode()); err != nil {
+		return err
+	}
+	times := []unix.Timespec{unix.Timespec(stat.Atim), unix.Timespec(stat.Mtim)}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, dst, times, unix.AT_SYMLINK_NOFOLLOW)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExtractLayersConcurrentlyMatchesSequential(t *testing.T) {
+	outside := t.TempDir()
+	sentinel := filepath.Join(outside, "sentinel")
+
+	tests := []struct {
+		name   string
+		layers [][]tarEntry
+	}{
+		{
+			name: "directory over a relative symlink",
+			layers: [][]tarEntry{
+				{tarDir("usr/"), tarDir("usr/lib/"), tarFile("usr/lib/libc.so", "libc"), tarSymlink("lib", "usr/lib")},
+				{tarDir("lib/"), tarFile("lib/libm.so", "libm")},
+			},
+		},
+		{
+			name: "directory over an absolute symlink",
+			layers: [][]tarEntry{
+				{tarDir("usr/"), tarDir("usr/lib/"), tarSymlink("lib", "/usr/lib")},
+				{tarDir("lib/"), tarDir("lib/x86_64/"), tarFile("lib/x86_64/ld.so", "ld")},
+			},
+		},
+		{
+			name: "whiteouts",
+			layers: [][]tarEntry{
+				{tarDir("etc/"), tarFile("etc/hostname", "h"), tarFile("etc/passwd", "p"), tarDir("var/"), tarFile("var/a", "a"), tarFile("var/b", "b")},
+				{tarFile("etc/.wh.hostname", ""), tarDir("var/"), tarFile("var/.wh..wh..opq", ""), tarFile("var/c", "c")},
+			},
+		},
+		{
+			name: "whiteouts through a symlink",
+			layers: [][]tarEntry{
+				{tarDir("usr/"), tarDir("usr/lib/"), tarFile("usr/lib/a", "a"), tarFile("usr/lib/b", "b"), tarSymlink("lib", "usr/lib")},
+				{tarDir("lib/"), tarFile("lib/.wh.a", "")},
+			},
+		},
+		{
+			name: "replacing entries",
+			layers: [][]tarEntry{
+				{tarDir("a/"), tarFile("a/x", "x"), tarFile("b", "b"), tarDir("c/"), tarFile("d", "d")},
+				{tarFile("a", "file"), tarDir("b/"), tarFile("b/y", "y"), tarSymlink("c", "a"), tarSymlink("d", "b")},
+			},
+		},
+		{
+			name: "directory metadata",
+			layers: [][]tarEntry{
+				{tarDir("srv/"), tarFile("srv/a", "a")},
+				{{name: "srv/", typeflag: tar.TypeDir, mode: 0700}, tarFile("srv/b", "b")},
+			},
+		},
+		{
+			name: "whiteout through a symlink to the host",
+			layers: [][]tarEntry{
+				{tarSymlink("d", outside), tarSymlink("e", "../../../../../.."+outside)},
+				{tarFile("d/.wh.sentinel", ""), tarDir("e/"), tarFile("e/.wh..wh..opq", ""), tarFile("e/sentinel", "overwritten")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			if err := os.WriteFile(sentinel, []byte("host"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var layers []ImageLayer
+			for _, entries := range tt.layers {
+				layers = append(layers, storeLayer(t, entries))
+			}
+
+			sequential := t.TempDir()
+			for i := range layers {
+				if err := extractLayer(sequential, &layers[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			concurrent := filepath.Join(t.TempDir(), "rootfs")
+			if err := os.Mkdir(concurrent, 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := extractLayersConcurrently(concurrent, &layers, len(layers)); err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := snapshot(t, concurrent), snapshot(t, sequential); got != want {
+				t.Errorf("extracting concurrently gave\n%s\nwant\n%s", got, want)
+			}
+			if body, err := os.ReadFile(sentinel); err != nil || string(body) != "host" {
+				t.Errorf("file outside of the root filesystem changed: %q, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestMergeLayerRefusesInvalidWhiteouts(t *testing.T) {
+	tests := []struct {
+		name string
+		// marker is a whiteout left in the staged layer, in dir
+		dir    string
+		marker string
+	}{
+		{name: "dot", marker: ".wh.."},
+		{name: "dot dot", marker: ".wh..."},
+		{name: "dot in a directory", dir: "d", marker: ".wh.."},
+		{name: "dot dot in a directory", dir: "d", marker: ".wh..."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The root filesystem has a sibling, which removing its parent would take with it
+			parent := t.TempDir()
+			root, sibling := filepath.Join(parent, "rootfs"), filepath.Join(parent, "sibling")
+			if err := os.MkdirAll(filepath.Join(root, "d"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "d", "kept"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(sibling, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			staged := t.TempDir()
+			if err := os.MkdirAll(filepath.Join(staged, tt.dir), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(staged, tt.dir, tt.marker), nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := mergeLayer(staged, root); err == nil {
+				t.Error("merging succeeded, want the whiteout refused")
+			}
+			for _, path := range []string{filepath.Join(root, "d", "kept"), sibling} {
+				if _, err := os.Lstat(path); err != nil {
+					t.Errorf("merging removed %s: %v", path, err)
+				}
+			}
+		})
+	}
+}
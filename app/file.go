@@ -2,7 +2,6 @@ package main
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"errors"
 	"fmt"
 	"golang.org/x/sys/unix"
@@ -10,9 +9,16 @@ import (
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"syscall"
 )
 
+const (
+	// Whiteout files mark paths deleted from lower layers, as described by the OCI image spec.
+	whiteoutPrefix    = ".wh."
+	whiteoutOpaqueDir = ".wh..wh..opq"
+)
+
 func cwd() (string, error) {
 	path, err := os.Getwd()
 	if err != nil {
@@ -21,32 +27,41 @@ func cwd() (string, error) {
 	return path, nil
 }
 
-func lwd() error {
+func lwd() ([]string, error) {
 	files, err := ioutil.ReadDir(".")
 	if err != nil {
-		return err
+		return nil, err
 	}
+	names := make([]string, 0, len(files))
 	for _, f := range files {
-		fmt.Printf("Directory: %s\n", f.Name())
+		names = append(names, f.Name())
 	}
-	return nil
+	return names, nil
 }
 
-func createCharacterfile(path string) error {
-	// device /dev/null is set as 0x4 according to device major number
-	// mode is 0x2000 for S_IFCHR on POSIX systems
-	return mknod(path, 0x2000, 0x4)
+// createCharacterfile creates a character device node, such as /dev/null with major 1 and minor 3
+func createCharacterfile(path string, major, minor uint32, perm uint32) error {
+	if err := mknod(path, unix.S_IFCHR|perm, int(unix.Mkdev(major, minor))); err != nil {
+		return err
+	}
+	// The node is created subject to the umask
+	return os.Chmod(path, os.FileMode(perm))
 }
 
 func mknod(path string, mode uint32, dev int) error {
 	return unix.Mknod(path, mode, dev)
 }
 
-func copyFile(sourcePath, currentPath, destinationPath, fileToCopy string) error {
+// copyFile copies the file at sourcePath, with its permissions, to destinationPath, creating
+// any missing parent directories. The copy reads up to the end of the source as it is
+// then, rather than the size it had when opened, so a file still being written to is copied
+// whole or as far as it has got, never cut short or padded.
+func copyFile(sourcePath, destinationPath string) error {
 	file, err := os.Open(sourcePath)
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
 	fs, err := file.Stat()
 	if err != nil {
@@ -54,49 +69,32 @@ func copyFile(sourcePath, currentPath, destinationPath, fileToCopy string) error
 	}
 	permissions := fs.Mode().Perm()
 
-	newFilePath := fmt.Sprintf("%s%s", currentPath, destinationPath)
-	if len(debugCapabilities) > 0 {
-		fmt.Printf("Copying to new file: %s\n", newFilePath)
-	}
+	destinationPath = filepath.Clean(destinationPath)
+	logger.Debug("copying file", "source", sourcePath, "destination", destinationPath)
 
-	err = os.MkdirAll(newFilePath, 0750)
+	err = os.MkdirAll(filepath.Dir(destinationPath), 0750)
 	if err != nil {
 		return err
 	}
 
-	destinationFile, err := os.Create(fmt.Sprintf("%s%s", newFilePath, fileToCopy))
+	destinationFile, err := os.Create(destinationPath)
 	if err != nil {
 		return err
 	}
+	defer destinationFile.Close()
 
 	if err = destinationFile.Chmod(permissions); err != nil {
 		return err
 	}
 
-	buf := make([]byte, fs.Size()+1)
-
-	defer destinationFile.Close()
-	defer file.Close()
-
-	for {
-		n, err := file.Read(buf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 {
-			return nil
-		}
-
-		if _, err := destinationFile.Write(buf[:n]); err != nil {
-			return err
-		}
+	if _, err := io.Copy(destinationFile, file); err != nil {
+		return err
 	}
+	return destinationFile.Close()
 }
 
 func setup_chroot(path string) error {
-	if len(debugCapabilities) > 0 {
-		fmt.Printf("Temporary directory for chroot: %s\n", path)
-	}
+	logger.Debug("changing root", "path", path)
 	// Ideally use syscall.PivotRoot here
 	err := syscall.Chroot(path)
 	if err != nil {
@@ -111,48 +109,466 @@ func setup_chroot(path string) error {
 	return nil
 }
 
-func untar(dst string, r io.Reader) error {
-	gzr, err := gzip.NewReader(r)
+// errCrossLayerLink is returned when a layer staged on its own hardlinks to a file from another layer
+var errCrossLayerLink = errors.New("hardlink refers to a file outside of the layer")
+
+// hardlink is a hardlink entry waiting for the file it links to. The file is named as in the
+// layer, to be resolved once it exists, as the symlinks along its path may have changed by then.
+type hardlink struct {
+	linkname, target string
+}
+
+// maxSymlinks bounds how many symlinks resolving a path may follow, as the kernel's ELOOP does
+const maxSymlinks = 255
+
+// untar extracts a layer of the given media type into dst, decompressing it as its content
+// requires
+func untar(dst string, r io.Reader, mediaType string) error {
+	return extractTar(dst, r, mediaType, false)
+}
+
+// extractTar extracts a layer into dst. When staging, dst holds only this layer, so whiteout
+// markers are kept as empty files to be applied once the layer is merged onto those beneath it.
+func extractTar(dst string, r io.Reader, mediaType string, staging bool) error {
+	decompressed, err := decompress(r, mediaType)
 	if err != nil {
 		return err
 	}
-	defer gzr.Close()
+	defer decompressed.Close()
 
-	tr := tar.NewReader(gzr)
+	// Paths written by this layer, so that an opaque whiteout only hides entries from lower layers
+	extracted := make(map[string]bool)
+	directories := make(map[string]*tar.Header)
+	// Hardlinks listed before the file they link to are made once the whole layer is extracted
+	var pendingLinks []hardlink
+
+	tr := tar.NewReader(decompressed)
 	for {
 		header, err := tr.Next()
 		switch {
 		case err == io.EOF:
+			for _, link := range pendingLinks {
+				source, err := linkSource(dst, link.linkname)
+				if err != nil {
+					return err
+				}
+				if _, err := os.Lstat(source); os.IsNotExist(err) && staging {
+					return errCrossLayerLink
+				}
+				if err := os.Link(source, link.target); err != nil {
+					return err
+				}
+			}
+			// Directory metadata is applied last, as extracting their contents updates their mtime.
+			// The directories are found again, as later entries may have replaced them.
+			for name, header := range directories {
+				target, err := resolveDirInRoot(dst, name)
+				if err != nil {
+					return err
+				}
+				if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+					continue
+				}
+				if err := restoreMetadata(target, header); err != nil {
+					return err
+				}
+			}
 			return nil
 		case err != nil:
 			return err
 		case header == nil:
 			continue
 		}
-		target := filepath.Join(dst, header.Name)
+		// Symlinks extracted by this or earlier layers are followed as they would be inside the
+		// container, so that no entry is written outside of dst
+		target, err := resolveInRoot(dst, header.Name)
+		if err != nil {
+			return fmt.Errorf("could not extract %s: %w", header.Name, err)
+		}
+
+		base := filepath.Base(target)
+		// A whiteout is checked to hide an entry of its own directory even when staging, as
+		// merging the staged layer applies it all the same
+		var hidden string
+		if strings.HasPrefix(base, whiteoutPrefix) && base != whiteoutOpaqueDir {
+			if hidden, err = whiteoutTarget(dst, filepath.Dir(filepath.Clean("/"+header.Name)), base); err != nil {
+				return fmt.Errorf("could not extract %s: %w", header.Name, err)
+			}
+		}
+		if staging && strings.HasPrefix(base, whiteoutPrefix) {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.WriteFile(target, nil, 0600); err != nil {
+				return err
+			}
+			continue
+		} else if base == whiteoutOpaqueDir {
+			if err := removeLowerEntries(filepath.Dir(target), extracted); err != nil {
+				return err
+			}
+			continue
+		} else if hidden != "" {
+			if err := os.RemoveAll(hidden); err != nil {
+				return err
+			}
+			continue
+		}
+		extracted[target] = true
+
+		// Layers need not contain entries for every parent directory
+		if header.Typeflag != tar.TypeDir {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+		}
 
 		switch header.Typeflag {
 		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
+			// A symlink to a directory, such as lib -> usr/lib, stays in place of the directory
+			if target, err = resolveDirInRoot(dst, header.Name); err != nil {
+				return fmt.Errorf("could not extract %s: %w", header.Name, err)
+			}
+			if info, err := os.Lstat(target); err != nil || !info.IsDir() {
+				if err := os.RemoveAll(target); err != nil {
+					return err
+				}
 				if err := os.MkdirAll(target, 0755); err != nil {
 					return err
 				}
 			}
+			directories[header.Name] = header
 		case tar.TypeSymlink:
-			os.Symlink(header.Linkname, filepath.Join(dst,header.Name))
+			// A later layer may replace an existing entry, even a directory, with a symlink
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+			if err := restoreMetadata(target, header); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source, err := linkSource(dst, header.Linkname)
 			if err != nil {
 				return err
 			}
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if _, err := os.Lstat(source); os.IsNotExist(err) {
+				pendingLinks = append(pendingLinks, hardlink{linkname: header.Linkname, target: target})
+				continue
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			if err := createSpecialFile(target, header); err != nil {
+				// Creating device nodes requires CAP_MKNOD, which we may not have when unprivileged
+				if errors.Is(err, unix.EPERM) {
+					logger.Warn("skipping special file", "name", header.Name, "error", err)
+					continue
+				}
+				return err
+			}
+			if err := restoreMetadata(target, header); err != nil {
+				return err
+			}
 		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
+			// An existing entry is replaced rather than written through, as it may be a symlink
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_EXCL, os.FileMode(header.Mode))
 			if err != nil {
 				return err
 			}
 
 			if _, err := io.Copy(f, tr); err != nil {
+				f.Close()
 				return err
 			}
 			f.Close()
+
+			if err := restoreMetadata(target, header); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// IDMapping maps a range of user or group IDs inside a user namespace onto IDs on the host
+type IDMapping struct {
+	ContainerID int
+	HostID      int
+	Size        int
+}
+
+// extractUIDMappings and extractGIDMappings shift the ownership recorded in image layers as they
+// are extracted, so that files land owned by the host IDs that the container's user namespace
+// maps to the recorded IDs. Without mappings, ownership is restored unchanged.
+var extractUIDMappings, extractGIDMappings []IDMapping
+
+// mapID returns the host ID for a container ID, or the ID unchanged when no mapping covers it
+func mapID(id int, mappings []IDMapping) int {
+	for _, m := range mappings {
+		if id >= m.ContainerID && id < m.ContainerID+m.Size {
+			return m.HostID + id - m.ContainerID
+		}
+	}
+	return id
+}
+
+// restoreMetadata applies the ownership, permissions and timestamps recorded in header to path.
+// Ownership is only restored when running as root.
+func restoreMetadata(path string, header *tar.Header) error {
+	if os.Geteuid() == 0 {
+		uid := mapID(header.Uid, extractUIDMappings)
+		gid := mapID(header.Gid, extractGIDMappings)
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return err
 		}
 	}
+
+	// Permissions are set after ownership, since chown clears the setuid and setgid bits
+	if header.Typeflag != tar.TypeSymlink {
+		if err := os.Chmod(path, header.FileInfo().Mode()); err != nil {
+			return err
+		}
+	}
+
+	accessTime := header.AccessTime
+	if accessTime.IsZero() {
+		accessTime = header.ModTime
+	}
+	times := []unix.Timespec{
+		unix.NsecToTimespec(accessTime.UnixNano()),
+		unix.NsecToTimespec(header.ModTime.UnixNano()),
+	}
+	return unix.UtimesNanoAt(unix.AT_FDCWD, path, times, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+func createSpecialFile(path string, header *tar.Header) error {
+	mode := uint32(header.Mode & 07777)
+	switch header.Typeflag {
+	case tar.TypeChar:
+		return mknod(path, mode|unix.S_IFCHR, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+	case tar.TypeBlock:
+		return mknod(path, mode|unix.S_IFBLK, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+	case tar.TypeFifo:
+		return unix.Mkfifo(path, mode)
+	}
+	return fmt.Errorf("unsupported special file type: %c", header.Typeflag)
+}
+
+// withinDir reports whether path is dir itself or is nested beneath it
+func withinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvesWithin reports whether path, or else the closest of its ancestors that exists,
+// resolves to a location within dir. A dangling symlink could be followed anywhere once its
+// target is created, so is never considered within dir.
+func resolvesWithin(dir, path string) bool {
+	for {
+		if resolved, err := filepath.EvalSymlinks(path); err == nil {
+			return withinDir(dir, resolved)
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return false
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return false
+		}
+		path = parent
+	}
+}
+
+// resolveInRoot returns where name, a path in the root filesystem at root, is on the host. The
+// symlinks along its parent directories are followed as they would be inside the container, with
+// absolute symlinks taken from root and .. never climbing above it, so the result is always
+// within root. The last element is left as it is, so that an entry replacing a symlink
+// replaces the symlink itself.
+func resolveInRoot(root, name string) (string, error) {
+	name = filepath.Clean("/" + name)
+	if name == "/" {
+		return root, nil
+	}
+	parent, err := resolveDirInRoot(root, filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(name)), nil
+}
+
+// resolveDirInRoot returns where name, a path in the root filesystem at root, is on the host,
+// following every symlink along it as resolveInRoot does
+func resolveDirInRoot(root, name string) (string, error) {
+	resolved := "/"
+	remaining := name
+	links := 0
+	for remaining != "" {
+		var part string
+		part, remaining, _ = strings.Cut(remaining, "/")
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links in %s", name)
+		}
+		link, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(link) {
+			resolved = "/"
+		}
+		remaining = link + "/" + remaining
+	}
+	return filepath.Join(root, resolved), nil
+}
+
+// whiteoutTarget returns where the entry hidden by the whiteout name, found in the directory dir
+// of the root filesystem at root, is on the host. A whiteout only hides an entry of its own
+// directory, so one naming ., .. or a path is refused rather than removing dir, its parent or
+// anything outside of root.
+func whiteoutTarget(root, dir, name string) (string, error) {
+	hidden := strings.TrimPrefix(name, whiteoutPrefix)
+	if hidden == "" || hidden == "." || hidden == ".." || strings.Contains(hidden, "/") {
+		return "", fmt.Errorf("invalid whiteout %s", name)
+	}
+	target, err := resolveInRoot(root, filepath.Join(dir, hidden))
+	if err != nil {
+		return "", err
+	}
+	if target == filepath.Clean(root) || !withinDir(root, target) {
+		return "", fmt.Errorf("whiteout %s hides an entry outside of the root filesystem", name)
+	}
+	return target, nil
+}
+
+// linkSource returns the file a hardlink entry links to. The link is made to the file itself, so
+// its parent directories are resolved as resolveInRoot does, and the result checked to be within
+// the root filesystem.
+func linkSource(root, linkname string) (string, error) {
+	source, err := resolveInRoot(root, linkname)
+	if err != nil {
+		return "", err
+	}
+	if !withinDir(root, source) || !resolvesWithin(root, filepath.Dir(source)) {
+		return "", fmt.Errorf("hardlink points outside of the root filesystem: %s", linkname)
+	}
+	return source, nil
+}
+
+func removeLowerEntries(dir string, extracted map[string]bool) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		if extracted[path] {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarDirectory writes the contents of src to w as an uncompressed tar stream with paths relative to src.
+// Files linked to more than once are archived once, with hard links to them for their other names.
+func tarDirectory(src string, w io.Writer) error {
+	tw := tar.NewWriter(w)
+	type inode struct{ dev, ino uint64 }
+	archived := make(map[inode]string)
+
+	err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+			key := inode{uint64(stat.Dev), uint64(stat.Ino)}
+			if first, ok := archived[key]; ok {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+				return tw.WriteHeader(header)
+			}
+			archived[key] = header.Name
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
 }
@@ -0,0 +1,823 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestSquashLayers(t *testing.T) {
+	useLayerStore(t)
+	layers := []ImageLayer{
+		storeLayer(t, []tarEntry{
+			tarDir("etc/"),
+			tarFile("etc/hostname", "lower"),
+			tarFile("etc/passwd", "root:x:0:0"),
+			tarDir("usr/"),
+			tarDir("usr/lib/"),
+			tarFile("usr/lib/libc.so", "libc"),
+			tarSymlink("lib", "usr/lib"),
+			tarDir("var/"),
+			tarFile("var/cache", "stale"),
+		}),
+		storeLayer(t, []tarEntry{
+			tarFile("etc/.wh.hostname", ""),
+			tarFile("etc/motd", "hello"),
+			tarDir("lib/"),
+			tarFile("lib/libm.so", "libm"),
+			tarDir("var/"),
+			tarFile("var/.wh..wh..opq", ""),
+			tarFile("var/log", "fresh"),
+		}),
+		storeLayer(t, []tarEntry{
+			tarFile("etc/hostname", "upper"),
+			tarFile(".wh.usr", ""),
+		}),
+	}
+
+	stacked := t.TempDir()
+	for i := range layers {
+		if err := extractLayer(stacked, &layers[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	squashed, err := squashLayers(&layers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*squashed) != 1 {
+		t.Fatalf("squashed image has %d layers, want 1", len(*squashed))
+	}
+	flattened := t.TempDir()
+	if err := extractLayer(flattened, &(*squashed)[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := snapshot(t, flattened), snapshot(t, stacked); got != want {
+		t.Errorf("squashed layer contains\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestExtractSquashedLayersRemovesSquashedLayer(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]tarEntry
+		// want is a file the squashed root filesystem has
+		want string
+	}{
+		{name: "single layer", layers: [][]tarEntry{{tarFile("a", "a")}}, want: "a"},
+		{name: "several layers", layers: [][]tarEntry{{tarFile("a", "a")}, {tarFile(".wh.a", ""), tarFile("b", "b")}}, want: "b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			var layers []ImageLayer
+			for _, entries := range tt.layers {
+				layers = append(layers, storeLayer(t, entries))
+			}
+			before, err := os.ReadDir(ImageLayersPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			root := t.TempDir()
+			if _, err := extractSquashedLayers(root, &layers); err != nil {
+				t.Fatal(err)
+			}
+
+			after, err := os.ReadDir(ImageLayersPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(after) != len(before) {
+				t.Errorf("layer store has %d entries after squashing, want %d", len(after), len(before))
+			}
+			if _, err := os.Lstat(filepath.Join(root, tt.want)); err != nil {
+				t.Errorf("squashed layer was not extracted: %v", err)
+			}
+		})
+	}
+}
+
+func TestExtractTarStaysWithinRoot(t *testing.T) {
+	outside := t.TempDir()
+	sentinel := filepath.Join(outside, "sentinel")
+
+	tests := []struct {
+		name   string
+		layers [][]tarEntry
+	}{
+		{
+			name: "whiteout through absolute symlink",
+			layers: [][]tarEntry{
+				{tarSymlink("d", outside)},
+				{tarFile("d/.wh.sentinel", "")},
+			},
+		},
+		{
+			name: "whiteout through relative symlink",
+			layers: [][]tarEntry{
+				{tarSymlink("d", "../../../../../../.."+outside)},
+				{tarFile("d/.wh.sentinel", "")},
+			},
+		},
+		{
+			name: "opaque whiteout through symlink",
+			layers: [][]tarEntry{
+				{tarSymlink("d", outside)},
+				{tarFile("d/.wh..wh..opq", "")},
+			},
+		},
+		{
+			name: "whiteout through symlinked parent",
+			layers: [][]tarEntry{
+				{tarSymlink("d", "/"), tarDir("e/"), tarSymlink("e/f", "../d"+outside)},
+				{tarFile("e/f/.wh.sentinel", "")},
+			},
+		},
+		{
+			name: "file through symlink",
+			layers: [][]tarEntry{
+				{tarSymlink("d", outside)},
+				{tarFile("d/sentinel", "overwritten")},
+			},
+		},
+		{
+			name: "file replacing symlink",
+			layers: [][]tarEntry{
+				{tarSymlink("f", sentinel)},
+				{tarFile("f", "overwritten")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			if err := os.WriteFile(sentinel, []byte("host"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			var layers []ImageLayer
+			for _, entries := range tt.layers {
+				layers = append(layers, storeLayer(t, entries))
+			}
+
+			root := t.TempDir()
+			for i := range layers {
+				if err := extractLayer(root, &layers[i]); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, err := squashLayers(&layers); err != nil {
+				t.Fatal(err)
+			}
+
+			if body, err := os.ReadFile(sentinel); err != nil || string(body) != "host" {
+				t.Errorf("file outside of the root filesystem changed: %q, %v", body, err)
+			}
+		})
+	}
+}
+
+func TestExtractTarRefusesInvalidWhiteouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{name: "dot", entries: []tarEntry{tarFile(".wh..", "")}},
+		{name: "dot dot", entries: []tarEntry{tarFile(".wh...", "")}},
+		{name: "dot in a directory", entries: []tarEntry{tarDir("d/"), tarFile("d/.wh..", "")}},
+		{name: "dot dot in a directory", entries: []tarEntry{tarDir("d/"), tarFile("d/.wh...", "")}},
+		{name: "nothing", entries: []tarEntry{tarFile(".wh.", "")}},
+	}
+
+	for _, tt := range tests {
+		for _, staging := range []bool{false, true} {
+			// The root filesystem has a sibling, which removing its parent would take with it
+			parent := t.TempDir()
+			root, sibling := filepath.Join(parent, "rootfs"), filepath.Join(parent, "sibling")
+			if err := os.MkdirAll(filepath.Join(root, "d"), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(root, "d", "kept"), nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(sibling, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := extractTar(root, bytes.NewReader(buildLayer(t, tt.entries)), string(DockerImageTypeRootFs), staging)
+			if err == nil {
+				t.Errorf("%s: extracting with staging %t succeeded, want the whiteout refused", tt.name, staging)
+			}
+			for _, path := range []string{filepath.Join(root, "d", "kept"), sibling} {
+				if _, err := os.Lstat(path); err != nil {
+					t.Errorf("%s: extracting with staging %t removed %s: %v", tt.name, staging, path, err)
+				}
+			}
+		}
+	}
+}
+
+func TestExtractTarHardlinks(t *testing.T) {
+	outside := t.TempDir()
+	sentinel := filepath.Join(outside, "sentinel")
+	if err := os.WriteFile(sentinel, []byte("host"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		layers  [][]tarEntry
+		linked  []string
+		wantErr bool
+	}{
+		{
+			name:   "to an earlier entry",
+			layers: [][]tarEntry{{tarFile("a", "a"), tarHardlink("b", "a")}},
+			linked: []string{"a", "b"},
+		},
+		{
+			name:   "to a later entry",
+			layers: [][]tarEntry{{tarHardlink("b", "a"), tarFile("a", "a")}},
+			linked: []string{"a", "b"},
+		},
+		{
+			name:   "to a lower layer",
+			layers: [][]tarEntry{{tarFile("a", "a")}, {tarHardlink("b", "a")}},
+			linked: []string{"a", "b"},
+		},
+		{
+			name:   "through a symlink within the root filesystem",
+			layers: [][]tarEntry{{tarDir("usr/"), tarFile("usr/a", "a"), tarSymlink("u", "/usr")}, {tarHardlink("b", "u/a")}},
+			linked: []string{"usr/a", "b"},
+		},
+		{
+			name:    "through a symlink to the host",
+			layers:  [][]tarEntry{{tarSymlink("x", "/")}, {tarHardlink("b", "x"+sentinel)}},
+			wantErr: true,
+		},
+		{
+			name:    "through a symlink to the host in the same layer",
+			layers:  [][]tarEntry{{tarSymlink("x", "/"), tarHardlink("b", "x"+sentinel)}},
+			wantErr: true,
+		},
+		{
+			name:    "above the root filesystem",
+			layers:  [][]tarEntry{{tarHardlink("b", "../../../../../../.."+sentinel)}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			root := t.TempDir()
+			var err error
+			for _, entries := range tt.layers {
+				layer := storeLayer(t, entries)
+				if err = extractLayer(root, &layer); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extracting gave %v, want error %t", err, tt.wantErr)
+			}
+
+			var host syscall.Stat_t
+			if err := syscall.Stat(sentinel, &host); err != nil {
+				t.Fatal(err)
+			}
+			if host.Nlink != 1 {
+				t.Errorf("file outside of the root filesystem was linked to")
+			}
+
+			var inodes []uint64
+			for _, name := range tt.linked {
+				var st syscall.Stat_t
+				if err := syscall.Lstat(filepath.Join(root, name), &st); err != nil {
+					t.Fatal(err)
+				}
+				inodes = append(inodes, st.Ino)
+			}
+			for i := range inodes {
+				if inodes[i] != inodes[0] {
+					t.Errorf("%s is not linked to %s", tt.linked[i], tt.linked[0])
+				}
+			}
+		})
+	}
+}
+
+func TestExtractTarSymlinks(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]tarEntry
+		// want is the target of the symlink l once the layers are extracted
+		want    string
+		wantErr bool
+	}{
+		{
+			name:   "new symlink",
+			layers: [][]tarEntry{{tarSymlink("l", "target")}},
+			want:   "target",
+		},
+		{
+			name:   "replacing a symlink",
+			layers: [][]tarEntry{{tarSymlink("l", "old")}, {tarSymlink("l", "new")}},
+			want:   "new",
+		},
+		{
+			name:   "replacing a symlink in the same layer",
+			layers: [][]tarEntry{{tarSymlink("l", "old"), tarSymlink("l", "new")}},
+			want:   "new",
+		},
+		{
+			name:   "replacing a file",
+			layers: [][]tarEntry{{tarFile("l", "file")}, {tarSymlink("l", "new")}},
+			want:   "new",
+		},
+		{
+			name:   "replacing a directory",
+			layers: [][]tarEntry{{tarDir("l/"), tarFile("l/f", "file")}, {tarSymlink("l", "new")}},
+			want:   "new",
+		},
+		{
+			name:    "below a file",
+			layers:  [][]tarEntry{{tarFile("f", "file"), tarSymlink("f/l", "target")}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			root := t.TempDir()
+			var err error
+			for _, entries := range tt.layers {
+				layer := storeLayer(t, entries)
+				if err = extractLayer(root, &layer); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extracting gave %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if target, err := os.Readlink(filepath.Join(root, "l")); err != nil || target != tt.want {
+				t.Errorf("l links to %q, %v, want %q", target, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExtractTarSpecialFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		layers   [][]tarEntry
+		wantType uint32
+		// wantDev is the device number of a character or block device
+		wantDev uint64
+		root    bool
+	}{
+		{
+			name:     "fifo",
+			layers:   [][]tarEntry{{{name: "fifo", typeflag: tar.TypeFifo, mode: 0600}}},
+			wantType: unix.S_IFIFO,
+		},
+		{
+			name:     "fifo replacing a file",
+			layers:   [][]tarEntry{{tarFile("fifo", "file")}, {{name: "fifo", typeflag: tar.TypeFifo, mode: 0600}}},
+			wantType: unix.S_IFIFO,
+		},
+		{
+			name:     "fifo replacing a directory",
+			layers:   [][]tarEntry{{tarDir("fifo/"), tarFile("fifo/f", "file")}, {{name: "fifo", typeflag: tar.TypeFifo, mode: 0600}}},
+			wantType: unix.S_IFIFO,
+		},
+		{
+			name:     "character device",
+			layers:   [][]tarEntry{{{name: "null", typeflag: tar.TypeChar, mode: 0666, devmajor: 1, devminor: 3}}},
+			wantType: unix.S_IFCHR,
+			wantDev:  unix.Mkdev(1, 3),
+			root:     true,
+		},
+		{
+			name:     "block device",
+			layers:   [][]tarEntry{{{name: "loop", typeflag: tar.TypeBlock, mode: 0660, devmajor: 7, devminor: 0}}},
+			wantType: unix.S_IFBLK,
+			wantDev:  unix.Mkdev(7, 0),
+			root:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.root && os.Geteuid() != 0 {
+				t.Skip("creating device nodes needs root")
+			}
+			useLayerStore(t)
+			root := t.TempDir()
+			var name string
+			for _, entries := range tt.layers {
+				layer := storeLayer(t, entries)
+				if err := extractLayer(root, &layer); err != nil {
+					t.Fatal(err)
+				}
+				name = entries[len(entries)-1].name
+			}
+
+			var st unix.Stat_t
+			if err := unix.Lstat(filepath.Join(root, name), &st); err != nil {
+				t.Fatal(err)
+			}
+			if uint32(st.Mode)&unix.S_IFMT != tt.wantType {
+				t.Errorf("%s has type %o, want %o", name, uint32(st.Mode)&unix.S_IFMT, tt.wantType)
+			}
+			if tt.wantDev != 0 && uint64(st.Rdev) != tt.wantDev {
+				t.Errorf("%s is device %d:%d, want %d:%d", name,
+					unix.Major(uint64(st.Rdev)), unix.Minor(uint64(st.Rdev)), unix.Major(tt.wantDev), unix.Minor(tt.wantDev))
+			}
+		})
+	}
+}
+
+func TestExtractTarSkipsDevicesWithoutPermission(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root may create device nodes")
+	}
+	useLayerStore(t)
+	root := t.TempDir()
+	layer := storeLayer(t, []tarEntry{
+		{name: "null", typeflag: tar.TypeChar, mode: 0666, devmajor: 1, devminor: 3},
+		tarFile("after", "after"),
+	})
+	if err := extractLayer(root, &layer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(root, "after")); err != nil {
+		t.Errorf("entries after a skipped device node were not extracted: %v", err)
+	}
+}
+
+func TestExtractTarRestoresMetadata(t *testing.T) {
+	// buildTar records every entry as last modified at this time
+	modTime := time.Unix(1700000000, 0)
+	owned := func(e tarEntry, uid, gid int) tarEntry {
+		e.uid, e.gid = uid, gid
+		return e
+	}
+	withMode := func(e tarEntry, mode int64) tarEntry {
+		e.mode = mode
+		return e
+	}
+
+	tests := []struct {
+		name     string
+		entries  []tarEntry
+		path     string
+		wantMode os.FileMode
+		// wantUID and wantGID are only checked when running as root
+		wantUID int
+		wantGID int
+	}{
+		{
+			name:     "file",
+			entries:  []tarEntry{owned(withMode(tarFile("f", "f"), 0640), 1000, 1001)},
+			path:     "f",
+			wantMode: 0640,
+			wantUID:  1000,
+			wantGID:  1001,
+		},
+		{
+			name:     "setuid file",
+			entries:  []tarEntry{owned(withMode(tarFile("su", "su"), 04755), 0, 0)},
+			path:     "su",
+			wantMode: 0755 | os.ModeSetuid,
+		},
+		{
+			name:     "setgid file owned by a group",
+			entries:  []tarEntry{owned(withMode(tarFile("sg", "sg"), 02755), 0, 50)},
+			path:     "sg",
+			wantMode: 0755 | os.ModeSetgid,
+			wantGID:  50,
+		},
+		{
+			name:     "directory written to afterwards",
+			entries:  []tarEntry{owned(withMode(tarDir("d/"), 01777), 2, 3), tarFile("d/f", "f")},
+			path:     "d",
+			wantMode: os.ModeDir | os.ModeSticky | 0777,
+			wantUID:  2,
+			wantGID:  3,
+		},
+		{
+			name:     "symlink",
+			entries:  []tarEntry{owned(tarSymlink("l", "missing"), 5, 6)},
+			path:     "l",
+			wantMode: os.ModeSymlink | 0777,
+			wantUID:  5,
+			wantGID:  6,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			root := t.TempDir()
+			layer := storeLayer(t, tt.entries)
+			if err := extractLayer(root, &layer); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := os.Lstat(filepath.Join(root, tt.path))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode() != tt.wantMode {
+				t.Errorf("%s has mode %v, want %v", tt.path, info.Mode(), tt.wantMode)
+			}
+			if !info.ModTime().Equal(modTime) {
+				t.Errorf("%s was modified at %v, want %v", tt.path, info.ModTime(), modTime)
+			}
+			if os.Geteuid() == 0 {
+				st := info.Sys().(*syscall.Stat_t)
+				if int(st.Uid) != tt.wantUID || int(st.Gid) != tt.wantGID {
+					t.Errorf("%s is owned by %d:%d, want %d:%d", tt.path, st.Uid, st.Gid, tt.wantUID, tt.wantGID)
+				}
+			}
+		})
+	}
+}
+
+func TestMapID(t *testing.T) {
+	mappings := []IDMapping{
+		{ContainerID: 0, HostID: 1000, Size: 1},
+		{ContainerID: 1, HostID: 100000, Size: 65536},
+	}
+
+	tests := []struct {
+		id   int
+		want int
+	}{
+		{id: 0, want: 1000},
+		{id: 1, want: 100000},
+		{id: 1000, want: 100999},
+		{id: 65536, want: 165535},
+		{id: 65537, want: 65537},
+	}
+
+	for _, tt := range tests {
+		if got := mapID(tt.id, mappings); got != tt.want {
+			t.Errorf("mapID(%d) = %d, want %d", tt.id, got, tt.want)
+		}
+	}
+	if got := mapID(42, nil); got != 42 {
+		t.Errorf("mapID(42) without mappings = %d, want 42", got)
+	}
+}
+
+func TestExtractTarShiftsOwnership(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing ownership needs root")
+	}
+	uids, gids := extractUIDMappings, extractGIDMappings
+	extractUIDMappings = []IDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+	extractGIDMappings = []IDMapping{{ContainerID: 0, HostID: 200000, Size: 65536}}
+	t.Cleanup(func() { extractUIDMappings, extractGIDMappings = uids, gids })
+
+	tests := []struct {
+		entry   tarEntry
+		wantUID uint32
+		wantGID uint32
+	}{
+		{entry: tarFile("root", "root"), wantUID: 100000, wantGID: 200000},
+		{entry: tarEntry{name: "user", typeflag: tar.TypeReg, mode: 0644, uid: 1000, gid: 100}, wantUID: 101000, wantGID: 200100},
+		{entry: tarEntry{name: "dir/", typeflag: tar.TypeDir, mode: 0755, uid: 5, gid: 6}, wantUID: 100005, wantGID: 200006},
+		{entry: tarEntry{name: "link", typeflag: tar.TypeSymlink, linkname: "root", uid: 7, gid: 8}, wantUID: 100007, wantGID: 200008},
+		{entry: tarEntry{name: "nobody", typeflag: tar.TypeReg, mode: 0644, uid: 70000, gid: 70000}, wantUID: 70000, wantGID: 70000},
+	}
+
+	useLayerStore(t)
+	root := t.TempDir()
+	var entries []tarEntry
+	for _, tt := range tests {
+		entries = append(entries, tt.entry)
+	}
+	layer := storeLayer(t, entries)
+	if err := extractLayer(root, &layer); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(root, tt.entry.name), &st); err != nil {
+			t.Fatal(err)
+		}
+		if st.Uid != tt.wantUID || st.Gid != tt.wantGID {
+			t.Errorf("%s is owned by %d:%d, want %d:%d", tt.entry.name, st.Uid, st.Gid, tt.wantUID, tt.wantGID)
+		}
+	}
+}
+
+func TestExtractTarDefersHardlinks(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+		staging bool
+		linked  []string
+		wantErr error
+	}{
+		{
+			name:    "target listed first",
+			entries: []tarEntry{tarFile("a", "a"), tarHardlink("b", "a")},
+			linked:  []string{"a", "b"},
+		},
+		{
+			name:    "target listed later",
+			entries: []tarEntry{tarHardlink("b", "a"), tarFile("a", "a")},
+			linked:  []string{"a", "b"},
+		},
+		{
+			name:    "several links listed before a nested target",
+			entries: []tarEntry{tarHardlink("b", "dir/a"), tarHardlink("c", "dir/a"), tarDir("dir/"), tarFile("dir/a", "a")},
+			linked:  []string{"dir/a", "b", "c"},
+		},
+		{
+			name:    "target listed later when staging",
+			entries: []tarEntry{tarHardlink("b", "a"), tarFile("a", "a")},
+			staging: true,
+			linked:  []string{"a", "b"},
+		},
+		{
+			name:    "target in another layer when staging",
+			entries: []tarEntry{tarHardlink("b", "a")},
+			staging: true,
+			wantErr: errCrossLayerLink,
+		},
+		{
+			name:    "target missing",
+			entries: []tarEntry{tarHardlink("b", "a")},
+			wantErr: os.ErrNotExist,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			err := extractTar(root, bytes.NewReader(buildLayer(t, tt.entries)), string(DockerImageTypeRootFs), tt.staging)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("extracting gave %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("extracting: %v", err)
+			}
+
+			var first syscall.Stat_t
+			for i, name := range tt.linked {
+				var st syscall.Stat_t
+				if err := syscall.Lstat(filepath.Join(root, name), &st); err != nil {
+					t.Fatal(err)
+				}
+				if i == 0 {
+					first = st
+				} else if st.Ino != first.Ino {
+					t.Errorf("%s is not linked to %s", name, tt.linked[0])
+				}
+			}
+			if want := uint64(len(tt.linked)); uint64(first.Nlink) != want {
+				t.Errorf("%s has %d links, want %d", tt.linked[0], first.Nlink, want)
+			}
+		})
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	tests := []struct {
+		name string
+		// source is the file copied, written with content and mode unless it exists already
+		source  string
+		content string
+		mode    os.FileMode
+		// existing is what the destination holds beforehand, if anything
+		existing string
+	}{
+		{name: "empty", content: "", mode: 0644},
+		{name: "small", content: "hello\n", mode: 0644},
+		{name: "larger than a read", content: noise(1 << 20), mode: 0644},
+		{name: "executable", content: "#!/bin/sh\n", mode: 0755},
+		{name: "replaces a longer file", content: "short", mode: 0600, existing: "a much longer file"},
+		// Files in /proc report a size of zero, but have content to copy
+		{name: "size unknown", source: "/proc/version"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := tt.source
+			if source == "" {
+				source = filepath.Join(dir, "source")
+				if err := os.WriteFile(source, []byte(tt.content), tt.mode); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.Chmod(source, tt.mode); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Stat(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			destination := filepath.Join(dir, "missing", "dirs", "copy")
+			if tt.existing != "" {
+				if err := os.MkdirAll(filepath.Dir(destination), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(destination, []byte(tt.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := copyFile(source, destination); err != nil {
+				t.Fatalf("copyFile: %v", err)
+			}
+			got, err := os.ReadFile(destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("copy holds %d bytes, want the %d of the source", len(got), len(want))
+			}
+			copied, err := os.Stat(destination)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if copied.Mode().Perm() != info.Mode().Perm() {
+				t.Errorf("copy has mode %v, want %v", copied.Mode().Perm(), info.Mode().Perm())
+			}
+		})
+	}
+}
+
+func TestCopyFileDestination(t *testing.T) {
+	tests := []struct {
+		name        string
+		destination string
+		// want is where the copy ends up, relative to the test's directory
+		want string
+	}{
+		{name: "existing directory", destination: "file", want: "file"},
+		{name: "missing directories", destination: "a/b/c/file", want: "a/b/c/file"},
+		{name: "unclean path", destination: "a//b/./../c/file", want: "a/c/file"},
+		{name: "renamed", destination: "etc/greeting.conf", want: "etc/greeting.conf"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := filepath.Join(t.TempDir(), "source")
+			if err := os.WriteFile(source, []byte("hello\n"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := copyFile(source, dir+"/"+tt.destination); err != nil {
+				t.Fatalf("copyFile: %v", err)
+			}
+			if got, err := os.ReadFile(filepath.Join(dir, tt.want)); err != nil || string(got) != "hello\n" {
+				t.Errorf("%s holds %q, %v, want the source", tt.want, got, err)
+			}
+			// Only the directories leading to the copy are created
+			var created []string
+			filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && path != dir {
+					rel, _ := filepath.Rel(dir, path)
+					created = append(created, rel)
+				}
+				return nil
+			})
+			var want []string
+			for path := tt.want; path != "."; path = filepath.Dir(path) {
+				want = append([]string{path}, want...)
+			}
+			if len(created) != len(want) {
+				t.Errorf("copyFile created %q, want %q", created, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// tarEntry describes an entry of a layer built by buildLayer
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+	mode     int64
+	// devmajor and devminor number a character or block device
+	devmajor int64
+	devminor int64
+	uid      int
+	gid      int
+}
+
+func tarDir(name string) tarEntry { return tarEntry{name: name, typeflag: tar.TypeDir, mode: 0755} }
+
+func tarFile(name, body string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeReg, body: body, mode: 0644}
+}
+
+func tarSymlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeSymlink, linkname: target}
+}
+
+func tarHardlink(name, target string) tarEntry {
+	return tarEntry{name: name, typeflag: tar.TypeLink, linkname: target}
+}
+
+// noise returns n bytes which do not compress, for building layers of about that size
+func noise(n int) string {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(data)
+	return string(data)
+}
+
+// buildTar returns an uncompressed tar stream of entries
+func buildTar(t testing.TB, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		header := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     e.mode,
+			Devmajor: e.devmajor,
+			Devminor: e.devminor,
+			Uid:      e.uid,
+			Gid:      e.gid,
+			ModTime:  time.Unix(1700000000, 0),
+		}
+		if e.typeflag == tar.TypeReg {
+			header.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildLayer returns a gzip compressed tar stream of entries
+func buildLayer(t testing.TB, entries []tarEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	if _, err := gzw.Write(buildTar(t, entries)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gzw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// useLayerStore points the layer store and the image index recording what it holds at a
+// directory removed when the test ends
+func useLayerStore(t testing.TB) {
+	t.Helper()
+	layers, index := ImageLayersPath, ImageIndexPath
+	ImageLayersPath = t.TempDir()
+	ImageIndexPath = filepath.Join(ImageLayersPath, "images.json")
+	t.Cleanup(func() { ImageLayersPath, ImageIndexPath = layers, index })
+}
+
+// storeLayer adds a layer of entries to the layer store
+func storeLayer(t *testing.T, entries []tarEntry) ImageLayer {
+	t.Helper()
+	data := buildLayer(t, entries)
+	sum := fmt.Sprintf("%x", sha256.Sum256(data))
+	if err := os.WriteFile(filepath.Join(ImageLayersPath, sum+".tar.gz"), data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	var layer ImageLayer
+	layer.Digest = "sha256:" + sum
+	layer.MediaType = string(DockerImageTypeRootFs)
+	layer.Size = len(data)
+	layer.Sha256Sum = sum
+	return layer
+}
+
+// snapshot describes every entry below root, one line each, for comparing filesystems
+func snapshot(t *testing.T, root string) string {
+	t.Helper()
+	var lines []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, _ := filepath.Rel(root, path)
+		switch mode := info.Mode(); {
+		case mode&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s -> %s", name, target))
+		case mode.IsDir():
+			lines = append(lines, fmt.Sprintf("%s/ %v", name, mode.Perm()))
+		default:
+			body, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			lines = append(lines, fmt.Sprintf("%s %v %q", name, mode.Perm(), body))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// fakeImage is an image as a registry serves it
+type fakeImage struct {
+	platform Platform
+	manifest []byte
+	config   []byte
+	layers   [][]byte
+}
+
+// newFakeImage builds an image for the host's platform from gzip compressed layers
+func newFakeImage(t testing.TB, layers ...[]byte) *fakeImage {
+	t.Helper()
+	return newFakeImageFor(t, Platform{Os: "linux", Architecture: runtime.GOARCH}, layers...)
+}
+
+// newFakeImageFor builds an image for platform from gzip compressed layers
+func newFakeImageFor(t testing.TB, platform Platform, layers ...[]byte) *fakeImage {
+	t.Helper()
+	return buildFakeImage(t, platform, OCIImageConfig{Cmd: []string{"/bin/sh"}, Env: []string{"PATH=/bin"}}, layers...)
+}
+
+// newFakeImageWith builds an image for the host's platform with the given runtime settings
+func newFakeImageWith(t *testing.T, settings OCIImageConfig, layers ...[]byte) *fakeImage {
+	t.Helper()
+	return buildFakeImage(t, Platform{Os: "linux", Architecture: runtime.GOARCH}, settings, layers...)
+}
+
+func buildFakeImage(t testing.TB, platform Platform, settings OCIImageConfig, layers ...[]byte) *fakeImage {
+	t.Helper()
+	config, err := json.Marshal(DockerImageConfig{
+		Architecture: platform.Architecture,
+		Os:           platform.Os,
+		Variant:      platform.Variant,
+		Config:       settings,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := &fakeImage{platform: platform, config: config, layers: layers}
+	manifest := map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     string(DockerImageTypeDistributionManifestV2),
+		"config": map[string]interface{}{
+			"mediaType": string(DockerImageTypeContainerImageManifestV1),
+			"size":      len(image.config),
+			"digest":    digestOf(image.config),
+		},
+	}
+	var descriptors []map[string]interface{}
+	for _, layer := range layers {
+		descriptors = append(descriptors, map[string]interface{}{
+			"mediaType": string(DockerImageTypeRootFs),
+			"size":      len(layer),
+			"digest":    digestOf(layer),
+		})
+	}
+	manifest["layers"] = descriptors
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image.manifest = data
+	return image
+}
+
+// layerDescriptors returns the image's layers as its manifest describes them
+func (image *fakeImage) layerDescriptors(t testing.TB) []ImageLayer {
+	t.Helper()
+	var manifest ImageManifest
+	if err := json.Unmarshal(image.manifest, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	return manifest.Layers
+}
+
+func digestOf(data []byte) string {
+	return fmt.Sprintf("sha256:%x", sha256.Sum256(data))
+}
+
+// fakeRegistry serves images over plain HTTP as a registry's distribution API does, without
+// authentication, recording each request it receives
+type fakeRegistry struct {
+	server *httptest.Server
+	// host is the registry's host:port, which image references start with
+	host string
+	// handle, if set, sees each request first, and answers it instead of the registry by
+	// returning true. It is set under mu once requests may be arriving from another process,
+	// which the race detector cannot see the test wait for.
+	handle func(w http.ResponseWriter, r *http.Request) bool
+
+	mu        sync.Mutex
+	requests  []string
+	manifests map[string]fakeManifest
+	blobs     map[string][]byte
+}
+
+type fakeManifest struct {
+	mediaType string
+	body      []byte
+}
+
+// newFakeRegistry starts a registry, reached at its host by image references, which is stopped
+// when the test ends
+func newFakeRegistry(t testing.TB) *fakeRegistry {
+	t.Helper()
+	registry := &fakeRegistry{manifests: make(map[string]fakeManifest), blobs: make(map[string][]byte)}
+	registry.server = httptest.NewServer(http.HandlerFunc(registry.serve))
+	registry.host = strings.TrimPrefix(registry.server.URL, "http://")
+	Registries[registry.host] = &ContainerRegistryDetails{
+		Alias:        registry.host,
+		FQDN:         registry.host,
+		ManifestPath: "/v2/%s/manifests/%s",
+		BlobsPath:    "/v2/%s/blobs/%s",
+		Scheme:       "http",
+	}
+	t.Cleanup(func() {
+		registry.server.Close()
+		delete(Registries, registry.host)
+	})
+	return registry
+}
+
+// newFakeTLSRegistry starts a registry served over HTTPS with config, if not nil, which is not
+// in Registries, so that image references reach it at its host as they do any other registry.
+// It is stopped when the test ends.
+func newFakeTLSRegistry(t *testing.T, config *tls.Config) *fakeRegistry {
+	t.Helper()
+	registry := &fakeRegistry{manifests: make(map[string]fakeManifest), blobs: make(map[string][]byte)}
+	registry.server = httptest.NewUnstartedServer(http.HandlerFunc(registry.serve))
+	registry.server.TLS = config
+	// Clients which do not trust the registry are expected to refuse its handshakes
+	registry.server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	registry.server.StartTLS()
+	registry.host = strings.TrimPrefix(registry.server.URL, "https://")
+	t.Cleanup(registry.server.Close)
+	return registry
+}
+
+// useHTTPClient rebuilds the client registries are reached with after configure changes the
+// settings it is built from, restoring them when the test ends
+func useHTTPClient(t *testing.T, configure func()) {
+	t.Helper()
+	roots, certificates, insecure, client := registryRootCAs, registryClientCertificates, insecureRegistries, defaultHTTPClient
+	t.Cleanup(func() {
+		registryRootCAs, registryClientCertificates, insecureRegistries, defaultHTTPClient = roots, certificates, insecure, client
+	})
+	configure()
+	defaultHTTPClient = createHTTPClient()
+}
+
+// trustRegistry has the client trust the certificate of a registry served over HTTPS
+func trustRegistry(t *testing.T, registry *fakeRegistry) {
+	t.Helper()
+	pool := x509.NewCertPool()
+	pool.AddCert(registry.server.Certificate())
+	useHTTPClient(t, func() { registryRootCAs = pool })
+}
+
+// push serves image as repository:tag, returning its reference
+func (registry *fakeRegistry) push(repository, tag string, image *fakeImage) string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	manifest := fakeManifest{mediaType: string(DockerImageTypeDistributionManifestV2), body: image.manifest}
+	registry.manifests[repository+":"+tag] = manifest
+	registry.manifests[repository+"@"+digestOf(image.manifest)] = manifest
+	registry.blobs[digestOf(image.config)] = image.config
+	for _, layer := range image.layers {
+		registry.blobs[digestOf(layer)] = layer
+	}
+	return registry.host + "/" + repository + ":" + tag
+}
+
+// pushIndex serves an index of images, one for each platform, as repository:tag, returning its
+// reference
+func (registry *fakeRegistry) pushIndex(t *testing.T, repository, tag string, images ...*fakeImage) string {
+	t.Helper()
+	var manifests []map[string]interface{}
+	for _, image := range images {
+		registry.push(repository, digestOf(image.manifest), image)
+		manifests = append(manifests, map[string]interface{}{
+			"mediaType": string(DockerImageTypeDistributionManifestV2),
+			"size":      len(image.manifest),
+			"digest":    digestOf(image.manifest),
+			"platform":  image.platform,
+		})
+	}
+	index, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     string(DockerImageTypeDistributionListManifestV2),
+		"manifests":     manifests,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	registry.manifests[repository+":"+tag] = fakeManifest{mediaType: string(DockerImageTypeDistributionListManifestV2), body: index}
+	return registry.host + "/" + repository + ":" + tag
+}
+
+// requireToken makes the registry refuse requests not bearing token with a challenge naming its
+// /token endpoint, which answers each token request with the status and body returned by issue
+func (registry *fakeRegistry) requireToken(token string, issue func(r *http.Request) (int, string)) {
+	registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/token" {
+			status, body := issue(r)
+			w.WriteHeader(status)
+			fmt.Fprint(w, body)
+			return true
+		}
+		if r.Header.Get("Authorization") == "Bearer "+token {
+			return false
+		}
+		repository, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/"), "/manifests/")
+		repository, _, _ = strings.Cut(repository, "/blobs/")
+		w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:%s:pull"`, registry.server.URL, repository))
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprint(w, `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`)
+		return true
+	}
+}
+
+// served returns the requests received so far, each as its method and path
+func (registry *fakeRegistry) served() []string {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return append([]string(nil), registry.requests...)
+}
+
+// count returns how many requests received so far had paths containing part
+func (registry *fakeRegistry) count(part string) int {
+	n := 0
+	for _, request := range registry.served() {
+		if strings.Contains(request, part) {
+			n++
+		}
+	}
+	return n
+}
+
+func (registry *fakeRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	registry.mu.Lock()
+	registry.requests = append(registry.requests, r.Method+" "+r.URL.Path)
+	handle := registry.handle
+	registry.mu.Unlock()
+	if handle != nil && handle(w, r) {
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	if repository, reference, ok := strings.Cut(path, "/manifests/"); ok {
+		separator := ":"
+		if strings.HasPrefix(reference, "sha256:") {
+			separator = "@"
+		}
+		registry.mu.Lock()
+		manifest, ok := registry.manifests[repository+separator+reference]
+		registry.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", manifest.mediaType)
+		w.Header().Set("Docker-Content-Digest", digestOf(manifest.body))
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(manifest.body))
+		return
+	}
+	if _, digest, ok := strings.Cut(path, "/blobs/"); ok {
+		registry.mu.Lock()
+		blob, ok := registry.blobs[digest]
+		registry.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[{"code":"BLOB_UNKNOWN","message":"blob unknown to registry"}]}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(blob))
+		return
+	}
+	w.WriteHeader(http.StatusNotFound)
+}
+
+// withoutBackoff retries failed requests straight away for the rest of the test
+func withoutBackoff(t *testing.T) {
+	t.Helper()
+	previous := retryBackoff
+	retryBackoff = time.Millisecond
+	t.Cleanup(func() { retryBackoff = previous })
+}
+
+// captureLog sends what logger writes at level and above to the returned buffer for the rest of
+// the test
+func captureLog(t *testing.T, level slog.Level) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	previous := logger
+	logger = slog.New(slog.HandlerOptions{Level: level}.NewTextHandler(&buf))
+	t.Cleanup(func() { logger = previous })
+	return &buf
+}
+
+// captureStdout returns what fn writes to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	previous := os.Stdout
+	os.Stdout = w
+	done := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+	fn()
+	os.Stdout = previous
+	w.Close()
+	return string(<-done)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// stringList is a flag.Value collecting every occurrence of a repeatable flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// flagConflict names two flags that cannot be used together
+type flagConflict [2]string
+
+// checkFlags rejects arguments, already parsed by flags, which give a single-valued flag more
+// than once, whether by the same name or through its shorthand, or which use flags that
+// conflict. Boolean flags only conflict when they are enabled.
+func checkFlags(flags *flag.FlagSet, arguments []string, conflicts []flagConflict) error {
+	// A shorthand shares its value with the long flag, so each value is named after its longest flag
+	names := make(map[flag.Value]string)
+	flags.VisitAll(func(f *flag.Flag) {
+		if len(f.Name) > len(names[f.Value]) {
+			names[f.Value] = f.Name
+		}
+	})
+
+	given := make(map[string]string)
+	for i := 0; i < len(arguments); i++ {
+		arg := arguments[i]
+		if arg == "--" || arg == "-" || !strings.HasPrefix(arg, "-") {
+			break
+		}
+		name, _, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		f := flags.Lookup(name)
+		if f == nil {
+			break
+		}
+		if !hasValue && !isBoolFlag(f) {
+			i++
+		}
+
+		canonical := names[f.Value]
+		if _, repeatable := f.Value.(*stringList); !repeatable {
+			if previous, ok := given[canonical]; ok {
+				if previous == name {
+					return fmt.Errorf("%s was given more than once", flagName(name))
+				}
+				return fmt.Errorf("%s was given more than once, as %s and %s", flagName(canonical), flagName(previous), flagName(name))
+			}
+		}
+		given[canonical] = name
+	}
+
+	for _, conflict := range conflicts {
+		if flagEnabled(flags, given, conflict[0]) && flagEnabled(flags, given, conflict[1]) {
+			return fmt.Errorf("%s cannot be combined with %s", flagName(conflict[0]), flagName(conflict[1]))
+		}
+	}
+	return nil
+}
+
+// flagName writes a flag's name as it is usually given, with one dash for a shorthand
+func flagName(name string) string {
+	if len(name) == 1 {
+		return "-" + name
+	}
+	return "--" + name
+}
+
+// flagEnabled reports whether a flag was given, and for a boolean flag whether it was enabled
+func flagEnabled(flags *flag.FlagSet, given map[string]string, name string) bool {
+	if _, ok := given[name]; !ok {
+		return false
+	}
+	f := flags.Lookup(name)
+	return !isBoolFlag(f) || f.Value.String() == "true"
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
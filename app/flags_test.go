@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"testing"
+)
+
+func TestCheckFlags(t *testing.T) {
+	tests := []struct {
+		name      string
+		arguments []string
+		wantErr   string
+	}{
+		{name: "none"},
+		{name: "once each", arguments: []string{"--name", "web", "-v", "--stream", "image"}},
+		{name: "value after equals", arguments: []string{"--name=web", "--pin=sha256:abc"}},
+		{name: "repeatable", arguments: []string{"-e", "A=1", "--env", "B=2", "-e=C=3"}},
+		{name: "repeated", arguments: []string{"--name", "web", "--name", "db"}, wantErr: "--name was given more than once"},
+		{name: "repeated with one dash", arguments: []string{"-name", "web", "-name=db"}, wantErr: "--name was given more than once"},
+		{name: "repeated boolean", arguments: []string{"-v", "-v"}, wantErr: "-v was given more than once"},
+		{
+			name:      "repeated through shorthand",
+			arguments: []string{"--name", "web", "-n", "db"},
+			wantErr:   "--name was given more than once, as --name and -n",
+		},
+		{
+			name:      "conflict",
+			arguments: []string{"--stream", "--pin", "sha256:abc"},
+			wantErr:   "--stream cannot be combined with --pin",
+		},
+		{name: "disabled boolean does not conflict", arguments: []string{"--stream=false", "--pin", "sha256:abc"}},
+		{name: "after the first argument", arguments: []string{"--name", "web", "image", "--name", "db"}},
+		{name: "after a terminator", arguments: []string{"--name", "web", "--", "--name", "db"}},
+		{name: "value looking like a flag", arguments: []string{"--name", "--name"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			flags := flag.NewFlagSet("test", flag.ContinueOnError)
+			flags.SetOutput(io.Discard)
+			name := flags.String("name", "", "")
+			flags.StringVar(name, "n", "", "")
+			verbose := flags.Bool("verbose", false, "")
+			flags.BoolVar(verbose, "v", false, "")
+			var env stringList
+			flags.Var(&env, "env", "")
+			flags.Var(&env, "e", "")
+			flags.Bool("stream", false, "")
+			flags.String("pin", "", "")
+			if err := flags.Parse(tt.arguments); err != nil {
+				t.Fatal(err)
+			}
+
+			err := checkFlags(flags, tt.arguments, []flagConflict{{"stream", "pin"}})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkFlags(%q): %v", tt.arguments, err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("checkFlags(%q) returned %v, want %q", tt.arguments, err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -3,21 +3,21 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
 	"crypto/sha256"
+	"crypto/sha512"
 	"encoding/json"
 	"errors"
 	"fmt"
-	regexp "github.com/oriser/regroup"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"runtime"
+	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -27,41 +27,41 @@ type (
 		MediaType string   `json:"mediaType"`
 		Size      int      `json:"size"`
 		Platform  Platform `json:"platform"`
+		// URLs are where a foreign layer, which the registry need not hold, is downloaded from
+		URLs []string `json:"urls,omitempty"`
 	}
 	Platform struct {
 		Architecture string `json:"architecture"`
 		Os           string `json:"os"`
+		// Variant tells apart versions of an architecture, such as v6 and v7 of 32-bit ARM
+		Variant string `json:"variant,omitempty"`
+		// OSVersion is the version of the OS the image needs, which only Windows images set
+		OSVersion string `json:"os.version,omitempty"`
 	}
 	Auth struct {
-		Bearer  string `regroup:"bearer"`
-		Service string `regroup:"service"`
-		Scope   string `regroup:"scope"`
+		// Bearer is the realm of the token service, with the service and scope to request
+		Bearer  string
+		Service string
+		Scope   string
 		Token   string `json:"token"`
+		// AccessToken is where registries following OAuth 2 conventions, such as GHCR, return
+		// the token instead, which Token falls back to
+		AccessToken string `json:"access_token"`
 	}
 	RegistryResponse struct {
 		Manifests     []Manifest `json:"manifests"`
 		MediaType     string     `json:"mediaType"`
 		SchemaVersion int        `json:"schemaVersion"`
 	}
-	OCIImageManifest struct {
-		SchemaVersion uint32         `json:"schemaVersion"`
-		MediaType     string         `json:"mediaType"`
-		ArtifactType  string         `json:"artifactType"`
-		Config        OCIImageConfig `json:"config"`
-		Layers        []ImageLayer   `json:"layers"`
-		Annotations   struct {
-			// TODO: Support annotations according to OCI spec
-		} `json:"annotations"`
-	}
-	DockerDistributionManifest struct {
-		SchemaVersion uint32         `json:"schemaVersion"`
-		MediaType     string         `json:"mediaType"`
-		ArtifactType  string         `json:"artifactType"`
-		Config        OCIImageConfig `json:"config"`
-		Layers        []ImageLayer   `json:"layers"`
-		Annotations   struct {
-			// TODO: Support annotations according to Docker spec
-		} `json:"annotations"`
+	// ImageManifest is a platform-specific image manifest. Docker's v2 schema 2 manifests and
+	// OCI v1 manifests share the same layout, so MediaType tells them apart.
+	ImageManifest struct {
+		SchemaVersion uint32            `json:"schemaVersion"`
+		MediaType     string            `json:"mediaType"`
+		ArtifactType  string            `json:"artifactType"`
+		Config        Manifest          `json:"config"`
+		Layers        []ImageLayer      `json:"layers"`
+		Annotations   map[string]string `json:"annotations"`
 	}
 	ImageLayer struct {
 		Manifest
@@ -80,13 +80,78 @@ type (
 	ContainerRegistries = map[string]*ContainerRegistryDetails
 	RegistrySchema      string
 	OCIImageManifestV1  string
-	OCIImageConfig      struct{}
-	DockerImageConfig   struct{}
+	// OCIImageConfig holds the execution parameters an image provides for its containers
+	OCIImageConfig struct {
+		User         string              `json:"User"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+		Env          []string            `json:"Env"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		Volumes      map[string]struct{} `json:"Volumes"`
+		WorkingDir   string              `json:"WorkingDir"`
+		Labels       map[string]string   `json:"Labels"`
+		Shell        []string            `json:"Shell"`
+	}
+	// DockerImageConfig is the image configuration blob referenced by a manifest's config descriptor
+	DockerImageConfig struct {
+		Architecture string         `json:"architecture"`
+		Os           string         `json:"os"`
+		Variant      string         `json:"variant,omitempty"`
+		OSVersion    string         `json:"os.version,omitempty"`
+		Config       OCIImageConfig `json:"config"`
+	}
+	// PullOptions adjusts how pullImage resolves and fetches an image
+	PullOptions struct {
+		// LayerReady, if set, is called in manifest order with each layer as soon as it and
+		// every layer before it have been fetched
+		LayerReady func(*ImageLayer) error
+		// PinnedDigest, if set, is the digest the image reference must resolve to
+		PinnedDigest string
+		// Sequential fetches layers one at a time in manifest order rather than concurrently
+		Sequential bool
+		// MaxConcurrentDownloads bounds how many layers are downloaded at once, defaulting to
+		// defaultMaxConcurrentDownloads
+		MaxConcurrentDownloads int
+		// ExtractStreaming extracts each layer into ExtractTo directly from the registry response
+		// instead of staging it in the layer store, optionally still caching it there
+		ExtractStreaming    bool
+		ExtractTo           string
+		CacheStreamedLayers bool
+		// Progress, if set, is told how much of each layer has been downloaded as it arrives.
+		// Every layer is first reported with nothing downloaded, and layers already in the
+		// layer store are reported as complete.
+		Progress ProgressFunc
+		// Downloading, if set, is told before any layer is fetched how many layers the pull
+		// downloads and how many bytes, as downloadSize counts them
+		Downloading func(layers int, size int64)
+		// Platform, if set, is the platform the image is resolved for in place of the host's
+		Platform Platform
+	}
 	// RegistryRequest contains common details for pulling image manifests and layers across various registry requests
 	RegistryRequest struct {
 		ImageReference string
 		ImageTag       string
 		Auth           *Auth
+		*PullOptions
+		// delivered counts the layers already handed over by a previous attempt
+		delivered int
+	}
+	// ResolvedImage is an image whose manifest and configuration have been fetched for this
+	// platform, ready for its layers to be fetched
+	ResolvedImage struct {
+		Reference string
+		// Digest identifies the platform-specific manifest the image resolved to
+		Digest   string
+		Platform Platform
+		Layers   []ImageLayer
+		Config   *DockerImageConfig
+		// ConfigSize is the size of the image's configuration blob, as its manifest gives it
+		ConfigSize int
+
+		registry   *ContainerRegistryDetails
+		repository string
+		tag        string
+		auth       *Auth
 	}
 	// RegistryCache comprises any cached image layers previously fetched from a registry
 	// First we check the RegisryCache and then the file-system on disk for the image layer.
@@ -106,19 +171,48 @@ type (
 
 const (
 	DefaultRegistry        string             = "docker.io"
-	ImageLayersPath        string             = "/tmp/containers/layers"
 	OCIImageTypeManifestV1 OCIImageManifestV1 = "application/vnd.oci.image.manifest.v1+json"
 	// Docker Image Manifest Version 2, Schema 2
 	DockerImageTypeDistributionManifestV2     RegistrySchema = "application/vnd.docker.distribution.manifest.v2+json"
 	DockerImageTypeDistributionListManifestV2 RegistrySchema = "application/vnd.docker.distribution.manifest.list.v2+json"
 	DockerImageTypeContainerImageManifestV1   RegistrySchema = "application/vnd.docker.container.image.v1+json"
 	DockerImageTypeRootFs                     RegistrySchema = "application/vnd.docker.image.rootfs.diff.tar.gzip"
-	DockerImageTypeRootFsForeign              RegistrySchema = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	DockerImageTypeRootFsForeign              RegistrySchema = "application/vnd.docker.image.rootfs.foreign.diff.tar.gzip"
 	DockerImageTypePlugin                     RegistrySchema = "application/vnd.docker.plugin.v1+json"
 	OciImageIndexV1                                          = "application/vnd.oci.image.index.v1+json"
-	AcceptHeaders                             string         = "application/vnd.docker.distribution.manifest.list.v2+json, application/vnd.oci.image.manifest.v1+json"
+	OCIImageTypeLayerGzip                     RegistrySchema = "application/vnd.oci.image.layer.v1.tar+gzip"
+	OCIImageTypeLayer                         RegistrySchema = "application/vnd.oci.image.layer.v1.tar"
+	OCIImageTypeLayerZstd                     RegistrySchema = "application/vnd.oci.image.layer.v1.tar+zstd"
+	OCIImageTypeLayerNondistributable         RegistrySchema = "application/vnd.oci.image.layer.nondistributable.v1.tar"
+	OCIImageTypeLayerNondistributableGzip     RegistrySchema = "application/vnd.oci.image.layer.nondistributable.v1.tar+gzip"
+	OCIImageTypeLayerNondistributableZstd     RegistrySchema = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+// ImageLayersPath holds every cached layer, named after its sha256 sum
+var ImageLayersPath = "/tmp/containers/layers"
+
+var (
+	// indexMediaTypes are the multi-platform index types resolveImage selects a manifest from
+	indexMediaTypes = []string{string(DockerImageTypeDistributionListManifestV2), OciImageIndexV1}
+	// manifestMediaTypes are the platform-specific manifest types resolveImage reads layers from
+	manifestMediaTypes = []string{string(DockerImageTypeDistributionManifestV2), string(OCIImageTypeManifestV1)}
 )
 
+// acceptHeaders lists the manifest media types requested from registries in order of
+// preference: every type resolveImage handles, with indices ahead of single manifests
+var acceptHeaders = strings.Join(append(append([]string{}, indexMediaTypes...), manifestMediaTypes...), ", ")
+
+// preferOCIManifests reorders the Accept header so that registries able to serve both formats
+// return the OCI index and manifest types ahead of docker's manifest list
+func preferOCIManifests() {
+	acceptHeaders = strings.Join([]string{
+		OciImageIndexV1,
+		string(OCIImageTypeManifestV1),
+		string(DockerImageTypeDistributionListManifestV2),
+		string(DockerImageTypeDistributionManifestV2),
+	}, ", ")
+}
+
 // RegistryCache is a map of string containing sha256:digest values pointing to ImageLayer values
 var registryCache RegistryCache
 
@@ -133,7 +227,22 @@ var Registries = ContainerRegistries{
 		Scheme:       "https",
 	},
 }
-var bearerRegex = regexp.MustCompile(`(?i)(Bearer[[:space:]]+realm="(?P<bearer>(?:\\"|.)*?)")[[:space:]]*?,[[:space:]]*?(service[[:space:]]*?="(?P<service>(?:\\"|.)*?))"[[:space:]]*?,[[:space:]]*?(scope[[:space:]]*?="(?P<scope>(?:\\"|.)*?)")`)
+
+// lookupRegistry returns the details of the registry an image reference names. Registries other
+// than those in Registries are reached at their name, a host with an optional port such as
+// localhost:5000, which serves the distribution API at its standard paths.
+func lookupRegistry(name string) *ContainerRegistryDetails {
+	if registry, ok := Registries[name]; ok {
+		return registry
+	}
+	return &ContainerRegistryDetails{
+		Alias:        name,
+		FQDN:         name,
+		ManifestPath: "/v2/%s/manifests/%s",
+		BlobsPath:    "/v2/%s/blobs/%s",
+		Scheme:       "https",
+	}
+}
 
 // auth: https://auth.docker.io/token?scope=repository:library/alpine:pull&service=registry.docker.io
 // manifest:  https://registry-1.docker.io/v2/library/alpine/manifests/latest
@@ -150,6 +259,21 @@ func (registry *ContainerRegistryDetails) generateBlobRequest(ref, blob string)
 
 var defaultHTTPClient *http.Client
 
+// dialTimeout and tlsHandshakeTimeout bound connecting to a registry separately from the overall
+// request timeout, so that a dead endpoint fails fast without cutting short a slow transfer
+var (
+	dialTimeout         = 10 * time.Second
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// requestTimeout bounds each request for a manifest, image configuration or token, bodies and
+// all, as well as the wait for a layer's response headers. Layer bodies can take far longer to
+// arrive, so are not bound by it.
+var requestTimeout = 20 * time.Second
+
+// pullTimeout, if set, bounds how long a whole pull may take, however many layers it fetches
+var pullTimeout time.Duration
+
 func init() {
 	if defaultHTTPClient = createHTTPClient(); defaultHTTPClient == nil {
 		fmt.Println("unable to create a default HTTP client, exiting...")
@@ -157,67 +281,105 @@ func init() {
 	}
 }
 
-// TODO: Move to net.go
-func createHTTPClient() *http.Client {
-	return &http.Client{
-		Timeout: time.Second * 20,
-		Transport: &http.Transport{
-			// TLSClientConfig: &tls.Config{
-			// 	InsecureSkipVerify: true,
-			// },
-			IdleConnTimeout: time.Second * 30,
-			MaxIdleConns:    10,
-			DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
-				return (&net.Dialer{}).DialContext(ctx, "tcp4", addr)
-			},
-		},
+// pullImage resolves an image and fetches its layers into the layer store. The pull is abandoned
+// when ctx is done or, if set, pullTimeout has elapsed.
+func pullImage(ctx context.Context, imageReference string, auth *Auth, options *PullOptions) (*[]ImageLayer, *DockerImageConfig, error) {
+	if options == nil {
+		options = &PullOptions{}
 	}
-}
-
-func pullImage(imageReference string, auth *Auth) (*[]ImageLayer, error) {
-	trueImageReference, registry, tag := sanitiseImageReference(imageReference)
-	registryDetails, ok := Registries[registry]
-	if !ok {
-		return nil, errors.New("unable to find appropriate registry for the image provided")
+	if pullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pullTimeout)
+		defer cancel()
 	}
 
-	query := registryDetails.generateManifestRequest(trueImageReference, tag)
-	req, err := http.NewRequest("GET", query, nil)
+	emitEvent("pull-start", "image", imageReference)
+	image, err := resolveImage(ctx, imageReference, auth, options)
 	if err != nil {
-		return nil, err
+		return nil, nil, pullError(ctx, err)
 	}
 
-	if auth != nil {
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", auth.Token))
+	if options.Downloading != nil {
+		options.Downloading(image.downloadSize(image.cachedLayers()))
 	}
-	req.Header.Set("Accept", AcceptHeaders)
-	resp, err := defaultHTTPClient.Do(req)
-	if err != nil {
-		return nil, err
+	if options.Progress != nil {
+		for i := range image.Layers {
+			options.Progress(&image.Layers[i], 0, int64(image.Layers[i].Size))
+		}
 	}
 
-	defer resp.Body.Close()
+	var registryRequest = &RegistryRequest{
+		ImageReference: image.repository,
+		ImageTag:       image.tag,
+		Auth:           image.auth,
+		PullOptions:    options,
+	}
 
-	// Attempt to (re)authenticate
-	if (resp.StatusCode > 400 && resp.StatusCode < 500) || auth == nil {
-		auth, err = registryDetails.requestAuthenticationToken(resp)
-		req, err := http.NewRequest("GET", query, nil)
-		if err != nil {
-			return nil, err
+	err = withRetries(ctx, func() error {
+		return image.registry.fetchLayers(ctx, &image.Layers, registryRequest)
+	})
+	if err != nil {
+		return nil, nil, pullError(ctx, err)
+	}
+
+	// Streamed layers are only in the layer store if they were cached as they were extracted
+	if !options.ExtractStreaming || options.CacheStreamedLayers {
+		if err := storeImage(imageReference, image); err != nil {
+			logger.Warn("could not record image in the local image index", "image", imageReference, "error", err)
 		}
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", auth.Token))
-		req.Header.Set("Accept", AcceptHeaders)
-		resp, err = defaultHTTPClient.Do(req)
 	}
+	return &image.Layers, image.Config, nil
+}
+
+// pullError reports why a pull failed. Once ctx is done, requests fail in many different ways,
+// so the pull is reported as cancelled or timed out instead.
+func pullError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		return fmt.Errorf("pull did not complete within %s: %w", pullTimeout, ctx.Err())
+	case context.Canceled:
+		return fmt.Errorf("pull cancelled: %w", ctx.Err())
+	}
+	return err
+}
+
+// resolveImage fetches the manifest and configuration of the image for this platform, or the one
+// options name, leaving its layers to be fetched
+func resolveImage(ctx context.Context, imageReference string, auth *Auth, options *PullOptions) (*ResolvedImage, error) {
+	if options == nil {
+		options = &PullOptions{}
+	}
+	if err := validateReference(imageReference); err != nil {
+		return nil, err
+	}
+	platform := options.platform()
+
+	trueImageReference, registry, tag := sanitiseImageReference(imageReference)
+	registryDetails := lookupRegistry(registry)
 
+	query := registryDetails.generateManifestRequest(trueImageReference, tag)
+
+	var (
+		body   []byte
+		header http.Header
+	)
+	// Indices for images with many platforms can be large, so a failed transfer is retried
+	// with the same budget as the layers
+	err := withRetries(ctx, func() (err error) {
+		body, header, auth, err = registryDetails.fetchIndex(ctx, query, auth)
+		return err
+	})
 	if err != nil {
 		return nil, err
-	} else if resp != nil && resp.Body != nil {
-		defer resp.Body.Close()
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	contentType, ok := resp.Header["Content-Type"]
+	if options.PinnedDigest != "" {
+		if resolved := fmt.Sprintf("sha256:%x", sha256.Sum256(body)); resolved != options.PinnedDigest {
+			return nil, fmt.Errorf("image %s resolved to digest %s which does not match the pinned digest %s", imageReference, resolved, options.PinnedDigest)
+		}
+	}
+
+	contentType, ok := header["Content-Type"]
 	if !ok || len(contentType) != 1 {
 		return nil, errors.New("unsupported Content-Type returned from registry")
 	}
@@ -225,78 +387,372 @@ func pullImage(imageReference string, auth *Auth) (*[]ImageLayer, error) {
 	var (
 		manifests RegistryResponse
 		manifest  *Manifest
+		// single is set when the registry has no index for the image and returned its only
+		// manifest, whose platform is only known from its configuration
+		single bool
 	)
-	switch RegistrySchema(contentType[0]) {
-	case DockerImageTypeDistributionListManifestV2:
-		fallthrough
-	case OciImageIndexV1:
-		manifest, err = manifests.getDigestForSystem(body)
+	switch {
+	case containsString(indexMediaTypes, contentType[0]):
+		if err := checkManifestBody(body); err != nil {
+			return nil, err
+		}
+		manifest, err = manifests.getDigestForSystem(body, platform)
+	case containsString(manifestMediaTypes, contentType[0]):
+		single = true
+		manifest = &Manifest{
+			Digest:    fmt.Sprintf("sha256:%x", sha256.Sum256(body)),
+			MediaType: contentType[0],
+			Size:      len(body),
+		}
 	default:
-		return nil, errors.New("unsupported Content-Type returned from registry")
+		return nil, fmt.Errorf("unsupported Content-Type %s returned from registry: %w", contentType[0], unexpectedBodyError(body))
 	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	var layers *[]ImageLayer
+	image := &ResolvedImage{
+		Reference:  canonicalReference(imageReference),
+		Digest:     manifest.Digest,
+		Platform:   manifest.Platform,
+		registry:   registryDetails,
+		repository: trueImageReference,
+		tag:        tag,
+		auth:       auth,
+	}
 
-	switch manifest.MediaType {
-	case string(DockerImageTypeDistributionManifestV2):
-		// https://registry-1.docker.io/v2/library/ubuntu/blobs/sha256:...
-		query = registryDetails.generateManifestRequest(trueImageReference, manifest.Digest)
-		resp, err := registryDetails.sendRequest(query, "GET", auth)
-		if err != nil {
-			return nil, err
+	switch {
+	case containsString(manifestMediaTypes, manifest.MediaType):
+		if !single {
+			body, err = registryDetails.fetchManifest(ctx, trueImageReference, manifest.Digest, auth)
+			if err != nil {
+				return nil, err
+			}
 		}
 
-		defer resp.Body.Close()
-		body, err = io.ReadAll(resp.Body)
+		if err := checkManifestBody(body); err != nil {
+			return nil, err
+		}
 
-		var dockerManifest = DockerDistributionManifest{}
-		err = json.Unmarshal(body, &dockerManifest)
-		if err != nil {
+		var imageManifest ImageManifest
+		if err := json.Unmarshal(body, &imageManifest); err != nil {
 			return nil, err
 		}
 
-		if manifest.Platform.Os != runtime.GOOS && manifest.Platform.Architecture != runtime.GOARCH {
+		if !single && !platform.matches(manifest.Platform) {
 			return nil, errors.New("no matching manifest for this system architecture found")
 		}
-		layers = &dockerManifest.Layers
-	case string(OCIImageTypeManifestV1):
-		// For this resource we need to first retrieve the image manifest hash
-		// Then we can retrieve the image layer as with the returned docker image manifest
-		// https://registry-1.docker.io/v2/library/ubuntu/manifests/sha256:aa772...
-		// TODO: Implement handling for retrieving OCIv1 image manifests
-		return nil, errors.New("not implemented")
+		image.Layers = imageManifest.Layers
+		// Images which could never run here are reported as such before anything more is
+		// fetched, rather than as a platform mismatch or a layer that fails to extract
+		if err := checkSupportedPlatform(image.Platform, image.Layers); err != nil {
+			return nil, err
+		}
+
+		image.Config, err = registryDetails.fetchConfig(ctx, trueImageReference, imageManifest.Config, auth)
+		if err != nil {
+			return nil, err
+		}
+		image.ConfigSize = imageManifest.Config.Size
+		if single {
+			image.Platform = image.Config.platform()
+			if err := checkSupportedPlatform(image.Platform, nil); err != nil {
+				return nil, err
+			}
+			if !platform.matches(image.Platform) {
+				return nil, fmt.Errorf("image is only available for %s", image.Platform)
+			}
+		}
 	default:
 		return nil, errors.New(fmt.Sprintf("unsupported Content-Type: %s returnend from registry", manifest.MediaType))
 	}
+	return image, nil
+}
 
-	var registryRequest = &RegistryRequest{
-		ImageReference: trueImageReference,
-		ImageTag:       tag,
-		Auth:           auth,
+// fetchManifest fetches the platform-specific manifest with the given digest, checking that it
+// is the manifest asked for
+func (registry *ContainerRegistryDetails) fetchManifest(ctx context.Context, repository, digest string, auth *Auth) ([]byte, error) {
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	// https://registry-1.docker.io/v2/library/ubuntu/manifests/sha256:...
+	resp, err := registry.sendRequest(ctx, registry.generateManifestRequest(repository, digest), "GET", auth)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, ErrImageNotFound); err != nil {
+		return nil, err
 	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image manifest: %w", err)
+	}
+	if err := verifyDigest(body, digest); err != nil {
+		return nil, fmt.Errorf("image manifest: %w", err)
+	}
+	return body, nil
+}
 
-	// TODO: Make this option configurable.
-	var maxRetries = 5
-	for retryCount := 0; retryCount < maxRetries; retryCount++ {
-		err = registryDetails.fetchLayers(layers, registryRequest)
+// containsString reports whether s is one of values
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
+
+// checkManifestBody guards against proxies and registries which respond successfully with an
+// error document or HTML page in place of the manifest
+func checkManifestBody(body []byte) error {
+	var document struct {
+		SchemaVersion int             `json:"schemaVersion"`
+		Errors        json.RawMessage `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &document); err != nil || len(document.Errors) > 0 || document.SchemaVersion == 0 {
+		return unexpectedBodyError(body)
+	}
+	return nil
+}
+
+// ErrDigestMismatch is returned when content fetched by digest does not hash to that digest
+var ErrDigestMismatch = errors.New("digest mismatch")
+
+// verifyDigest checks that content fetched by digest, such as a manifest or image
+// configuration, is what was asked for, as a registry or anything between it and us could
+// otherwise substitute its own
+func verifyDigest(body []byte, digest string) error {
+	algorithm, expected, ok := strings.Cut(digest, ":")
+	if !ok {
+		return fmt.Errorf("malformed digest %q", digest)
+	}
+	var actual string
+	switch algorithm {
+	case "sha256":
+		actual = fmt.Sprintf("%x", sha256.Sum256(body))
+	case "sha512":
+		actual = fmt.Sprintf("%x", sha512.Sum512(body))
+	default:
+		return fmt.Errorf("unsupported digest algorithm %q", algorithm)
+	}
+	if actual != expected {
+		return fmt.Errorf("%w: expected %s but content hashes to %s:%s", ErrDigestMismatch, digest, algorithm, actual)
+	}
+	return nil
+}
+
+// unexpectedBodyError reports a response body that is not what the registry claimed it to be,
+// quoting the start of the body to help diagnose the cause
+func unexpectedBodyError(body []byte) error {
+	return fmt.Errorf("registry returned an unexpected body: %q", bodySnippet(body))
+}
+
+// bodySnippet is the start of a response body, short enough to quote in an error
+func bodySnippet(body []byte) string {
+	const maxSnippet = 200
+	snippet := strings.TrimSpace(string(body))
+	if len(snippet) > maxSnippet {
+		snippet = snippet[:maxSnippet] + "..."
+	}
+	return snippet
+}
+
+var (
+	// ErrImageNotFound is returned when the registry has no manifest for the image reference
+	ErrImageNotFound = errors.New("image not found")
+	// ErrUnauthorized is returned when the registry refuses access to the image
+	ErrUnauthorized = errors.New("not authorized to access image")
+)
+
+// RegistryError is an unsuccessful response from a registry
+type RegistryError struct {
+	StatusCode int
+	Status     string
+	// Detail is what the registry gave as the reason, from its error document if it sent one
+	Detail string
+	// kind is the sentinel error the response corresponds to, if any
+	kind error
+}
+
+func (e *RegistryError) Error() string {
+	message := fmt.Sprintf("registry responded with %s", e.Status)
+	if e.Detail != "" {
+		message += ": " + e.Detail
+	}
+	if e.kind != nil {
+		return e.kind.Error() + ": " + message
+	}
+	return message
+}
+
+func (e *RegistryError) Unwrap() error {
+	return e.kind
+}
+
+// temporary reports whether the request may succeed if it is retried
+func (e *RegistryError) temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// checkResponse returns a RegistryError for an unsuccessful response. A 404 is reported as
+// notFound, if given, since what is missing depends on what was requested.
+func checkResponse(resp *http.Response, notFound error) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	registryErr := &RegistryError{StatusCode: resp.StatusCode, Status: resp.Status}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		registryErr.kind = notFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		registryErr.kind = ErrUnauthorized
+	}
+
+	// Registries describe failures with a document listing errors, though proxies in front of
+	// them may respond with anything
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, int64(64*KB)))
+	var document struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(body, &document); err == nil && len(document.Errors) > 0 {
+		var details []string
+		for _, e := range document.Errors {
+			details = append(details, fmt.Sprintf("%s: %s", e.Code, e.Message))
+		}
+		registryErr.Detail = strings.Join(details, "; ")
+	} else if len(body) > 0 {
+		registryErr.Detail = fmt.Sprintf("%q", bodySnippet(body))
+	}
+	return registryErr
+}
+
+// fetchIndex retrieves the manifest or index an image tag points to, authenticating if required
+func (registry *ContainerRegistryDetails) fetchIndex(ctx context.Context, query string, auth *Auth) ([]byte, http.Header, *Auth, error) {
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	// A token given in the environment is tried first, falling back to requesting one below
+	// if the registry refuses it
+	if auth == nil {
+		auth = registry.presetToken()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", query, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if auth != nil {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", auth.Token))
+	}
+	req.Header.Set("Accept", acceptHeaders)
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	defer resp.Body.Close()
+
+	// Attempt to (re)authenticate when the registry refuses the request for lack of a token,
+	// or because the token has expired. Registries allowing anonymous access are used as-is, and
+	// a refusal without a challenge to answer is reported as it is rather than retried.
+	refused := resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden
+	if refused && resp.Header.Get("Www-Authenticate") != "" {
+		auth, err = registry.requestAuthenticationToken(ctx, resp)
 		if err != nil {
-			continue
-		} else {
-			break
+			return nil, nil, nil, fmt.Errorf("could not authenticate with registry: %w", err)
+		}
+		req, err = http.NewRequestWithContext(ctx, "GET", query, nil)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", auth.Token))
+		req.Header.Set("Accept", acceptHeaders)
+		resp, err = defaultHTTPClient.Do(req)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		defer resp.Body.Close()
+	}
+	if err := checkResponse(resp, ErrImageNotFound); err != nil {
+		return nil, nil, nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not read image index: %w", err)
+	}
+	return body, resp.Header, auth, nil
+}
+
+// TODO: Make this option configurable.
+var maxRetries = 5
+
+// retryBackoff is the delay before the first retry, doubling with each further retry
+var retryBackoff = 500 * time.Millisecond
+
+// withRetries calls fn until it succeeds or maxRetries attempts have failed, backing off between
+// attempts. Retrying stops as soon as ctx is done.
+func withRetries(ctx context.Context, fn func() error) error {
+	var err error
+	backoff := retryBackoff
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return err
+		}
+		// A registry refusing the request outright will refuse it again, and one serving other
+		// content than was asked for will most likely serve it again
+		var registryErr *RegistryError
+		if errors.As(err, &registryErr) && !registryErr.temporary() || errors.Is(err, ErrDigestMismatch) {
+			return err
+		}
+		if attempt < maxRetries {
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return err
+			}
+			backoff *= 2
 		}
 	}
+	return err
+}
+
+// withRequestTimeout bounds a request whose whole response should arrive within requestTimeout
+func withRequestTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if requestTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, requestTimeout)
+}
+
+func (registry *ContainerRegistryDetails) sendRequest(ctx context.Context, query string, method string, auth *Auth) (*http.Response, error) {
+	req, err := registry.newRequest(ctx, query, method, auth)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := defaultHTTPClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
-	return layers, err
+
+	return resp, nil
 }
 
-func (registry *ContainerRegistryDetails) sendRequest(query string, method string, auth *Auth) (*http.Response, error) {
-	req, err := http.NewRequest(method, query, nil)
+// newRequest prepares a request to the registry, authorized with auth if set
+func (registry *ContainerRegistryDetails) newRequest(ctx context.Context, query string, method string, auth *Auth) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, query, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -305,14 +761,110 @@ func (registry *ContainerRegistryDetails) sendRequest(query string, method strin
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", auth.Token))
 	}
 
-	req.Header.Set("Accept", AcceptHeaders)
+	req.Header.Set("Accept", acceptHeaders)
+	return req, nil
+}
 
-	resp, err := defaultHTTPClient.Do(req)
+func (registry *ContainerRegistryDetails) fetchConfig(ctx context.Context, ref string, descriptor Manifest, auth *Auth) (*DockerImageConfig, error) {
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	resp, err := registry.sendRequest(ctx, registry.generateBlobRequest(ref, descriptor.Digest), "GET", auth)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, nil); err != nil {
+		return nil, fmt.Errorf("could not fetch image configuration: %w", err)
+	}
 
-	return resp, nil
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read image configuration: %w", err)
+	}
+	if err := verifyDigest(body, descriptor.Digest); err != nil {
+		return nil, fmt.Errorf("image configuration: %w", err)
+	}
+
+	config := &DockerImageConfig{}
+	if err := json.Unmarshal(body, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// shell returns the shell used to run shell-form commands, falling back to /bin/sh -c
+func (config *DockerImageConfig) shell() []string {
+	if config == nil || len(config.Config.Shell) == 0 {
+		return []string{"/bin/sh", "-c"}
+	}
+	return config.Config.Shell
+}
+
+// argv assembles the command to run in the container the same way docker does. An entrypoint
+// given on the command line replaces the image's entrypoint and discards its default command,
+// user arguments replace the default command, and in shell form the command is passed as a
+// single string to the image's shell.
+func (config *DockerImageConfig) argv(entrypoint string, userArgs []string, shellForm bool) ([]string, error) {
+	var imageEntrypoint, imageCmd []string
+	if config != nil {
+		imageEntrypoint, imageCmd = config.Config.Entrypoint, config.Config.Cmd
+	}
+
+	if entrypoint != "" {
+		imageEntrypoint, imageCmd = []string{entrypoint}, nil
+	}
+
+	cmd := imageCmd
+	if len(userArgs) > 0 {
+		cmd = userArgs
+	}
+	if shellForm && len(cmd) > 0 {
+		cmd = append(append([]string{}, config.shell()...), strings.Join(cmd, " "))
+	}
+
+	argv := append(append([]string{}, imageEntrypoint...), cmd...)
+	if len(argv) == 0 {
+		return nil, errors.New("no command specified and the image does not define one")
+	}
+	return argv, nil
+}
+
+// defaultPath is used when the image does not define its own PATH
+const defaultPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// env builds the container's environment from the image's Env with overrides applied on top.
+// An override given as a bare KEY takes its value from the host environment.
+func (config *DockerImageConfig) env(overrides []string) []string {
+	var env []string
+	index := make(map[string]int)
+	set := func(variable string) {
+		key, _, _ := strings.Cut(variable, "=")
+		if i, ok := index[key]; ok {
+			env[i] = variable
+			return
+		}
+		index[key] = len(env)
+		env = append(env, variable)
+	}
+
+	set(defaultPath)
+	if config != nil {
+		for _, variable := range config.Config.Env {
+			set(variable)
+		}
+	}
+	for _, variable := range overrides {
+		if !strings.Contains(variable, "=") {
+			value, ok := os.LookupEnv(variable)
+			if !ok {
+				continue
+			}
+			variable += "=" + value
+		}
+		set(variable)
+	}
+	return env
 }
 
 func (registry RegistryCache) hasLayer(layer *ImageLayer) error {
@@ -355,47 +907,366 @@ func (l *ImageLayer) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// defaultMaxConcurrentDownloads is how many layers are downloaded at once unless told otherwise,
+// as docker does
+const defaultMaxConcurrentDownloads = 3
+
 // TODO: Setup a permanent image layer caching structure.
 // TODO: Setup up an expiring context with retry logic to allow for some error resiliency when pulling layers concurrently
-func (registry *ContainerRegistryDetails) fetchLayers(layers *[]ImageLayer, registryRequest *RegistryRequest) error {
+func (registry *ContainerRegistryDetails) fetchLayers(ctx context.Context, layers *[]ImageLayer, registryRequest *RegistryRequest) error {
+	if registryRequest.ExtractStreaming {
+		return registry.streamLayers(ctx, layers, registryRequest)
+	} else if registryRequest.Sequential {
+		return registry.fetchLayersSequentially(ctx, layers, registryRequest)
+	}
+
 	var (
-		wg           sync.WaitGroup
-		successCount atomic.Int32
+		wg   sync.WaitGroup
+		errs = make([]error, len(*layers))
 	)
 
-	for _, layer := range *layers {
+	// Each layer reports whether it was fetched on its own channel, so that completed layers
+	// can be handed over in manifest order while later layers are still downloading.
+	done := make([]chan bool, len(*layers))
+	for i := range done {
+		done[i] = make(chan bool, 1)
+	}
+
+	queue := make(chan int, len(*layers))
+	for _, i := range fetchOrder(*layers) {
+		queue <- i
+	}
+	close(queue)
+
+	// A fixed number of workers take layers from the queue in turn, bounding the downloads in flight
+	workers := registryRequest.MaxConcurrentDownloads
+	if workers <= 0 {
+		workers = defaultMaxConcurrentDownloads
+	}
+	for w := 0; w < workers && w < len(*layers); w++ {
 		wg.Add(1)
-		go func(l *ImageLayer, w *sync.WaitGroup) {
-			defer w.Done()
-			// Do we have the layer already in our cache?
-			if err := registryCache.hasLayer(l); err == nil {
-				successCount.Add(1)
-				return
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				errs[i] = registry.fetchLayer(ctx, &(*layers)[i], registryRequest)
+				done[i] <- errs[i] == nil
 			}
+		}()
+	}
 
-			resp, err := registry.sendRequest(registry.generateBlobRequest(
-				registryRequest.ImageReference,
-				url.QueryEscape(l.Digest)),
-				"GET",
-				registryRequest.Auth,
-			)
-			if err != nil {
-				return
+	readyErr := registryRequest.deliverLayers(layers, done)
+	wg.Wait()
+
+	if readyErr != nil {
+		return readyErr
+	}
+	// The first layer in manifest order to fail is reported, so that withRetries can tell
+	// whether fetching it again may help
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("could not fetch layer %s: %w", (*layers)[i].Sha256Sum, err)
+		}
+	}
+	return nil
+}
+
+// fetchOrder returns the indices of layers in the order they are requested. Smaller layers are
+// requested first so the leading layers become available sooner.
+func fetchOrder(layers []ImageLayer) []int {
+	order := make([]int, len(layers))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return layers[order[a]].Size < layers[order[b]].Size
+	})
+	return order
+}
+
+// fetchLayersSequentially fetches layers one at a time in manifest order, which makes it clear
+// exactly which layer a registry fails on
+func (registry *ContainerRegistryDetails) fetchLayersSequentially(ctx context.Context, layers *[]ImageLayer, registryRequest *RegistryRequest) error {
+	for i := registryRequest.delivered; i < len(*layers); i++ {
+		l := &(*layers)[i]
+		if err := registry.fetchLayer(ctx, l, registryRequest); err != nil {
+			return fmt.Errorf("could not fetch layer %s: %w", l.Sha256Sum, err)
+		}
+		if registryRequest.LayerReady != nil {
+			if err := registryRequest.LayerReady(l); err != nil {
+				return err
 			}
+		}
+		registryRequest.delivered++
+	}
+	return nil
+}
+
+// fetchLayer downloads a single layer into the layer store unless it is already present
+func (registry *ContainerRegistryDetails) fetchLayer(ctx context.Context, l *ImageLayer, registryRequest *RegistryRequest) error {
+	// Do we have the layer already in our cache?
+	if err := registryCache.hasLayer(l); err == nil {
+		if registryRequest.Progress != nil {
+			registryRequest.Progress(l, int64(l.Size), int64(l.Size))
+		}
+		return nil
+	}
+
+	// An image may list the same layer twice, which must not be written by two downloads at once
+	return layerDownloads.do(l.Digest, func() error {
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		// A download cut short by an earlier attempt, or an earlier pull, is resumed from where
+		// it stopped rather than started over
+		offset := partialLayerSize(l)
+		resp, err := registry.openLayer(ctx, l, registryRequest, offset)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if offset > 0 && resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+			os.Remove(partialLayerPath(l))
+			return fmt.Errorf("registry could not resume the download of layer %s at byte %d", l.Sha256Sum, offset)
+		}
+		if err := checkResponse(resp, nil); err != nil {
+			return err
+		}
+		// Registries which do not support ranges send the whole blob instead
+		if offset > 0 && !resumesAt(resp, offset) {
+			logger.Debug("registry did not resume layer download, starting over", "layer", l.Sha256Sum)
+			offset = 0
+		} else if offset > 0 {
+			logger.Debug("resuming layer download", "layer", l.Sha256Sum, "offset", offset)
+		}
+
+		body := watchForStalls(resp.Body, cancel)
+		defer body.stop()
+		if err := copyTo(withProgressFrom(body, l, registryRequest.Progress, offset), l, offset); err != nil {
+			return err
+		}
+		emitEvent("layer-downloaded", "digest", l.Digest, "bytes", l.Size)
+		return nil
+	})
+}
+
+// openLayer requests a layer from offset onwards. A foreign layer is downloaded from the first
+// of its URLs which serves it, and any other from the registry.
+func (registry *ContainerRegistryDetails) openLayer(ctx context.Context, l *ImageLayer, registryRequest *RegistryRequest, offset int64) (*http.Response, error) {
+	if len(l.URLs) == 0 {
+		req, err := registry.newRequest(ctx, registry.generateBlobRequest(
+			registryRequest.ImageReference,
+			url.QueryEscape(l.Digest)),
+			"GET",
+			registryRequest.Auth,
+		)
+		if err != nil {
+			return nil, err
+		}
+		setRange(req, offset)
+		return defaultHTTPClient.Do(req)
+	}
+
+	var lastErr error
+	for _, u := range l.URLs {
+		resp, err := openForeignLayer(ctx, u, offset)
+		if err == nil {
+			return resp, nil
+		}
+		logger.Debug("could not download foreign layer, trying its next URL", "layer", l.Sha256Sum, "url", u, "error", err)
+		lastErr = err
+	}
+	return nil, fmt.Errorf("could not download foreign layer %s from any of its URLs: %w", l.Sha256Sum, lastErr)
+}
+
+// openForeignLayer requests a foreign layer from u, which is not sent the registry's token. A
+// URL which does not serve the layer is reported as an error, except for a range it cannot
+// serve, which is left to the caller to start the download over.
+func openForeignLayer(ctx context.Context, u string, offset int64) (*http.Response, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported URL scheme %q", parsed.Scheme)
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	setRange(req, offset)
+	resp, err := defaultHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 && resp.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+	return resp, nil
+}
+
+// setRange asks for the rest of a blob from offset onwards, unless that is the whole blob
+func setRange(req *http.Request, offset int64) {
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+}
+
+// partialLayerPath is where a layer is downloaded to, until it is complete and verified
+func partialLayerPath(l *ImageLayer) string {
+	return fmt.Sprintf("%s/%s.tar.gz.part", ImageLayersPath, l.Sha256Sum)
+}
+
+// partialLayerSize returns how much of a layer an earlier download left behind, or 0 if there is
+// nothing to resume
+func partialLayerSize(l *ImageLayer) int64 {
+	info, err := os.Stat(partialLayerPath(l))
+	if err != nil || info.Size() >= int64(l.Size) {
+		return 0
+	}
+	return info.Size()
+}
+
+// resumesAt reports whether resp holds the rest of a blob from offset onwards
+func resumesAt(resp *http.Response, offset int64) bool {
+	if resp.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	var start, end int64
+	_, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/", &start, &end)
+	return err == nil && start == offset
+}
+
+// inFlightDownloads coalesces concurrent fetches of a layer onto a single download
+type inFlightDownloads struct {
+	mu        sync.Mutex
+	downloads map[string]*inFlightDownload
+}
+
+type inFlightDownload struct {
+	done chan struct{}
+	err  error
+}
+
+var layerDownloads = inFlightDownloads{downloads: make(map[string]*inFlightDownload)}
+
+// do calls download unless a download of the same digest is already in flight, in which case
+// it waits for that download to finish and returns its result instead
+func (d *inFlightDownloads) do(digest string, download func() error) error {
+	d.mu.Lock()
+	if existing, ok := d.downloads[digest]; ok {
+		d.mu.Unlock()
+		<-existing.done
+		return existing.err
+	}
+	current := &inFlightDownload{done: make(chan struct{})}
+	d.downloads[digest] = current
+	d.mu.Unlock()
+
+	current.err = download()
+
+	d.mu.Lock()
+	delete(d.downloads, digest)
+	d.mu.Unlock()
+	close(current.done)
+	return current.err
+}
+
+// deliverLayers passes each fetched layer to LayerReady in manifest order, skipping any layers
+// already delivered by a previous attempt. Delivery stops at the first layer that failed to fetch.
+func (registryRequest *RegistryRequest) deliverLayers(layers *[]ImageLayer, done []chan bool) error {
+	if registryRequest.LayerReady == nil {
+		return nil
+	}
+
+	for i := registryRequest.delivered; i < len(done); i++ {
+		if fetched := <-done[i]; !fetched {
+			return nil
+		}
+		if err := registryRequest.LayerReady(&(*layers)[i]); err != nil {
+			return err
+		}
+		registryRequest.delivered++
+	}
+	return nil
+}
+
+// streamLayers fetches layers one at a time in manifest order, extracting each straight from the
+// registry response, since extraction must honour the layer order.
+func (registry *ContainerRegistryDetails) streamLayers(ctx context.Context, layers *[]ImageLayer, registryRequest *RegistryRequest) error {
+	for i := registryRequest.delivered; i < len(*layers); i++ {
+		l := &(*layers)[i]
+		if err := registry.streamLayer(ctx, l, registryRequest); err != nil {
+			return fmt.Errorf("could not stream layer %s: %w", l.Sha256Sum, err)
+		}
+		registryRequest.delivered++
+	}
+	return nil
+}
+
+func (registry *ContainerRegistryDetails) streamLayer(ctx context.Context, l *ImageLayer, registryRequest *RegistryRequest) (err error) {
+	if err := registryCache.hasLayer(l); err == nil {
+		if registryRequest.Progress != nil {
+			registryRequest.Progress(l, int64(l.Size), int64(l.Size))
+		}
+		return extractLayer(registryRequest.ExtractTo, l)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	resp, err := registry.openLayer(ctx, l, registryRequest, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := checkResponse(resp, nil); err != nil {
+		return err
+	}
 
-			err = copyTo(resp.Body, l)
+	hash := sha256.New()
+	counter := &countingWriter{}
+	writers := []io.Writer{hash, counter}
+	if registryRequest.CacheStreamedLayers {
+		if err := os.MkdirAll(ImageLayersPath, 0600); err != nil {
+			return errors.New("could not create directory for this image")
+		}
+		// err is assigned rather than declared here, as the cached copy is removed if the stream
+		// then fails
+		var f *os.File
+		f, err = os.OpenFile(fmt.Sprintf("%s/%s.tar.gz", ImageLayersPath, l.Sha256Sum), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return errors.New("could not open image file for writing")
+		}
+		defer func() {
 			if err != nil {
-				return
+				os.Remove(f.Name())
 			}
-			successCount.Add(1)
-			return
-		}(&layer, &wg)
+		}()
+		defer f.Close()
+
+		wFile := bufio.NewWriter(f)
+		defer wFile.Flush()
+		writers = append(writers, wFile)
+	}
+
+	body := watchForStalls(resp.Body, cancel)
+	defer body.stop()
+	r := io.TeeReader(withProgress(body, l, registryRequest.Progress), io.MultiWriter(writers...))
+	if err := untar(registryRequest.ExtractTo, r, l.MediaType); err != nil {
+		return err
+	}
+	// The archive may end before the blob does, so drain the remainder for the digest and cache
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return err
 	}
-	wg.Wait()
 
-	if int(successCount.Load()) != len(*layers) {
-		return errors.New("unable to fetch all layers in image")
+	if counter.n != int64(l.Size) {
+		return errors.New("streamed layer size does not match remote layer size")
+	}
+	if fmt.Sprintf("%x", hash.Sum(nil)) != l.Sha256Sum {
+		return fmt.Errorf("%w for streamed layer and the remote", ErrDigestMismatch)
 	}
+	emitEvent("layer-downloaded", "digest", l.Digest, "bytes", l.Size)
 	return nil
 }
 
@@ -415,68 +1286,211 @@ const (
 //		3. The cache entries have no expiries.
 const cacheEnabled = false
 
-func copyTo(reader io.ReadCloser, l *ImageLayer) error {
+// copyTo writes a layer downloaded from offset onwards to its partial file, appending to what
+// an earlier download left there, and moves it into the layer store once it is complete and
+// matches its digest. A download cut short leaves the partial file behind to be resumed.
+func copyTo(reader io.Reader, l *ImageLayer, offset int64) error {
 	r := bufio.NewReader(reader)
 	err := os.MkdirAll(ImageLayersPath, 0600)
 	if err != nil {
 		return errors.New("could not create directory for this image")
 	}
 
-	f, err := os.OpenFile(fmt.Sprintf("%s/%s.tar.gz", ImageLayersPath, l.Sha256Sum), os.O_WRONLY|os.O_CREATE, 0600)
+	// The digest covers the whole layer, so what was downloaded before is hashed first
+	hash := sha256.New()
+	part := partialLayerPath(l)
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if offset > 0 {
+		existing, err := os.Open(part)
+		if err != nil {
+			return err
+		}
+		n, err := io.Copy(hash, io.LimitReader(existing, offset))
+		existing.Close()
+		if err != nil {
+			return err
+		}
+		if n != offset {
+			return fmt.Errorf("partial download of layer %s is shorter than expected", l.Sha256Sum)
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+
+	f, err := os.OpenFile(part, flags, 0600)
 	if err != nil {
 		return errors.New("could not open image file for writing")
 	}
 
 	defer f.Close()
+	if offset > 0 {
+		// Anything written past the hashed part, such as by an interrupted earlier run, is dropped
+		if err := f.Truncate(offset); err != nil {
+			return err
+		}
+	}
 
-	var writers []io.Writer
+	writers := []io.Writer{hash}
 	wFile := bufio.NewWriter(f)
 	writers = append(writers, wFile)
-	if cacheEnabled {
+	if cacheEnabled && offset == 0 {
 		wCache := bufio.NewWriter(&l.Data)
 		writers = append(writers, wCache)
 	}
-	defer wFile.Flush()
 
 	mw := io.MultiWriter(writers...)
 	bytesWritten, err := io.Copy(mw, r)
-
+	// What did arrive is kept for the download to be resumed from, even if it was cut short
+	if flushErr := wFile.Flush(); err == nil {
+		err = flushErr
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
 		return err
 	}
 
-	if bytesWritten != int64(l.Size) {
+	if offset+bytesWritten != int64(l.Size) {
+		os.Remove(part)
 		return errors.New("written layer size does not match remote layer size")
 	}
+	if fmt.Sprintf("%x", hash.Sum(nil)) != l.Sha256Sum {
+		os.Remove(part)
+		// What an earlier download left behind may be what is wrong, so a resumed download is
+		// retried from the start rather than blamed on the registry
+		if offset > 0 {
+			return fmt.Errorf("resumed download of layer %s does not match its digest, starting over", l.Sha256Sum)
+		}
+		return fmt.Errorf("%w for downloaded layer and the remote", ErrDigestMismatch)
+	}
 
-	return nil
+	return os.Rename(part, fmt.Sprintf("%s/%s.tar.gz", ImageLayersPath, l.Sha256Sum))
+}
+
+// extractLayer unpacks a fetched layer from the layer store into the root filesystem at dst
+func extractLayer(dst string, layer *ImageLayer) error {
+	f, err := os.Open(fmt.Sprintf("%s/%s.tar.gz", ImageLayersPath, layer.Sha256Sum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return untar(dst, f, layer.MediaType)
+}
+
+// extractSquashedLayers squashes layers and extracts the result into dst. The squashed layer is
+// not part of any stored image, so it is removed once extracted rather than left in the layer
+// store for good, unless it happens to be one of the image's own layers.
+func extractSquashedLayers(dst string, layers *[]ImageLayer) (*[]ImageLayer, error) {
+	squashed, err := squashLayers(layers)
+	if err != nil {
+		return nil, fmt.Errorf("could not squash image layers: %w", err)
+	}
+	layer := &(*squashed)[0]
+	shared := false
+	for _, l := range *layers {
+		shared = shared || l.Sha256Sum == layer.Sha256Sum
+	}
+	if !shared {
+		defer os.Remove(fmt.Sprintf("%s/%s.tar.gz", ImageLayersPath, layer.Sha256Sum))
+	}
+
+	if err := extractLayer(dst, layer); err != nil {
+		return nil, fmt.Errorf("could not extract layer %s - %w", layer.Sha256Sum, err)
+	}
+	return squashed, nil
+}
+
+// squashLayers stacks every layer, resolving whiteouts, and re-archives the resulting filesystem
+// as a single layer stored alongside the other cached layers.
+func squashLayers(layers *[]ImageLayer) (*[]ImageLayer, error) {
+	stagingDir, err := os.MkdirTemp("/tmp/", "squash.")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(stagingDir)
+
+	for _, layer := range *layers {
+		if err := extractLayer(stagingDir, &layer); err != nil {
+			return nil, fmt.Errorf("could not extract layer %s: %w", layer.Sha256Sum, err)
+		}
+	}
+
+	f, err := os.CreateTemp(ImageLayersPath, "squash.*.tar.gz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+	gzw := gzip.NewWriter(io.MultiWriter(f, hash, counter))
+	if err := tarDirectory(stagingDir, gzw); err != nil {
+		return nil, err
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, err
+	}
+
+	sum := fmt.Sprintf("%x", hash.Sum(nil))
+	if err := os.Rename(f.Name(), filepath.Join(ImageLayersPath, sum+".tar.gz")); err != nil {
+		return nil, err
+	}
+
+	return &[]ImageLayer{{
+		Manifest: Manifest{
+			Digest:    "sha256:" + sum,
+			MediaType: string(DockerImageTypeRootFs),
+			Size:      int(counter.n),
+		},
+		Sha256Sum: sum,
+	}}, nil
 }
 
-func (manifests *RegistryResponse) getDigestForSystem(body []byte) (*Manifest, error) {
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// getDigestForSystem selects the manifest for platform from an index
+func (manifests *RegistryResponse) getDigestForSystem(body []byte, platform Platform) (*Manifest, error) {
 	err := json.Unmarshal(body, &manifests)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, manifest := range manifests.Manifests {
-		if manifest.Platform.Os == runtime.GOOS && manifest.Platform.Architecture == runtime.GOARCH {
-			return &manifest, err
+	// An exact match is preferred, falling back to the latest variant the platform can also run
+	var best *Manifest
+	bestRank := 0
+	for i, manifest := range manifests.Manifests {
+		if rank, ok := platform.rank(manifest.Platform); ok && (best == nil || rank < bestRank) {
+			best, bestRank = &manifests.Manifests[i], rank
 		}
 	}
-	return nil, errors.New("no digest found that supports this architecture or system")
+	if best == nil {
+		if windowsOnly(manifests.Manifests) {
+			return nil, checkSupportedPlatform(manifests.Manifests[0].Platform, nil)
+		}
+		return nil, fmt.Errorf("no digest found that supports this architecture or system (%s)", platform)
+	}
+	return best, nil
 }
 
-func (registry *ContainerRegistryDetails) requestAuthenticationToken(response *http.Response) (*Auth, error) {
+func (registry *ContainerRegistryDetails) requestAuthenticationToken(ctx context.Context, response *http.Response) (*Auth, error) {
 	if wwwAuth, ok := response.Header["Www-Authenticate"]; !ok {
 		return nil, errors.New("no Www-Authenticate header present; cannot perform authentication")
 	} else {
-		auth := &Auth{}
-		err := bearerRegex.MatchToTarget(wwwAuth[0], auth)
+		auth, err := bearerChallenge(wwwAuth)
 		if err != nil {
-			return nil, errors.New("malformed Www-Authenticate header present; cannot perform authentication")
+			return nil, err
 		}
 
-		err = registry.constructAuth(auth)
+		err = registry.constructAuth(ctx, auth)
 		if err != nil {
 			return nil, err
 		}
@@ -484,53 +1498,71 @@ func (registry *ContainerRegistryDetails) requestAuthenticationToken(response *h
 	}
 }
 
-func (registry *ContainerRegistryDetails) constructAuth(auth *Auth) error {
-	query := fmt.Sprintf("%s?scope=%s&service=%s", auth.Bearer, url.QueryEscape(auth.Scope), url.QueryEscape(auth.Service))
-	req, err := http.NewRequest("GET", query, nil)
+func (registry *ContainerRegistryDetails) constructAuth(ctx context.Context, auth *Auth) error {
+	ctx, cancel := withRequestTimeout(ctx)
+	defer cancel()
+
+	// Registries may omit the scope or service, and the realm may carry a query of its own
+	realm, err := url.Parse(auth.Bearer)
+	if err != nil {
+		return fmt.Errorf("invalid token realm %q: %w", auth.Bearer, err)
+	}
+	query := realm.Query()
+	if auth.Scope != "" {
+		query.Set("scope", auth.Scope)
+	}
+	if auth.Service != "" {
+		query.Set("service", auth.Service)
+	}
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, "GET", realm.String(), nil)
 	if err != nil {
 		return err
 	}
+	// Without credentials the token only grants anonymous access
+	if credentials := registry.credentials(); credentials != nil {
+		req.SetBasicAuth(credentials.Username, credentials.Password)
+	}
 
 	resp, err := defaultHTTPClient.Do(req)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not reach token service %s: %w", realm.Host, err)
 	}
 	defer resp.Body.Close()
+	// Failures are reported as the registry's own are, so that withRetries retries the request
+	// the token was for when the token service fails in a way it may recover from, such as a
+	// 503, and gives up at once when it refuses the credentials
+	if err := checkResponse(resp, nil); err != nil {
+		return fmt.Errorf("token service %s: %w", realm.Host, err)
+	}
 
 	body, err := io.ReadAll(resp.Body)
-
-	err = json.Unmarshal(body, &auth)
 	if err != nil {
-		return err
+		return fmt.Errorf("could not read token from %s: %w", realm.Host, err)
+	}
+
+	// Any token auth held before was refused, and must not outlive the one replacing it
+	auth.Token, auth.AccessToken = "", ""
+	if err := json.Unmarshal(body, auth); err != nil {
+		return fmt.Errorf("token service %s returned an unexpected body: %q", realm.Host, bodySnippet(body))
+	}
+	if auth.Token == "" {
+		auth.Token = auth.AccessToken
+	}
+	if auth.Token == "" {
+		return fmt.Errorf("token service %s returned no token", realm.Host)
 	}
 	return nil
 }
 
 func sanitiseImageReference(ref string) (string, string, string) {
-	// Simplified logic for the special (registry-1)?.docker.io case
 	// When providing the short form of an image reference such as "alpine" or "alpine:latest"
 	// to CLI tools such as docker or podman they will "familiarise" the given image
-	// reference by prepending "docker.io/library/" to it.
-	var registryDomain string
-	i := strings.IndexRune(ref, '/')
-
-	if i == -1 || (!strings.ContainsAny(ref[:i], ".:")) {
-		registryDomain = DefaultRegistry
-	} else {
-		registryDomain = ref[:i]
-		ref = ref[i+1:]
-	}
-
-	var found bool
-	if found = strings.HasPrefix(ref, "library/"); !found && registryDomain == DefaultRegistry {
-		ref = "library/" + ref
-	}
-
-	var tag string
-	// If there is no tag for the image reference use the default "latest"
-	ref, tag, found = strings.Cut(ref, ":")
-	if !found {
-		tag = "latest"
+	// reference by prepending "docker.io/library/" to it. References are validated before
+	// they are used, so one that cannot be parsed is passed through for the registry to refuse.
+	parsed, err := parseReference(ref)
+	if err != nil {
+		return ref, DefaultRegistry, "latest"
 	}
-	return ref, registryDomain, tag
+	return parsed.Repository, parsed.Registry, parsed.manifestReference()
 }
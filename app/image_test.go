@@ -0,0 +1,2053 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestImageConfigShell(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *DockerImageConfig
+		want   []string
+	}{
+		{name: "no image config", want: []string{"/bin/sh", "-c"}},
+		{name: "no shell", config: &DockerImageConfig{}, want: []string{"/bin/sh", "-c"}},
+		{
+			name:   "image shell",
+			config: &DockerImageConfig{Config: OCIImageConfig{Shell: []string{"/bin/bash", "-o", "pipefail", "-c"}}},
+			want:   []string{"/bin/bash", "-o", "pipefail", "-c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.shell(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("shell() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageConfigArgv(t *testing.T) {
+	image := func(shell, entrypoint, cmd []string) *DockerImageConfig {
+		config := &DockerImageConfig{}
+		config.Config.Shell, config.Config.Entrypoint, config.Config.Cmd = shell, entrypoint, cmd
+		return config
+	}
+
+	tests := []struct {
+		name       string
+		config     *DockerImageConfig
+		entrypoint string
+		args       []string
+		shellForm  bool
+		want       []string
+		wantErr    bool
+	}{
+		{
+			name:   "image command",
+			config: image(nil, nil, []string{"/bin/sh"}),
+			want:   []string{"/bin/sh"},
+		},
+		{
+			name:   "arguments replace the image command",
+			config: image(nil, nil, []string{"/bin/sh"}),
+			args:   []string{"echo", "hi"},
+			want:   []string{"echo", "hi"},
+		},
+		{
+			name:   "image entrypoint with its command",
+			config: image(nil, []string{"/entry"}, []string{"--default"}),
+			want:   []string{"/entry", "--default"},
+		},
+		{
+			name:   "image entrypoint with arguments",
+			config: image(nil, []string{"/entry"}, []string{"--default"}),
+			args:   []string{"--given"},
+			want:   []string{"/entry", "--given"},
+		},
+		{
+			name:       "entrypoint discards the image command",
+			config:     image(nil, []string{"/entry"}, []string{"--default"}),
+			entrypoint: "/other",
+			want:       []string{"/other"},
+		},
+		{
+			name:       "entrypoint with arguments",
+			config:     image(nil, []string{"/entry"}, []string{"--default"}),
+			entrypoint: "/other",
+			args:       []string{"--given"},
+			want:       []string{"/other", "--given"},
+		},
+		{
+			name:      "shell form uses /bin/sh -c by default",
+			config:    image(nil, nil, nil),
+			args:      []string{"echo", "$HOME"},
+			shellForm: true,
+			want:      []string{"/bin/sh", "-c", "echo $HOME"},
+		},
+		{
+			name:      "shell form uses the image's shell",
+			config:    image([]string{"/bin/bash", "-o", "pipefail", "-c"}, nil, []string{"ls"}),
+			shellForm: true,
+			want:      []string{"/bin/bash", "-o", "pipefail", "-c", "ls"},
+		},
+		{
+			name:      "shell form follows the image entrypoint",
+			config:    image([]string{"/bin/ash", "-c"}, []string{"/entry"}, nil),
+			args:      []string{"a", "b"},
+			shellForm: true,
+			want:      []string{"/entry", "/bin/ash", "-c", "a b"},
+		},
+		{
+			name:   "no image config",
+			config: nil,
+			args:   []string{"/bin/true"},
+			want:   []string{"/bin/true"},
+		},
+		{
+			name:    "nothing to run",
+			config:  image([]string{"/bin/ash", "-c"}, nil, nil),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.config.argv(tt.entrypoint, tt.args, tt.shellForm)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("argv gave error %v, want error %t", err, tt.wantErr)
+			}
+			if strings.Join(got, "\x00") != strings.Join(tt.want, "\x00") {
+				t.Errorf("argv = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchLayersReportsCause(t *testing.T) {
+	withoutBackoff(t)
+	layers := [][]byte{
+		buildLayer(t, []tarEntry{tarFile("a", "a")}),
+		buildLayer(t, []tarEntry{tarFile("b", "b")}),
+		buildLayer(t, []tarEntry{tarFile("c", "c")}),
+	}
+	failing := digestOf(layers[1])
+
+	tests := []struct {
+		name string
+		// fail answers the first requests for the failing layer
+		fail      func(w http.ResponseWriter)
+		failTimes int
+		// wantStatus is the status of the RegistryError reported, if any
+		wantStatus   int
+		wantMismatch bool
+		wantRequests int
+	}{
+		{name: "all fetched", wantRequests: 1},
+		{
+			name:         "not found",
+			fail:         func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotFound) },
+			failTimes:    maxRetries,
+			wantStatus:   http.StatusNotFound,
+			wantRequests: 1,
+		},
+		{
+			name:         "forbidden",
+			fail:         func(w http.ResponseWriter) { w.WriteHeader(http.StatusForbidden) },
+			failTimes:    maxRetries,
+			wantStatus:   http.StatusForbidden,
+			wantRequests: 1,
+		},
+		{
+			name:         "digest mismatch",
+			fail:         func(w http.ResponseWriter) { w.Write(layers[2][:len(layers[1])]) },
+			failTimes:    maxRetries,
+			wantMismatch: true,
+			wantRequests: 1,
+		},
+		{
+			name:         "server error",
+			fail:         func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+			failTimes:    maxRetries,
+			wantStatus:   http.StatusServiceUnavailable,
+			wantRequests: maxRetries,
+		},
+		{
+			name:         "transient server error",
+			fail:         func(w http.ResponseWriter) { w.WriteHeader(http.StatusServiceUnavailable) },
+			failTimes:    2,
+			wantRequests: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImage(t, layers...)
+			registry.pushIndex(t, "app", "latest", image)
+			var failed atomic.Int32
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if tt.fail == nil || !strings.HasSuffix(r.URL.Path, failing) || int(failed.Add(1)) > tt.failTimes {
+					return false
+				}
+				tt.fail(w)
+				return true
+			}
+
+			_, _, err := pullImage(context.Background(), registry.host+"/app:latest", &Auth{Token: "token"}, nil)
+
+			var registryErr *RegistryError
+			switch {
+			case tt.wantStatus != 0:
+				if !errors.As(err, &registryErr) || registryErr.StatusCode != tt.wantStatus {
+					t.Errorf("pullImage gave %v, want a registry error with status %d", err, tt.wantStatus)
+				}
+			case tt.wantMismatch:
+				if !errors.Is(err, ErrDigestMismatch) {
+					t.Errorf("pullImage gave %v, want a digest mismatch", err)
+				}
+			case err != nil:
+				t.Errorf("pullImage gave %v", err)
+			}
+			if err != nil && !strings.Contains(err.Error(), strings.TrimPrefix(failing, "sha256:")) {
+				t.Errorf("error %q does not name the failing layer", err)
+			}
+			if got := registry.count(failing); got != tt.wantRequests {
+				t.Errorf("failing layer was requested %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestFetchOrderSmallestFirst(t *testing.T) {
+	tests := []struct {
+		name string
+		// sizes are the layer sizes in manifest order
+		sizes []int
+		// want is the order the layers should be requested in, by index into the manifest
+		want []int
+	}{
+		{name: "ascending", sizes: []int{1 << 10, 8 << 10, 64 << 10}, want: []int{0, 1, 2}},
+		{name: "descending", sizes: []int{64 << 10, 8 << 10, 1 << 10}, want: []int{2, 1, 0}},
+		{name: "mixed", sizes: []int{8 << 10, 64 << 10, 1 << 10, 16 << 10}, want: []int{2, 0, 3, 1}},
+		{name: "equal sizes keep manifest order", sizes: []int{4 << 10, 1 << 10, 4 << 10}, want: []int{1, 0, 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layers := make([]ImageLayer, len(tt.sizes))
+			for i, size := range tt.sizes {
+				layers[i].Size = size
+			}
+			if got := fetchOrder(layers); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("layers are requested in order %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// BenchmarkTimeToFirstLayer measures how long fetching takes to hand over its first layer, from
+// a registry which serves each layer in time proportional to its size, as a slow link would
+func BenchmarkTimeToFirstLayer(b *testing.B) {
+	var layers [][]byte
+	for _, size := range []int{32 << 10, 2 << 20, 1 << 20, 8 << 10, 512 << 10} {
+		layers = append(layers, buildLayer(b, []tarEntry{tarFile("file", noise(size))}))
+	}
+	useLayerStore(b)
+	registry := newFakeRegistry(b)
+	image := newFakeImage(b, layers...)
+	registry.push("app", "latest", image)
+	registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		registry.mu.Lock()
+		blob := registry.blobs[path.Base(r.URL.Path)]
+		registry.mu.Unlock()
+		time.Sleep(time.Duration(len(blob)) * time.Microsecond / 64)
+		return false
+	}
+
+	for _, bb := range []struct {
+		name    string
+		options PullOptions
+	}{
+		{name: "sequential", options: PullOptions{Sequential: true}},
+		{name: "concurrent"},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			var first time.Duration
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				ImageLayersPath = b.TempDir()
+				descriptors := image.layerDescriptors(b)
+				options := bb.options
+				var start time.Time
+				var once sync.Once
+				options.LayerReady = func(*ImageLayer) error {
+					once.Do(func() { first += time.Since(start) })
+					return nil
+				}
+				b.StartTimer()
+
+				start = time.Now()
+				if err := Registries[registry.host].fetchLayers(context.Background(), &descriptors, &RegistryRequest{ImageReference: "app", PullOptions: &options}); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(first.Nanoseconds())/float64(b.N), "ns-to-first-layer/op")
+		})
+	}
+}
+
+func TestStreamLayers(t *testing.T) {
+	layers := [][]byte{
+		buildLayer(t, []tarEntry{tarDir("etc/"), tarFile("etc/first", "first"), tarFile("etc/gone", "gone")}),
+		buildLayer(t, []tarEntry{tarFile("etc/second", "second"), tarFile("etc/.wh.gone", "")}),
+	}
+	// corrupt differs from the second layer only in its gzip header's modification time, so it
+	// extracts the same but does not match the layer's digest
+	corrupt := append([]byte(nil), layers[1]...)
+	corrupt[4] ^= 1
+
+	tests := []struct {
+		name  string
+		cache bool
+		// cached layers are in the layer store before the pull
+		cached  []int
+		corrupt bool
+		// wantRequested is how many layers are fetched from the registry
+		wantRequested int
+		wantErr       bool
+	}{
+		{name: "without caching", wantRequested: 2},
+		{name: "caching", cache: true, wantRequested: 2},
+		{name: "already cached", cached: []int{0}, wantRequested: 1},
+		{name: "digest mismatch", corrupt: true, wantRequested: 2, wantErr: true},
+		{name: "digest mismatch while caching", cache: true, corrupt: true, wantRequested: 2, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImage(t, layers...)
+			registry.push("app", "latest", image)
+			if tt.corrupt {
+				registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+					if !strings.HasSuffix(r.URL.Path, digestOf(layers[1])) {
+						return false
+					}
+					w.Write(corrupt)
+					return true
+				}
+			}
+			for _, i := range tt.cached {
+				name := filepath.Join(ImageLayersPath, strings.TrimPrefix(digestOf(layers[i]), "sha256:")+".tar.gz")
+				if err := os.WriteFile(name, layers[i], 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			root := t.TempDir()
+			pulled := image.layerDescriptors(t)
+			err := Registries[registry.host].streamLayers(context.Background(), &pulled, &RegistryRequest{ImageReference: "app", PullOptions: &PullOptions{
+				ExtractStreaming:    true,
+				ExtractTo:           root,
+				CacheStreamedLayers: tt.cache,
+			}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("streaming gave error %v, want error %t", err, tt.wantErr)
+			}
+			if got := registry.count(digestOf(layers[0])) + registry.count(digestOf(layers[1])); got != tt.wantRequested {
+				t.Errorf("%d layers were requested, want %d", got, tt.wantRequested)
+			}
+			if tt.wantErr {
+				if !strings.Contains(err.Error(), "digest mismatch") {
+					t.Errorf("streaming gave %v, want a digest mismatch", err)
+				}
+				name := filepath.Join(ImageLayersPath, strings.TrimPrefix(digestOf(layers[1]), "sha256:")+".tar.gz")
+				if _, err := os.Stat(name); !os.IsNotExist(err) {
+					t.Errorf("layer which failed to stream was left in the layer store: %v", err)
+				}
+				return
+			}
+
+			if got, want := snapshot(t, filepath.Join(root, "etc")), `./ -rwxr-xr-x
+first -rw-r--r-- "first"
+second -rw-r--r-- "second"`; got != want {
+				t.Errorf("extracted /etc holds\n%s\nwant\n%s", got, want)
+			}
+			for i := range pulled {
+				cached := registryCache.hasLayer(&pulled[i]) == nil
+				if want := tt.cache || containsInt(tt.cached, i); cached != want {
+					t.Errorf("layer %d is cached: %t, want %t", i, cached, want)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkFetchLayersStreaming compares extracting each layer once it is staged in the layer store,
+// as run does by default, with extracting it straight from the registry response
+func BenchmarkFetchLayersStreaming(b *testing.B) {
+	var layers [][]byte
+	for i := 0; i < 4; i++ {
+		var entries []tarEntry
+		for j := 0; j < 16; j++ {
+			entries = append(entries, tarFile(fmt.Sprintf("file%d.%d", i, j), noise(64<<10+j)))
+		}
+		layers = append(layers, buildLayer(b, entries))
+	}
+	useLayerStore(b)
+	registry := newFakeRegistry(b)
+	image := newFakeImage(b, layers...)
+	registry.push("app", "latest", image)
+
+	for _, bb := range []struct {
+		name    string
+		options PullOptions
+	}{
+		{name: "staged"},
+		{name: "streaming", options: PullOptions{ExtractStreaming: true}},
+		{name: "streaming and caching", options: PullOptions{ExtractStreaming: true, CacheStreamedLayers: true}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				ImageLayersPath = b.TempDir()
+				root := b.TempDir()
+				options := bb.options
+				options.ExtractTo = root
+				if !options.ExtractStreaming {
+					options.LayerReady = func(layer *ImageLayer) error {
+						return extractLayer(root, layer)
+					}
+				}
+				descriptors := image.layerDescriptors(b)
+				b.StartTimer()
+
+				if err := Registries[registry.host].fetchLayers(context.Background(), &descriptors, &RegistryRequest{ImageReference: "app", PullOptions: &options}); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func TestFetchIndexRetries(t *testing.T) {
+	withoutBackoff(t)
+	image := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+
+	tests := []struct {
+		name string
+		// fail answers the first requests for the index
+		fail         func(w http.ResponseWriter)
+		failTimes    int
+		wantErr      bool
+		wantRequests int
+	}{
+		{name: "no failures", wantRequests: 1},
+		{
+			name: "truncated index",
+			fail: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(image.manifest)))
+				w.Write(image.manifest[:len(image.manifest)/2])
+			},
+			failTimes:    2,
+			wantRequests: 3,
+		},
+		{
+			name: "dropped connection",
+			fail: func(w http.ResponseWriter) {
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err == nil {
+					conn.Close()
+				}
+			},
+			failTimes:    1,
+			wantRequests: 2,
+		},
+		{
+			name: "persistently truncated index",
+			fail: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(image.manifest)))
+				w.Write(image.manifest[:len(image.manifest)/2])
+			},
+			failTimes:    maxRetries,
+			wantErr:      true,
+			wantRequests: maxRetries,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			registry.push("app", "latest", image)
+			var failed atomic.Int32
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if tt.fail == nil || int(failed.Add(1)) > tt.failTimes {
+					return false
+				}
+				tt.fail(w)
+				return true
+			}
+
+			details := Registries[registry.host]
+			var body []byte
+			err := withRetries(context.Background(), func() (err error) {
+				body, _, _, err = details.fetchIndex(context.Background(), details.generateManifestRequest("app", "latest"), &Auth{Token: "token"})
+				return err
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetching gave error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !bytes.Equal(body, image.manifest) {
+				t.Errorf("fetched %q, want %q", body, image.manifest)
+			}
+			if got := registry.count("/manifests/latest"); got != tt.wantRequests {
+				t.Errorf("index was requested %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestFetchLayersSequentially(t *testing.T) {
+	// The layers grow smaller, so that fetching the smallest first would reverse their order
+	layers := [][]byte{
+		buildLayer(t, []tarEntry{tarFile("a", noise(64*1024))}),
+		buildLayer(t, []tarEntry{tarFile("b", noise(32*1024))}),
+		buildLayer(t, []tarEntry{tarFile("c", "c")}),
+	}
+	blobs := make(map[string][]byte)
+	for _, layer := range layers {
+		blobs[digestOf(layer)] = layer
+	}
+
+	tests := []struct {
+		name string
+		// missing is the index of a layer the registry does not have, if any
+		missing     int
+		wantErr     bool
+		wantFetched []int
+	}{
+		{name: "all layers", missing: -1, wantFetched: []int{0, 1, 2}},
+		{name: "missing first layer", missing: 0, wantErr: true, wantFetched: []int{0}},
+		{name: "missing middle layer", missing: 1, wantErr: true, wantFetched: []int{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImage(t, layers...)
+			registry.push("app", "latest", image)
+			var inFlight, maxInFlight atomic.Int32
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				_, digest, ok := strings.Cut(r.URL.Path, "/blobs/")
+				blob, isLayer := blobs[digest]
+				if !ok || !isLayer {
+					return false
+				}
+				if n := inFlight.Add(1); n > maxInFlight.Load() {
+					maxInFlight.Store(n)
+				}
+				defer inFlight.Add(-1)
+				if tt.missing >= 0 && digest == digestOf(layers[tt.missing]) {
+					w.WriteHeader(http.StatusNotFound)
+					return true
+				}
+				time.Sleep(10 * time.Millisecond)
+				w.Write(blob)
+				return true
+			}
+
+			var ready []string
+			descriptors := image.layerDescriptors(t)
+			err := Registries[registry.host].fetchLayers(context.Background(), &descriptors, &RegistryRequest{ImageReference: "app", PullOptions: &PullOptions{
+				Sequential: true,
+				LayerReady: func(l *ImageLayer) error {
+					ready = append(ready, l.Digest)
+					return nil
+				},
+			}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetching gave error %v, want error %t", err, tt.wantErr)
+			}
+
+			var fetched, want []string
+			for _, request := range registry.served() {
+				if _, digest, ok := strings.Cut(request, "/blobs/"); ok && blobs[digest] != nil {
+					fetched = append(fetched, digest)
+				}
+			}
+			for _, i := range tt.wantFetched {
+				want = append(want, digestOf(layers[i]))
+			}
+			if strings.Join(fetched, " ") != strings.Join(want, " ") {
+				t.Errorf("layers were fetched in the order %q, want %q", fetched, want)
+			}
+			if n := maxInFlight.Load(); n != 1 {
+				t.Errorf("%d layers were fetched at once, want 1", n)
+			}
+			if !tt.wantErr && strings.Join(ready, " ") != strings.Join(want, " ") {
+				t.Errorf("layers were ready in the order %q, want %q", ready, want)
+			}
+		})
+	}
+}
+
+func TestFetchImageConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    DockerImageConfig
+		wantErr bool
+	}{
+		{
+			name: "docker image",
+			config: `{"architecture":"amd64","os":"linux","config":{
+				"User":"nginx","ExposedPorts":{"80/tcp":{}},"Env":["PATH=/usr/bin","NGINX_VERSION=1.25"],
+				"Entrypoint":["/docker-entrypoint.sh"],"Cmd":["nginx","-g","daemon off;"],
+				"Volumes":{"/var/cache/nginx":{}},"WorkingDir":"/srv","Labels":{"maintainer":"NGINX"},
+				"StopSignal":"SIGQUIT"},"rootfs":{"type":"layers","diff_ids":[]}}`,
+			want: DockerImageConfig{Architecture: "amd64", Os: "linux", Config: OCIImageConfig{
+				User:         "nginx",
+				ExposedPorts: map[string]struct{}{"80/tcp": {}},
+				Env:          []string{"PATH=/usr/bin", "NGINX_VERSION=1.25"},
+				Entrypoint:   []string{"/docker-entrypoint.sh"},
+				Cmd:          []string{"nginx", "-g", "daemon off;"},
+				Volumes:      map[string]struct{}{"/var/cache/nginx": {}},
+				WorkingDir:   "/srv",
+				Labels:       map[string]string{"maintainer": "NGINX"},
+			}},
+		},
+		{
+			name:   "null settings",
+			config: `{"architecture":"amd64","os":"linux","config":{"Env":null,"Entrypoint":null,"Cmd":null,"Labels":null}}`,
+			want:   DockerImageConfig{Architecture: "amd64", Os: "linux"},
+		},
+		{
+			name:   "no settings",
+			config: `{"architecture":"amd64","os":"linux"}`,
+			want:   DockerImageConfig{Architecture: "amd64", Os: "linux"},
+		},
+		{
+			name:    "not json",
+			config:  `config`,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			registry.push("app", "latest", &fakeImage{config: []byte(tt.config)})
+
+			descriptor := Manifest{Digest: digestOf([]byte(tt.config)), Size: len(tt.config)}
+			config, err := Registries[registry.host].fetchConfig(context.Background(), "app", descriptor, nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetching gave error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(*config, tt.want) {
+				t.Errorf("fetched configuration\n%+v\nwant\n%+v", *config, tt.want)
+			}
+		})
+	}
+}
+
+func TestImageConfigEnv(t *testing.T) {
+	t.Setenv("MYDOCKER_TEST_HOST_VALUE", "from host")
+	os.Unsetenv("MYDOCKER_TEST_UNSET")
+	image := &DockerImageConfig{}
+	image.Config.Env = []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "EMPTY="}
+
+	tests := []struct {
+		name      string
+		config    *DockerImageConfig
+		overrides []string
+		want      []string
+	}{
+		{
+			name:   "image environment",
+			config: image,
+			want:   []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "EMPTY="},
+		},
+		{
+			name:   "default path",
+			config: &DockerImageConfig{},
+			want:   []string{defaultPath},
+		},
+		{
+			name:   "no image config",
+			config: nil,
+			want:   []string{defaultPath},
+		},
+		{
+			name:      "overrides replace in place",
+			config:    image,
+			overrides: []string{"LANG=en_GB.UTF-8", "DEBUG=1"},
+			want:      []string{"PATH=/usr/local/bin:/usr/bin", "LANG=en_GB.UTF-8", "EMPTY=", "DEBUG=1"},
+		},
+		{
+			name:      "later overrides win",
+			config:    image,
+			overrides: []string{"DEBUG=1", "DEBUG=2"},
+			want:      []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "EMPTY=", "DEBUG=2"},
+		},
+		{
+			name:      "values may hold =",
+			config:    image,
+			overrides: []string{"OPTS=a=b"},
+			want:      []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "EMPTY=", "OPTS=a=b"},
+		},
+		{
+			name:      "bare key from the host",
+			config:    image,
+			overrides: []string{"MYDOCKER_TEST_HOST_VALUE"},
+			want:      []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "EMPTY=", "MYDOCKER_TEST_HOST_VALUE=from host"},
+		},
+		{
+			name:      "bare key unset on the host",
+			config:    image,
+			overrides: []string{"MYDOCKER_TEST_UNSET", "EMPTY"},
+			want:      []string{"PATH=/usr/local/bin:/usr/bin", "LANG=C.UTF-8", "EMPTY="},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.env(tt.overrides); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("env = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPullImageUnexpectedBody(t *testing.T) {
+	index := string(DockerImageTypeDistributionListManifestV2)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		// wantErr is part of the error expected
+		wantErr string
+	}{
+		{
+			name:        "error document",
+			contentType: index,
+			body:        `{"errors":[{"code":"TOOMANYREQUESTS","message":"rate limited"}]}`,
+			wantErr:     `unexpected body: "{\"errors\":[{\"code\":\"TOOMANYREQUESTS\"`,
+		},
+		{
+			name:        "login page",
+			contentType: index,
+			body:        "<html><body>Sign in</body></html>",
+			wantErr:     `unexpected body: "<html><body>Sign in</body></html>"`,
+		},
+		{
+			name:        "no schema version",
+			contentType: index,
+			body:        `{"manifests":[]}`,
+			wantErr:     "unexpected body",
+		},
+		{
+			name:        "empty",
+			contentType: index,
+			body:        "",
+			wantErr:     `unexpected body: ""`,
+		},
+		{
+			name:        "html content type",
+			contentType: "text/html",
+			body:        "<html>" + strings.Repeat("x", 500) + "</html>",
+			wantErr:     "unsupported Content-Type text/html returned from registry: registry returned an unexpected body: \"<html>" + strings.Repeat("x", 194) + "...\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Write([]byte(tt.body))
+				return true
+			}
+			// A token is given up front, as the registry does not ask for one
+			_, _, err := pullImage(context.Background(), registry.host+"/app:latest", &Auth{Token: "token"}, &PullOptions{})
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("pulling gave %v, want an error containing %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestPreferOCIManifests(t *testing.T) {
+	image := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+	tests := []struct {
+		name      string
+		preferOCI bool
+		wantFirst string
+	}{
+		{name: "docker first", wantFirst: string(DockerImageTypeDistributionListManifestV2)},
+		{name: "oci first", preferOCI: true, wantFirst: OciImageIndexV1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := acceptHeaders
+			t.Cleanup(func() { acceptHeaders = previous })
+			if tt.preferOCI {
+				preferOCIManifests()
+			}
+
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "app", "latest", image)
+			registry.mu.Lock()
+			index := registry.manifests["app:latest"].body
+			registry.mu.Unlock()
+			// The registry serves the index in whichever format the client prefers
+			var accept []string
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.HasSuffix(r.URL.Path, "/manifests/latest") {
+					return false
+				}
+				accept = strings.Split(r.Header.Get("Accept"), ", ")
+				w.Header().Set("Content-Type", accept[0])
+				w.Write(index)
+				return true
+			}
+
+			// A token is given up front, as the registry does not ask for one
+			resolved, err := resolveImage(context.Background(), ref, &Auth{Token: "token"}, nil)
+			if err != nil {
+				t.Fatalf("resolveImage: %v", err)
+			}
+			if resolved.Digest != digestOf(image.manifest) {
+				t.Errorf("resolved %s, want %s", resolved.Digest, digestOf(image.manifest))
+			}
+			if len(accept) == 0 || accept[0] != tt.wantFirst {
+				t.Errorf("index was requested accepting %q, want %s first", accept, tt.wantFirst)
+			}
+		})
+	}
+}
+
+func TestInFlightDownloads(t *testing.T) {
+	failure := errors.New("boom")
+	tests := []struct {
+		name    string
+		digests []string
+		err     error
+		// wantCalls is how many downloads are made for the requests, which are all in flight at once
+		wantCalls int
+	}{
+		{name: "same digest", digests: []string{"sha256:a", "sha256:a", "sha256:a"}, wantCalls: 1},
+		{name: "different digests", digests: []string{"sha256:a", "sha256:b"}, wantCalls: 2},
+		{name: "shared failure", digests: []string{"sha256:a", "sha256:a"}, err: failure, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			downloads := inFlightDownloads{downloads: make(map[string]*inFlightDownload)}
+			var calls atomic.Int32
+			release := make(chan struct{})
+			errs := make(chan error, len(tt.digests))
+			for _, digest := range tt.digests {
+				digest := digest
+				go func() {
+					errs <- downloads.do(digest, func() error {
+						calls.Add(1)
+						<-release
+						return tt.err
+					})
+				}()
+			}
+			// Give every request time to join the download in flight before it completes
+			time.Sleep(50 * time.Millisecond)
+			close(release)
+			for range tt.digests {
+				if err := <-errs; err != tt.err {
+					t.Errorf("do returned %v, want %v", err, tt.err)
+				}
+			}
+			if got := int(calls.Load()); got != tt.wantCalls {
+				t.Errorf("downloaded %d times, want %d", got, tt.wantCalls)
+			}
+			if len(downloads.downloads) != 0 {
+				t.Errorf("finished downloads are still in flight: %v", downloads.downloads)
+			}
+		})
+	}
+}
+
+func TestPullSharedLayerOnce(t *testing.T) {
+	useLayerStore(t)
+	registry := newFakeRegistry(t)
+	shared := buildLayer(t, []tarEntry{tarFile("shared", noise(64<<10))})
+	own := buildLayer(t, []tarEntry{tarFile("own", "own")})
+	first := registry.pushIndex(t, "first", "latest", newFakeImage(t, shared, own))
+	second := registry.pushIndex(t, "second", "latest", newFakeImage(t, shared))
+	// The shared layer is served slowly enough for both pulls to want it at once
+	registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, digestOf(shared)) {
+			time.Sleep(100 * time.Millisecond)
+		}
+		return false
+	}
+
+	errs := make(chan error, 2)
+	for _, ref := range []string{first, second} {
+		ref := ref
+		go func() {
+			// A token is given up front, as the registry does not ask for one
+			_, _, err := pullImage(context.Background(), ref, &Auth{Token: "token"}, nil)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("pulling: %v", err)
+		}
+	}
+	if got := registry.count("/blobs/" + digestOf(shared)); got != 1 {
+		t.Errorf("shared layer was downloaded %d times, want 1", got)
+	}
+}
+
+func TestFetchIndexAuthentication(t *testing.T) {
+	tests := []struct {
+		name string
+		// auth is the token the image is resolved with to begin with
+		auth *Auth
+		// status is how the registry answers requests without a valid token, and challenge is
+		// set when it says how to get one
+		status    int
+		challenge bool
+		// tokenStatus is how the token service answers
+		tokenStatus int
+		wantErr     string
+		wantTokens  int
+	}{
+		{name: "anonymous", status: http.StatusOK},
+		{name: "token required", status: http.StatusUnauthorized, challenge: true, tokenStatus: http.StatusOK, wantTokens: 1},
+		{name: "forbidden", status: http.StatusForbidden, challenge: true, tokenStatus: http.StatusOK, wantTokens: 1},
+		{name: "expired token", auth: &Auth{Token: "expired"}, status: http.StatusUnauthorized, challenge: true, tokenStatus: http.StatusOK, wantTokens: 1},
+		{name: "valid token", auth: &Auth{Token: "granted"}, status: http.StatusUnauthorized, challenge: true},
+		{
+			name:    "not found",
+			status:  http.StatusNotFound,
+			wantErr: "image not found",
+		},
+		{
+			name:    "refused without challenge",
+			status:  http.StatusUnauthorized,
+			wantErr: "401 Unauthorized",
+		},
+		{
+			name:        "token service error",
+			status:      http.StatusUnauthorized,
+			challenge:   true,
+			tokenStatus: http.StatusInternalServerError,
+			wantErr:     "could not authenticate with registry: token service 127.0.0.1",
+			// A server error from the token service is retried like one from the registry
+			wantTokens: maxRetries,
+		},
+		{
+			name:        "token refused",
+			status:      http.StatusUnauthorized,
+			challenge:   true,
+			tokenStatus: http.StatusUnauthorized,
+			wantErr:     "responded with 401 Unauthorized",
+			wantTokens:  1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "app", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if r.URL.Path == "/token" {
+					w.WriteHeader(tt.tokenStatus)
+					w.Write([]byte(`{"token":"granted"}`))
+					return true
+				}
+				if tt.status == http.StatusOK || r.Header.Get("Authorization") == "Bearer granted" {
+					return false
+				}
+				if tt.challenge {
+					w.Header().Set("Www-Authenticate", `Bearer realm="`+registry.server.URL+`/token",service="fake"`)
+				}
+				w.WriteHeader(tt.status)
+				return true
+			}
+
+			_, err := resolveImage(context.Background(), ref, tt.auth, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("resolveImage returned %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("resolveImage: %v", err)
+			}
+			if got := registry.count("/token"); got != tt.wantTokens {
+				t.Errorf("requested %d tokens, want %d", got, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestCheckResponse(t *testing.T) {
+	errorDocument := `{"errors":[{"code":"MANIFEST_UNKNOWN","message":"manifest unknown"},{"code":"NAME_UNKNOWN","message":"repository name not known"}]}`
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		notFound error
+		// wantErr is the message of the error, empty when the response is successful
+		wantErr       string
+		wantKind      error
+		wantTemporary bool
+	}{
+		{name: "200", status: http.StatusOK},
+		{name: "204", status: http.StatusNoContent},
+		{name: "206", status: http.StatusPartialContent},
+		{
+			name:     "404 with error document",
+			status:   http.StatusNotFound,
+			body:     errorDocument,
+			notFound: ErrImageNotFound,
+			wantErr:  "image not found: registry responded with 404 Not Found: MANIFEST_UNKNOWN: manifest unknown; NAME_UNKNOWN: repository name not known",
+			wantKind: ErrImageNotFound,
+		},
+		{
+			name:    "404 of a blob",
+			status:  http.StatusNotFound,
+			wantErr: "registry responded with 404 Not Found",
+		},
+		{
+			name:     "401",
+			status:   http.StatusUnauthorized,
+			body:     `{"errors":[{"code":"UNAUTHORIZED","message":"authentication required"}]}`,
+			wantErr:  "not authorized to access image: registry responded with 401 Unauthorized: UNAUTHORIZED: authentication required",
+			wantKind: ErrUnauthorized,
+		},
+		{
+			name:     "403",
+			status:   http.StatusForbidden,
+			body:     "<html>denied</html>",
+			wantErr:  `not authorized to access image: registry responded with 403 Forbidden: "<html>denied</html>"`,
+			wantKind: ErrUnauthorized,
+		},
+		{name: "400", status: http.StatusBadRequest, wantErr: "registry responded with 400 Bad Request"},
+		{name: "429", status: http.StatusTooManyRequests, wantErr: "registry responded with 429 Too Many Requests", wantTemporary: true},
+		{name: "500", status: http.StatusInternalServerError, body: "oops", wantErr: `registry responded with 500 Internal Server Error: "oops"`, wantTemporary: true},
+		{name: "502", status: http.StatusBadGateway, wantErr: "registry responded with 502 Bad Gateway", wantTemporary: true},
+		{name: "503", status: http.StatusServiceUnavailable, wantErr: "registry responded with 503 Service Unavailable", wantTemporary: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{
+				StatusCode: tt.status,
+				Status:     strconv.Itoa(tt.status) + " " + http.StatusText(tt.status),
+				Body:       io.NopCloser(strings.NewReader(tt.body)),
+			}
+			err := checkResponse(resp, tt.notFound)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("checkResponse: %v", err)
+				}
+				return
+			}
+			var registryErr *RegistryError
+			if !errors.As(err, &registryErr) {
+				t.Fatalf("checkResponse returned %v, want a RegistryError", err)
+			}
+			if err.Error() != tt.wantErr {
+				t.Errorf("checkResponse returned %q, want %q", err, tt.wantErr)
+			}
+			if tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+				t.Errorf("checkResponse returned %v, want it to be %v", err, tt.wantKind)
+			}
+			for _, kind := range []error{ErrImageNotFound, ErrUnauthorized} {
+				if kind != tt.wantKind && errors.Is(err, kind) {
+					t.Errorf("checkResponse returned %v, which is %v", err, kind)
+				}
+			}
+			if registryErr.temporary() != tt.wantTemporary {
+				t.Errorf("temporary() = %t, want %t", registryErr.temporary(), tt.wantTemporary)
+			}
+		})
+	}
+}
+
+func TestResolveImageStatus(t *testing.T) {
+	tests := []struct {
+		status   int
+		wantKind error
+		// wantRequests is how many times the manifest is requested, as errors which may pass
+		// are retried
+		wantRequests int
+	}{
+		{status: http.StatusNotFound, wantKind: ErrImageNotFound, wantRequests: 1},
+		{status: http.StatusForbidden, wantKind: ErrUnauthorized, wantRequests: 1},
+		{status: http.StatusUnauthorized, wantKind: ErrUnauthorized, wantRequests: 1},
+		{status: http.StatusBadRequest, wantRequests: 1},
+		{status: http.StatusTooManyRequests, wantRequests: maxRetries},
+		{status: http.StatusInternalServerError, wantRequests: maxRetries},
+		{status: http.StatusServiceUnavailable, wantRequests: maxRetries},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.status), func(t *testing.T) {
+			withoutBackoff(t)
+			registry := newFakeRegistry(t)
+			ref := registry.push("app", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.Contains(r.URL.Path, "/manifests/") {
+					return false
+				}
+				w.WriteHeader(tt.status)
+				return true
+			}
+
+			_, err := resolveImage(context.Background(), ref, nil, nil)
+			var registryErr *RegistryError
+			if !errors.As(err, &registryErr) || registryErr.StatusCode != tt.status {
+				t.Fatalf("resolveImage returned %v, want a %d response", err, tt.status)
+			}
+			if tt.wantKind != nil && !errors.Is(err, tt.wantKind) {
+				t.Errorf("resolveImage returned %v, want it to be %v", err, tt.wantKind)
+			}
+			if got := registry.count("/manifests/"); got != tt.wantRequests {
+				t.Errorf("requested the manifest %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestResolveImageRetriesIndex(t *testing.T) {
+	withoutBackoff(t)
+	layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	image := newFakeImage(t, layer)
+
+	tests := []struct {
+		name string
+		// fail answers the first requests for the index
+		fail         func(w http.ResponseWriter, index []byte)
+		failTimes    int
+		wantErr      bool
+		wantRequests int
+	}{
+		{
+			name:         "no failures",
+			fail:         nil,
+			wantRequests: 1,
+		},
+		{
+			name:         "transient server error",
+			fail:         func(w http.ResponseWriter, index []byte) { w.WriteHeader(http.StatusBadGateway) },
+			failTimes:    2,
+			wantRequests: 3,
+		},
+		{
+			name:         "too many requests",
+			fail:         func(w http.ResponseWriter, index []byte) { w.WriteHeader(http.StatusTooManyRequests) },
+			failTimes:    1,
+			wantRequests: 2,
+		},
+		{
+			name: "truncated index",
+			fail: func(w http.ResponseWriter, index []byte) {
+				w.Header().Set("Content-Type", string(DockerImageTypeDistributionListManifestV2))
+				w.Header().Set("Content-Length", strconv.Itoa(len(index)))
+				w.Write(index[:len(index)/2])
+			},
+			failTimes:    1,
+			wantRequests: 2,
+		},
+		{
+			name:         "persistent server error",
+			fail:         func(w http.ResponseWriter, index []byte) { w.WriteHeader(http.StatusServiceUnavailable) },
+			failTimes:    maxRetries,
+			wantErr:      true,
+			wantRequests: maxRetries,
+		},
+		{
+			name:         "refused without a challenge",
+			fail:         func(w http.ResponseWriter, index []byte) { w.WriteHeader(http.StatusForbidden) },
+			failTimes:    maxRetries,
+			wantErr:      true,
+			wantRequests: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "app", "latest", image)
+			registry.mu.Lock()
+			index := registry.manifests["app:latest"].body
+			registry.mu.Unlock()
+			var failed atomic.Int32
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if tt.fail == nil || !strings.HasSuffix(r.URL.Path, "/manifests/latest") || int(failed.Add(1)) > tt.failTimes {
+					return false
+				}
+				tt.fail(w, index)
+				return true
+			}
+
+			_, err := resolveImage(context.Background(), ref, nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolving gave error %v, want error %t", err, tt.wantErr)
+			}
+			if got := registry.count("/manifests/latest"); got != tt.wantRequests {
+				t.Errorf("index was requested %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestResolveImageReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		// truncate picks the requests whose response bodies are cut short
+		truncate func(r *http.Request, image *fakeImage) bool
+		wantErr  string
+	}{
+		{
+			name: "index",
+			truncate: func(r *http.Request, image *fakeImage) bool {
+				return strings.HasSuffix(r.URL.Path, "/manifests/latest")
+			},
+			wantErr: "could not read image index",
+		},
+		{
+			name: "manifest",
+			truncate: func(r *http.Request, image *fakeImage) bool {
+				return strings.HasSuffix(r.URL.Path, "/manifests/"+digestOf(image.manifest))
+			},
+			wantErr: "could not read image manifest",
+		},
+		{
+			name: "configuration",
+			truncate: func(r *http.Request, image *fakeImage) bool {
+				return strings.HasSuffix(r.URL.Path, "/blobs/"+digestOf(image.config))
+			},
+			wantErr: "could not read image configuration",
+		},
+		{
+			name:     "token",
+			truncate: func(r *http.Request, image *fakeImage) bool { return r.URL.Path == "/token" },
+			wantErr:  "could not read token from 127.0.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImageFor(t, Platform{Os: "linux", Architecture: runtime.GOARCH}, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+			ref := registry.pushIndex(t, "app", "latest", image)
+			registry.requireToken("granted", func(r *http.Request) (int, string) { return http.StatusOK, `{"token":"granted"}` })
+			authenticate := registry.handle
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !tt.truncate(r, image) {
+					return authenticate(w, r)
+				}
+				// The body ends before the length promised, as when the connection drops
+				w.Header().Set("Content-Length", "1024")
+				w.Write([]byte(`{"schemaVersion":`))
+				return true
+			}
+
+			_, err := resolveImage(context.Background(), ref, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("resolveImage returned %v, want %q", err, tt.wantErr)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("resolveImage returned %v, want it to be %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
+
+func TestPullCancelled(t *testing.T) {
+	tests := []struct {
+		name string
+		// cancelled is set when the context is cancelled once the layer is requested, and
+		// timeout bounds the pull otherwise
+		cancelled bool
+		timeout   time.Duration
+		wantErr   string
+		wantCause error
+	}{
+		{name: "cancelled", cancelled: true, wantErr: "pull cancelled", wantCause: context.Canceled},
+		{name: "timed out", timeout: 100 * time.Millisecond, wantErr: "pull did not complete within 100ms", wantCause: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			previous := pullTimeout
+			pullTimeout = tt.timeout
+			t.Cleanup(func() { pullTimeout = previous })
+
+			registry := newFakeRegistry(t)
+			layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+			ref := registry.pushIndex(t, "app", "latest", newFakeImage(t, layer))
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			// The layer never arrives, so the pull waits until it is abandoned
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.HasSuffix(r.URL.Path, digestOf(layer)) {
+					return false
+				}
+				if tt.cancelled {
+					cancel()
+				}
+				<-r.Context().Done()
+				return true
+			}
+
+			start := time.Now()
+			_, _, err := pullImage(ctx, ref, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("pullImage returned %v, want %q", err, tt.wantErr)
+			}
+			if !errors.Is(err, tt.wantCause) {
+				t.Errorf("pullImage returned %v, want it to be %v", err, tt.wantCause)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("pull took %s to be abandoned", elapsed)
+			}
+		})
+	}
+}
+
+func TestWithRetriesStopsWhenDone(t *testing.T) {
+	failure := errors.New("failed")
+	tests := []struct {
+		name string
+		// cancelAfter is the attempt after which the context is cancelled, or 0 to leave it
+		cancelAfter  int
+		wantAttempts int
+	}{
+		{name: "not cancelled", wantAttempts: maxRetries},
+		{name: "cancelled during first attempt", cancelAfter: 1, wantAttempts: 1},
+		{name: "cancelled during second attempt", cancelAfter: 2, wantAttempts: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			attempts := 0
+			err := withRetries(ctx, func() error {
+				attempts++
+				if attempts == tt.cancelAfter {
+					cancel()
+				}
+				return failure
+			})
+			if err != failure {
+				t.Errorf("withRetries returned %v, want %v", err, failure)
+			}
+			if attempts != tt.wantAttempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	body := []byte(`{"schemaVersion":2}`)
+	sha256Digest := fmt.Sprintf("sha256:%x", sha256.Sum256(body))
+	sha512Digest := fmt.Sprintf("sha512:%x", sha512.Sum512(body))
+	other := fmt.Sprintf("sha256:%x", sha256.Sum256([]byte("other")))
+
+	tests := []struct {
+		name     string
+		digest   string
+		wantErr  string
+		mismatch bool
+	}{
+		{name: "sha256", digest: sha256Digest},
+		{name: "sha512", digest: sha512Digest},
+		{name: "mismatch", digest: other, wantErr: "digest mismatch: expected " + other + " but content hashes to " + sha256Digest, mismatch: true},
+		{name: "sha512 mismatch", digest: "sha512:" + strings.Repeat("0", 128), wantErr: "but content hashes to " + sha512Digest, mismatch: true},
+		{name: "unsupported", digest: "md5:" + strings.Repeat("0", 32), wantErr: `unsupported digest algorithm "md5"`},
+		{name: "malformed", digest: "0123", wantErr: `malformed digest "0123"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyDigest(body, tt.digest)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verifyDigest: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("verifyDigest returned %v, want %q", err, tt.wantErr)
+			}
+			if got := errors.Is(err, ErrDigestMismatch); got != tt.mismatch {
+				t.Errorf("verifyDigest returned %v, a mismatch: %t, want %t", err, got, tt.mismatch)
+			}
+		})
+	}
+}
+
+func TestResolveImageDigestMismatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// substitute is the path whose content the registry replaces
+		substitute func(image *fakeImage) string
+		wantErr    string
+	}{
+		{
+			name:       "manifest",
+			substitute: func(image *fakeImage) string { return "/manifests/" + digestOf(image.manifest) },
+			wantErr:    "image manifest: digest mismatch",
+		},
+		{
+			name:       "configuration",
+			substitute: func(image *fakeImage) string { return "/blobs/" + digestOf(image.config) },
+			wantErr:    "image configuration: digest mismatch",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImageFor(t, Platform{Os: "linux", Architecture: runtime.GOARCH}, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+			ref := registry.pushIndex(t, "app", "latest", image)
+			substituted := tt.substitute(image)
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.HasSuffix(r.URL.Path, substituted) {
+					return false
+				}
+				// Valid content of the right kind, but not what was asked for
+				w.Header().Set("Content-Type", string(DockerImageTypeDistributionManifestV2))
+				w.Write(newFakeImage(t, buildLayer(t, []tarEntry{tarFile("b", "b")})).manifest)
+				return true
+			}
+
+			_, err := resolveImage(context.Background(), ref, nil, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("resolveImage returned %v, want %q", err, tt.wantErr)
+			}
+			if !errors.Is(err, ErrDigestMismatch) {
+				t.Errorf("resolveImage returned %v, want it to be %v", err, ErrDigestMismatch)
+			}
+			// The registry will most likely serve the same content again, so it is not retried
+			if got := registry.count(substituted); got != 1 {
+				t.Errorf("requested %s %d times, want once", substituted, got)
+			}
+		})
+	}
+}
+
+func TestResolveManifestTypes(t *testing.T) {
+	layers := [][]byte{
+		buildLayer(t, []tarEntry{tarFile("a", "a")}),
+		buildTar(t, []tarEntry{tarFile("b", "b")}),
+	}
+	image := newFakeImageWith(t, OCIImageConfig{Cmd: []string{"/bin/app"}}, layers...)
+	layerTypes := []string{string(OCIImageTypeLayerGzip), string(OCIImageTypeLayer)}
+
+	// ociManifest describes image as an OCI manifest, its layers given as OCI layer types
+	ociManifest, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     string(OCIImageTypeManifestV1),
+		"config": map[string]interface{}{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"size":      len(image.config),
+			"digest":    digestOf(image.config),
+		},
+		"layers": []map[string]interface{}{
+			{"mediaType": layerTypes[0], "size": len(layers[0]), "digest": digestOf(layers[0])},
+			{"mediaType": layerTypes[1], "size": len(layers[1]), "digest": digestOf(layers[1])},
+		},
+		"annotations": map[string]string{"org.opencontainers.image.source": "https://example.com/app"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tags must name an index, so each manifest is given as the only one in an index
+	dockerIndex, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     string(DockerImageTypeDistributionListManifestV2),
+		"manifests": []map[string]interface{}{{
+			"mediaType": string(DockerImageTypeDistributionManifestV2),
+			"size":      len(image.manifest),
+			"digest":    digestOf(image.manifest),
+			"platform":  Platform{Os: "linux", Architecture: runtime.GOARCH},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ociIndex, err := json.Marshal(map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     OciImageIndexV1,
+		"manifests": []map[string]interface{}{{
+			"mediaType": string(OCIImageTypeManifestV1),
+			"size":      len(ociManifest),
+			"digest":    digestOf(ociManifest),
+			"platform":  Platform{Os: "linux", Architecture: runtime.GOARCH},
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// tagged is what the tag points at, with the manifests fetched by digest in byDigest
+		tagged     fakeManifest
+		byDigest   []fakeManifest
+		wantDigest string
+		wantTypes  []string
+	}{
+		{
+			name:       "docker manifest",
+			tagged:     fakeManifest{mediaType: string(DockerImageTypeDistributionListManifestV2), body: dockerIndex},
+			wantDigest: digestOf(image.manifest),
+			wantTypes:  []string{string(DockerImageTypeRootFs), string(DockerImageTypeRootFs)},
+		},
+		{
+			name:       "OCI manifest",
+			tagged:     fakeManifest{mediaType: OciImageIndexV1, body: ociIndex},
+			byDigest:   []fakeManifest{{mediaType: string(OCIImageTypeManifestV1), body: ociManifest}},
+			wantDigest: digestOf(ociManifest),
+			wantTypes:  layerTypes,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			registry.push("app", "docker", image)
+			registry.mu.Lock()
+			registry.manifests["app:latest"] = tt.tagged
+			for _, manifest := range tt.byDigest {
+				registry.manifests["app@"+digestOf(manifest.body)] = manifest
+			}
+			registry.mu.Unlock()
+
+			resolved, err := resolveImage(context.Background(), registry.host+"/app:latest", nil, nil)
+			if err != nil {
+				t.Fatalf("resolveImage: %v", err)
+			}
+			if resolved.Digest != tt.wantDigest {
+				t.Errorf("resolved %s, want %s", resolved.Digest, tt.wantDigest)
+			}
+			var types []string
+			for i, layer := range resolved.Layers {
+				types = append(types, layer.MediaType)
+				if layer.Digest != digestOf(layers[i]) {
+					t.Errorf("layer %d is %s, want %s", i, layer.Digest, digestOf(layers[i]))
+				}
+			}
+			if !reflect.DeepEqual(types, tt.wantTypes) {
+				t.Errorf("layers have media types %q, want %q", types, tt.wantTypes)
+			}
+			if !reflect.DeepEqual(resolved.Config.Config.Cmd, []string{"/bin/app"}) {
+				t.Errorf("configuration has command %q, want /bin/app", resolved.Config.Config.Cmd)
+			}
+		})
+	}
+}
+
+func TestRequestTimeouts(t *testing.T) {
+	layer := buildLayer(t, []tarEntry{tarFile("a", noise(64*1024))})
+	image := newFakeImage(t, layer)
+
+	// stall sends the response headers and the start of the body, then nothing more
+	stall := func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.Write([]byte("{"))
+		w.(http.Flusher).Flush()
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+
+	tests := []struct {
+		name string
+		// path is the request the registry answers with serve
+		path    string
+		serve   func(w http.ResponseWriter, r *http.Request)
+		wantErr string
+	}{
+		{name: "manifest body", path: "/manifests/latest", serve: stall, wantErr: "could not read image index: context deadline exceeded"},
+		{name: "configuration body", path: "/blobs/" + digestOf(image.config), serve: stall, wantErr: "could not read image configuration: context deadline exceeded"},
+		{name: "token body", path: "/token", serve: stall, wantErr: "could not read token from 127.0.0.1"},
+		{
+			name: "layer headers",
+			path: "/blobs/" + digestOf(layer),
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			},
+			wantErr: "timeout awaiting response headers",
+		},
+		{
+			// A layer taking longer than the request timeout to arrive is fine while it keeps coming
+			name: "slow layer body",
+			path: "/blobs/" + digestOf(layer),
+			serve: func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+				for i := 0; i < len(layer); i += len(layer)/6 + 1 {
+					end := i + len(layer)/6 + 1
+					if end > len(layer) {
+						end = len(layer)
+					}
+					w.Write(layer[i:end])
+					w.(http.Flusher).Flush()
+					time.Sleep(50 * time.Millisecond)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			useLayerStore(t)
+			previousTimeout, previousClient := requestTimeout, defaultHTTPClient
+			requestTimeout = 100 * time.Millisecond
+			defaultHTTPClient = createHTTPClient()
+			t.Cleanup(func() { requestTimeout, defaultHTTPClient = previousTimeout, previousClient })
+
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "app", "latest", image)
+			registry.requireToken("granted", func(r *http.Request) (int, string) { return http.StatusOK, `{"token":"granted"}` })
+			authenticate := registry.handle
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if strings.HasSuffix(r.URL.Path, tt.path) {
+					tt.serve(w, r)
+					return true
+				}
+				return authenticate(w, r)
+			}
+
+			start := time.Now()
+			_, _, err := pullImage(context.Background(), ref, nil, nil)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("pullImage: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("pullImage returned %v, want %q", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 4*time.Second {
+				t.Errorf("pull took %s to fail", elapsed)
+			}
+		})
+	}
+}
+
+func TestResolveSingleManifest(t *testing.T) {
+	other := "arm64"
+	if runtime.GOARCH == other {
+		other = "amd64"
+	}
+	layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+
+	tests := []struct {
+		name string
+		// push serves the image the tag names
+		push    func(registry *fakeRegistry) string
+		wantErr string
+	}{
+		{
+			name: "host platform",
+			push: func(registry *fakeRegistry) string {
+				return registry.push("app", "latest", newFakeImage(t, layer))
+			},
+		},
+		{
+			name: "other architecture",
+			push: func(registry *fakeRegistry) string {
+				return registry.push("app", "latest", newFakeImageFor(t, Platform{Os: "linux", Architecture: other}, layer))
+			},
+			wantErr: "image is only available for linux/" + other,
+		},
+		{
+			name: "index",
+			push: func(registry *fakeRegistry) string {
+				return registry.pushIndex(t, "app", "latest", newFakeImage(t, layer), newFakeImageFor(t, Platform{Os: "linux", Architecture: other}, layer))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			registry := newFakeRegistry(t)
+			ref := tt.push(registry)
+			var accepted []string
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if strings.Contains(r.URL.Path, "/manifests/") {
+					accepted = append(accepted, r.Header.Get("Accept"))
+				}
+				return false
+			}
+
+			_, err := resolveImage(context.Background(), ref, nil, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("resolveImage: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("resolveImage returned %v, want %q", err, tt.wantErr)
+			}
+			// Every manifest type is accepted, indices first, so that registries holding no index
+			// for an image return its manifest instead of refusing the request
+			want := []string{
+				string(DockerImageTypeDistributionListManifestV2),
+				OciImageIndexV1,
+				string(DockerImageTypeDistributionManifestV2),
+				string(OCIImageTypeManifestV1),
+			}
+			for _, header := range accepted {
+				if got := strings.Split(header, ", "); !reflect.DeepEqual(got, want) {
+					t.Errorf("requested manifest accepting %q, want %q", got, want)
+				}
+			}
+			if len(accepted) == 0 {
+				t.Error("no manifest was requested")
+			}
+		})
+	}
+}
+
+func TestLookupRegistry(t *testing.T) {
+	tests := []struct {
+		name     string
+		want     *ContainerRegistryDetails
+		wantFQDN string
+	}{
+		{name: DefaultRegistry, want: Registries[DefaultRegistry], wantFQDN: "registry-1.docker.io"},
+		{name: "localhost:5000", wantFQDN: "localhost:5000"},
+		{name: "registry.example.com", wantFQDN: "registry.example.com"},
+		{name: "10.0.0.1:443", wantFQDN: "10.0.0.1:443"},
+	}
+
+	for _, tt := range tests {
+		registry := lookupRegistry(tt.name)
+		if tt.want != nil && registry != tt.want {
+			t.Errorf("%s: looked up %+v, want %+v", tt.name, registry, tt.want)
+		}
+		if registry.FQDN != tt.wantFQDN || registry.Scheme != "https" {
+			t.Errorf("%s: looked up %s://%s, want https://%s", tt.name, registry.Scheme, registry.FQDN, tt.wantFQDN)
+		}
+		if got := registry.generateBlobRequest("library/alpine", "sha256:0"); got != "https://"+tt.wantFQDN+"/v2/library/alpine/blobs/sha256:0" {
+			t.Errorf("%s: blob request is %s", tt.name, got)
+		}
+	}
+}
+
+func TestResolveImageFromRegistryHost(t *testing.T) {
+	registry := newFakeTLSRegistry(t, nil)
+	trustRegistry(t, registry)
+	image := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+	registry.push("app", "latest", image)
+	registry.push("team/app", "1.0", image)
+
+	tests := []struct {
+		name string
+		ref  string
+	}{
+		{name: "tag", ref: registry.host + "/app:latest"},
+		{name: "default tag", ref: registry.host + "/app"},
+		{name: "nested repository", ref: registry.host + "/team/app:1.0"},
+		{name: "digest", ref: registry.host + "/app@" + digestOf(image.manifest)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := resolveImage(context.Background(), tt.ref, nil, nil)
+			if err != nil {
+				t.Fatalf("resolving %s gave %v", tt.ref, err)
+			}
+			if resolved.Digest != digestOf(image.manifest) {
+				t.Errorf("resolved %s, want %s", resolved.Digest, digestOf(image.manifest))
+			}
+		})
+	}
+}
+
+func TestResumeLayerDownload(t *testing.T) {
+	withoutBackoff(t)
+	layer := buildLayer(t, []tarEntry{tarFile("big", noise(256<<10))})
+	half := len(layer) / 2
+	sum := strings.TrimPrefix(digestOf(layer), "sha256:")
+
+	tests := []struct {
+		name string
+		// partial is left in the layer store by an earlier pull before this one
+		partial []byte
+		// disconnect cuts the first download short half way through
+		disconnect bool
+		// ignoreRanges serves whole blobs whatever range is asked for, and refuseRanges answers
+		// requests for ranges with 416 Range Not Satisfiable
+		ignoreRanges bool
+		refuseRanges bool
+		// wantRanges are the Range headers of each download of the layer
+		wantRanges []string
+	}{
+		{name: "disconnect", disconnect: true, wantRanges: []string{"", fmt.Sprintf("bytes=%d-", half)}},
+		{name: "disconnect without ranges", disconnect: true, ignoreRanges: true, wantRanges: []string{"", fmt.Sprintf("bytes=%d-", half)}},
+		{name: "earlier pull", partial: layer[:half], wantRanges: []string{fmt.Sprintf("bytes=%d-", half)}},
+		{name: "range not satisfiable", partial: layer[:half], refuseRanges: true, wantRanges: []string{fmt.Sprintf("bytes=%d-", half), ""}},
+		{name: "corrupt partial download", partial: make([]byte, half), wantRanges: []string{fmt.Sprintf("bytes=%d-", half), ""}},
+		{name: "partial download as large as the layer", partial: make([]byte, len(layer)), wantRanges: []string{""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			ref := registry.push("app", "latest", newFakeImage(t, layer))
+			if tt.partial != nil {
+				if err := os.WriteFile(filepath.Join(ImageLayersPath, sum+".tar.gz.part"), tt.partial, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var (
+				mu     sync.Mutex
+				ranges []string
+			)
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !strings.HasSuffix(r.URL.Path, digestOf(layer)) {
+					return false
+				}
+				mu.Lock()
+				ranges = append(ranges, r.Header.Get("Range"))
+				first := len(ranges) == 1
+				mu.Unlock()
+				switch {
+				case tt.disconnect && first:
+					w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+					w.Write(layer[:half])
+					w.(http.Flusher).Flush()
+					panic(http.ErrAbortHandler)
+				case tt.refuseRanges && r.Header.Get("Range") != "":
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return true
+				case tt.ignoreRanges:
+					r.Header.Del("Range")
+				}
+				return false
+			}
+
+			if _, _, err := pullImage(context.Background(), ref, nil, &PullOptions{}); err != nil {
+				t.Fatalf("pull gave %v", err)
+			}
+			if !reflect.DeepEqual(ranges, tt.wantRanges) {
+				t.Errorf("layer was downloaded with ranges %q, want %q", ranges, tt.wantRanges)
+			}
+			stored, err := os.ReadFile(filepath.Join(ImageLayersPath, sum+".tar.gz"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if digestOf(stored) != digestOf(layer) {
+				t.Errorf("stored layer is %s, want %s", digestOf(stored), digestOf(layer))
+			}
+			if _, err := os.Stat(filepath.Join(ImageLayersPath, sum+".tar.gz.part")); !os.IsNotExist(err) {
+				t.Errorf("partial download was left behind: %v", err)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentDownloads(t *testing.T) {
+	var layers [][]byte
+	digests := make(map[string]bool)
+	for i := 0; i < 6; i++ {
+		layers = append(layers, buildLayer(t, []tarEntry{tarFile("file", noise(1024+i))}))
+		digests[digestOf(layers[i])] = true
+	}
+
+	tests := []struct {
+		name string
+		max  int
+		// wantPeak is the most layer downloads the registry should see in flight at once
+		wantPeak int
+	}{
+		{name: "default", wantPeak: defaultMaxConcurrentDownloads},
+		{name: "one", max: 1, wantPeak: 1},
+		{name: "two", max: 2, wantPeak: 2},
+		{name: "more than the layers", max: 10, wantPeak: len(layers)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			ref := registry.push("app", "latest", newFakeImage(t, layers...))
+			var inFlight, peak atomic.Int32
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				if !digests[path.Base(r.URL.Path)] {
+					return false
+				}
+				n := inFlight.Add(1)
+				defer inFlight.Add(-1)
+				for {
+					current := peak.Load()
+					if n <= current || peak.CompareAndSwap(current, n) {
+						break
+					}
+				}
+				// Each download is held open long enough for the others allowed to start
+				time.Sleep(50 * time.Millisecond)
+				return false
+			}
+
+			_, _, err := pullImage(context.Background(), ref, nil, &PullOptions{MaxConcurrentDownloads: tt.max})
+			if err != nil {
+				t.Fatalf("pull gave %v", err)
+			}
+			if got := int(peak.Load()); got != tt.wantPeak {
+				t.Errorf("%d layers were downloaded at once, want %d", got, tt.wantPeak)
+			}
+		})
+	}
+}
+
+func TestForeignLayers(t *testing.T) {
+	withoutBackoff(t)
+	base := buildLayer(t, []tarEntry{tarFile("base", "base")})
+	foreign := buildLayer(t, []tarEntry{tarFile("foreign", "foreign")})
+	var (
+		mu         sync.Mutex
+		downloads  int
+		authorized bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/layer" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		downloads++
+		authorized = authorized || r.Header.Get("Authorization") != ""
+		mu.Unlock()
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(foreign))
+	}))
+	t.Cleanup(server.Close)
+
+	tests := []struct {
+		name      string
+		mediaType RegistrySchema
+		urls      []string
+		stream    bool
+		// wantDownloads is how many times the layer is downloaded from its URLs
+		wantDownloads int
+		wantErr       string
+	}{
+		{name: "url", mediaType: DockerImageTypeRootFsForeign, urls: []string{server.URL + "/layer"}, wantDownloads: 1},
+		{name: "streamed", mediaType: DockerImageTypeRootFsForeign, urls: []string{server.URL + "/layer"}, stream: true, wantDownloads: 1},
+		{name: "oci", mediaType: OCIImageTypeLayerNondistributableGzip, urls: []string{server.URL + "/layer"}, wantDownloads: 1},
+		{name: "next url", mediaType: DockerImageTypeRootFsForeign, urls: []string{server.URL + "/missing", server.URL + "/layer"}, wantDownloads: 1},
+		{name: "unsupported scheme", mediaType: DockerImageTypeRootFsForeign, urls: []string{"ftp://example.com/layer", server.URL + "/layer"}, wantDownloads: 1},
+		{name: "no url serves it", mediaType: DockerImageTypeRootFsForeign, urls: []string{server.URL + "/missing"}, wantErr: "from any of its URLs"},
+		{name: "no urls", mediaType: DockerImageTypeRootFsForeign, wantErr: ErrUnsupportedPlatform.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			mu.Lock()
+			downloads, authorized = 0, false
+			mu.Unlock()
+			image := newFakeImage(t, base, foreign)
+			var manifest map[string]interface{}
+			if err := json.Unmarshal(image.manifest, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			layer := manifest["layers"].([]interface{})[1].(map[string]interface{})
+			layer["mediaType"] = string(tt.mediaType)
+			if tt.urls != nil {
+				layer["urls"] = tt.urls
+			}
+			data, err := json.Marshal(manifest)
+			if err != nil {
+				t.Fatal(err)
+			}
+			image.manifest = data
+			registry := newFakeRegistry(t)
+			registry.requireToken("granted", func(r *http.Request) (int, string) { return http.StatusOK, `{"token":"granted"}` })
+			ref := registry.push("app", "latest", image)
+			// The registry does not distribute the foreign layer
+			delete(registry.blobs, digestOf(foreign))
+
+			root := t.TempDir()
+			_, _, err = pullImage(context.Background(), ref, nil, &PullOptions{ExtractStreaming: tt.stream, ExtractTo: root})
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("pull gave %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("pull gave %v", err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if downloads != tt.wantDownloads {
+				t.Errorf("foreign layer was downloaded %d times, want %d", downloads, tt.wantDownloads)
+			}
+			if authorized {
+				t.Error("the registry's token was sent with the foreign layer's download")
+			}
+			if tt.stream {
+				if data, err := os.ReadFile(filepath.Join(root, "foreign")); err != nil || string(data) != "foreign" {
+					t.Errorf("foreign layer was extracted as %q, %v", data, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// ImageIndexPath records the images held locally, so that they can be run without a registry
+var ImageIndexPath = "/tmp/containers/images.json"
+
+// StoredImage is an entry of the local image index, naming an image whose layers are all in
+// the layer store
+type StoredImage struct {
+	Reference string            `json:"reference"`
+	Digest    string            `json:"digest"`
+	Layers    []Manifest        `json:"layers"`
+	Config    DockerImageConfig `json:"config"`
+}
+
+// readImageIndex reads the local image index. There is no index until an image is stored.
+func readImageIndex() ([]StoredImage, error) {
+	data, err := os.ReadFile(ImageIndexPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var images []StoredImage
+	if err := json.Unmarshal(data, &images); err != nil {
+		return nil, fmt.Errorf("could not parse image index %s: %w", ImageIndexPath, err)
+	}
+	return images, nil
+}
+
+// writeImageIndex replaces the local image index. It is written aside and renamed into place
+// so that an interrupted write does not lose every image.
+func writeImageIndex(images []StoredImage) error {
+	if err := os.MkdirAll(filepath.Dir(ImageIndexPath), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(images, "", "    ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(ImageIndexPath), "images.*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), ImageIndexPath)
+}
+
+// storeImage records image in the local index under reference, replacing any image that
+// reference named before
+func storeImage(reference string, image *ResolvedImage) error {
+	images, err := readImageIndex()
+	if err != nil {
+		return err
+	}
+	stored := StoredImage{
+		Reference: canonicalReference(reference),
+		Digest:    image.Digest,
+		Config:    *image.Config,
+	}
+	for _, layer := range image.Layers {
+		stored.Layers = append(stored.Layers, layer.Manifest)
+	}
+
+	for i := range images {
+		if images[i].Reference == stored.Reference {
+			// The image the reference pointed to before is no longer listed, so its layers are
+			// deleted as removeImage would, unless another image or the new one still uses them
+			replaced := images[i]
+			images[i] = stored
+			if err := writeImageIndex(images); err != nil {
+				return err
+			}
+			_, err := deleteUnreferencedLayers(images, replaced.Layers)
+			return err
+		}
+	}
+	return writeImageIndex(append(images, stored))
+}
+
+// findImage looks reference up in the local image index, returning nil if it is not there
+func findImage(reference string) (*StoredImage, error) {
+	images, err := readImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	reference = canonicalReference(reference)
+	for i := range images {
+		if images[i].Reference == reference {
+			return &images[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// removeImage drops reference from the local image index and deletes those of its layers that
+// no remaining image uses, returning the digests of the layers deleted. Layers shared with
+// another image are kept.
+func removeImage(reference string) ([]string, error) {
+	images, err := readImageIndex()
+	if err != nil {
+		return nil, err
+	}
+	reference = canonicalReference(reference)
+	var (
+		removed   *StoredImage
+		remaining []StoredImage
+	)
+	for i := range images {
+		if images[i].Reference == reference {
+			removed = &images[i]
+			continue
+		}
+		remaining = append(remaining, images[i])
+	}
+	if removed == nil {
+		return nil, fmt.Errorf("%w: %s", ErrImageNotFound, reference)
+	}
+	if err := writeImageIndex(remaining); err != nil {
+		return nil, err
+	}
+	return deleteUnreferencedLayers(remaining, removed.Layers)
+}
+
+// deleteUnreferencedLayers deletes those of layers that none of images use from the layer store,
+// returning the digests of the layers deleted
+func deleteUnreferencedLayers(images []StoredImage, layers []Manifest) ([]string, error) {
+	referenced := make(map[string]bool)
+	for _, image := range images {
+		for _, layer := range image.Layers {
+			referenced[layer.Digest] = true
+		}
+	}
+	var deleted []string
+	for _, layer := range layers {
+		if referenced[layer.Digest] {
+			continue
+		}
+		// A layer listed twice in the image is only deleted once
+		referenced[layer.Digest] = true
+		path := filepath.Join(ImageLayersPath, strings.TrimPrefix(layer.Digest, "sha256:")+".tar.gz")
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return deleted, fmt.Errorf("could not delete layer %s: %w", layer.Digest, err)
+		}
+		deleted = append(deleted, layer.Digest)
+	}
+	return deleted, nil
+}
+
+// imageLayers returns the layers of a stored image in manifest order, checking that each of
+// them is still in the layer store
+func (image *StoredImage) imageLayers() ([]ImageLayer, error) {
+	layers := make([]ImageLayer, 0, len(image.Layers))
+	for _, manifest := range image.Layers {
+		layer := ImageLayer{
+			Manifest:  manifest,
+			Sha256Sum: strings.TrimPrefix(manifest.Digest, "sha256:"),
+		}
+		if err := registryCache.hasLayer(&layer); err != nil {
+			return nil, fmt.Errorf("layer %s of %s is missing from the layer store: %w", manifest.Digest, image.Reference, err)
+		}
+		layers = append(layers, layer)
+	}
+	return layers, nil
+}
+
+// imagesCommand lists the images in the local image index, whether pulled or loaded, with the
+// total size of their layers as stored.
+//
+// Usage: your_docker.sh images [-q|--quiet]
+func imagesCommand(arguments []string) {
+	flags := flag.NewFlagSet("images", flag.ExitOnError)
+	quiet := flags.Bool("quiet", false, "only print image digests")
+	flags.BoolVar(quiet, "q", false, "shorthand for --quiet")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() != 0 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+
+	images, err := readImageIndex()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *quiet {
+		for _, image := range images {
+			fmt.Println(shortDigest(image.Digest))
+		}
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REPOSITORY\tTAG\tDIGEST\tSIZE")
+	for _, image := range images {
+		repository, tag := image.Reference, "<none>"
+		if ref, err := parseReference(image.Reference); err == nil {
+			repository = ref.familiarRepository()
+			if ref.Tag != "" {
+				tag = ref.Tag
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", repository, tag, shortDigest(image.Digest), formatBytes(image.size()))
+	}
+	w.Flush()
+}
+
+// size is the total size of the image's layers as held in the layer store
+func (image *StoredImage) size() int64 {
+	var size int64
+	for _, layer := range image.Layers {
+		size += int64(layer.Size)
+	}
+	return size
+}
+
+// shortDigest abbreviates a digest to the 12 hex characters docker shows for image IDs
+func shortDigest(digest string) string {
+	hex := digest
+	if _, encoded, ok := strings.Cut(digest, ":"); ok {
+		hex = encoded
+	}
+	if len(hex) > 12 {
+		hex = hex[:12]
+	}
+	return hex
+}
+
+// rmiCommand removes images from the local image index, reclaiming the space of any layers
+// no other image uses.
+//
+// Usage: your_docker.sh rmi <image> [<image> ...]
+func rmiCommand(arguments []string) {
+	flags := flag.NewFlagSet("rmi", flag.ExitOnError)
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, ref := range flags.Args() {
+		deleted, err := removeImage(ref)
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		fmt.Printf("Untagged: %s\n", canonicalReference(ref))
+		for _, digest := range deleted {
+			fmt.Printf("Deleted: %s\n", digest)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
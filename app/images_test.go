@@ -0,0 +1,289 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStoreImage(t *testing.T) {
+	type stored struct {
+		reference string
+		digest    string
+	}
+	tests := []struct {
+		name   string
+		stores []stored
+		find   string
+		// want is the digest found, empty when nothing is
+		want      string
+		wantCount int
+	}{
+		{name: "stored", stores: []stored{{"app", "sha256:a"}}, find: "app:latest", want: "sha256:a", wantCount: 1},
+		{name: "normalized", stores: []stored{{"docker.io/library/app:latest", "sha256:a"}}, find: "app", want: "sha256:a", wantCount: 1},
+		{name: "replaced", stores: []stored{{"app", "sha256:a"}, {"app:latest", "sha256:b"}}, find: "app", want: "sha256:b", wantCount: 1},
+		{name: "other tag", stores: []stored{{"app", "sha256:a"}, {"app:1.0", "sha256:b"}}, find: "app:1.0", want: "sha256:b", wantCount: 2},
+		{name: "not stored", stores: []stored{{"app", "sha256:a"}}, find: "other", wantCount: 1},
+		{name: "no index", find: "app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			for _, s := range tt.stores {
+				if err := storeImage(s.reference, &ResolvedImage{Digest: s.digest, Config: &DockerImageConfig{}}); err != nil {
+					t.Fatalf("storeImage(%q): %v", s.reference, err)
+				}
+			}
+			got, err := findImage(tt.find)
+			if err != nil {
+				t.Fatalf("findImage: %v", err)
+			}
+			digest := ""
+			if got != nil {
+				digest = got.Digest
+			}
+			if digest != tt.want {
+				t.Errorf("findImage(%q) found %q, want %q", tt.find, digest, tt.want)
+			}
+			images, err := readImageIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != tt.wantCount {
+				t.Errorf("image index holds %d images, want %d", len(images), tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestImageLayers(t *testing.T) {
+	useLayerStore(t)
+	layer := storeLayer(t, []tarEntry{tarFile("a", "a")})
+	missing := Manifest{Digest: "sha256:" + strings.Repeat("0", 64)}
+
+	tests := []struct {
+		name    string
+		layers  []Manifest
+		wantErr string
+	}{
+		{name: "in store", layers: []Manifest{layer.Manifest}},
+		{name: "missing", layers: []Manifest{layer.Manifest, missing}, wantErr: "layer " + missing.Digest + " of app is missing from the layer store"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := &StoredImage{Reference: "app", Layers: tt.layers}
+			got, err := image.imageLayers()
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("imageLayers returned error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("imageLayers: %v", err)
+			}
+			if len(got) != len(tt.layers) || got[0].Sha256Sum != layer.Sha256Sum {
+				t.Errorf("imageLayers returned %+v, want %+v", got, tt.layers)
+			}
+		})
+	}
+}
+
+func TestPullRecordsImage(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *PullOptions
+		// wantRecorded is set when the image should be in the image index after the pull
+		wantRecorded bool
+	}{
+		{name: "pulled", wantRecorded: true},
+		{name: "sequential", options: &PullOptions{Sequential: true}, wantRecorded: true},
+		{name: "streamed", options: &PullOptions{ExtractStreaming: true}},
+		{name: "streamed and cached", options: &PullOptions{ExtractStreaming: true, CacheStreamedLayers: true}, wantRecorded: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+			ref := registry.pushIndex(t, "app", "latest", image)
+			if tt.options != nil && tt.options.ExtractStreaming {
+				tt.options.ExtractTo = t.TempDir()
+			}
+			if _, _, err := pullImage(context.Background(), ref, nil, tt.options); err != nil {
+				t.Fatalf("pullImage: %v", err)
+			}
+
+			stored, err := findImage(ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (stored != nil) != tt.wantRecorded {
+				t.Fatalf("image recorded: %t, want %t", stored != nil, tt.wantRecorded)
+			}
+			if stored != nil && (stored.Digest != digestOf(image.manifest) || len(stored.Layers) != 1 || stored.size() != int64(len(image.layers[0]))) {
+				t.Errorf("recorded %+v, want digest %s with one layer of %d bytes", stored, digestOf(image.manifest), len(image.layers[0]))
+			}
+		})
+	}
+}
+
+func TestShortDigest(t *testing.T) {
+	tests := []struct {
+		digest string
+		want   string
+	}{
+		{digest: "sha256:0123456789abcdef0123", want: "0123456789ab"},
+		{digest: "sha256:0123", want: "0123"},
+		{digest: "0123456789abcdef", want: "0123456789ab"},
+		{digest: "", want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := shortDigest(tt.digest); got != tt.want {
+			t.Errorf("shortDigest(%q) = %q, want %q", tt.digest, got, tt.want)
+		}
+	}
+}
+
+func TestRemoveImage(t *testing.T) {
+	tests := []struct {
+		name string
+		// images are the layers of each stored image, by index into the shared layers
+		images  map[string][]int
+		remove  string
+		wantErr error
+		// wantDeleted are the layers deleted, and wantKept those left in the layer store
+		wantDeleted []int
+		wantKept    []int
+		wantImages  int
+	}{
+		{name: "only image", images: map[string][]int{"app": {0, 1}}, remove: "app", wantDeleted: []int{0, 1}},
+		{name: "by full reference", images: map[string][]int{"app": {0}}, remove: "docker.io/library/app:latest", wantDeleted: []int{0}},
+		{
+			name:        "shared layer",
+			images:      map[string][]int{"app": {0, 1}, "other": {0, 2}},
+			remove:      "app",
+			wantDeleted: []int{1},
+			wantKept:    []int{0, 2},
+			wantImages:  1,
+		},
+		{name: "layer listed twice", images: map[string][]int{"app": {0, 0}}, remove: "app", wantDeleted: []int{0}},
+		{
+			name:       "not stored",
+			images:     map[string][]int{"app": {0}},
+			remove:     "other",
+			wantErr:    ErrImageNotFound,
+			wantKept:   []int{0},
+			wantImages: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			var layers []ImageLayer
+			for _, name := range []string{"a", "b", "c"} {
+				layers = append(layers, storeLayer(t, []tarEntry{tarFile(name, name)}))
+			}
+			for reference, indices := range tt.images {
+				image := &ResolvedImage{Digest: "sha256:" + reference, Config: &DockerImageConfig{}}
+				for _, i := range indices {
+					image.Layers = append(image.Layers, layers[i])
+				}
+				if err := storeImage(reference, image); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deleted, err := removeImage(tt.remove)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("removeImage returned %v, want %v", err, tt.wantErr)
+			}
+			var want []string
+			for _, i := range tt.wantDeleted {
+				want = append(want, layers[i].Digest)
+			}
+			if !reflect.DeepEqual(deleted, want) {
+				t.Errorf("removeImage deleted %q, want %q", deleted, want)
+			}
+			for _, i := range tt.wantDeleted {
+				if registryCache.hasLayer(&layers[i]) == nil {
+					t.Errorf("layer %d was left in the layer store", i)
+				}
+			}
+			for _, i := range tt.wantKept {
+				if err := registryCache.hasLayer(&layers[i]); err != nil {
+					t.Errorf("layer %d was deleted: %v", i, err)
+				}
+			}
+			images, err := readImageIndex()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(images) != tt.wantImages {
+				t.Errorf("image index holds %d images, want %d", len(images), tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestStoreImageDeletesReplacedLayers(t *testing.T) {
+	type stored struct {
+		reference string
+		// layers are indices into the shared layers
+		layers []int
+	}
+	tests := []struct {
+		name   string
+		stores []stored
+		// wantDeleted are the layers deleted, and wantKept those left in the layer store
+		wantDeleted []int
+		wantKept    []int
+	}{
+		{name: "replaced", stores: []stored{{"app", []int{0, 1}}, {"app", []int{2}}}, wantDeleted: []int{0, 1}, wantKept: []int{2}},
+		{name: "layer kept by the new image", stores: []stored{{"app", []int{0, 1}}, {"app", []int{0, 2}}}, wantDeleted: []int{1}, wantKept: []int{0, 2}},
+		{
+			name:        "layer kept by another image",
+			stores:      []stored{{"app", []int{0, 1}}, {"other", []int{1}}, {"app", []int{2}}},
+			wantDeleted: []int{0},
+			wantKept:    []int{1, 2},
+		},
+		{name: "other tag", stores: []stored{{"app", []int{0}}, {"app:1.0", []int{1}}}, wantKept: []int{0, 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			var layers []ImageLayer
+			for _, name := range []string{"a", "b", "c"} {
+				layers = append(layers, storeLayer(t, []tarEntry{tarFile(name, name)}))
+			}
+			for _, s := range tt.stores {
+				image := &ResolvedImage{Digest: "sha256:" + s.reference, Config: &DockerImageConfig{}}
+				for _, i := range s.layers {
+					image.Layers = append(image.Layers, layers[i])
+				}
+				if err := storeImage(s.reference, image); err != nil {
+					t.Fatalf("storeImage(%q): %v", s.reference, err)
+				}
+			}
+
+			for _, i := range tt.wantDeleted {
+				if registryCache.hasLayer(&layers[i]) == nil {
+					t.Errorf("layer %d was left in the layer store", i)
+				}
+			}
+			for _, i := range tt.wantKept {
+				if err := registryCache.hasLayer(&layers[i]); err != nil {
+					t.Errorf("layer %d was deleted: %v", i, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Injection copies a file from the host into the container's root filesystem before it starts
+type Injection struct {
+	Source      string
+	Destination string
+}
+
+// parseInjection parses a host-path:container-path injection specification
+func parseInjection(spec string) (*Injection, error) {
+	source, destination, ok := strings.Cut(spec, ":")
+	if !ok || source == "" || destination == "" {
+		return nil, fmt.Errorf("invalid injection %q, expected host-path:container-path", spec)
+	}
+	if !filepath.IsAbs(destination) || filepath.Clean(destination) == "/" {
+		return nil, fmt.Errorf("invalid injection %q, the container path must be an absolute file path", spec)
+	}
+
+	info, err := os.Stat(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid injection %q: %w", spec, err)
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("invalid injection %q: %s is not a regular file", spec, source)
+	}
+	return &Injection{Source: source, Destination: filepath.Clean(destination)}, nil
+}
+
+// inject copies the injected file into the root filesystem at rootfs, keeping its permissions
+func (injection *Injection) inject(rootfs string) error {
+	rootfs, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		return err
+	}
+	// The image could contain a symlink redirecting the destination outside of the root filesystem
+	if !resolvesWithin(rootfs, filepath.Join(rootfs, injection.Destination)) {
+		return fmt.Errorf("injection destination %s resolves outside of the container", injection.Destination)
+	}
+
+	if err := copyFile(injection.Source, filepath.Join(rootfs, injection.Destination)); err != nil {
+		return fmt.Errorf("could not inject %s at %s: %w", injection.Source, injection.Destination, err)
+	}
+	return nil
+}
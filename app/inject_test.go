@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseInjection(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "tool")
+	if err := os.WriteFile(source, []byte("tool"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		spec    string
+		want    Injection
+		wantErr string
+	}{
+		{name: "file", spec: source + ":/usr/local/bin/tool", want: Injection{Source: source, Destination: "/usr/local/bin/tool"}},
+		{name: "cleaned destination", spec: source + ":/usr//bin/../bin/tool", want: Injection{Source: source, Destination: "/usr/bin/tool"}},
+		{name: "no destination", spec: source, wantErr: "expected host-path:container-path"},
+		{name: "no source", spec: ":/tool", wantErr: "expected host-path:container-path"},
+		{name: "empty destination", spec: source + ":", wantErr: "expected host-path:container-path"},
+		{name: "relative destination", spec: source + ":tool", wantErr: "the container path must be an absolute file path"},
+		{name: "root destination", spec: source + ":/", wantErr: "the container path must be an absolute file path"},
+		{name: "missing source", spec: filepath.Join(dir, "missing") + ":/tool", wantErr: "no such file or directory"},
+		{name: "directory source", spec: dir + ":/tool", wantErr: dir + " is not a regular file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseInjection(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseInjection(%q) returned %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseInjection(%q): %v", tt.spec, err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseInjection(%q) = %+v, want %+v", tt.spec, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInject(t *testing.T) {
+	source := filepath.Join(t.TempDir(), "tool")
+	if err := os.WriteFile(source, []byte("tool"), 0751); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		rootfs      []tarEntry
+		destination string
+		// want is where the file should end up within the root filesystem
+		want    string
+		wantErr string
+	}{
+		{name: "new directory", destination: "/usr/local/bin/tool", want: "usr/local/bin/tool"},
+		{name: "replaces file", rootfs: []tarEntry{tarDir("bin/"), tarFile("bin/tool", "old")}, destination: "/bin/tool", want: "bin/tool"},
+		{name: "through symlink within", rootfs: []tarEntry{tarDir("usr/"), tarDir("usr/bin/"), tarSymlink("bin", "usr/bin")}, destination: "/bin/tool", want: "usr/bin/tool"},
+		{name: "through absolute symlink", rootfs: []tarEntry{tarDir("usr/"), tarDir("usr/bin/"), tarSymlink("bin", "/usr/bin")}, destination: "/bin/tool", wantErr: "resolves outside of the container"},
+		{name: "symlink escaping", rootfs: []tarEntry{tarSymlink("bin", "../../..")}, destination: "/bin/tool", wantErr: "resolves outside of the container"},
+		{name: "dangling symlink", rootfs: []tarEntry{tarDir("bin/"), tarSymlink("bin/tool", "missing")}, destination: "/bin/tool", wantErr: "resolves outside of the container"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			if err := extractTar(rootfs, bytes.NewReader(buildLayer(t, tt.rootfs)), string(DockerImageTypeRootFs), false); err != nil {
+				t.Fatal(err)
+			}
+			injection := &Injection{Source: source, Destination: tt.destination}
+			err := injection.inject(rootfs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("inject returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("inject: %v", err)
+			}
+			name := filepath.Join(rootfs, tt.want)
+			info, err := os.Lstat(name)
+			if errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("%s was not injected", tt.want)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := os.ReadFile(name); string(data) != "tool" || info.Mode() != 0751 {
+				t.Errorf("%s holds %q with mode %v, want %q with mode %v", tt.want, data, info.Mode(), "tool", os.FileMode(0751))
+			}
+		})
+	}
+}
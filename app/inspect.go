@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"text/tabwriter"
+	"text/template"
+)
+
+// ImageInspection is the description of an image printed by inspect
+type ImageInspection struct {
+	Reference string
+	Digest    string
+	Platform  Platform
+	Layers    []InspectedLayer
+	Config    OCIImageConfig
+	// DownloadSize is how many bytes pulling the image would download, leaving out the layers
+	// already in the layer store
+	DownloadSize int64
+}
+
+// InspectedLayer describes one of an image's layers without its contents
+type InspectedLayer struct {
+	Digest    string
+	MediaType string
+	Size      int
+}
+
+// inspectCommand describes an image from its registry without pulling its layers. By default
+// the image's platform, layers, configuration and download size are printed as JSON, or
+// formatted with the Go template given by --format, such as '{{json .Config.Env}}'.
+//
+// Usage: your_docker.sh inspect [--platform <os/arch>] [--format <template>] <image>
+//
+//	your_docker.sh inspect --platforms <image>
+func inspectCommand(ctx context.Context, arguments []string) {
+	flags := flag.NewFlagSet("inspect", flag.ExitOnError)
+	platforms := flags.Bool("platforms", false, "list every platform the image is available for")
+	format := flags.String("format", "", "format the output using the given Go template")
+	preferOCI := flags.Bool("prefer-oci", false, "ask registries for OCI manifests ahead of docker manifest lists")
+	var platform Platform
+	flags.Var(&platform, "platform", "describe the image for `os/arch[/variant]`, such as linux/arm64, rather than for this host")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, []flagConflict{{"platforms", "format"}, {"platforms", "platform"}}); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if flags.NArg() != 1 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+	ref := flags.Arg(0)
+	if *preferOCI {
+		preferOCIManifests()
+	}
+
+	if !*platforms {
+		if err := inspectImage(ctx, ref, *format, platform); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	manifests, err := listPlatforms(ctx, ref)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PLATFORM\tDIGEST\tSIZE")
+	for _, manifest := range manifests {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", manifest.Platform, manifest.Digest, manifest.Size)
+	}
+	w.Flush()
+}
+
+// inspectImage resolves an image for platform, or this one if unset, and prints its description
+func inspectImage(ctx context.Context, ref, format string, platform Platform) error {
+	image, err := resolveImage(ctx, ref, nil, &PullOptions{Platform: platform})
+	if err != nil {
+		return err
+	}
+
+	inspection := ImageInspection{
+		Reference: image.Reference,
+		Digest:    image.Digest,
+		Platform:  image.Platform,
+		Layers:    make([]InspectedLayer, 0, len(image.Layers)),
+	}
+	for _, layer := range image.Layers {
+		inspection.Layers = append(inspection.Layers, InspectedLayer{Digest: layer.Digest, MediaType: layer.MediaType, Size: layer.Size})
+	}
+	if image.Config != nil {
+		inspection.Config = image.Config.Config
+	}
+	_, inspection.DownloadSize = image.downloadSize(image.cachedLayers())
+
+	if format == "" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "    ")
+		return encoder.Encode(inspection)
+	}
+
+	tmpl, err := template.New("format").Funcs(template.FuncMap{
+		"json": func(v interface{}) (string, error) {
+			data, err := json.Marshal(v)
+			return string(data), err
+		},
+	}).Parse(format)
+	if err != nil {
+		return fmt.Errorf("invalid format: %w", err)
+	}
+	if err := tmpl.Execute(os.Stdout, inspection); err != nil {
+		return err
+	}
+	fmt.Println()
+	return nil
+}
+
+// listPlatforms fetches the index of a multi-platform image and returns the manifest
+// descriptor of each platform it contains, without fetching the manifests themselves
+func listPlatforms(ctx context.Context, imageReference string) ([]Manifest, error) {
+	if err := validateReference(imageReference); err != nil {
+		return nil, err
+	}
+
+	repository, registry, tag := sanitiseImageReference(imageReference)
+	registryDetails := lookupRegistry(registry)
+
+	query := registryDetails.generateManifestRequest(repository, tag)
+	var (
+		body   []byte
+		header http.Header
+	)
+	err := withRetries(ctx, func() (err error) {
+		body, header, _, err = registryDetails.fetchIndex(ctx, query, nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !containsString(indexMediaTypes, header.Get("Content-Type")) {
+		return nil, fmt.Errorf("%s is not a multi-platform image", imageReference)
+	}
+	if err := checkManifestBody(body); err != nil {
+		return nil, err
+	}
+
+	var index RegistryResponse
+	if err := json.Unmarshal(body, &index); err != nil {
+		return nil, err
+	}
+	return index.Manifests, nil
+}
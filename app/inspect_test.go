@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestListPlatforms(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	amd64 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "amd64"}, layer)
+	arm64 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "arm64", Variant: "v8"}, layer)
+	multi := registry.pushIndex(t, "multi", "latest", amd64, arm64)
+	single := registry.push("single", "latest", amd64)
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    []string
+		wantErr string
+	}{
+		{
+			name: "index",
+			ref:  multi,
+			want: []string{
+				"linux/amd64 " + digestOf(amd64.manifest),
+				"linux/arm64/v8 " + digestOf(arm64.manifest),
+			},
+		},
+		{name: "single platform", ref: single, wantErr: "is not a multi-platform image"},
+		{name: "missing", ref: registry.host + "/missing:latest", wantErr: "manifest unknown"},
+		{name: "invalid", ref: registry.host + "/Upper:latest", wantErr: "invalid reference format"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			manifests, err := listPlatforms(context.Background(), tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("listPlatforms returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("listPlatforms: %v", err)
+			}
+			var got []string
+			for _, manifest := range manifests {
+				got = append(got, manifest.Platform.String()+" "+manifest.Digest)
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("listPlatforms found\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestInspectImage(t *testing.T) {
+	useLayerStore(t)
+	registry := newFakeRegistry(t)
+	layers := [][]byte{buildLayer(t, []tarEntry{tarFile("a", "a")}), buildLayer(t, []tarEntry{tarFile("b", "b")})}
+	settings := OCIImageConfig{Cmd: []string{"/bin/app"}, Env: []string{"PATH=/bin", "MODE=test"}}
+	amd64 := buildFakeImage(t, Platform{Os: "linux", Architecture: "amd64"}, settings, layers...)
+	arm64 := buildFakeImage(t, Platform{Os: "linux", Architecture: "arm64"}, settings, layers[0])
+	ref := registry.pushIndex(t, "app", "latest", amd64, arm64)
+
+	tests := []struct {
+		name       string
+		format     string
+		platform   Platform
+		wantStdout string
+		wantErr    string
+	}{
+		{name: "platform", format: "{{.Platform}}", platform: amd64.platform, wantStdout: "linux/amd64\n"},
+		{name: "other platform", format: "{{.Platform}} {{len .Layers}}", platform: arm64.platform, wantStdout: "linux/arm64 1\n"},
+		{name: "digest", format: "{{.Digest}}", platform: amd64.platform, wantStdout: digestOf(amd64.manifest) + "\n"},
+		{name: "json", format: "{{json .Config.Env}}", platform: amd64.platform, wantStdout: `["PATH=/bin","MODE=test"]` + "\n"},
+		{
+			name:       "layers",
+			format:     "{{range .Layers}}{{.Digest}} {{.Size}}\n{{end}}",
+			platform:   amd64.platform,
+			wantStdout: fmt.Sprintf("%s %d\n%s %d\n\n", digestOf(layers[0]), len(layers[0]), digestOf(layers[1]), len(layers[1])),
+		},
+		{name: "invalid format", format: "{{.Platform", platform: amd64.platform, wantErr: "invalid format"},
+		{name: "unknown field", format: "{{.Bogus}}", platform: amd64.platform, wantErr: "can't evaluate field Bogus"},
+		{name: "missing platform", format: "{{.Platform}}", platform: Platform{Os: "linux", Architecture: "s390x"}, wantErr: "no digest found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var err error
+			stdout := captureStdout(t, func() { err = inspectImage(context.Background(), ref, tt.format, tt.platform) })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("inspectImage returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("inspectImage: %v", err)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("inspectImage printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+
+	t.Run("default", func(t *testing.T) {
+		var err error
+		stdout := captureStdout(t, func() { err = inspectImage(context.Background(), ref, "", amd64.platform) })
+		if err != nil {
+			t.Fatalf("inspectImage: %v", err)
+		}
+		var got ImageInspection
+		if err := json.Unmarshal([]byte(stdout), &got); err != nil {
+			t.Fatalf("inspectImage printed %q: %v", stdout, err)
+		}
+		want := ImageInspection{
+			Reference: ref,
+			Digest:    digestOf(amd64.manifest),
+			Platform:  amd64.platform,
+			Layers: []InspectedLayer{
+				{Digest: digestOf(layers[0]), MediaType: string(DockerImageTypeRootFs), Size: len(layers[0])},
+				{Digest: digestOf(layers[1]), MediaType: string(DockerImageTypeRootFs), Size: len(layers[1])},
+			},
+			Config:       settings,
+			DownloadSize: int64(len(amd64.config) + len(layers[0]) + len(layers[1])),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("inspectImage printed %+v, want %+v", got, want)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/exp/slog"
+)
+
+// logLevel sets which messages logger writes. Debugging output is only shown with --verbose,
+// or when the binary was built with debugCapabilities set.
+var logLevel = new(slog.LevelVar)
+
+// logger writes diagnostic messages to stderr, keeping them apart from a command's output
+var logger = slog.New(slog.HandlerOptions{Level: logLevel}.NewTextHandler(os.Stderr))
+
+// The formats --log-format accepts. Text is for people, while json writes each message as a
+// JSON object on a line of its own, along with lifecycle events for scripts to follow.
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// eventLogger reports lifecycle events to stderr, and is only set with --log-format json
+var eventLogger *slog.Logger
+
+// setLogFormat switches logger to format
+func setLogFormat(format string) error {
+	switch format {
+	case logFormatText:
+	case logFormatJSON:
+		logger = slog.New(slog.HandlerOptions{Level: logLevel}.NewJSONHandler(os.Stderr))
+		eventLogger = slog.New(slog.HandlerOptions{ReplaceAttr: eventAttr}.NewJSONHandler(os.Stderr))
+	default:
+		return fmt.Errorf("invalid log format %q, expected %s or %s", format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// eventAttr names an event by its "event" key rather than "msg", which sets it apart from
+// diagnostic messages, and leaves out the level, which says nothing about an event
+func eventAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.MessageKey:
+		a.Key = "event"
+	case slog.LevelKey:
+		return slog.Attr{}
+	}
+	return a
+}
+
+// logFlags are the global options that have a child process, such as init, log as this one does
+func logFlags() []string {
+	var flags []string
+	if debugEnabled() {
+		flags = append(flags, "--verbose")
+	}
+	if eventLogger != nil {
+		flags = append(flags, "--log-format", logFormatJSON)
+	}
+	return flags
+}
+
+// emitEvent reports that a step of a command's lifecycle, such as pull-start or exited, has
+// happened, with args as the key-value pairs describing it. Events are only written with
+// --log-format json.
+func emitEvent(event string, args ...any) {
+	if eventLogger != nil {
+		eventLogger.Info(event, args...)
+	}
+}
+
+func init() {
+	if len(debugCapabilities) > 0 {
+		logLevel.Set(slog.LevelDebug)
+	}
+}
+
+// debugEnabled reports whether debugging output is being logged
+func debugEnabled() bool {
+	return logger.Enabled(context.Background(), slog.LevelDebug)
+}
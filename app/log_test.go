@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestDebugEnabled(t *testing.T) {
+	tests := []struct {
+		name  string
+		level slog.Level
+		want  bool
+	}{
+		{name: "default", level: slog.LevelInfo},
+		{name: "verbose", level: slog.LevelDebug, want: true},
+		{name: "warnings only", level: slog.LevelWarn},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := logLevel.Level()
+			t.Cleanup(func() { logLevel.Set(previous) })
+			logLevel.Set(tt.level)
+			if got := debugEnabled(); got != tt.want {
+				t.Errorf("debugEnabled() at level %s = %t, want %t", tt.level, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogFlags(t *testing.T) {
+	tests := []struct {
+		name   string
+		level  slog.Level
+		format string
+		want   []string
+	}{
+		{name: "default", level: slog.LevelInfo, format: logFormatText},
+		{name: "verbose", level: slog.LevelDebug, format: logFormatText, want: []string{"--verbose"}},
+		{name: "json", level: slog.LevelInfo, format: logFormatJSON, want: []string{"--log-format", "json"}},
+		{name: "verbose json", level: slog.LevelDebug, format: logFormatJSON, want: []string{"--verbose", "--log-format", "json"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previousLogger, previousEvents, previousLevel := logger, eventLogger, logLevel.Level()
+			t.Cleanup(func() {
+				logger, eventLogger = previousLogger, previousEvents
+				logLevel.Set(previousLevel)
+			})
+			logLevel.Set(tt.level)
+			if err := setLogFormat(tt.format); err != nil {
+				t.Fatal(err)
+			}
+			if got := logFlags(); strings.Join(got, " ") != strings.Join(tt.want, " ") {
+				t.Errorf("logFlags() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := setLogFormat("xml"); err == nil || err.Error() != `invalid log format "xml", expected text or json` {
+		t.Errorf("setLogFormat(\"xml\") returned %v", err)
+	}
+}
@@ -4,134 +4,233 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
-	// "kernel.org/pub/linux/libs/security/libcap/cap"
-	"io/ioutil"
 	"os"
-	"os/exec"
+	"os/signal"
 	"syscall"
+	"text/tabwriter"
+
+	"golang.org/x/exp/slog"
 )
 
 // NOTE: Helpful debugging build flags for checking system capaabilities on host
 // go build  -ldflags "-X main.debugCapabilities=yes"
 var debugCapabilities string
 
-// Usage: your_docker.sh run <image> <command> <arg1> <arg2> ...
+// Usage:
+//
+//	your_docker.sh [global options] run [options] <image> <command> <arg1> <arg2> ...
+//	your_docker.sh [global options] pull [options] <image>
+//	your_docker.sh [global options] inspect [--platform <os/arch>] [--format <template> | --platforms] <image>
+//	your_docker.sh [global options] load <tarfile>
+//	your_docker.sh [global options] images [-q]
+//	your_docker.sh [global options] rmi <image> [<image> ...]
+//	your_docker.sh [global options] export [-o <file>] <image>
+//	your_docker.sh [global options] exec [options] <container> <command> <arg1> ...
+//	your_docker.sh [global options] ps [-a]
+//	your_docker.sh [global options] stop [-t <seconds>] <container> [<container> ...]
+//	your_docker.sh [global options] rm [-f] <container> [<container> ...]
+//	your_docker.sh [global options] pause <container>
+//	your_docker.sh [global options] unpause <container>
+//	your_docker.sh [global options] selftest [options]
+//	your_docker.sh [global options] version
+//	your_docker.sh [global options] help
+//
+// The global options -v/--verbose, --log-format, --connect-timeout, --tls-handshake-timeout,
+// --request-timeout, --stall-timeout, --pull-timeout, --insecure-registry, --ca-cert,
+// --client-cert and --client-key are given before the command.
+//
+// commands lists the same for the usage message printed for a missing or unknown command.
+var commands = []struct {
+	synopsis    string
+	description string
+}{
+	{"run [options] <image> <command> [arg1] ...", "run a command in a new container"},
+	{"pull [options] <image>", "fetch an image into the layer store, or with --dry-run list what would be fetched"},
+	{"inspect [--platform <os/arch>] [--format <template> | --platforms] <image>", "describe an image in a registry"},
+	{"load <tarfile>", "import images from a docker save archive"},
+	{"images [-q]", "list the images in the local image index"},
+	{"rmi <image> [<image> ...]", "remove images from the local image index"},
+	{"export [-o <file>] <image>", "write an image's root filesystem as a tar archive"},
+	{"exec [options] <container> <command> [arg1] ...", "run another command in a running container"},
+	{"ps [-a]", "list containers"},
+	{"stop [-t <seconds>] <container> [<container> ...]", "stop running containers"},
+	{"rm [-f] <container> [<container> ...]", "remove exited containers, or with -f running ones too"},
+	{"pause <container>", "suspend every process of a container"},
+	{"unpause <container>", "resume a paused container"},
+	{"selftest [options]", "pull a small image and run a command in it, reporting what failed"},
+	{"version", "print which build of the tool is running"},
+}
+
+// usage describes the commands and global options
+func usage(globalFlags *flag.FlagSet) {
+	out := globalFlags.Output()
+	fmt.Fprintf(out, "Usage: %s [global options] <command> [options] [arguments]\n\nCommands:\n", globalFlags.Name())
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, command := range commands {
+		fmt.Fprintf(w, "  %s\t%s\n", command.synopsis, command.description)
+	}
+	w.Flush()
+	fmt.Fprintln(out, "\nGlobal options:")
+	globalFlags.PrintDefaults()
+}
+
 func main() {
-	if len(os.Args) < 4 {
-		fmt.Println("Incorrect number of arguments specified.\n")
+	globalFlags := flag.NewFlagSet("your_docker.sh", flag.ExitOnError)
+	verbose := globalFlags.Bool("verbose", false, "log debugging output to stderr")
+	globalFlags.BoolVar(verbose, "v", false, "shorthand for --verbose")
+	logFormat := globalFlags.String("log-format", logFormatText, "format of what is logged to stderr: text, or json for one object per line along with lifecycle events")
+	globalFlags.DurationVar(&dialTimeout, "connect-timeout", dialTimeout, "time allowed to connect to a registry")
+	globalFlags.DurationVar(&tlsHandshakeTimeout, "tls-handshake-timeout", tlsHandshakeTimeout, "time allowed for the TLS handshake with a registry")
+	globalFlags.DurationVar(&requestTimeout, "request-timeout", requestTimeout, "time allowed for each manifest, configuration and token request, or 0 for no limit")
+	globalFlags.DurationVar(&stallTimeout, "stall-timeout", stallTimeout, "time a layer download may go without receiving data before it is retried, or 0 for no limit")
+	globalFlags.DurationVar(&pullTimeout, "pull-timeout", pullTimeout, "time allowed for a whole pull, or 0 for no limit")
+	globalFlags.Var(&insecureRegistries, "insecure-registry", "registry, as host[:port], whose certificate is not verified and which may be reached over plain HTTP (repeatable)")
+	globalFlags.Var(&caCerts, "ca-cert", "PEM file of CA certificates to trust for registries besides the system's, defaulting to $"+caCertEnv+" (repeatable)")
+	globalFlags.StringVar(&clientCert, "client-cert", "", "PEM file of the certificate to present to registries requiring client certificates")
+	globalFlags.StringVar(&clientKey, "client-key", "", "PEM file of the private key of --client-cert")
+	globalFlags.Usage = func() { usage(globalFlags) }
+	globalFlags.Parse(os.Args[1:])
+	if err := setLogFormat(*logFormat); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-
-	// We only support the "run" command for now.
-	if os.Args[1] != "run" {
-		fmt.Println("Only the 'run' option is currently supported")
+	if err := checkInsecureRegistries(); err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	ref := os.Args[2]
-
-	command := os.Args[3]
-	args := os.Args[4:len(os.Args)]
-
-	// Pull the image down first before switching chroot
-	layers, err := pullImage(ref, nil)
-	if err != nil {
+	if err := loadCACerts(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
-
-	cmd := exec.Command(command, args...)
-
-	// TODO: We should create a true character file here
-	if cmd.Stdin == nil || cmd.Stderr == nil || cmd.Stdout == nil {
-		if createFileError := os.WriteFile("/dev/null", []byte(""), 0666); createFileError != nil {
-			fmt.Printf("Unable to get stdin/stdout/stderr\n")
-			os.Exit(1)
-		}
-
-		// NOTE: If we are already running in a containerised environment we may not have the
-		//	 capabalities available to us to create a true character device file.
-		//       In that case we should do a check for capabilities here, otherwise...
-		// if len(debugCapabilities) > 0 {
-		// 	caps := cap.GetProc()
-		// 	fmt.Printf("Available capabalities on this system: %q\n", caps)
-		// }
-
-		// if err := createCharacterfile("/tmp/mynull"); err != nil {
-		// 	fmt.Printf("Error: %s\n", err)
-		// 	fmt.Printf("Unable to get stdin/stdout/stderr\n")
-		// 	os.Exit(1)
-		// }
+	if err := loadClientCertificate(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	// The client is rebuilt in case its timeouts were changed
+	defaultHTTPClient = createHTTPClient()
 
-	cmd.Stdin = os.Stdin
-	cmd.Stderr = os.Stderr
-	cmd.Stdout = os.Stdout
-
-	// fmt.Printf("Available capabilities: %q\n", syscall.SysProcAttr{})
-	cmd.SysProcAttr = &syscall.SysProcAttr{
-		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID,
+	args := globalFlags.Args()
+	if len(args) < 1 {
+		fmt.Fprintln(globalFlags.Output(), "No command specified.")
+		usage(globalFlags)
+		os.Exit(1)
 	}
-
-	// TODO: Provide a better location than /tmp
-	chdir, err := ioutil.TempDir("/tmp/", "container.")
-	if err != nil {
-		fmt.Println("Could not create temporary directory: %s", err)
+	if *verbose {
+		logLevel.Set(slog.LevelDebug)
 	}
-	defer os.RemoveAll(chdir)
 
-	if len(debugCapabilities) > 0 {
-		err = copyFile("./docker-explorer", chdir, "/usr/local/bin/", "docker-explorer")
-		if err != nil {
-			fmt.Printf("Error copying file: %s\n", err)
-		}
+	// Commands that talk to a registry abandon their requests on SIGINT or SIGTERM and report
+	// why. The others keep the default handling, so that an interrupt stops them at once.
+	ctx := context.Background()
+	switch args[0] {
+	case "run", "pull", "inspect", "export", "selftest":
+		var stop context.CancelFunc
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		// A second signal is handled as usual once the first has cancelled the context
+		go func() {
+			<-ctx.Done()
+			stop()
+		}()
 	}
 
-	err = copyFile("/usr/local/bin/docker-explorer", chdir, "/usr/local/bin/", "docker-explorer")
-	if err != nil {
-		fmt.Printf("Error copying file: %s\n", err)
+	switch args[0] {
+	case "run":
+		runCommand(ctx, args[1:])
+	case "pull":
+		pullCommand(ctx, args[1:])
+	case "inspect":
+		inspectCommand(ctx, args[1:])
+	case "load":
+		loadCommand(args[1:])
+	case "images":
+		imagesCommand(args[1:])
+	case "rmi":
+		rmiCommand(args[1:])
+	case "export":
+		exportCommand(ctx, args[1:])
+	case "exec":
+		execCommand(args[1:])
+	case "ps":
+		psCommand(args[1:])
+	case "stop":
+		stopCommand(args[1:])
+	case "rm":
+		rmCommand(args[1:])
+	case "pause":
+		pauseCommand(args[1:])
+	case "unpause":
+		unpauseCommand(args[1:])
+	case "selftest":
+		selftestCommand(ctx, args[1:])
+	case "version":
+		versionCommand(args[1:])
+	case "help":
+		globalFlags.SetOutput(os.Stdout)
+		usage(globalFlags)
+	case "init":
+		// Internal: the first process inside a container started by run
+		initCommand()
+	default:
+		fmt.Fprintf(globalFlags.Output(), "Unknown command %q.\n", args[0])
+		usage(globalFlags)
 		os.Exit(1)
 	}
+}
 
-	// TODO: Get file and then untar
-	for _, layer := range *layers {
-		layerPath := fmt.Sprintf("%s/%s", ImageLayersPath, layer.Sha256Sum)
-		f, err := os.OpenFile(fmt.Sprintf("%s.tar.gz", layerPath), os.O_RDONLY, 0600)
-		if err != nil {
-			fmt.Printf("could not open layer %s - %s\n", layer.Sha256Sum, err)
-			os.Exit(1)
-		}
-		err = untar(chdir, f)
-		if err != nil {
-			fmt.Printf("could not extract layer %s - %s\n", layer.Sha256Sum, err)
-			os.Exit(1)
-		}
-	}
-
-	err = setup_chroot(chdir)
-	if err != nil {
+// pullCommand fetches an image's layers into the layer store without running it.
+// Unlike run, this only talks to the registry and so works on any platform. With --dry-run,
+// the image is only resolved, and the layers that would be fetched are listed.
+func pullCommand(ctx context.Context, arguments []string) {
+	flags := flag.NewFlagSet("pull", flag.ExitOnError)
+	sequential := flags.Bool("sequential", false, "fetch layers one at a time in manifest order")
+	maxConcurrentDownloads := flags.Int("max-concurrent-downloads", defaultMaxConcurrentDownloads, "maximum number of layers to download at once")
+	preferOCI := flags.Bool("prefer-oci", false, "ask registries for OCI manifests ahead of docker manifest lists")
+	dryRun := flags.Bool("dry-run", false, "resolve the image and list the layers that would be downloaded, without downloading them")
+	var platform Platform
+	flags.Var(&platform, "platform", "pull the image for `os/arch[/variant]`, such as linux/arm64, rather than for this host")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	if *maxConcurrentDownloads < 1 {
+		fmt.Println("--max-concurrent-downloads must be at least 1")
+		os.Exit(1)
+	}
 
-	if len(debugCapabilities) > 0 {
-		pwd, err := cwd()
-		if err != nil {
-			fmt.Printf("error getting current working directory:\n", err)
-		}
-		fmt.Printf("current working directory: %s\n", pwd)
+	if flags.NArg() != 1 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+	ref := flags.Arg(0)
+	if *preferOCI {
+		preferOCIManifests()
+	}
 
-		err = lwd()
-		if err != nil {
-			fmt.Printf("error getting working directory listing:\n", err)
+	if *dryRun {
+		if err := planPull(ctx, os.Stdout, ref, &PullOptions{Platform: platform}); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		return
 	}
 
-	err = cmd.Run()
+	progress := newProgressReporter(os.Stderr)
+	layers, _, err := pullImage(ctx, ref, nil, &PullOptions{
+		Sequential:             *sequential,
+		MaxConcurrentDownloads: *maxConcurrentDownloads,
+		Progress:               progress.report,
+		Downloading:            progress.downloading,
+		Platform:               platform,
+	})
+	progress.finish()
 	if err != nil {
-		fmt.Printf("error executing command: %v\n", err)
-		if exitError, ok := err.(*exec.ExitError); ok {
-			os.Exit(exitError.ExitCode())
-		}
+		fmt.Println(err)
+		os.Exit(1)
 	}
+	fmt.Printf("Pulled %s (%d layers)\n", canonicalReference(ref), len(*layers))
 }
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stateDirEnv, when set for the test binary run as the tool, names a directory holding the layer
+// store, image index and container records in place of /tmp/containers
+const stateDirEnv = "MYDOCKER_TEST_STATE"
+
+// TestMain lets the integration tests run the test binary itself as the tool, including as the
+// init process run re-executes through /proc/self/exe
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-test.") {
+		if dir := os.Getenv(stateDirEnv); dir != "" {
+			ImageLayersPath = filepath.Join(dir, "layers")
+			ImageIndexPath = filepath.Join(dir, "images.json")
+			containerStatePath = filepath.Join(dir, "state")
+			containerNamesPath = filepath.Join(dir, "names")
+		}
+		main()
+		os.Exit(0)
+	}
+	code := m.Run()
+	if probe.path != "" {
+		os.RemoveAll(filepath.Dir(probe.path))
+	}
+	os.Exit(code)
+}
+
+// requireContainers skips tests which run containers unless running as root, which creating
+// their namespaces and mounts needs
+func requireContainers(t *testing.T) {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping container test in short mode")
+	}
+	if os.Geteuid() != 0 {
+		t.Skip("running containers needs root")
+	}
+}
+
+var probe struct {
+	once sync.Once
+	path string
+	err  error
+}
+
+// probeBinary builds testdata/probe, a static binary to run inside containers, once per test run
+func probeBinary(t *testing.T) []byte {
+	t.Helper()
+	probe.once.Do(func() {
+		dir, err := os.MkdirTemp("", "probe.")
+		if err != nil {
+			probe.err = err
+			return
+		}
+		probe.path = filepath.Join(dir, "probe")
+		cmd := exec.Command(filepath.Join(runtime.GOROOT(), "bin", "go"), "build", "-o", probe.path, "./testdata/probe")
+		cmd.Env = append(os.Environ(), "CGO_ENABLED=0")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			probe.err = fmt.Errorf("could not build probe: %v\n%s", err, out)
+		}
+	})
+	if probe.err != nil {
+		t.Fatal(probe.err)
+	}
+	data, err := os.ReadFile(probe.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// probeLayer is a layer holding the probe at /bin/probe
+func probeLayer(t *testing.T) []byte {
+	t.Helper()
+	return buildLayer(t, []tarEntry{
+		tarDir("bin/"),
+		{name: "bin/probe", typeflag: tar.TypeReg, body: string(probeBinary(t)), mode: 0755},
+	})
+}
+
+// tool runs the tool with its state kept in dir, returning what it wrote to stdout and stderr
+// and its exit code
+func tool(t *testing.T, dir string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), stateDirEnv+"="+dir)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	if _, ok := err.(*exec.ExitError); err != nil && !ok {
+		t.Fatal(err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// startTool starts the tool like tool, in the background, to run a container whose state is
+// kept in dir, returning once the container is running. What the tool writes to stdout and stderr
+// goes to output.
+func startTool(t *testing.T, dir string, output io.Writer, args ...string) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), stateDirEnv+"="+dir)
+	cmd.Stdout, cmd.Stderr = output, output
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if cmd.ProcessState == nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+		}
+	})
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if states, _ := filepath.Glob(filepath.Join(dir, "state", "*.json")); len(states) > 0 {
+			return cmd
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("container did not start: %v", output)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestPullCommand(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layers := [][]byte{
+		buildLayer(t, []tarEntry{tarFile("a", "a")}),
+		buildLayer(t, []tarEntry{tarFile("b", "b")}),
+	}
+	ref := registry.push("app", "latest", newFakeImage(t, layers...))
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		// wantLayers is set when the layers should be in the layer store afterwards
+		wantLayers bool
+	}{
+		{
+			name:       "pull",
+			args:       []string{ref},
+			wantStdout: fmt.Sprintf("Pulled %s (2 layers)\n", ref),
+			wantLayers: true,
+		},
+		{
+			name:       "sequential",
+			args:       []string{"--sequential", ref},
+			wantStdout: fmt.Sprintf("Pulled %s (2 layers)\n", ref),
+			wantLayers: true,
+		},
+		{
+			name:       "missing image",
+			args:       []string{registry.host + "/missing:latest"},
+			wantCode:   1,
+			wantStdout: "manifest unknown",
+		},
+		{
+			name:       "long tag",
+			args:       []string{registry.host + "/app:" + strings.Repeat("t", maxTagLength+1)},
+			wantCode:   1,
+			wantStdout: "image tag is 129 characters long, but tags may be at most 128\n",
+		},
+		{
+			name:       "no image",
+			wantCode:   1,
+			wantStdout: "Incorrect number of arguments specified.\n",
+		},
+		{
+			name:       "no downloads",
+			args:       []string{"--max-concurrent-downloads", "0", ref},
+			wantCode:   1,
+			wantStdout: "--max-concurrent-downloads must be at least 1\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := append([]string{"--insecure-registry", registry.host, "pull"}, tt.args...)
+			stdout, stderr, code := tool(t, dir, args...)
+			if code != tt.wantCode {
+				t.Fatalf("pull exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("pull printed %q, want %q", stdout, tt.wantStdout)
+			}
+			for _, layer := range layers {
+				name := filepath.Join(dir, "layers", strings.TrimPrefix(digestOf(layer), "sha256:")+".tar.gz")
+				if _, err := os.Stat(name); (err == nil) != tt.wantLayers {
+					t.Errorf("layer %s is in the layer store: %t, want %t", digestOf(layer), err == nil, tt.wantLayers)
+				}
+			}
+		})
+	}
+}
+
+// runProbe runs the probe with args in a container of an image holding nothing else, passing
+// flags to run, and returns what the run wrote to stdout and stderr and its exit code
+func runProbe(t *testing.T, flags []string, args ...string) (string, string, int) {
+	t.Helper()
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+	command := append([]string{"--insecure-registry", registry.host, "run"}, flags...)
+	command = append(append(command, ref, "/bin/probe"), args...)
+	return tool(t, t.TempDir(), command...)
+}
+
+func TestSelftestCommand(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	echo := buildLayer(t, []tarEntry{
+		tarDir("bin/"),
+		{name: "bin/echo", typeflag: tar.TypeReg, body: string(probeBinary(t)), mode: 0755},
+	})
+	withEcho := registry.push("echo", "latest", newFakeImage(t, echo))
+	withoutEcho := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+
+	tests := []struct {
+		name       string
+		image      string
+		wantCode   int
+		wantStdout string
+	}{
+		{
+			name:       "passes",
+			image:      withEcho,
+			wantStdout: "selftest: pull... ok\nselftest: run... ok\nselftest passed\n",
+		},
+		{
+			name:       "missing image",
+			image:      registry.host + "/missing:latest",
+			wantCode:   1,
+			wantStdout: "selftest: pull... failed\nselftest failed at step \"pull\"",
+		},
+		{
+			name:       "no echo",
+			image:      withoutEcho,
+			wantCode:   1,
+			wantStdout: "selftest: run... failed\nselftest failed at step \"run\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := tool(t, t.TempDir(), "--insecure-registry", registry.host, "selftest", "--image", tt.image)
+			if code != tt.wantCode {
+				t.Fatalf("selftest exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("selftest printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestInspectCommand(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	amd64 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "amd64"}, layer)
+	arm := newFakeImageFor(t, Platform{Os: "linux", Architecture: "arm", Variant: "v7"}, layer)
+	multi := registry.pushIndex(t, "multi", "latest", amd64, arm)
+	single := registry.push("single", "latest", amd64)
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{
+			name: "platforms",
+			args: []string{"--platforms", multi},
+			// Columns are as wide as their widest entry, a digest being 71 characters long
+			wantStdout: fmt.Sprintf("%-14s%-73s%s\n%-14s%-73s%d\n%-14s%-73s%d\n",
+				"PLATFORM", "DIGEST", "SIZE",
+				"linux/amd64", digestOf(amd64.manifest), len(amd64.manifest),
+				"linux/arm/v7", digestOf(arm.manifest), len(arm.manifest)),
+		},
+		{
+			name:       "single platform",
+			args:       []string{"--platforms", single},
+			wantCode:   1,
+			wantStdout: single + " is not a multi-platform image\n",
+		},
+		{
+			name:       "platforms with format",
+			args:       []string{"--platforms", "--format", "{{.Digest}}", multi},
+			wantCode:   1,
+			wantStdout: "--platforms cannot be combined with --format\n",
+		},
+		{
+			name:       "platforms with platform",
+			args:       []string{"--platforms", "--platform", "linux/amd64", multi},
+			wantCode:   1,
+			wantStdout: "--platforms cannot be combined with --platform\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--insecure-registry", registry.host, "inspect"}, tt.args...)
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != tt.wantCode {
+				t.Fatalf("inspect exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("inspect printed\n%s\nwant\n%s", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestLoadCommand(t *testing.T) {
+	first := newFakeImageWith(t, OCIImageConfig{Cmd: []string{"first"}}, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+	second := newFakeImageWith(t, OCIImageConfig{Cmd: []string{"second"}}, buildTar(t, []tarEntry{tarFile("b", "b")}))
+	both := writeArchive(t, archiveEntries(t,
+		archiveImage{[]string{"first:latest", "first:1.0"}, first},
+		archiveImage{[]string{"second:latest"}, second},
+	))
+	untagged := writeArchive(t, archiveEntries(t, archiveImage{nil, first}))
+	noManifest := writeArchive(t, []tarEntry{tarFile("a", "a")})
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		// wantImages are the references of the image index afterwards
+		wantImages []string
+	}{
+		{
+			name:       "tagged",
+			args:       []string{both},
+			wantStdout: "Loaded image: first:latest\nLoaded image: first:1.0\nLoaded image: second:latest\n",
+			wantImages: []string{"docker.io/library/first:latest", "docker.io/library/first:1.0", "docker.io/library/second:latest"},
+		},
+		{
+			name:       "untagged",
+			args:       []string{untagged},
+			wantStdout: "Loaded image ID: " + digestOf(first.config) + "\n",
+		},
+		{
+			name:       "no manifest",
+			args:       []string{noManifest},
+			wantCode:   1,
+			wantStdout: "archive " + noManifest + " has no manifest.json describing its images; is it the output of docker save?\n",
+		},
+		{
+			name:       "no archive",
+			wantCode:   1,
+			wantStdout: "Incorrect number of arguments specified.\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			stdout, stderr, code := tool(t, dir, append([]string{"load"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Fatalf("load exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("load printed %q, want %q", stdout, tt.wantStdout)
+			}
+			var images []StoredImage
+			if data, err := os.ReadFile(filepath.Join(dir, "images.json")); err == nil {
+				if err := json.Unmarshal(data, &images); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var references []string
+			for _, image := range images {
+				references = append(references, image.Reference)
+			}
+			if !reflect.DeepEqual(references, tt.wantImages) {
+				t.Errorf("image index holds %q, want %q", references, tt.wantImages)
+			}
+		})
+	}
+}
+
+func TestExportCommand(t *testing.T) {
+	registry := newFakeRegistry(t)
+	ref := registry.push("app", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStderr string
+		// wantOutput is set when the tar should be written to the output file
+		wantOutput bool
+	}{
+		{name: "to file", args: []string{ref}, wantOutput: true},
+		{name: "missing image", args: []string{registry.host + "/missing"}, wantCode: 1, wantStderr: "manifest unknown"},
+		{name: "no image", wantCode: 1, wantStderr: "Incorrect number of arguments specified.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			output := filepath.Join(dir, "rootfs.tar")
+			args := append([]string{"--insecure-registry", registry.host, "export", "-o", output}, tt.args...)
+			stdout, stderr, code := tool(t, dir, args...)
+			if code != tt.wantCode {
+				t.Fatalf("export exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stderr, tt.wantStderr) {
+				t.Errorf("export printed %q to stderr, want %q", stderr, tt.wantStderr)
+			}
+			data, err := os.ReadFile(output)
+			if (err == nil) != tt.wantOutput {
+				t.Fatalf("export wrote %s: %t, want %t", output, err == nil, tt.wantOutput)
+			}
+			if tt.wantOutput && !reflect.DeepEqual(tarListing(t, data), []string{`a "a"`}) {
+				t.Errorf("export wrote %q", tarListing(t, data))
+			}
+		})
+	}
+}
+
+func TestPullInterrupted(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	ref := registry.push("app", "latest", newFakeImage(t, layer))
+	requested := make(chan struct{}, 1)
+	registry.mu.Lock()
+	registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+		if !strings.HasSuffix(r.URL.Path, digestOf(layer)) {
+			return false
+		}
+		select {
+		case requested <- struct{}{}:
+		default:
+		}
+		<-r.Context().Done()
+		return true
+	}
+	registry.mu.Unlock()
+
+	tests := []struct {
+		name   string
+		signal syscall.Signal
+	}{
+		{name: "interrupt", signal: syscall.SIGINT},
+		{name: "terminate", signal: syscall.SIGTERM},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var output bytes.Buffer
+			cmd := exec.Command(os.Args[0], "--insecure-registry", registry.host, "pull", ref)
+			cmd.Env = append(os.Environ(), stateDirEnv+"="+t.TempDir())
+			cmd.Stdout, cmd.Stderr = &output, &output
+			if err := cmd.Start(); err != nil {
+				t.Fatal(err)
+			}
+			defer cmd.Process.Kill()
+			select {
+			case <-requested:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("layer was not requested: %s", &output)
+			}
+
+			cmd.Process.Signal(tt.signal)
+			done := make(chan error, 1)
+			go func() { done <- cmd.Wait() }()
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatalf("pull did not stop after %v", tt.signal)
+			}
+			if code := cmd.ProcessState.ExitCode(); code != 1 {
+				t.Errorf("pull exited with %d, want 1: %s", code, &output)
+			}
+			if !strings.Contains(output.String(), "pull cancelled: context canceled") {
+				t.Errorf("pull printed %q, want it to report being cancelled", &output)
+			}
+		})
+	}
+}
+
+func TestImagesCommand(t *testing.T) {
+	registry := newFakeRegistry(t)
+	first := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+	second := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("b", "b")}), buildLayer(t, []tarEntry{tarFile("c", "c")}))
+	firstRef := registry.push("first", "1.0", first)
+	secondRef := registry.push("team/second", "latest", second)
+	secondSize := int64(len(second.layers[0]) + len(second.layers[1]))
+	// Columns are as wide as their widest entry and two spaces
+	width := len(registry.host+"/team/second") + 2
+
+	tests := []struct {
+		name string
+		// pulled are the images pulled beforehand
+		pulled     []string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "none", wantStdout: "REPOSITORY  TAG  DIGEST  SIZE\n"},
+		{
+			name:   "pulled",
+			pulled: []string{firstRef, secondRef},
+			wantStdout: fmt.Sprintf("%-*s%-8s%-14s%s\n%-*s%-8s%-14s%s\n%-*s%-8s%-14s%s\n",
+				width, "REPOSITORY", "TAG", "DIGEST", "SIZE",
+				width, registry.host+"/first", "1.0", shortDigest(digestOf(first.manifest)), formatBytes(int64(len(first.layers[0]))),
+				width, registry.host+"/team/second", "latest", shortDigest(digestOf(second.manifest)), formatBytes(secondSize)),
+		},
+		{
+			name:       "quiet",
+			pulled:     []string{firstRef, secondRef},
+			args:       []string{"-q"},
+			wantStdout: shortDigest(digestOf(first.manifest)) + "\n" + shortDigest(digestOf(second.manifest)) + "\n",
+		},
+		{
+			name:       "repulled",
+			pulled:     []string{firstRef, firstRef},
+			args:       []string{"--quiet"},
+			wantStdout: shortDigest(digestOf(first.manifest)) + "\n",
+		},
+		{name: "argument", args: []string{"first"}, wantCode: 1, wantStdout: "Incorrect number of arguments specified.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, ref := range tt.pulled {
+				if stdout, stderr, code := tool(t, dir, "--insecure-registry", registry.host, "pull", ref); code != 0 {
+					t.Fatalf("pull exited with %d: %s%s", code, stdout, stderr)
+				}
+			}
+			stdout, stderr, code := tool(t, dir, append([]string{"images"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Fatalf("images exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("images printed\n%s\nwant\n%s", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestRmiCommand(t *testing.T) {
+	registry := newFakeRegistry(t)
+	shared := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	own := buildLayer(t, []tarEntry{tarFile("b", "b")})
+	app := registry.push("app", "latest", newFakeImage(t, shared, own))
+	other := registry.push("other", "latest", newFakeImage(t, shared))
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{
+			name:       "unshared layers",
+			args:       []string{app},
+			wantStdout: "Untagged: " + app + "\nDeleted: " + digestOf(own) + "\n",
+		},
+		{
+			name:       "every image",
+			args:       []string{app, other},
+			wantStdout: "Untagged: " + app + "\nDeleted: " + digestOf(own) + "\nUntagged: " + other + "\nDeleted: " + digestOf(shared) + "\n",
+		},
+		{
+			name:       "missing image",
+			args:       []string{registry.host + "/missing", other},
+			wantCode:   1,
+			wantStdout: "image not found: " + registry.host + "/missing:latest\nUntagged: " + other + "\n",
+		},
+		{name: "no image", wantCode: 1, wantStdout: "Incorrect number of arguments specified.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for _, ref := range []string{app, other} {
+				if stdout, stderr, code := tool(t, dir, "--insecure-registry", registry.host, "pull", ref); code != 0 {
+					t.Fatalf("pull exited with %d: %s%s", code, stdout, stderr)
+				}
+			}
+			stdout, stderr, code := tool(t, dir, append([]string{"rmi"}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Fatalf("rmi exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("rmi printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestVersionCommand(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{
+			name: "version",
+			args: []string{"version"},
+			wantStdout: "Version:     (devel)\nGit commit:  unknown\nGo version:  " + runtime.Version() + "\n" +
+				"OS/Arch:     " + runtime.GOOS + "/" + runtime.GOARCH + "\n",
+		},
+		{name: "arguments", args: []string{"version", "extra"}, wantCode: 1, wantStdout: "Incorrect number of arguments specified.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := tool(t, t.TempDir(), tt.args...)
+			if code != tt.wantCode {
+				t.Fatalf("version exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("version printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestUsage(t *testing.T) {
+	tests := []struct {
+		name     string
+		args     []string
+		wantCode int
+		// wantStdout and wantStderr start what is printed, with usage following in one of them
+		wantStdout string
+		wantStderr string
+	}{
+		{name: "help", args: []string{"help"}, wantStdout: "Usage: "},
+		{name: "no command", args: []string{"--verbose"}, wantCode: 1, wantStderr: "No command specified.\nUsage: "},
+		{name: "unknown command", args: []string{"bogus"}, wantCode: 1, wantStderr: "Unknown command \"bogus\".\nUsage: "},
+		{name: "global -h", args: []string{"-h"}, wantStderr: "Usage: "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := tool(t, t.TempDir(), tt.args...)
+			if code != tt.wantCode {
+				t.Fatalf("exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.HasPrefix(stdout, tt.wantStdout) || !strings.HasPrefix(stderr, tt.wantStderr) {
+				t.Fatalf("printed %q and %q to stderr, want them to start %q and %q", stdout, stderr, tt.wantStdout, tt.wantStderr)
+			}
+			printed := stdout + stderr
+			for _, command := range commands {
+				if !strings.Contains(printed, command.synopsis) || !strings.Contains(printed, command.description) {
+					t.Errorf("usage does not describe %s", strings.Fields(command.synopsis)[0])
+				}
+			}
+			if !strings.Contains(printed, "Global options:\n") || !strings.Contains(printed, "-insecure-registry") {
+				t.Errorf("usage does not list the global options:\n%s", printed)
+			}
+		})
+	}
+
+	// Each command listed is one the tool runs
+	for _, command := range commands {
+		name := strings.Fields(command.synopsis)[0]
+		stdout, stderr, _ := tool(t, t.TempDir(), name, "--no-such-flag")
+		if strings.Contains(stdout+stderr, "Unknown command") {
+			t.Errorf("usage lists %s, which is not a command", name)
+		}
+	}
+}
+
+func TestLogEvents(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layer := probeLayer(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, layer))
+
+	tests := []struct {
+		name      string
+		format    string
+		args      []string
+		container bool
+		wantCode  int
+		// wantEvents are the events logged, in order, and wantExitCode the code of the exited one
+		wantEvents   []string
+		wantExitCode float64
+	}{
+		{name: "pull", format: logFormatJSON, args: []string{"pull", ref}, wantEvents: []string{"pull-start", "layer-downloaded"}},
+		{
+			name:       "run",
+			format:     logFormatJSON,
+			args:       []string{"run", ref, "/bin/probe", "exit", "0"},
+			container:  true,
+			wantEvents: []string{"pull-start", "layer-downloaded", "extract-complete", "container-started", "exited"},
+		},
+		{
+			name:         "run failing",
+			format:       logFormatJSON,
+			args:         []string{"run", ref, "/bin/probe", "exit", "3"},
+			container:    true,
+			wantCode:     3,
+			wantEvents:   []string{"pull-start", "layer-downloaded", "extract-complete", "container-started", "exited"},
+			wantExitCode: 3,
+		},
+		{name: "text", format: logFormatText, args: []string{"run", ref, "/bin/probe", "exit", "0"}, container: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.container {
+				requireContainers(t)
+			}
+			args := append([]string{"--log-format", tt.format, "--insecure-registry", registry.host}, tt.args...)
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != tt.wantCode {
+				t.Fatalf("exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+
+			var events []string
+			for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+				if line == "" {
+					continue
+				}
+				var object map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &object); err != nil {
+					if tt.format == logFormatJSON {
+						t.Errorf("logged %q, which is not a JSON object", line)
+					}
+					continue
+				}
+				event, ok := object["event"].(string)
+				if !ok {
+					continue
+				}
+				events = append(events, event)
+				if _, ok := object["level"]; ok {
+					t.Errorf("event %s has a level: %s", event, line)
+				}
+				switch event {
+				case "layer-downloaded":
+					if object["digest"] != digestOf(layer) || object["bytes"] != float64(len(layer)) {
+						t.Errorf("logged %s, want layer %s of %d bytes", line, digestOf(layer), len(layer))
+					}
+				case "exited":
+					if object["code"] != tt.wantExitCode {
+						t.Errorf("logged %s, want code %v", line, tt.wantExitCode)
+					}
+				}
+			}
+			if strings.Join(events, " ") != strings.Join(tt.wantEvents, " ") {
+				t.Errorf("logged events %q, want %q:\n%s", events, tt.wantEvents, stderr)
+			}
+		})
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "pull", args: []string{"pull", "--dry-run", ref}, wantStdout: "1 of 1 layers would be downloaded"},
+		{name: "run", args: []string{"run", "--dry-run", ref, "/bin/probe", "exit", "3"}, wantStdout: "1 of 1 layers would be downloaded"},
+		{name: "run from an archive", args: []string{"run", "--dry-run", "--from-archive", "image.tar", "/bin/probe"}, wantCode: 1, wantStdout: "--dry-run cannot be combined with --from-archive\n"},
+		{name: "run generating a spec", args: []string{"run", "--dry-run", "--generate-spec", "bundle", ref}, wantCode: 1, wantStdout: "--dry-run cannot be combined with --generate-spec\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			layers := registry.count("/blobs/")
+			stdout, stderr, code := tool(t, dir, append([]string{"--insecure-registry", registry.host}, tt.args...)...)
+			if code != tt.wantCode {
+				t.Fatalf("exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("printed %q, want it to contain %q", stdout, tt.wantStdout)
+			}
+			// Only the image's configuration is fetched, and nothing is stored or run
+			if n := registry.count("/blobs/") - layers; n > 1 {
+				t.Errorf("%d blobs were downloaded, want only the configuration", n)
+			}
+			for _, name := range []string{"layers", "state"} {
+				if entries, _ := os.ReadDir(filepath.Join(dir, name)); len(entries) > 0 {
+					t.Errorf("%s has %d entries after a dry run", name, len(entries))
+				}
+			}
+		})
+	}
+}
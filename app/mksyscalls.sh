@@ -0,0 +1,32 @@
+#!/bin/sh
+#
+# mksyscalls.sh writes the tables mapping syscall names, as used in seccomp profiles, to their
+# numbers on each architecture seccomp profiles can be compiled for, from those defined by
+# golang.org/x/sys/unix. Run it with go generate after updating golang.org/x/sys.
+set -e
+dir=$(go list -m -f '{{.Dir}}' golang.org/x/sys)/unix
+for arch in amd64 arm64; do
+	case $arch in
+	amd64) audit=AUDIT_ARCH_X86_64 ;;
+	arm64) audit=AUDIT_ARCH_AARCH64 ;;
+	esac
+	out=seccomp_syscalls_linux_$arch.go
+	{
+		echo "// Code generated by mksyscalls.sh; DO NOT EDIT."
+		echo
+		echo "package main"
+		echo
+		echo 'import "golang.org/x/sys/unix"'
+		echo
+		echo "// seccompAuditArch identifies this architecture's syscalls to seccomp filters"
+		echo "const seccompAuditArch = unix.$audit"
+		echo
+		echo "// syscallNumbers maps syscall names to their numbers on this architecture"
+		echo "var syscallNumbers = map[string]uintptr{"
+		sed -n 's/^	\(SYS_\([A-Z0-9_]*\)\) .*/\2 \1/p' "$dir/zsysnum_linux_$arch.go" | while read -r name constant; do
+			printf '\t"%s": unix.%s,\n' "$(echo "$name" | tr 'A-Z' 'a-z')" "$constant"
+		done
+		echo "}"
+	} >"$out"
+	gofmt -w "$out"
+done
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// setupBindMounts mounts each volume's host path over its destination beneath rootfs. It must run
+// in the container's mount namespace before the root is pivoted, while host paths are reachable.
+func setupBindMounts(rootfs string, mounts []BindMount) error {
+	rootfs, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range mounts {
+		// The image could contain symlinks redirecting the destination, which are followed as
+		// they would be inside the container so that the mount, and any directories created
+		// for it, stay within the root filesystem
+		target, err := resolveDirInRoot(rootfs, m.Destination)
+		if err != nil {
+			return fmt.Errorf("could not find volume destination %s: %w", m.Destination, err)
+		}
+
+		if err := createMountTarget(m.Source, target); err != nil {
+			return err
+		}
+		if err := syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+			return fmt.Errorf("could not mount volume %s at %s: %w", m.Source, m.Destination, err)
+		}
+		// The read-only flag is ignored when creating a bind mount, so it must be applied by remounting
+		if m.ReadOnly {
+			if err := syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|syscall.MS_REC, ""); err != nil {
+				return fmt.Errorf("could not make volume %s read-only: %w", m.Destination, err)
+			}
+		}
+	}
+	return nil
+}
+
+// createMountTarget creates the file or directory a bind mount of source is mounted over
+func createMountTarget(source, target string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return os.MkdirAll(target, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(target, os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// readOnlyTmpfs are the directories given a writable tmpfs when the root filesystem is read-only,
+// as programs expect to be able to write temporary and runtime files there
+var readOnlyTmpfs = []struct {
+	path string
+	mode string
+}{
+	{"/tmp", "1777"},
+	{"/run", "755"},
+}
+
+// makeRootReadOnly remounts the pivoted root filesystem read-only, after mounting a tmpfs over
+// each of readOnlyTmpfs that no volume is mounted at. Mounts beneath the root, such as /proc,
+// /dev and volumes, keep their own flags.
+func makeRootReadOnly(mounts []BindMount) error {
+	for _, tmpfs := range readOnlyTmpfs {
+		if hasMountAt(mounts, tmpfs.path) {
+			continue
+		}
+		if err := os.MkdirAll(tmpfs.path, 0755); err != nil {
+			return err
+		}
+		if err := syscall.Mount("tmpfs", tmpfs.path, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "mode="+tmpfs.mode); err != nil {
+			return fmt.Errorf("could not mount tmpfs at %s: %w", tmpfs.path, err)
+		}
+	}
+	if err := syscall.Mount("", "/", "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY, ""); err != nil {
+		return fmt.Errorf("could not make the root filesystem read-only: %w", err)
+	}
+	return nil
+}
+
+// unwritableVolumes lists, in order, the volumes an image declares that nothing would be mounted
+// at in a container whose root filesystem is read-only, so that the image could not write there
+func unwritableVolumes(volumes map[string]struct{}, mounts []BindMount) []string {
+	var unwritable []string
+	for volume := range volumes {
+		writable := hasMountAt(mounts, volume)
+		for _, tmpfs := range readOnlyTmpfs {
+			writable = writable || withinDir(tmpfs.path, volume)
+		}
+		if !writable {
+			unwritable = append(unwritable, volume)
+		}
+	}
+	sort.Strings(unwritable)
+	return unwritable
+}
+
+// hasMountAt reports whether one of mounts is mounted at path in the container
+func hasMountAt(mounts []BindMount, path string) bool {
+	for _, m := range mounts {
+		if filepath.Clean(m.Destination) == filepath.Clean(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// makeMountsPrivate keeps mount events within the container's mount namespace from propagating
+// back to the host
+func makeMountsPrivate() error {
+	if err := syscall.Mount("", "/", "", syscall.MS_PRIVATE|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("could not make mounts private: %w", err)
+	}
+	return nil
+}
+
+// unmountBeneath detaches every mount at or beneath dir visible in this mount namespace, in the
+// reverse of the order they were mounted so that nested mounts are removed first
+func unmountBeneath(dir string) error {
+	f, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var mountpoints []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+		mountpoint := unescapeMountinfo(fields[4])
+		if withinDir(dir, mountpoint) {
+			mountpoints = append(mountpoints, mountpoint)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for i := len(mountpoints) - 1; i >= 0; i-- {
+		if err := syscall.Unmount(mountpoints[i], syscall.MNT_DETACH); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("could not unmount %s: %w", mountpoints[i], err)
+		}
+	}
+	return nil
+}
+
+// unescapeMountinfo decodes the octal escapes used for spaces and other characters in mountinfo paths
+func unescapeMountinfo(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
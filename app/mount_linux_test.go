@@ -0,0 +1,260 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRunVolumes(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("volumes", "latest", newFakeImage(t,
+		probeLayer(t),
+		buildLayer(t, []tarEntry{tarSymlink("escape", "/..")}),
+	))
+	host := t.TempDir()
+	file := filepath.Join(host, "file")
+
+	tests := []struct {
+		name  string
+		flags []string
+		args  []string
+		// wantCode is the exit code of the run, and wantStdout part of what it prints
+		wantCode   int
+		wantStdout string
+		// wantHost is the content of the host file afterwards
+		wantHost string
+	}{
+		{
+			name:       "read from a volume",
+			flags:      []string{"-v", host + ":/data"},
+			args:       []string{"cat", "/data/file"},
+			wantStdout: "host",
+			wantHost:   "host",
+		},
+		{
+			name:     "write to a volume",
+			flags:    []string{"-v", host + ":/data:rw"},
+			args:     []string{"write", "/data/file", "container"},
+			wantHost: "container",
+		},
+		{
+			name:     "write to a read-only volume",
+			flags:    []string{"-v", host + ":/data:ro"},
+			args:     []string{"write", "/data/file", "container"},
+			wantCode: 1,
+			wantHost: "host",
+		},
+		{
+			name:       "mount a single file",
+			flags:      []string{"--volume", filepath.Join(host, "file") + ":/etc/file"},
+			args:       []string{"cat", "/etc/file"},
+			wantStdout: "host",
+			wantHost:   "host",
+		},
+		{
+			name:       "destination through a symlink leaving the container",
+			flags:      []string{"-v", host + ":/escape" + filepath.Join(host, "created")},
+			args:       []string{"cat", filepath.Join(host, "created", "file")},
+			wantStdout: "host",
+			wantHost:   "host",
+		},
+		{
+			name:       "protected host path",
+			flags:      []string{"-v", "/proc:/host"},
+			args:       []string{"ls", "/host"},
+			wantCode:   1,
+			wantStdout: "is a protected host path",
+			wantHost:   "host",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := os.WriteFile(file, []byte("host"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			args := append([]string{"--insecure-registry", registry.host, "run"}, tt.flags...)
+			args = append(append(args, ref, "/bin/probe"), tt.args...)
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+			if body, err := os.ReadFile(file); err != nil || string(body) != tt.wantHost {
+				t.Errorf("host file holds %q, %v, want %q", body, err, tt.wantHost)
+			}
+			if _, err := os.Lstat(filepath.Join(host, "created")); !os.IsNotExist(err) {
+				t.Errorf("a volume destination was created on the host: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunExposeCache(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	probe := probeLayer(t)
+	ref := registry.push("cache", "latest", newFakeImage(t, probe))
+	layer := strings.TrimPrefix(digestOf(probe), "sha256:") + ".tar.gz"
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "layers are listed", args: []string{"ls", "/cache"}, wantStdout: layer},
+		{name: "layers cannot be changed", args: []string{"write", "/cache/" + layer, "changed"}, wantCode: 1},
+		{name: "layers cannot be added", args: []string{"write", "/cache/new", "new"}, wantCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := []string{"--insecure-registry", registry.host, "run", "--expose-cache", "/cache", ref, "/bin/probe"}
+			stdout, stderr, code := tool(t, dir, append(args, tt.args...)...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+			if _, err := os.Stat(filepath.Join(dir, "layers", "new")); !os.IsNotExist(err) {
+				t.Errorf("a file was added to the layer store: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunVolumeModes(t *testing.T) {
+	requireContainers(t)
+	host := t.TempDir()
+
+	tests := []struct {
+		name   string
+		volume string
+		// wantOptions is the mount option expected for /data, or empty when the run should fail
+		wantOptions string
+	}{
+		{name: "default", volume: host + ":/data", wantOptions: "rw"},
+		{name: "read-write", volume: host + ":/data:rw", wantOptions: "rw"},
+		{name: "read-only", volume: host + ":/data:ro", wantOptions: "ro"},
+		{name: "unknown mode", volume: host + ":/data:rx"},
+		{name: "missing host path", volume: filepath.Join(host, "missing") + ":/data"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, []string{"-v", tt.volume}, "cat", "/proc/self/mountinfo")
+			if tt.wantOptions == "" {
+				if code == 0 || !strings.Contains(stdout, "invalid volume") {
+					t.Errorf("run exited with %d, want it to refuse the volume: %s%s", code, stdout, stderr)
+				}
+				return
+			}
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			var options string
+			for _, line := range strings.Split(stdout, "\n") {
+				if fields := strings.Fields(line); len(fields) > 5 && fields[4] == "/data" {
+					options = fields[5]
+				}
+			}
+			if !containsString(strings.Split(options, ","), tt.wantOptions) {
+				t.Errorf("/data is mounted with %q, want %s", options, tt.wantOptions)
+			}
+		})
+	}
+}
+
+func TestUnwritableVolumes(t *testing.T) {
+	tests := []struct {
+		name    string
+		volumes []string
+		mounts  []BindMount
+		want    []string
+	}{
+		{name: "none"},
+		{name: "unmounted", volumes: []string{"/var/lib/data", "/data"}, want: []string{"/data", "/var/lib/data"}},
+		{name: "mounted", volumes: []string{"/data"}, mounts: []BindMount{{Source: "/srv", Destination: "/data/"}}},
+		{name: "beneath a tmpfs", volumes: []string{"/tmp/cache", "/run/app"}},
+		{name: "tmpfs itself", volumes: []string{"/tmp"}},
+		{name: "beside a tmpfs", volumes: []string{"/tmpdata"}, want: []string{"/tmpdata"}},
+		{name: "mount elsewhere", volumes: []string{"/data"}, mounts: []BindMount{{Source: "/srv", Destination: "/data/sub"}}, want: []string{"/data"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volumes := make(map[string]struct{})
+			for _, volume := range tt.volumes {
+				volumes[volume] = struct{}{}
+			}
+			if got := unwritableVolumes(volumes, tt.mounts); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("unwritableVolumes(%q) = %q, want %q", tt.volumes, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunReadOnly(t *testing.T) {
+	requireContainers(t)
+	host := t.TempDir()
+
+	tests := []struct {
+		name       string
+		flags      []string
+		args       []string
+		volumes    []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "write to the root", flags: []string{"--read-only"}, args: []string{"write", "/file", "data"}, wantCode: 1},
+		{name: "write to /tmp", flags: []string{"--read-only"}, args: []string{"write", "/tmp/file", "data"}},
+		{name: "write to /run", flags: []string{"--read-only"}, args: []string{"write", "/run/file", "data"}},
+		{name: "write to a volume", flags: []string{"--read-only", "-v", host + ":/data"}, args: []string{"write", "/data/file", "data"}},
+		{name: "write without --read-only", args: []string{"write", "/file", "data"}},
+		{
+			name:       "unmounted image volume",
+			flags:      []string{"--read-only"},
+			args:       []string{"ls", "/"},
+			volumes:    []string{"/var/lib/app"},
+			wantCode:   1,
+			wantStdout: "the image expects /var/lib/app to be writable, but the root filesystem is read-only",
+		},
+		{
+			name:    "mounted image volume",
+			flags:   []string{"--read-only", "-v", host + ":/var/lib/app"},
+			args:    []string{"write", "/var/lib/app/file", "data"},
+			volumes: []string{"/var/lib/app"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := OCIImageConfig{Cmd: []string{"/bin/probe"}, Volumes: make(map[string]struct{})}
+			for _, volume := range tt.volumes {
+				settings.Volumes[volume] = struct{}{}
+			}
+			registry := newFakeRegistry(t)
+			ref := registry.push("readonly", "latest", newFakeImageWith(t, settings, probeLayer(t)))
+
+			args := append([]string{"--insecure-registry", registry.host, "run"}, tt.flags...)
+			args = append(append(args, ref, "/bin/probe"), tt.args...)
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
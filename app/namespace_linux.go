@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// setupTimeNamespace creates a time namespace for the container process offsetting CLOCK_MONOTONIC
+// and CLOCK_BOOTTIME by the given duration.
+// A new time namespace only applies to children of the calling thread, so the calling goroutine
+// is locked to its OS thread and must be the one that starts the container process.
+func setupTimeNamespace(offset time.Duration) error {
+	runtime.LockOSThread()
+
+	if err := unix.Unshare(unix.CLONE_NEWTIME); err != nil {
+		if errors.Is(err, unix.EINVAL) {
+			// Warnings go to stderr, which unlike stdout does not carry the container's output
+			logger.Warn("time namespaces are not supported by this kernel, ignoring time offset")
+			return nil
+		}
+		return fmt.Errorf("could not create time namespace: %w", err)
+	}
+
+	// timens_offsets is only listed for processes, but /proc/<tid> reaches the calling thread
+	// even when it does not lead its thread group
+	secs, nsecs := splitTimeOffset(offset)
+	offsets := fmt.Sprintf("monotonic %d %d\nboottime %d %d\n", secs, nsecs, secs, nsecs)
+	if err := os.WriteFile(fmt.Sprintf("/proc/%d/timens_offsets", unix.Gettid()), []byte(offsets), 0644); err != nil {
+		return fmt.Errorf("could not set time namespace offsets: %w", err)
+	}
+	return nil
+}
+
+// splitTimeOffset splits a clock offset into seconds and nanoseconds. The kernel requires the
+// nanosecond component to be positive, so negative offsets borrow from the seconds.
+func splitTimeOffset(offset time.Duration) (int64, int64) {
+	secs := int64(offset / time.Second)
+	nsecs := int64(offset % time.Second)
+	if nsecs < 0 {
+		secs--
+		nsecs += int64(time.Second)
+	}
+	return secs, nsecs
+}
+
+// setup_pivot_root makes newRoot the root filesystem of the current mount namespace and detaches
+// the old root, so that unlike a chroot it cannot be escaped back into. Mounts must already have
+// been made private.
+func setup_pivot_root(newRoot string) error {
+	// pivot_root requires the new root to be a mount point
+	if err := syscall.Mount(newRoot, newRoot, "", syscall.MS_BIND|syscall.MS_REC, ""); err != nil {
+		return fmt.Errorf("could not bind mount new root: %w", err)
+	}
+
+	putOld := filepath.Join(newRoot, ".pivot_root")
+	if err := os.MkdirAll(putOld, 0700); err != nil {
+		return err
+	}
+
+	if err := syscall.PivotRoot(newRoot, putOld); err != nil {
+		return fmt.Errorf("could not pivot root: %w", err)
+	}
+	if err := syscall.Chdir("/"); err != nil {
+		return fmt.Errorf("could not change directory: %w", err)
+	}
+
+	if err := syscall.Unmount("/.pivot_root", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("could not unmount old root: %w", err)
+	}
+	return os.Remove("/.pivot_root")
+}
+
+// mountProc mounts a fresh procfs at /proc within root so that it reflects the container's PID
+// namespace. Within a user namespace the kernel only allows procfs to be mounted while another
+// is still visible, so this must happen before the old root is detached.
+func mountProc(root string) error {
+	target := filepath.Join(root, "proc")
+	if err := os.MkdirAll(target, 0555); err != nil {
+		return err
+	}
+	if err := syscall.Mount("proc", target, "proc", syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_NODEV, ""); err != nil {
+		return fmt.Errorf("could not mount /proc: %w", err)
+	}
+	return nil
+}
+
+// rootlessIDMappings maps root inside the container's user namespace to the invoking user and group,
+// the only mapping an unprivileged user is allowed to create
+func rootlessIDMappings() (uidMappings, gidMappings []syscall.SysProcIDMap) {
+	uidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+	gidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	return uidMappings, gidMappings
+}
+
+func toIDMappings(mappings []syscall.SysProcIDMap) []IDMapping {
+	idMappings := make([]IDMapping, 0, len(mappings))
+	for _, m := range mappings {
+		idMappings = append(idMappings, IDMapping{ContainerID: m.ContainerID, HostID: m.HostID, Size: m.Size})
+	}
+	return idMappings
+}
+
+// execNamespaces are the namespaces exec joins, by their names under /proc/<pid>/ns. The mount
+// namespace cannot be joined by a process with several threads, as every Go program has, so
+// the container's root filesystem is entered through /proc/<pid>/root instead.
+var execNamespaces = []struct {
+	name string
+	flag int
+}{
+	{"ipc", unix.CLONE_NEWIPC},
+	{"uts", unix.CLONE_NEWUTS},
+	{"net", unix.CLONE_NEWNET},
+	{"pid", unix.CLONE_NEWPID},
+}
+
+// joinNamespaces moves the calling thread into the namespaces of the process pid, skipping
+// any it already shares, such as the network namespace of a container run with --network host
+func joinNamespaces(pid int) error {
+	for _, namespace := range execNamespaces {
+		path := fmt.Sprintf("/proc/%d/ns/%s", pid, namespace.name)
+		target, err := os.Stat(path)
+		if err != nil {
+			return fmt.Errorf("could not find %s namespace of container: %w", namespace.name, err)
+		}
+		if current, err := os.Stat("/proc/thread-self/ns/" + namespace.name); err == nil && os.SameFile(current, target) {
+			continue
+		}
+
+		fd, err := unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return fmt.Errorf("could not open %s namespace of container: %w", namespace.name, err)
+		}
+		err = unix.Setns(fd, namespace.flag)
+		unix.Close(fd)
+		if err != nil {
+			return fmt.Errorf("could not join %s namespace of container: %w", namespace.name, err)
+		}
+	}
+	return nil
+}
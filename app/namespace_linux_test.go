@@ -0,0 +1,177 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSplitTimeOffset(t *testing.T) {
+	tests := []struct {
+		offset    time.Duration
+		wantSecs  int64
+		wantNsecs int64
+	}{
+		{offset: 0, wantSecs: 0, wantNsecs: 0},
+		{offset: 90 * time.Second, wantSecs: 90, wantNsecs: 0},
+		{offset: 1500 * time.Millisecond, wantSecs: 1, wantNsecs: 500000000},
+		{offset: -90 * time.Second, wantSecs: -90, wantNsecs: 0},
+		{offset: -1500 * time.Millisecond, wantSecs: -2, wantNsecs: 500000000},
+		{offset: -time.Nanosecond, wantSecs: -1, wantNsecs: 999999999},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.offset.String(), func(t *testing.T) {
+			secs, nsecs := splitTimeOffset(tt.offset)
+			if secs != tt.wantSecs || nsecs != tt.wantNsecs {
+				t.Errorf("splitTimeOffset(%v) = %d, %d, want %d, %d", tt.offset, secs, nsecs, tt.wantSecs, tt.wantNsecs)
+			}
+		})
+	}
+}
+
+func TestRunTimeOffset(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+	dir := t.TempDir()
+	if _, stderr, code := tool(t, dir, "--insecure-registry", registry.host, "pull", ref); code != 0 {
+		t.Fatalf("pull exited with %d: %s", code, stderr)
+	}
+
+	tests := []struct {
+		name      string
+		offset    string
+		minUptime float64
+	}{
+		{name: "none", offset: "0s", minUptime: 0},
+		{name: "ten days", offset: "240h", minUptime: 240 * 60 * 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := tool(t, dir, "--insecure-registry", registry.host, "run", "--time-offset", tt.offset, ref, "/bin/probe", "cat", "/proc/uptime")
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			if strings.Contains(stderr, "time namespaces are not supported") {
+				t.Skip("time namespaces are not supported by this kernel")
+			}
+			fields := strings.Fields(stdout)
+			if len(fields) == 0 {
+				t.Fatalf("could not read /proc/uptime: %q", stdout)
+			}
+			uptime, err := strconv.ParseFloat(fields[0], 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if uptime < tt.minUptime {
+				t.Errorf("uptime in the container is %vs, want at least %vs", uptime, tt.minUptime)
+			}
+		})
+	}
+}
+
+func TestContainerMountNamespace(t *testing.T) {
+	requireContainers(t)
+
+	tests := []struct {
+		name string
+		args []string
+		// check reports what is wrong with what the probe printed, if anything
+		check func(stdout string) string
+	}{
+		{
+			name: "proc lists only the container's processes",
+			args: []string{"ls", "/proc"},
+			check: func(stdout string) string {
+				for _, name := range strings.Fields(stdout) {
+					if pid, err := strconv.Atoi(name); err == nil && pid != 1 {
+						return "process " + name + " from outside of the container is listed"
+					}
+				}
+				return ""
+			},
+		},
+		{
+			name: "proc is mounted at /proc",
+			args: []string{"cat", "/proc/self/mountinfo"},
+			check: func(stdout string) string {
+				for _, line := range strings.Split(stdout, "\n") {
+					if fields := strings.Fields(line); len(fields) > 4 && fields[4] == "/proc" {
+						return ""
+					}
+				}
+				return "no mount at /proc"
+			},
+		},
+		{
+			name: "host mounts are not visible",
+			args: []string{"cat", "/proc/self/mountinfo"},
+			check: func(stdout string) string {
+				for _, line := range strings.Split(stdout, "\n") {
+					fields := strings.Fields(line)
+					if len(fields) > 4 && (strings.HasPrefix(fields[4], "/.pivot_root") || strings.HasPrefix(fields[4], os.TempDir())) {
+						return "host mount " + fields[4] + " is listed"
+					}
+				}
+				return ""
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before, err := os.ReadFile("/proc/self/mountinfo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdout, stderr, code := runProbe(t, nil, tt.args...)
+			if code != 0 {
+				t.Fatalf("probe exited with %d: %s%s", code, stdout, stderr)
+			}
+			if problem := tt.check(stdout); problem != "" {
+				t.Errorf("%s:\n%s", problem, stdout)
+			}
+			after, err := os.ReadFile("/proc/self/mountinfo")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(strings.Split(string(after), "\n")) != len(strings.Split(string(before), "\n")) {
+				t.Errorf("the container's mounts leaked into the host")
+			}
+		})
+	}
+}
+
+func TestRunRootless(t *testing.T) {
+	requireContainers(t)
+
+	tests := []struct {
+		name string
+		args []string
+		want []string
+	}{
+		{name: "root in the container", args: []string{"id"}, want: []string{"uid=0", "gid=0"}},
+		{name: "uid map", args: []string{"cat", "/proc/self/uid_map"}, want: []string{"0", strconv.Itoa(os.Getuid()), "1"}},
+		{name: "gid map", args: []string{"cat", "/proc/self/gid_map"}, want: []string{"0", strconv.Itoa(os.Getgid()), "1"}},
+		{name: "setgroups denied", args: []string{"cat", "/proc/self/setgroups"}, want: []string{"deny"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, []string{"--rootless"}, tt.args...)
+			if code != 0 {
+				t.Fatalf("probe exited with %d: %s%s", code, stdout, stderr)
+			}
+			fields := strings.Fields(stdout)
+			for _, want := range tt.want {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("probe printed %q, want %s", fields, want)
+				}
+			}
+		})
+	}
+}
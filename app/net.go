@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// caCertEnv names a CA bundle to trust for registries when no --ca-cert is given
+const caCertEnv = "MYDOCKER_CA_CERT"
+
+// insecureRegistries are the registries, by host[:port], given with --insecure-registry. Their
+// certificates are not verified, and they are reached over plain HTTP if they do not speak TLS,
+// as self-hosted development registries often do not. Every other registry is verified.
+var insecureRegistries stringList
+
+// caCerts are the CA bundles given with --ca-cert, whose certificates registryRootCAs trusts
+// alongside the system's
+var (
+	caCerts         stringList
+	registryRootCAs *x509.CertPool
+)
+
+// loadCACerts adds the certificates of the CA bundles given with --ca-cert, or else named by
+// MYDOCKER_CA_CERT, to the system's roots, so that registries with certificates issued by an
+// internal CA are verified rather than needing --insecure-registry
+func loadCACerts() error {
+	if len(caCerts) == 0 {
+		if path := os.Getenv(caCertEnv); path != "" {
+			caCerts = stringList{path}
+		}
+	}
+	if len(caCerts) == 0 {
+		return nil
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		logger.Warn("could not load the system's root certificates, only trusting the given CAs", "error", err)
+		pool = x509.NewCertPool()
+	}
+	for _, path := range caCerts {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("could not read CA certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no PEM encoded certificates found in %s", path)
+		}
+	}
+	registryRootCAs = pool
+	return nil
+}
+
+// clientCert and clientKey are the files given with --client-cert and --client-key, holding
+// the certificate presented to registries which require clients to authenticate with one
+var (
+	clientCert                 string
+	clientKey                  string
+	registryClientCertificates []tls.Certificate
+)
+
+// loadClientCertificate loads the key pair given with --client-cert and --client-key
+func loadClientCertificate() error {
+	if clientCert == "" && clientKey == "" {
+		return nil
+	}
+	if clientCert == "" || clientKey == "" {
+		return errors.New("--client-cert and --client-key must be given together")
+	}
+	certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+	if err != nil {
+		return fmt.Errorf("could not load client certificate: %w", err)
+	}
+	registryClientCertificates = []tls.Certificate{certificate}
+	return nil
+}
+
+func createHTTPClient() *http.Client {
+	// There is no overall client timeout, as it would cover reading the body of every layer
+	return &http.Client{
+		Transport: &registryTransport{
+			secure: newTransport(&tls.Config{
+				RootCAs:      registryRootCAs,
+				Certificates: registryClientCertificates,
+			}),
+			insecure: newTransport(&tls.Config{
+				InsecureSkipVerify: true,
+				Certificates:       registryClientCertificates,
+			}),
+		},
+	}
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:       tlsConfig,
+		IdleConnTimeout:       time.Second * 30,
+		MaxIdleConns:          10,
+		TLSHandshakeTimeout:   tlsHandshakeTimeout,
+		ResponseHeaderTimeout: requestTimeout,
+		DialContext: func(ctx context.Context, network string, addr string) (net.Conn, error) {
+			return (&net.Dialer{Timeout: dialTimeout}).DialContext(ctx, "tcp4", addr)
+		},
+	}
+}
+
+// registryTransport sends requests for insecure registries through a transport which does not
+// verify certificates, and everything else through one which does
+type registryTransport struct {
+	secure   http.RoundTripper
+	insecure http.RoundTripper
+	// plainHTTP holds the insecure registries found to answer HTTPS requests with plain HTTP
+	plainHTTP sync.Map
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if !isInsecureRegistry(host) {
+		return t.secure.RoundTrip(req)
+	}
+	if req.URL.Scheme != "https" {
+		return t.insecure.RoundTrip(req)
+	}
+	if _, ok := t.plainHTTP.Load(host); ok {
+		return t.insecure.RoundTrip(withScheme(req, "http"))
+	}
+
+	resp, err := t.insecure.RoundTrip(req)
+	// A server speaking plain HTTP answers the TLS handshake with something other than a TLS
+	// record. Requests to registries have no body, so the request can be sent again as it was.
+	var recordErr tls.RecordHeaderError
+	if err != nil && errors.As(err, &recordErr) && (req.Body == nil || req.Body == http.NoBody) {
+		logger.Debug("insecure registry does not speak TLS, falling back to plain HTTP", "registry", host)
+		t.plainHTTP.Store(host, true)
+		return t.insecure.RoundTrip(withScheme(req, "http"))
+	}
+	return resp, err
+}
+
+// withScheme copies req to be sent with another URL scheme
+func withScheme(req *http.Request, scheme string) *http.Request {
+	req = req.Clone(req.Context())
+	req.URL.Scheme = scheme
+	return req
+}
+
+// isInsecureRegistry reports whether host, as it appears in a URL, was given with
+// --insecure-registry
+func isInsecureRegistry(host string) bool {
+	for _, registry := range insecureRegistries {
+		if registry == host {
+			return true
+		}
+	}
+	return false
+}
+
+// checkInsecureRegistries validates the registries given with --insecure-registry
+func checkInsecureRegistries() error {
+	for _, registry := range insecureRegistries {
+		if !referenceDomain.MatchString(registry) {
+			return fmt.Errorf("invalid insecure registry %q, expected host[:port]", registry)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// unansweredAddress returns the address of a socket which is listening but whose backlog is
+// full, so that connecting to it hangs until the connection attempt times out
+func unansweredAddress(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := (&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: sa.(*syscall.SockaddrInet4).Port}).String()
+	// Connections fill the backlog until one is no longer accepted
+	for i := 0; i < 8; i++ {
+		conn, err := net.DialTimeout("tcp4", addr, 100*time.Millisecond)
+		if err != nil {
+			return addr
+		}
+		t.Cleanup(func() { conn.Close() })
+	}
+	t.Skip("could not fill the backlog of a listening socket")
+	return ""
+}
+
+// silentAddress returns the address of a server which accepts connections but never says anything
+func silentAddress(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// testCA issues certificates for registries and their clients
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// path is a PEM file of the CA's certificate
+	path string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), name+".pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, path: path}
+}
+
+// issue returns a certificate for 127.0.0.1 signed by the CA, to be used by a server or, with
+// client set, a client, along with PEM files of the certificate and its key
+func (ca *testCA) issue(t *testing.T, client bool) (certificate tls.Certificate, certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if certificate, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certPath, keyPath = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certPath, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certificate, certPath, keyPath
+}
+
+func TestConnectTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     func(t *testing.T) string
+		wantErr string
+	}{
+		{name: "connect", url: func(t *testing.T) string { return "http://" + unansweredAddress(t) + "/v2/" }, wantErr: "i/o timeout"},
+		{name: "TLS handshake", url: func(t *testing.T) string { return "https://" + silentAddress(t) + "/v2/" }, wantErr: "TLS handshake timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previousDial, previousHandshake := dialTimeout, tlsHandshakeTimeout
+			dialTimeout, tlsHandshakeTimeout = 200*time.Millisecond, 200*time.Millisecond
+			t.Cleanup(func() { dialTimeout, tlsHandshakeTimeout = previousDial, previousHandshake })
+			client := createHTTPClient()
+			url := tt.url(t)
+
+			start := time.Now()
+			resp, err := client.Get(url)
+			if err == nil {
+				resp.Body.Close()
+				t.Fatalf("request to %s succeeded", url)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("request gave %v, want %q", err, tt.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("request took %s to time out", elapsed)
+			}
+		})
+	}
+}
+
+func TestCheckInsecureRegistries(t *testing.T) {
+	tests := []struct {
+		registries []string
+		wantErr    bool
+	}{
+		{registries: nil},
+		{registries: []string{"localhost:5000", "registry.example.com", "10.0.0.1:443", "[::1]:5000"}},
+		{registries: []string{"localhost:5000", "http://localhost:5000"}, wantErr: true},
+		{registries: []string{"localhost:5000/app"}, wantErr: true},
+		{registries: []string{"-registry"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		previous := insecureRegistries
+		insecureRegistries = tt.registries
+		err := checkInsecureRegistries()
+		insecureRegistries = previous
+		if (err != nil) != tt.wantErr {
+			t.Errorf("checking %q gave %v, want error %t", tt.registries, err, tt.wantErr)
+		}
+	}
+}
+
+func TestInsecureRegistries(t *testing.T) {
+	withoutBackoff(t)
+	image := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+	selfSigned := newFakeTLSRegistry(t, nil)
+	selfSigned.push("app", "latest", image)
+	plain := newFakeRegistry(t)
+	plain.push("app", "latest", image)
+	// The plain HTTP registry is reached as any registry not in Registries is, over HTTPS first
+	delete(Registries, plain.host)
+
+	tests := []struct {
+		name     string
+		registry *fakeRegistry
+		insecure []string
+		wantErr  string
+	}{
+		{name: "self-signed", registry: selfSigned, wantErr: "certificate"},
+		{name: "insecure self-signed", registry: selfSigned, insecure: []string{selfSigned.host}},
+		{name: "another registry insecure", registry: selfSigned, insecure: []string{plain.host}, wantErr: "certificate"},
+		{name: "plain HTTP", registry: plain, wantErr: "HTTP response to HTTPS client"},
+		{name: "insecure plain HTTP", registry: plain, insecure: []string{plain.host}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useHTTPClient(t, func() { insecureRegistries = tt.insecure })
+			requests := tt.registry.count("/manifests/")
+			// Each pull is made twice, the second going straight to plain HTTP for a registry
+			// found to speak it by the first
+			for i := 0; i < 2; i++ {
+				_, err := resolveImage(context.Background(), tt.registry.host+"/app:latest", nil, nil)
+				if tt.wantErr == "" && err != nil {
+					t.Fatalf("resolving gave %v", err)
+				}
+				if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+					t.Fatalf("resolving gave %v, want %q", err, tt.wantErr)
+				}
+			}
+			if served := tt.registry.count("/manifests/") - requests; tt.wantErr == "" && served != 2 {
+				t.Errorf("registry served %d manifest requests, want 2", served)
+			}
+		})
+	}
+}
+
+func TestCACerts(t *testing.T) {
+	withoutBackoff(t)
+	ca, other := newTestCA(t, "ca"), newTestCA(t, "other")
+	certificate, _, _ := ca.issue(t, false)
+	registry := newFakeTLSRegistry(t, &tls.Config{Certificates: []tls.Certificate{certificate}})
+	registry.push("app", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+	notPEM := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		caCerts []string
+		env     string
+		// wantLoadErr is an error loading the certificates, and wantErr one pulling with them
+		wantLoadErr string
+		wantErr     string
+	}{
+		{name: "untrusted", wantErr: "certificate signed by unknown authority"},
+		{name: "ca-cert", caCerts: []string{ca.path}},
+		{name: "several", caCerts: []string{other.path, ca.path}},
+		{name: "other CA", caCerts: []string{other.path}, wantErr: "certificate signed by unknown authority"},
+		{name: "environment", env: ca.path},
+		{name: "ca-cert over environment", caCerts: []string{other.path}, env: ca.path, wantErr: "certificate signed by unknown authority"},
+		{name: "missing", caCerts: []string{filepath.Join(t.TempDir(), "missing.pem")}, wantLoadErr: "could not read CA certificates"},
+		{name: "not PEM", caCerts: []string{notPEM}, wantLoadErr: "no PEM encoded certificates"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := caCerts
+			t.Cleanup(func() { caCerts = previous })
+			t.Setenv(caCertEnv, tt.env)
+			var err error
+			useHTTPClient(t, func() {
+				caCerts, registryRootCAs = tt.caCerts, nil
+				err = loadCACerts()
+			})
+			if tt.wantLoadErr != "" || err != nil {
+				if err == nil || !strings.Contains(err.Error(), tt.wantLoadErr) {
+					t.Errorf("loading gave %v, want %q", err, tt.wantLoadErr)
+				}
+				return
+			}
+
+			_, err = resolveImage(context.Background(), registry.host+"/app:latest", nil, nil)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("resolving gave %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("resolving gave %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	withoutBackoff(t)
+	ca, other := newTestCA(t, "ca"), newTestCA(t, "other")
+	serverCertificate, _, _ := ca.issue(t, false)
+	_, certPath, keyPath := ca.issue(t, true)
+	_, otherCertPath, otherKeyPath := other.issue(t, true)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	registry := newFakeTLSRegistry(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	registry.push("app", "latest", newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")})))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		insecure bool
+		// wantLoadErr is an error loading the certificate, and wantErr one pulling with it
+		wantLoadErr string
+		wantErr     bool
+	}{
+		{name: "no certificate", wantErr: true},
+		{name: "certificate", cert: certPath, key: keyPath},
+		{name: "insecure registry", cert: certPath, key: keyPath, insecure: true},
+		{name: "certificate of another CA", cert: otherCertPath, key: otherKeyPath, wantErr: true},
+		{name: "certificate without key", cert: certPath, wantLoadErr: "must be given together"},
+		{name: "key without certificate", key: keyPath, wantLoadErr: "must be given together"},
+		{name: "key of another certificate", cert: certPath, key: otherKeyPath, wantLoadErr: "could not load client certificate"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previousCert, previousKey := clientCert, clientKey
+			t.Cleanup(func() { clientCert, clientKey = previousCert, previousKey })
+			var err error
+			useHTTPClient(t, func() {
+				clientCert, clientKey, registryClientCertificates = tt.cert, tt.key, nil
+				registryRootCAs, insecureRegistries = roots, nil
+				if tt.insecure {
+					insecureRegistries = stringList{registry.host}
+				}
+				err = loadClientCertificate()
+			})
+			if tt.wantLoadErr != "" || err != nil {
+				if err == nil || !strings.Contains(err.Error(), tt.wantLoadErr) {
+					t.Errorf("loading gave %v, want %q", err, tt.wantLoadErr)
+				}
+				return
+			}
+
+			_, err = resolveImage(context.Background(), registry.host+"/app:latest", nil, nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("resolving gave %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// vethInfoPeer is the attribute of a veth link's info data describing its peer
+const vethInfoPeer = 1
+
+// netlinkRequest sends a route netlink request made of a message body followed by attributes,
+// and waits for the kernel to acknowledge it
+func netlinkRequest(msgType uint16, flags uint16, body []byte, attrs ...[]byte) error {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	payload := append([]byte(nil), body...)
+	for _, attr := range attrs {
+		payload = append(payload, attr...)
+	}
+	header := unix.NlMsghdr{
+		Len:   uint32(unix.SizeofNlMsghdr + len(payload)),
+		Type:  msgType,
+		Flags: flags | unix.NLM_F_REQUEST | unix.NLM_F_ACK,
+		Seq:   1,
+	}
+	message := append(asBytes(unsafe.Pointer(&header), unix.SizeofNlMsghdr), payload...)
+	if err := unix.Sendto(fd, message, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		replies, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, reply := range replies {
+			if reply.Header.Type != unix.NLMSG_ERROR || reply.Header.Seq != header.Seq {
+				continue
+			}
+			if len(reply.Data) < 4 {
+				return errors.New("truncated netlink acknowledgement")
+			}
+			if errno := *(*int32)(unsafe.Pointer(&reply.Data[0])); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// netlinkAttr encodes a netlink attribute, padded to the alignment the kernel expects
+func netlinkAttr(attrType uint16, value []byte) []byte {
+	header := unix.RtAttr{Len: uint16(unix.SizeofRtAttr + len(value)), Type: attrType}
+	attr := append(asBytes(unsafe.Pointer(&header), unix.SizeofRtAttr), value...)
+	for len(attr)%unix.RTA_ALIGNTO != 0 {
+		attr = append(attr, 0)
+	}
+	return attr
+}
+
+// netlinkNested encodes an attribute holding other attributes
+func netlinkNested(attrType uint16, attrs ...[]byte) []byte {
+	var value []byte
+	for _, attr := range attrs {
+		value = append(value, attr...)
+	}
+	return netlinkAttr(attrType, value)
+}
+
+func netlinkString(attrType uint16, value string) []byte {
+	return netlinkAttr(attrType, append([]byte(value), 0))
+}
+
+func netlinkUint32(attrType uint16, value uint32) []byte {
+	return netlinkAttr(attrType, asBytes(unsafe.Pointer(&value), 4))
+}
+
+// asBytes copies the size bytes of a netlink structure at p, which netlink sends in the host's
+// byte order
+func asBytes(p unsafe.Pointer, size int) []byte {
+	return append([]byte(nil), unsafe.Slice((*byte)(p), size)...)
+}
+
+func ifInfomsg(index int, flags, change uint32) []byte {
+	msg := unix.IfInfomsg{Family: unix.AF_UNSPEC, Index: int32(index), Flags: flags, Change: change}
+	return asBytes(unsafe.Pointer(&msg), unix.SizeofIfInfomsg)
+}
+
+// createBridge creates a bridge named name
+func createBridge(name string) error {
+	err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfomsg(0, 0, 0),
+		netlinkString(unix.IFLA_IFNAME, name),
+		netlinkNested(unix.IFLA_LINKINFO, netlinkString(unix.IFLA_INFO_KIND, "bridge")),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create bridge %s: %w", name, err)
+	}
+	return nil
+}
+
+// createVethPair creates a veth pair, with one end named name on the host and its peer named
+// peerName in the network namespace of the process pid
+func createVethPair(name, peerName string, pid int) error {
+	peer := append(ifInfomsg(0, 0, 0), netlinkString(unix.IFLA_IFNAME, peerName)...)
+	peer = append(peer, netlinkUint32(unix.IFLA_NET_NS_PID, uint32(pid))...)
+	err := netlinkRequest(unix.RTM_NEWLINK, unix.NLM_F_CREATE|unix.NLM_F_EXCL, ifInfomsg(0, 0, 0),
+		netlinkString(unix.IFLA_IFNAME, name),
+		netlinkNested(unix.IFLA_LINKINFO,
+			netlinkString(unix.IFLA_INFO_KIND, "veth"),
+			netlinkNested(unix.IFLA_INFO_DATA, netlinkAttr(vethInfoPeer, peer)),
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("could not create veth pair %s: %w", name, err)
+	}
+	return nil
+}
+
+// setLinkUp brings up the interface named name, attaching it to the bridge master if not empty
+func setLinkUp(name, master string) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	var attrs [][]byte
+	if master != "" {
+		bridge, err := net.InterfaceByName(master)
+		if err != nil {
+			return err
+		}
+		attrs = append(attrs, netlinkUint32(unix.IFLA_MASTER, uint32(bridge.Index)))
+	}
+	if err := netlinkRequest(unix.RTM_NEWLINK, 0, ifInfomsg(link.Index, unix.IFF_UP, unix.IFF_UP), attrs...); err != nil {
+		return fmt.Errorf("could not bring up %s: %w", name, err)
+	}
+	return nil
+}
+
+// addAddress assigns an IPv4 address to the interface named name
+func addAddress(name string, address *net.IPNet) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	prefix, _ := address.Mask.Size()
+	msg := unix.IfAddrmsg{Family: unix.AF_INET, Prefixlen: uint8(prefix), Index: uint32(link.Index)}
+	err = netlinkRequest(unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_EXCL, asBytes(unsafe.Pointer(&msg), unix.SizeofIfAddrmsg),
+		netlinkAttr(unix.IFA_LOCAL, address.IP.To4()),
+		netlinkAttr(unix.IFA_ADDRESS, address.IP.To4()),
+	)
+	if err != nil {
+		return fmt.Errorf("could not assign %s to %s: %w", address, name, err)
+	}
+	return nil
+}
+
+// addDefaultRoute routes traffic with no more specific route through gateway on the interface
+// named name
+func addDefaultRoute(name string, gateway net.IP) error {
+	link, err := net.InterfaceByName(name)
+	if err != nil {
+		return err
+	}
+	msg := unix.RtMsg{
+		Family:   unix.AF_INET,
+		Table:    unix.RT_TABLE_MAIN,
+		Protocol: unix.RTPROT_BOOT,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}
+	err = netlinkRequest(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, asBytes(unsafe.Pointer(&msg), unix.SizeofRtMsg),
+		netlinkAttr(unix.RTA_GATEWAY, gateway.To4()),
+		netlinkUint32(unix.RTA_OIF, uint32(link.Index)),
+	)
+	if err != nil {
+		return fmt.Errorf("could not add default route via %s: %w", gateway, err)
+	}
+	return nil
+}
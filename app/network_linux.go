@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Network modes accepted by run's --network flag
+const (
+	// networkNone gives the container a network namespace of its own holding only loopback
+	networkNone = "none"
+	// networkHost leaves the container in the host's network namespace
+	networkHost = "host"
+	// networkBridge connects the container's own network namespace to a bridge on the host,
+	// through which it reaches other containers and, by NAT, the outside world
+	networkBridge = "bridge"
+)
+
+// The bridge containers on the bridge network are attached to, and the subnet they are given
+// addresses from, with the bridge itself as their gateway
+const (
+	bridgeName   = "mydocker0"
+	bridgeSubnet = "172.29.0.0/16"
+)
+
+// networkLeasesPath holds a file for each address leased to a container on the bridge network
+const networkLeasesPath = "/tmp/containers/network"
+
+// containerInterface is the name of the interface a container is connected to the bridge by
+const containerInterface = "eth0"
+
+// checkNetworkMode validates the mode given with --network
+func checkNetworkMode(mode string) error {
+	switch mode {
+	case networkNone, networkHost, networkBridge:
+		return nil
+	}
+	return fmt.Errorf("unsupported network mode %q (expected %s, %s or %s)", mode, networkNone, networkHost, networkBridge)
+}
+
+// setupLoopback brings up the loopback interface, which starts out down in a new network namespace
+func setupLoopback() error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("could not bring up loopback: %w", err)
+	}
+	defer unix.Close(fd)
+
+	ifreq, err := unix.NewIfreq("lo")
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifreq); err != nil {
+		return fmt.Errorf("could not read loopback flags: %w", err)
+	}
+	ifreq.SetUint16(ifreq.Uint16() | unix.IFF_UP)
+	if err := unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifreq); err != nil {
+		return fmt.Errorf("could not bring up loopback: %w", err)
+	}
+	return nil
+}
+
+// NetworkInterface is how init configures the interface connecting a container to the bridge
+type NetworkInterface struct {
+	Name string
+	// Address is the container's address in CIDR notation
+	Address string
+	Gateway string
+}
+
+// bridgeAddresses returns the bridge subnet and the address of the bridge, its first host
+func bridgeAddresses() (*net.IPNet, net.IP) {
+	_, subnet, _ := net.ParseCIDR(bridgeSubnet)
+	gateway := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(gateway, binary.BigEndian.Uint32(subnet.IP.To4())+1)
+	return subnet, gateway
+}
+
+// setupBridge creates the bridge, unless another container already has, and allows containers
+// attached to it to reach the outside world. Without iptables, containers can still reach the
+// host and each other, so a failure to set up NAT is only warned about.
+func setupBridge() error {
+	subnet, gateway := bridgeAddresses()
+	if err := createBridge(bridgeName); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	prefix, _ := subnet.Mask.Size()
+	address := &net.IPNet{IP: gateway, Mask: net.CIDRMask(prefix, 32)}
+	if err := addAddress(bridgeName, address); err != nil && !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	if err := setLinkUp(bridgeName, ""); err != nil {
+		return err
+	}
+	if err := setupMasquerade(subnet); err != nil {
+		logger.Warn("containers on the bridge network will not reach beyond the host", "error", err)
+	}
+	return nil
+}
+
+// setupMasquerade enables forwarding and NATs traffic leaving the bridge subnet for other
+// networks, adding each iptables rule only if it is not already present
+func setupMasquerade(subnet *net.IPNet) error {
+	if err := os.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1"), 0644); err != nil {
+		return fmt.Errorf("could not enable IP forwarding: %w", err)
+	}
+	rules := []iptablesRule{
+		{"nat", "POSTROUTING", []string{"-s", subnet.String(), "!", "-o", bridgeName, "-j", "MASQUERADE"}},
+		{"filter", "FORWARD", []string{"-i", bridgeName, "-j", "ACCEPT"}},
+		{"filter", "FORWARD", []string{"-o", bridgeName, "-j", "ACCEPT"}},
+	}
+	for _, rule := range rules {
+		if err := rule.ensure(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// iptablesRule is a rule of a chain in one of iptables' tables
+type iptablesRule struct {
+	table string
+	chain string
+	spec  []string
+}
+
+// ensure appends the rule to its chain, unless the chain already holds it
+func (r iptablesRule) ensure() error {
+	if r.run("-C") == nil {
+		return nil
+	}
+	return r.run("-A")
+}
+
+// delete removes the rule from its chain
+func (r iptablesRule) delete() error {
+	return r.run("-D")
+}
+
+func (r iptablesRule) run(action string) error {
+	iptables, err := exec.LookPath("iptables")
+	if err != nil {
+		return err
+	}
+	args := append([]string{"-t", r.table, action, r.chain}, r.spec...)
+	if output, err := exec.Command(iptables, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("iptables %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// NetworkLease reserves an address on the bridge network for a container
+type NetworkLease struct {
+	Address *net.IPNet
+	path    string
+}
+
+// leaseAddress reserves the lowest free address in the bridge subnet. Each lease is a file
+// holding the pid of the run that took it, so that leases left behind by a run that died
+// without releasing them can be taken over. Leases are taken with the directory locked, so
+// that concurrent runs never take over the same stale lease.
+func leaseAddress() (*NetworkLease, error) {
+	if err := os.MkdirAll(networkLeasesPath, 0755); err != nil {
+		return nil, fmt.Errorf("could not create network lease directory: %w", err)
+	}
+	dir, err := os.Open(networkLeasesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("could not lock network leases: %w", err)
+	}
+	subnet, gateway := bridgeAddresses()
+	ones, bits := subnet.Mask.Size()
+	first := binary.BigEndian.Uint32(gateway) + 1
+	last := binary.BigEndian.Uint32(subnet.IP.To4()) + 1<<uint(bits-ones) - 2
+
+	for n := first; n <= last; n++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, n)
+		path := filepath.Join(networkLeasesPath, ip.String())
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if errors.Is(err, os.ErrExist) && staleLease(path) && os.Remove(path) == nil {
+			f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		}
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not lease an address: %w", err)
+		}
+		_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(path)
+			return nil, fmt.Errorf("could not lease an address: %w", err)
+		}
+		return &NetworkLease{Address: &net.IPNet{IP: ip, Mask: subnet.Mask}, path: path}, nil
+	}
+	return nil, fmt.Errorf("no free addresses left in %s", subnet)
+}
+
+// staleLease reports whether the run holding a lease has exited
+func staleLease(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return false
+	}
+	return unix.Kill(pid, 0) == unix.ESRCH
+}
+
+// release gives up the lease's address
+func (l *NetworkLease) release() error {
+	if err := os.Remove(l.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// networkInterface describes how init configures the container's end of its veth pair
+func (l *NetworkLease) networkInterface() *NetworkInterface {
+	_, gateway := bridgeAddresses()
+	return &NetworkInterface{Name: containerInterface, Address: l.Address.String(), Gateway: gateway.String()}
+}
+
+// connectToBridge creates a veth pair linking the network namespace of the container's init
+// process to the bridge. The end in the container is left for init to configure, and both ends
+// are destroyed by the kernel with the namespace.
+func connectToBridge(containerID string, pid int) error {
+	name := "veth" + containerID[:11]
+	if err := createVethPair(name, containerInterface, pid); err != nil {
+		return err
+	}
+	return setLinkUp(name, bridgeName)
+}
+
+// setupInterface configures the container's end of its veth pair from inside its namespace
+func setupInterface(config *NetworkInterface) error {
+	ip, address, err := net.ParseCIDR(config.Address)
+	if err != nil {
+		return err
+	}
+	address.IP = ip
+	if err := addAddress(config.Name, address); err != nil {
+		return err
+	}
+	if err := setLinkUp(config.Name, ""); err != nil {
+		return err
+	}
+	return addDefaultRoute(config.Name, net.ParseIP(config.Gateway))
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCheckNetworkMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{mode: "none"},
+		{mode: "host"},
+		{mode: "bridge"},
+		{mode: "", wantErr: true},
+		{mode: "Host", wantErr: true},
+		{mode: "overlay", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			if err := checkNetworkMode(tt.mode); (err != nil) != tt.wantErr {
+				t.Errorf("checkNetworkMode(%q) returned %v, want error %t", tt.mode, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRunNetworkNamespace(t *testing.T) {
+	requireContainers(t)
+	hostNamespace, err := os.Readlink("/proc/self/ns/net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		flags []string
+		// wantHostNamespace is whether the container shares the host's network namespace, and
+		// wantOnlyLoopback whether lo is its only interface
+		wantHostNamespace bool
+		wantOnlyLoopback  bool
+		wantCode          int
+	}{
+		{name: "default", wantOnlyLoopback: true},
+		{name: "none", flags: []string{"--network", "none"}, wantOnlyLoopback: true},
+		{name: "host", flags: []string{"--network", "host"}, wantHostNamespace: true},
+		{name: "unsupported", flags: []string{"--network", "overlay"}, wantCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "stat", "/proc/self/ns/net")
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if code != 0 {
+				if !strings.Contains(stdout, `unsupported network mode "overlay"`) {
+					t.Errorf("run printed %q, want it to refuse the network mode", stdout)
+				}
+				return
+			}
+			if shared := strings.Contains(stdout, hostNamespace); shared != tt.wantHostNamespace {
+				t.Errorf("container's network namespace is %q, sharing the host's %s: %t, want %t", stdout, hostNamespace, shared, tt.wantHostNamespace)
+			}
+
+			stdout, stderr, code = runProbe(t, tt.flags, "cat", "/proc/net/dev")
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			// Interfaces are listed one to a line after two lines of headings
+			var interfaces []string
+			for _, line := range strings.Split(stdout, "\n")[2:] {
+				if name, _, ok := strings.Cut(line, ":"); ok {
+					interfaces = append(interfaces, strings.TrimSpace(name))
+				}
+			}
+			if !containsString(interfaces, "lo") {
+				t.Errorf("container has interfaces %q, want lo", interfaces)
+			}
+			if only := len(interfaces) == 1; only != tt.wantOnlyLoopback {
+				t.Errorf("container has interfaces %q, only loopback: %t, want %t", interfaces, only, tt.wantOnlyLoopback)
+			}
+			// Addresses on lo are only routed once it is up
+			stdout, stderr, code = runProbe(t, tt.flags, "cat", "/proc/net/fib_trie")
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			if !strings.Contains(stdout, "|-- 127.0.0.1\n") {
+				t.Errorf("loopback is not up in the container:\n%s", stdout)
+			}
+		})
+	}
+}
+
+func TestBridgeAddresses(t *testing.T) {
+	subnet, gateway := bridgeAddresses()
+	if subnet.String() != bridgeSubnet {
+		t.Errorf("bridge subnet is %s, want %s", subnet, bridgeSubnet)
+	}
+	if gateway.String() != "172.29.0.1" {
+		t.Errorf("bridge address is %s, want 172.29.0.1", gateway)
+	}
+}
+
+func TestStaleLease(t *testing.T) {
+	exited := exec.Command("true")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// data is what the lease holds, or nil for no lease at all
+		data []byte
+		want bool
+	}{
+		{name: "held by a running process", data: []byte(strconv.Itoa(os.Getpid()) + "\n")},
+		{name: "held by an exited process", data: []byte(strconv.Itoa(exited.Process.Pid) + "\n"), want: true},
+		{name: "unreadable pid", data: []byte("unknown\n")},
+		{name: "empty", data: []byte{}},
+		{name: "missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "172.29.0.2")
+			if tt.data != nil {
+				if err := os.WriteFile(path, tt.data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := staleLease(path); got != tt.want {
+				t.Errorf("staleLease = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRunBridgeNetwork(t *testing.T) {
+	requireContainers(t)
+	leases := func() []string {
+		entries, _ := filepath.Glob(filepath.Join(networkLeasesPath, "*"))
+		return entries
+	}
+	before := len(leases())
+
+	tests := []struct {
+		name  string
+		flags []string
+		args  []string
+		// wantCode is the exit code of the run, and wantStdout lines it prints
+		wantCode   int
+		wantStdout []string
+	}{
+		{
+			name:  "interface",
+			flags: []string{"--network", "bridge"},
+			args:  []string{"cat", "/proc/net/dev"},
+			// eth0 is connected to the bridge, besides loopback
+			wantStdout: []string{"eth0:", "lo:"},
+		},
+		{
+			name:  "default route",
+			flags: []string{"--network", "bridge"},
+			args:  []string{"cat", "/proc/net/route"},
+			// /proc/net/route gives addresses as little-endian hex, so 172.29.0.1 is 01001DAC
+			wantStdout: []string{"eth0\t00000000\t01001DAC\t"},
+		},
+		{
+			name:       "address",
+			flags:      []string{"--network", "bridge"},
+			args:       []string{"cat", "/proc/net/fib_trie"},
+			wantStdout: []string{"|-- 172.29."},
+		},
+		{
+			name:       "rootless",
+			flags:      []string{"--network", "bridge", "--rootless"},
+			args:       []string{"ls", "/"},
+			wantCode:   1,
+			wantStdout: []string{"--network bridge needs root to set up the host's side of the network"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, tt.args...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			for _, want := range tt.wantStdout {
+				if !strings.Contains(stdout, want) {
+					t.Errorf("run printed %q, want %q", stdout, want)
+				}
+			}
+			if after := len(leases()); after != before {
+				t.Errorf("%d network leases are held after the run, want %d", after, before)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+// pauseCommand suspends every process of a running container with the cgroup freezer, and
+// unpauseCommand resumes them. A container is named by its name, its ID or a unique prefix of
+// its ID, such as the short ID it is given as its hostname by default.
+//
+// Usage: your_docker.sh pause <container>
+//
+//	your_docker.sh unpause <container>
+func pauseCommand(arguments []string) {
+	freezeCommand("pause", arguments, true)
+}
+
+func unpauseCommand(arguments []string) {
+	freezeCommand("unpause", arguments, false)
+}
+
+func freezeCommand(name string, arguments []string, frozen bool) {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() != 1 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+
+	if !cgroupsAvailable() {
+		fmt.Printf("%s requires the cgroup v2 freezer, but the unified hierarchy is not mounted at %s\n", name, cgroupRoot)
+		os.Exit(1)
+	}
+	id := flags.Arg(0)
+	if state, err := findContainer(id); err == nil {
+		id = state.ID
+	}
+	cgroup, err := findCgroup(id)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := cgroup.freeze(frozen); err != nil {
+		fmt.Printf("could not %s container: %s\n", name, err)
+		os.Exit(1)
+	}
+	fmt.Println(flags.Arg(0))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFreezeCgroup(t *testing.T) {
+	tests := []struct {
+		name   string
+		frozen bool
+		// events is what cgroup.events holds to begin with, and later what it holds after a
+		// moment, as the kernel updates it once every task is frozen
+		events, later string
+		wantErr       error
+	}{
+		{name: "freeze", frozen: true, events: "populated 1\nfrozen 1\n"},
+		{name: "thaw", events: "populated 1\nfrozen 0\n"},
+		{name: "frozen after a moment", frozen: true, events: "populated 1\nfrozen 0\n", later: "populated 1\nfrozen 1\n"},
+		{name: "no events", frozen: true, wantErr: os.ErrNotExist},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cgroup := &Cgroup{Path: t.TempDir()}
+			events := filepath.Join(cgroup.Path, "cgroup.events")
+			if tt.events != "" {
+				if err := os.WriteFile(events, []byte(tt.events), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.later != "" {
+				timer := time.AfterFunc(50*time.Millisecond, func() { os.WriteFile(events, []byte(tt.later), 0644) })
+				t.Cleanup(func() { timer.Stop() })
+			}
+
+			err := cgroup.freeze(tt.frozen)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("freeze returned %v, want %v", err, tt.wantErr)
+			}
+			want := "0"
+			if tt.frozen {
+				want = "1"
+			}
+			if got, _ := os.ReadFile(filepath.Join(cgroup.Path, "cgroup.freeze")); string(got) != want {
+				t.Errorf("cgroup.freeze = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestPauseCommand(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+	dir := t.TempDir()
+	var output strings.Builder
+	startTool(t, dir, &output, "--insecure-registry", registry.host, "run", "--name", "sleeper", ref, "/bin/probe", "sleep")
+
+	// Without cgroup v2 there is no freezer to pause containers with
+	available := cgroupsAvailable()
+	result := func(command string, code int, stdout string) (int, string) {
+		if !available {
+			return 1, command + " requires the cgroup v2 freezer, but the unified hierarchy is not mounted at " + cgroupRoot + "\n"
+		}
+		return code, stdout
+	}
+	pauseCode, pauseStdout := result("pause", 0, "sleeper\n")
+	unpauseCode, unpauseStdout := result("unpause", 0, "sleeper\n")
+	unknownCode, unknownStdout := result("pause", 1, "no such container: missing\n")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+		// wantFrozen is what the container's cgroup.freeze holds afterwards, if it has a cgroup
+		wantFrozen string
+	}{
+		{name: "pause", args: []string{"pause", "sleeper"}, wantCode: pauseCode, wantStdout: pauseStdout, wantFrozen: "1"},
+		{name: "unpause", args: []string{"unpause", "sleeper"}, wantCode: unpauseCode, wantStdout: unpauseStdout, wantFrozen: "0"},
+		{name: "unknown container", args: []string{"pause", "missing"}, wantCode: unknownCode, wantStdout: unknownStdout},
+		{name: "no container", args: []string{"pause"}, wantCode: 1, wantStdout: "Incorrect number of arguments specified.\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := tool(t, dir, tt.args...)
+			if code != tt.wantCode {
+				t.Fatalf("%s exited with %d, want %d: %s%s", tt.args[0], code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("%s printed %q, want %q", tt.args[0], stdout, tt.wantStdout)
+			}
+			if !available || tt.wantFrozen == "" {
+				return
+			}
+			cgroups, _ := filepath.Glob(filepath.Join(cgroupRoot, cgroupParent, "*", "cgroup.freeze"))
+			for _, name := range cgroups {
+				if got, _ := os.ReadFile(name); strings.TrimSpace(string(got)) == tt.wantFrozen {
+					return
+				}
+			}
+			t.Errorf("no container's cgroup.freeze is %s after %s", tt.wantFrozen, tt.args[0])
+		})
+	}
+}
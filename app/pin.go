@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// canonicalReference expands an image reference to its fully-qualified registry/repository:tag form
+func canonicalReference(ref string) string {
+	parsed, err := parseReference(ref)
+	if err != nil {
+		return ref
+	}
+	return parsed.String()
+}
+
+// loadDigestPins reads a pin file mapping image references to the digest they must resolve to.
+// Each non-empty line holds a reference and a digest separated by whitespace, and lines
+// starting with '#' are ignored.
+func loadDigestPins(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pins := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "sha256:") {
+			return nil, fmt.Errorf("%s:%d: expected '<reference> sha256:<digest>'", path, lineNumber)
+		}
+		pins[canonicalReference(fields[0])] = fields[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
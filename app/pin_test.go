@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadDigestPins(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	other := "sha256:" + strings.Repeat("b", 64)
+
+	tests := []struct {
+		name    string
+		file    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{
+			name: "references are expanded",
+			file: "alpine " + digest + "\nghcr.io/org/app:v1\t" + other + "\n",
+			want: map[string]string{
+				"docker.io/library/alpine:latest": digest,
+				"ghcr.io/org/app:v1":              other,
+			},
+		},
+		{
+			name: "comments and blank lines",
+			file: "# pinned images\n\n   \n  alpine:3.18   " + digest + "  \n",
+			want: map[string]string{"docker.io/library/alpine:3.18": digest},
+		},
+		{
+			name: "empty file",
+			file: "",
+			want: map[string]string{},
+		},
+		{
+			name:    "missing digest",
+			file:    "alpine\n",
+			wantErr: true,
+		},
+		{
+			name:    "digest without algorithm",
+			file:    "alpine " + strings.Repeat("a", 64) + "\n",
+			wantErr: true,
+		},
+		{
+			name:    "extra field",
+			file:    "alpine " + digest + " latest\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "pins")
+			if err := os.WriteFile(path, []byte(tt.file), 0644); err != nil {
+				t.Fatal(err)
+			}
+			pins, err := loadDigestPins(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loading pins gave error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(pins, tt.want) {
+				t.Errorf("loaded pins %v, want %v", pins, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveImagePinnedDigest(t *testing.T) {
+	registry := newFakeRegistry(t)
+	image := newFakeImage(t, buildLayer(t, []tarEntry{tarFile("a", "a")}))
+	ref := registry.pushIndex(t, "pinned", "latest", image)
+	registry.requireToken("token", func(r *http.Request) (int, string) { return http.StatusOK, `{"token":"token"}` })
+	// Pins are checked against the digest of the index the reference resolves to
+	index := digestOf(registry.manifests["pinned:latest"].body)
+
+	tests := []struct {
+		name    string
+		pinned  string
+		wantErr bool
+	}{
+		{name: "not pinned"},
+		{name: "matching digest", pinned: index},
+		{name: "other digest", pinned: "sha256:" + strings.Repeat("0", 64), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolved, err := resolveImage(context.Background(), ref, nil, &PullOptions{PinnedDigest: tt.pinned})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolving gave error %v, want error %t", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "does not match the pinned digest") {
+				t.Errorf("resolving gave %v, want a pinned digest mismatch", err)
+			}
+			if err == nil && resolved.Digest != digestOf(image.manifest) {
+				t.Errorf("resolved %s, want %s", resolved.Digest, digestOf(image.manifest))
+			}
+		})
+	}
+}
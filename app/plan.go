@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// planPull resolves an image as pullImage does, selecting its platform and authenticating with
+// its registry, and writes to w which of its layers a pull would download, without downloading
+// any of them
+func planPull(ctx context.Context, w io.Writer, imageReference string, options *PullOptions) error {
+	if pullTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pullTimeout)
+		defer cancel()
+	}
+
+	image, err := resolveImage(ctx, imageReference, nil, options)
+	if err != nil {
+		return pullError(ctx, err)
+	}
+
+	fmt.Fprintf(w, "Image:     %s\n", image.Reference)
+	fmt.Fprintf(w, "Digest:    %s\n", image.Digest)
+	fmt.Fprintf(w, "Platform:  %s\n\n", image.Platform)
+
+	cached := image.cachedLayers()
+	distinct := make(map[string]bool)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LAYER\tSIZE\tCACHE")
+	for _, l := range image.Layers {
+		cache := "miss"
+		if cached[l.Digest] {
+			cache = "hit"
+		}
+		distinct[l.Digest] = true
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", l.Digest, formatBytes(int64(l.Size)), cache)
+	}
+	tw.Flush()
+	missing, size := image.downloadSize(cached)
+	fmt.Fprintf(w, "\n%d of %d layers would be downloaded, %s in total\n", missing, len(distinct), formatBytes(size))
+	return nil
+}
+
+// cachedLayers returns the digests of the image's layers which are already in the layer store
+func (image *ResolvedImage) cachedLayers() map[string]bool {
+	cached := make(map[string]bool)
+	for i := range image.Layers {
+		l := &image.Layers[i]
+		if !cached[l.Digest] && registryCache.hasLayer(l) == nil {
+			cached[l.Digest] = true
+		}
+	}
+	return cached
+}
+
+// downloadSize returns how many layers pulling the image downloads, being those not in cached,
+// and how many bytes it downloads in all, counting the image's configuration, which is always
+// fetched. A layer the image lists twice is only downloaded once.
+func (image *ResolvedImage) downloadSize(cached map[string]bool) (int, int64) {
+	seen := make(map[string]bool)
+	layers, size := 0, int64(image.ConfigSize)
+	for _, l := range image.Layers {
+		if cached[l.Digest] || seen[l.Digest] {
+			continue
+		}
+		seen[l.Digest] = true
+		layers++
+		size += int64(l.Size)
+	}
+	return layers, size
+}
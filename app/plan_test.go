@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPlanPull(t *testing.T) {
+	first := buildLayer(t, []tarEntry{tarFile("first", "first")})
+	second := buildLayer(t, []tarEntry{tarFile("second", "second")})
+
+	tests := []struct {
+		name   string
+		layers [][]byte
+		// cached are in the layer store before the plan, and corrupt is there under the first
+		// layer's name without matching its digest
+		cached  [][]byte
+		corrupt bool
+		// wantCache is the CACHE column for each layer listed
+		wantCache   []string
+		wantSummary string
+	}{
+		{name: "nothing cached", layers: [][]byte{first, second}, wantCache: []string{"miss", "miss"}, wantSummary: "2 of 2 layers would be downloaded"},
+		{name: "one cached", layers: [][]byte{first, second}, cached: [][]byte{second}, wantCache: []string{"miss", "hit"}, wantSummary: "1 of 2 layers would be downloaded"},
+		{name: "all cached", layers: [][]byte{first, second}, cached: [][]byte{first, second}, wantCache: []string{"hit", "hit"}, wantSummary: "0 of 2 layers would be downloaded"},
+		{name: "repeated layer", layers: [][]byte{first, second, first}, wantCache: []string{"miss", "miss", "miss"}, wantSummary: "2 of 2 layers would be downloaded"},
+		{name: "corrupt cached layer", layers: [][]byte{first, second}, corrupt: true, wantCache: []string{"miss", "miss"}, wantSummary: "2 of 2 layers would be downloaded"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImage(t, tt.layers...)
+			ref := registry.push("app", "latest", image)
+			for _, layer := range tt.cached {
+				if err := os.WriteFile(filepath.Join(ImageLayersPath, strings.TrimPrefix(digestOf(layer), "sha256:")+".tar.gz"), layer, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.corrupt {
+				if err := os.WriteFile(filepath.Join(ImageLayersPath, strings.TrimPrefix(digestOf(first), "sha256:")+".tar.gz"), second, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			var out bytes.Buffer
+			if err := planPull(context.Background(), &out, ref, nil); err != nil {
+				t.Fatalf("planning gave %v", err)
+			}
+			if !strings.Contains(out.String(), "Digest:    "+digestOf(image.manifest)+"\n") {
+				t.Errorf("plan does not give the image's digest:\n%s", out.String())
+			}
+			var cache []string
+			for _, line := range strings.Split(out.String(), "\n") {
+				if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[0], "sha256:") {
+					cache = append(cache, fields[len(fields)-1])
+				}
+			}
+			if fmt.Sprint(cache) != fmt.Sprint(tt.wantCache) {
+				t.Errorf("plan lists layers as %q, want %q:\n%s", cache, tt.wantCache, out.String())
+			}
+			if !strings.Contains(out.String(), "\n"+tt.wantSummary+", ") {
+				t.Errorf("plan does not say %q:\n%s", tt.wantSummary, out.String())
+			}
+			for _, layer := range tt.layers {
+				if n := registry.count(digestOf(layer)); n != 0 {
+					t.Errorf("layer %s was requested %d times", digestOf(layer), n)
+				}
+			}
+		})
+	}
+}
+
+func TestDownloadSize(t *testing.T) {
+	first := buildLayer(t, []tarEntry{tarFile("first", noise(4096))})
+	second := buildLayer(t, []tarEntry{tarFile("second", "second")})
+
+	tests := []struct {
+		name   string
+		layers [][]byte
+		cached [][]byte
+		// wantLayers and wantLayerBytes are the layers to download and their size, to which the
+		// size of the image's configuration is added
+		wantLayers     int
+		wantLayerBytes int
+	}{
+		{name: "nothing cached", layers: [][]byte{first, second}, wantLayers: 2, wantLayerBytes: len(first) + len(second)},
+		{name: "one cached", layers: [][]byte{first, second}, cached: [][]byte{first}, wantLayers: 1, wantLayerBytes: len(second)},
+		{name: "all cached", layers: [][]byte{first, second}, cached: [][]byte{first, second}},
+		{name: "repeated layer", layers: [][]byte{first, second, first}, wantLayers: 2, wantLayerBytes: len(first) + len(second)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useLayerStore(t)
+			registry := newFakeRegistry(t)
+			image := newFakeImage(t, tt.layers...)
+			ref := registry.push("app", "latest", image)
+			for _, layer := range tt.cached {
+				if err := os.WriteFile(filepath.Join(ImageLayersPath, strings.TrimPrefix(digestOf(layer), "sha256:")+".tar.gz"), layer, 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wantSize := int64(len(image.config) + tt.wantLayerBytes)
+
+			var err error
+			inspected := captureStdout(t, func() { err = inspectImage(context.Background(), ref, "{{.DownloadSize}}", Platform{}) })
+			if err != nil {
+				t.Fatalf("inspecting gave %v", err)
+			}
+			if inspected != fmt.Sprintf("%d\n", wantSize) {
+				t.Errorf("inspect gave a download size of %q, want %d", inspected, wantSize)
+			}
+
+			var plan bytes.Buffer
+			if err := planPull(context.Background(), &plan, ref, nil); err != nil {
+				t.Fatalf("planning gave %v", err)
+			}
+			if want := fmt.Sprintf(" would be downloaded, %s in total\n", formatBytes(wantSize)); !strings.Contains(plan.String(), want) {
+				t.Errorf("plan does not say %q:\n%s", want, plan.String())
+			}
+
+			calls := 0
+			_, _, err = pullImage(context.Background(), ref, nil, &PullOptions{Downloading: func(layers int, size int64) {
+				calls++
+				if layers != tt.wantLayers || size != wantSize {
+					t.Errorf("pull is downloading %d layers, %d bytes, want %d layers, %d bytes", layers, size, tt.wantLayers, wantSize)
+				}
+			}})
+			if err != nil {
+				t.Fatalf("pull gave %v", err)
+			}
+			if calls != 1 {
+				t.Errorf("pull reported its download size %d times, want once", calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// ErrUnsupportedPlatform is returned for images which cannot run here whatever the host's
+// architecture, such as Windows images, whose layers hold a Windows filesystem rather than a
+// root filesystem
+var ErrUnsupportedPlatform = errors.New("unsupported platform")
+
+// foreignLayerMediaTypes are the types of layers which registries may not distribute, which
+// Windows images use for their base layers
+var foreignLayerMediaTypes = []string{
+	string(DockerImageTypeRootFsForeign),
+	string(OCIImageTypeLayerNondistributable),
+	string(OCIImageTypeLayerNondistributableGzip),
+	string(OCIImageTypeLayerNondistributableZstd),
+}
+
+// hostPlatform is the platform images are run on, which for ARM includes the variant of the
+// architecture this binary was built for, as set by GOARM for 32-bit ARM
+func hostPlatform() Platform {
+	platform := Platform{Os: runtime.GOOS, Architecture: runtime.GOARCH}
+	switch runtime.GOARCH {
+	case "arm64":
+		platform.Variant = "v8"
+	case "arm":
+		platform.Variant = "v7"
+		if info, ok := debug.ReadBuildInfo(); ok {
+			for _, setting := range info.Settings {
+				if setting.Key == "GOARM" && setting.Value != "" {
+					// GOARM may carry a floating point mode too, as in 7,softfloat
+					goarm, _, _ := strings.Cut(setting.Value, ",")
+					platform.Variant = "v" + goarm
+				}
+			}
+		}
+	}
+	return platform
+}
+
+// platform is the platform options resolve images for, which is the host's unless --platform
+// names another
+func (options *PullOptions) platform() Platform {
+	if options.Platform.Os != "" {
+		return options.Platform
+	}
+	return hostPlatform()
+}
+
+// Set parses a platform given as os/architecture[/variant], such as linux/arm/v7, making a
+// Platform a flag.Value for --platform
+func (p *Platform) Set(value string) error {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 || containsString(parts, "") {
+		return fmt.Errorf("invalid platform %q, expected os/architecture[/variant]", value)
+	}
+	*p = Platform{Os: strings.ToLower(parts[0]), Architecture: strings.ToLower(parts[1])}
+	if len(parts) == 3 {
+		p.Variant = strings.ToLower(parts[2])
+	}
+	return nil
+}
+
+// platform is the platform the image was built for, as its configuration records it
+func (config *DockerImageConfig) platform() Platform {
+	return Platform{Architecture: config.Architecture, Os: config.Os, Variant: config.Variant, OSVersion: config.OSVersion}
+}
+
+// String describes the platform as os/architecture[/variant], as docker does, or is empty for
+// no platform at all
+func (p Platform) String() string {
+	if p.Os == "" {
+		return ""
+	}
+	s := p.Os + "/" + p.Architecture
+	if p.Variant != "" {
+		s += "/" + p.Variant
+	}
+	return s
+}
+
+// normalized fills in the variant an image for the platform is assumed to have when it
+// names none, as containerd does: arm64 images are v8, and 32-bit ARM images v7
+func (p Platform) normalized() Platform {
+	if p.Variant == "" {
+		switch p.Architecture {
+		case "arm64":
+			p.Variant = "v8"
+		case "arm":
+			p.Variant = "v7"
+		}
+	}
+	return p
+}
+
+// rank reports whether an image for the platform other runs on the platform p, and if so how
+// well suited to it the image is, lower being better. A 32-bit ARM host runs images built for
+// its own variant or any earlier one, preferring the latest. The OS version, which only Windows
+// images set, is matched when p names one.
+func (p Platform) rank(other Platform) (int, bool) {
+	p, other = p.normalized(), other.normalized()
+	if p.Os != other.Os || p.Architecture != other.Architecture {
+		return 0, false
+	}
+	if p.OSVersion != "" && other.OSVersion != "" && p.OSVersion != other.OSVersion {
+		return 0, false
+	}
+	if p.Variant == other.Variant {
+		return 0, true
+	}
+	if p.Architecture == "arm" {
+		for i, variant := range armCompatibleVariants(p.Variant) {
+			if variant == other.Variant {
+				return i + 1, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// matches reports whether an image for the platform other runs on the platform p
+func (p Platform) matches(other Platform) bool {
+	_, ok := p.rank(other)
+	return ok
+}
+
+// armCompatibleVariants lists the 32-bit ARM variants older than variant, latest first
+func armCompatibleVariants(variant string) []string {
+	variants := []string{"v7", "v6", "v5"}
+	for i, v := range variants {
+		if v == variant {
+			return variants[i+1:]
+		}
+	}
+	return nil
+}
+
+// checkSupportedPlatform returns ErrUnsupportedPlatform for a Windows image, or one with the
+// foreign layers of a Windows image, neither of which can be extracted into a Linux root
+// filesystem. Foreign layers with URLs to download them from are left to the image's platform
+// to decide, as other images may have them too.
+func checkSupportedPlatform(platform Platform, layers []ImageLayer) error {
+	if platform.Os == "windows" {
+		return fmt.Errorf("%w: the image is built for %s, and Windows images cannot be run in Linux containers", ErrUnsupportedPlatform, platform)
+	}
+	for _, layer := range layers {
+		if containsString(foreignLayerMediaTypes, layer.MediaType) && len(layer.URLs) == 0 {
+			return fmt.Errorf("%w: layer %s has the foreign layer type %s of a Windows image, which cannot be run in Linux containers", ErrUnsupportedPlatform, layer.Digest, layer.MediaType)
+		}
+	}
+	return nil
+}
+
+// windowsOnly reports whether an index only has manifests for Windows
+func windowsOnly(manifests []Manifest) bool {
+	for _, manifest := range manifests {
+		if manifest.Platform.Os != "windows" {
+			return false
+		}
+	}
+	return len(manifests) > 0
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestPlatformSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Platform
+		wantErr bool
+	}{
+		{value: "linux/amd64", want: Platform{Os: "linux", Architecture: "amd64"}},
+		{value: "linux/arm/v7", want: Platform{Os: "linux", Architecture: "arm", Variant: "v7"}},
+		{value: "Windows/AMD64", want: Platform{Os: "windows", Architecture: "amd64"}},
+		{value: "linux", wantErr: true},
+		{value: "linux/", wantErr: true},
+		{value: "/amd64", wantErr: true},
+		{value: "linux/arm/v7/extra", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		var got Platform
+		err := got.Set(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Set(%q) gave %v, want error %t", tt.value, err, tt.wantErr)
+		} else if got != tt.want {
+			t.Errorf("Set(%q) gave %+v, want %+v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestResolveImageForPlatform(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	amd64 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "amd64"}, layer)
+	arm64 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "arm64", Variant: "v8"}, layer)
+	windows := newFakeImageFor(t, Platform{Os: "windows", Architecture: "amd64"}, layer)
+	multi := registry.pushIndex(t, "multi", "latest", amd64, arm64, windows)
+	windowsOnly := registry.pushIndex(t, "nanoserver", "latest", windows)
+	single := registry.push("single", "latest", windows)
+
+	tests := []struct {
+		name     string
+		ref      string
+		platform string
+		want     *fakeImage
+		// unsupported is set for images which should be reported as ErrUnsupportedPlatform
+		unsupported bool
+		wantErr     bool
+	}{
+		{name: "arm64 from an index", ref: multi, platform: "linux/arm64", want: arm64},
+		{name: "amd64 from an index", ref: multi, platform: "linux/amd64", want: amd64},
+		{name: "windows from an index", ref: multi, platform: "windows/amd64", unsupported: true},
+		{name: "windows only index", ref: windowsOnly, platform: "linux/amd64", unsupported: true},
+		{name: "windows manifest", ref: single, platform: "linux/amd64", unsupported: true},
+		{name: "missing platform", ref: multi, platform: "linux/s390x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options PullOptions
+			if err := options.Platform.Set(tt.platform); err != nil {
+				t.Fatal(err)
+			}
+			image, err := resolveImage(context.Background(), tt.ref, nil, &options)
+			switch {
+			case tt.unsupported:
+				if !errors.Is(err, ErrUnsupportedPlatform) {
+					t.Errorf("resolving gave %v, want ErrUnsupportedPlatform", err)
+				}
+			case tt.wantErr:
+				if err == nil || errors.Is(err, ErrUnsupportedPlatform) {
+					t.Errorf("resolving gave %v, want no matching manifest", err)
+				}
+			case err != nil:
+				t.Errorf("resolving gave %v", err)
+			case image.Digest != digestOf(tt.want.manifest):
+				t.Errorf("resolved %s for %s, want %s", image.Digest, image.Platform, digestOf(tt.want.manifest))
+			}
+		})
+	}
+}
+
+func TestPlatformRank(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     Platform
+		image    Platform
+		wantRank int
+		wantOK   bool
+	}{
+		{name: "same platform", host: Platform{Os: "linux", Architecture: "amd64"}, image: Platform{Os: "linux", Architecture: "amd64"}, wantOK: true},
+		{name: "other architecture", host: Platform{Os: "linux", Architecture: "amd64"}, image: Platform{Os: "linux", Architecture: "arm64"}},
+		{name: "other os", host: Platform{Os: "linux", Architecture: "amd64"}, image: Platform{Os: "windows", Architecture: "amd64"}},
+		{name: "arm64 without a variant", host: Platform{Os: "linux", Architecture: "arm64", Variant: "v8"}, image: Platform{Os: "linux", Architecture: "arm64"}, wantOK: true},
+		{name: "arm without a variant", host: Platform{Os: "linux", Architecture: "arm", Variant: "v7"}, image: Platform{Os: "linux", Architecture: "arm"}, wantOK: true},
+		{name: "older arm variant", host: Platform{Os: "linux", Architecture: "arm", Variant: "v7"}, image: Platform{Os: "linux", Architecture: "arm", Variant: "v6"}, wantRank: 1, wantOK: true},
+		{name: "oldest arm variant", host: Platform{Os: "linux", Architecture: "arm", Variant: "v7"}, image: Platform{Os: "linux", Architecture: "arm", Variant: "v5"}, wantRank: 2, wantOK: true},
+		{name: "newer arm variant", host: Platform{Os: "linux", Architecture: "arm", Variant: "v6"}, image: Platform{Os: "linux", Architecture: "arm", Variant: "v7"}},
+		{name: "other arm64 variant", host: Platform{Os: "linux", Architecture: "arm64", Variant: "v8"}, image: Platform{Os: "linux", Architecture: "arm64", Variant: "v9"}},
+		{name: "same os version", host: Platform{Os: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}, image: Platform{Os: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}, wantOK: true},
+		{name: "other os version", host: Platform{Os: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}, image: Platform{Os: "windows", Architecture: "amd64", OSVersion: "10.0.20348.1"}},
+		{name: "image without an os version", host: Platform{Os: "windows", Architecture: "amd64", OSVersion: "10.0.17763.1"}, image: Platform{Os: "windows", Architecture: "amd64"}, wantOK: true},
+	}
+
+	for _, tt := range tests {
+		rank, ok := tt.host.rank(tt.image)
+		if ok != tt.wantOK || (ok && rank != tt.wantRank) {
+			t.Errorf("%s: %s ranked %s as %d, %t, want %d, %t", tt.name, tt.host, tt.image, rank, ok, tt.wantRank, tt.wantOK)
+		}
+	}
+}
+
+func TestResolveImageVariant(t *testing.T) {
+	registry := newFakeRegistry(t)
+	layer := buildLayer(t, []tarEntry{tarFile("a", "a")})
+	v5 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "arm", Variant: "v5"}, layer)
+	v6 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "arm", Variant: "v6"}, layer)
+	v7 := newFakeImageFor(t, Platform{Os: "linux", Architecture: "arm", Variant: "v7"}, layer)
+	all := registry.pushIndex(t, "all", "latest", v5, v7, v6)
+	older := registry.pushIndex(t, "older", "latest", v5, v6)
+	newer := registry.pushIndex(t, "newer", "latest", v7)
+
+	tests := []struct {
+		name     string
+		ref      string
+		platform string
+		want     *fakeImage
+	}{
+		{name: "exact variant", ref: all, platform: "linux/arm/v6", want: v6},
+		{name: "latest older variant", ref: older, platform: "linux/arm/v7", want: v6},
+		{name: "default variant", ref: all, platform: "linux/arm", want: v7},
+		{name: "only newer variants", ref: newer, platform: "linux/arm/v6"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var options PullOptions
+			if err := options.Platform.Set(tt.platform); err != nil {
+				t.Fatal(err)
+			}
+			image, err := resolveImage(context.Background(), tt.ref, nil, &options)
+			switch {
+			case tt.want == nil:
+				if err == nil {
+					t.Errorf("resolved %s for %s, want no matching manifest", image.Digest, image.Platform)
+				}
+			case err != nil:
+				t.Errorf("resolving gave %v", err)
+			case image.Digest != digestOf(tt.want.manifest):
+				t.Errorf("resolved %s for %s, want %s", image.Digest, image.Platform, digestOf(tt.want.manifest))
+			}
+		})
+	}
+}
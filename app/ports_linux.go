@@ -0,0 +1,277 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// udpProxyIdleTimeout is how long the proxy keeps relaying replies to a UDP client that has
+// stopped sending
+const udpProxyIdleTimeout = 90 * time.Second
+
+// PortMapping publishes a port of a container on the bridge network on a port of the host
+type PortMapping struct {
+	// HostIP restricts the published port to one of the host's addresses, if set
+	HostIP        net.IP
+	HostPort      int
+	ContainerPort int
+	Protocol      string
+}
+
+// parsePortMapping parses a [host-ip:]host-port:container-port[/tcp|udp] port specification
+func parsePortMapping(spec string) (*PortMapping, error) {
+	mapping := &PortMapping{Protocol: "tcp"}
+	ports, protocol, found := strings.Cut(spec, "/")
+	if found {
+		if protocol != "tcp" && protocol != "udp" {
+			return nil, fmt.Errorf("invalid port %q, unknown protocol %q (expected tcp or udp)", spec, protocol)
+		}
+		mapping.Protocol = protocol
+	}
+
+	// The host IP may be an IPv6 address in brackets, holding colons of its own
+	split := strings.LastIndex(ports, ":")
+	if split == -1 {
+		return nil, fmt.Errorf("invalid port %q, expected [host-ip:]host-port:container-port[/tcp|udp]", spec)
+	}
+	hostPart, containerPort := ports[:split], ports[split+1:]
+	hostPort := hostPart
+	if split := strings.LastIndex(hostPart, ":"); split != -1 {
+		host := strings.TrimSuffix(strings.TrimPrefix(hostPart[:split], "["), "]")
+		if mapping.HostIP = net.ParseIP(host); mapping.HostIP == nil {
+			return nil, fmt.Errorf("invalid port %q, %q is not an IP address", spec, host)
+		}
+		hostPort = hostPart[split+1:]
+	}
+
+	var err error
+	if mapping.HostPort, err = parsePort(hostPort); err != nil {
+		return nil, fmt.Errorf("invalid port %q, host port %w", spec, err)
+	}
+	if mapping.ContainerPort, err = parsePort(containerPort); err != nil {
+		return nil, fmt.Errorf("invalid port %q, container port %w", spec, err)
+	}
+	return mapping, nil
+}
+
+func parsePort(port string) (int, error) {
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		return 0, fmt.Errorf("%q is not a port number between 1 and 65535", port)
+	}
+	return n, nil
+}
+
+// String describes the mapping in the form docker ps uses
+func (m *PortMapping) String() string {
+	host := "0.0.0.0"
+	if m.HostIP != nil {
+		host = m.HostIP.String()
+	}
+	return fmt.Sprintf("%s->%d/%s", net.JoinHostPort(host, strconv.Itoa(m.HostPort)), m.ContainerPort, m.Protocol)
+}
+
+// conflicts reports whether two mappings would publish on the same host port
+func (m *PortMapping) conflicts(other *PortMapping) bool {
+	if m.HostPort != other.HostPort || m.Protocol != other.Protocol {
+		return false
+	}
+	return m.HostIP == nil || other.HostIP == nil || m.HostIP.Equal(other.HostIP)
+}
+
+// parsePortMappings parses every -p flag, rejecting any two which publish the same host port
+func parsePortMappings(specs []string) ([]*PortMapping, error) {
+	var mappings []*PortMapping
+	for _, spec := range specs {
+		mapping, err := parsePortMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range mappings {
+			if mapping.conflicts(other) {
+				return nil, fmt.Errorf("host port %d/%s is published more than once", mapping.HostPort, mapping.Protocol)
+			}
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// PublishedPorts are the ports published for a container, each forwarded to it by iptables DNAT
+// rules for traffic from elsewhere and by a proxy on the host for traffic from the host itself,
+// which never passes through PREROUTING. The proxy's listener also holds the host port, so that
+// a port already in use, whether by another container or a host service, is reported as such.
+type PublishedPorts struct {
+	listeners []io.Closer
+	rules     []iptablesRule
+}
+
+// publishPorts publishes mappings for a container with the address container on the bridge.
+// Without iptables, the proxy alone forwards traffic, so a failure to add rules is only warned
+// about.
+func publishPorts(mappings []*PortMapping, container net.IP) (*PublishedPorts, error) {
+	published := &PublishedPorts{}
+	for _, mapping := range mappings {
+		target := net.JoinHostPort(container.String(), strconv.Itoa(mapping.ContainerPort))
+		address := net.JoinHostPort(mapping.HostIP.String(), strconv.Itoa(mapping.HostPort))
+		if mapping.HostIP == nil {
+			address = ":" + strconv.Itoa(mapping.HostPort)
+		}
+
+		var listener io.Closer
+		var err error
+		if mapping.Protocol == "udp" {
+			listener, err = proxyUDP(address, target)
+		} else {
+			listener, err = proxyTCP(address, target)
+		}
+		if err != nil {
+			published.close()
+			return nil, fmt.Errorf("could not publish %s: %w", mapping, err)
+		}
+		published.listeners = append(published.listeners, listener)
+
+		spec := []string{"-p", mapping.Protocol, "-m", "addrtype", "--dst-type", "LOCAL", "--dport", strconv.Itoa(mapping.HostPort)}
+		if mapping.HostIP != nil {
+			spec = append(spec, "-d", mapping.HostIP.String())
+		}
+		spec = append(spec, "-j", "DNAT", "--to-destination", target)
+		rules := []iptablesRule{
+			{"nat", "PREROUTING", spec},
+			{"nat", "OUTPUT", append([]string{"!", "-d", "127.0.0.0/8"}, spec...)},
+		}
+		for _, rule := range rules {
+			if err := rule.ensure(); err != nil {
+				logger.Warn("published port is only reachable through the proxy", "port", mapping.String(), "error", err)
+				break
+			}
+			published.rules = append(published.rules, rule)
+		}
+		logger.Debug("published port", "port", mapping.String())
+	}
+	return published, nil
+}
+
+// close stops forwarding the published ports
+func (p *PublishedPorts) close() error {
+	var errs []string
+	for _, rule := range p.rules {
+		if err := rule.delete(); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, listener := range p.listeners {
+		listener.Close()
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// proxyTCP accepts connections on address and relays each to a connection of its own to target
+func proxyTCP(address, target string) (io.Closer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			client, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go relayTCP(client.(*net.TCPConn), target)
+		}
+	}()
+	return listener, nil
+}
+
+func relayTCP(client *net.TCPConn, target string) {
+	defer client.Close()
+	conn, err := net.DialTimeout("tcp", target, 10*time.Second)
+	if err != nil {
+		logger.Debug("could not reach published port", "target", target, "error", err)
+		return
+	}
+	upstream := conn.(*net.TCPConn)
+	defer upstream.Close()
+
+	// Each direction is half closed once done, so that the other can still finish
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+		upstream.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		client.CloseWrite()
+	}()
+	wg.Wait()
+}
+
+// proxyUDP relays datagrams received on address to target, through a socket of its own for
+// each client so that replies can be told apart and sent back to the right one
+func proxyUDP(address, target string) (io.Closer, error) {
+	targetAddr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var mu sync.Mutex
+		clients := make(map[string]*net.UDPConn)
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			upstream, ok := clients[client.String()]
+			if !ok {
+				if upstream, err = net.DialUDP("udp", nil, targetAddr); err != nil {
+					mu.Unlock()
+					logger.Debug("could not reach published port", "target", target, "error", err)
+					continue
+				}
+				clients[client.String()] = upstream
+				go func(client net.Addr, upstream *net.UDPConn) {
+					defer func() {
+						mu.Lock()
+						delete(clients, client.String())
+						mu.Unlock()
+						upstream.Close()
+					}()
+					reply := make([]byte, 65535)
+					for {
+						upstream.SetReadDeadline(time.Now().Add(udpProxyIdleTimeout))
+						n, err := upstream.Read(reply)
+						if err != nil {
+							return
+						}
+						if _, err := listener.WriteTo(reply[:n], client); err != nil {
+							return
+						}
+					}
+				}(client, upstream)
+			}
+			mu.Unlock()
+			upstream.Write(buf[:n])
+		}
+	}()
+	return listener, nil
+}
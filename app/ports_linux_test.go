@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePortMapping(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    string
+		wantErr string
+	}{
+		{spec: "8080:80", want: "0.0.0.0:8080->80/tcp"},
+		{spec: "8080:80/tcp", want: "0.0.0.0:8080->80/tcp"},
+		{spec: "5353:53/udp", want: "0.0.0.0:5353->53/udp"},
+		{spec: "127.0.0.1:8080:80", want: "127.0.0.1:8080->80/tcp"},
+		{spec: "[::1]:8080:80", want: "[::1]:8080->80/tcp"},
+		{spec: "80", wantErr: "expected [host-ip:]host-port:container-port[/tcp|udp]"},
+		{spec: "8080:80/sctp", wantErr: `unknown protocol "sctp"`},
+		{spec: "localhost:8080:80", wantErr: `"localhost" is not an IP address`},
+		{spec: "0:80", wantErr: `host port "0" is not a port number`},
+		{spec: "8080:65536", wantErr: `container port "65536" is not a port number`},
+		{spec: "http:80", wantErr: `host port "http" is not a port number`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			mapping, err := parsePortMapping(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePortMapping(%q) returned %v, want %q", tt.spec, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePortMapping(%q): %v", tt.spec, err)
+			}
+			if got := mapping.String(); got != tt.want {
+				t.Errorf("parsePortMapping(%q) = %s, want %s", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePortMappings(t *testing.T) {
+	tests := []struct {
+		name    string
+		specs   []string
+		wantErr string
+	}{
+		{name: "distinct ports", specs: []string{"8080:80", "8443:443"}},
+		{name: "same port, different protocols", specs: []string{"53:53/tcp", "53:53/udp"}},
+		{name: "same port, different addresses", specs: []string{"127.0.0.1:8080:80", "127.0.0.2:8080:81"}},
+		{name: "same port twice", specs: []string{"8080:80", "8080:81"}, wantErr: "host port 8080/tcp is published more than once"},
+		{name: "every address and one", specs: []string{"8080:80", "127.0.0.1:8080:81"}, wantErr: "host port 8080/tcp is published more than once"},
+		{name: "invalid", specs: []string{"8080:80", "bad"}, wantErr: `invalid port "bad"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mappings, err := parsePortMappings(tt.specs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parsePortMappings(%q) returned %v, want %q", tt.specs, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePortMappings(%q): %v", tt.specs, err)
+			}
+			if len(mappings) != len(tt.specs) {
+				t.Errorf("parsePortMappings(%q) returned %d mappings, want %d", tt.specs, len(mappings), len(tt.specs))
+			}
+		})
+	}
+}
+
+// freePort returns a port on the loopback address nothing is listening on
+func freePort(t *testing.T) int {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+// ping sends ping to address over protocol until it is answered, returning the answer
+func ping(t *testing.T, protocol, address string) string {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		conn, err := net.DialTimeout(protocol, address, time.Second)
+		if err == nil {
+			conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+			fmt.Fprint(conn, "ping\n")
+			var reply string
+			if protocol == "udp" {
+				buf := make([]byte, 64)
+				n, _ := conn.Read(buf)
+				reply = string(buf[:n])
+			} else {
+				reply, _ = bufio.NewReader(conn).ReadString('\n')
+			}
+			conn.Close()
+			if reply != "" {
+				return reply
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s %s was not answered: %v", protocol, address, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	tests := []struct {
+		protocol string
+		proxy    func(address, target string) (io.Closer, error)
+	}{
+		{protocol: "tcp", proxy: proxyTCP},
+		{protocol: "udp", proxy: proxyUDP},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			// The target answers as the probe's serve does
+			var target string
+			if tt.protocol == "udp" {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				target = conn.LocalAddr().String()
+				go func() {
+					buf := make([]byte, 64)
+					for {
+						n, client, err := conn.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						conn.WriteTo(append([]byte("pong "), buf[:n]...), client)
+					}
+				}()
+			} else {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer listener.Close()
+				target = listener.Addr().String()
+				go func() {
+					for {
+						conn, err := listener.Accept()
+						if err != nil {
+							return
+						}
+						line, _ := bufio.NewReader(conn).ReadString('\n')
+						fmt.Fprintf(conn, "pong %s", line)
+						conn.Close()
+					}
+				}()
+			}
+
+			address := net.JoinHostPort("127.0.0.1", strconv.Itoa(freePort(t)))
+			proxy, err := tt.proxy(address, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer proxy.Close()
+			if got := ping(t, tt.protocol, address); got != "pong ping\n" {
+				t.Errorf("proxy answered %q, want %q", got, "pong ping\n")
+			}
+			if _, err := tt.proxy(address, target); err == nil {
+				t.Error("a second proxy could listen on the same address")
+			}
+		})
+	}
+}
+
+func TestRunPublish(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("publish", "latest", newFakeImage(t, probeLayer(t)))
+
+	tests := []struct {
+		name     string
+		protocol string
+		// publish gives the -p flags publishing the container's port 8080 on the host's port
+		publish func(port int) []string
+	}{
+		{name: "tcp", protocol: "tcp", publish: func(port int) []string { return []string{"-p", fmt.Sprintf("%d:8080", port)} }},
+		{name: "udp", protocol: "udp", publish: func(port int) []string { return []string{"-p", fmt.Sprintf("%d:8080/udp", port)} }},
+		{name: "host address", protocol: "tcp", publish: func(port int) []string { return []string{"-p", fmt.Sprintf("127.0.0.1:%d:8080", port)} }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := freePort(t)
+			dir := t.TempDir()
+			args := append([]string{"--insecure-registry", registry.host, "run", "--name", "server", "--network", "bridge"}, tt.publish(port)...)
+			args = append(args, ref, "/bin/probe", "serve", tt.protocol, "8080")
+			var output strings.Builder
+			cmd := startTool(t, dir, &output, args...)
+
+			address := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+			if got := ping(t, tt.protocol, address); got != "pong ping\n" {
+				t.Errorf("published port answered %q, want %q", got, "pong ping\n")
+			}
+			// Stopping the container lets the run unpublish the port
+			if stdout, stderr, code := tool(t, dir, "stop", "-t", "0", "server"); code != 0 {
+				t.Fatalf("stop exited with %d: %s%s", code, stdout, stderr)
+			}
+			cmd.Wait()
+			if conn, err := net.DialTimeout("tcp", address, time.Second); tt.protocol == "tcp" && err == nil {
+				conn.Close()
+				t.Error("port is still published after the container exited")
+			}
+		})
+	}
+}
+
+func TestRunPublishErrors(t *testing.T) {
+	requireContainers(t)
+	busy, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	busyPort := busy.Addr().(*net.TCPAddr).Port
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantStdout string
+	}{
+		{name: "without the bridge", flags: []string{"-p", "8080:80"}, wantStdout: "publishing ports needs --network bridge"},
+		{name: "invalid", flags: []string{"--network", "bridge", "-p", "8080"}, wantStdout: `invalid port "8080"`},
+		{name: "published twice", flags: []string{"--network", "bridge", "-p", "8080:80", "-p", "8080:81"}, wantStdout: "host port 8080/tcp is published more than once"},
+		{name: "port in use", flags: []string{"--network", "bridge", "-p", fmt.Sprintf("%d:80", busyPort)}, wantStdout: fmt.Sprintf("could not publish 0.0.0.0:%d->80/tcp", busyPort)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "ls", "/")
+			if code == 0 || !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run exited with %d, want it to fail with %q: %s%s", code, tt.wantStdout, stdout, stderr)
+			}
+		})
+	}
+}
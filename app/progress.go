@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// ProgressFunc is told how many bytes of a layer have been downloaded so far out of its total size.
+// It may be called concurrently for different layers.
+type ProgressFunc func(layer *ImageLayer, downloaded, total int64)
+
+// progressReader reports the bytes read through it as the download progress of a layer
+type progressReader struct {
+	r          io.Reader
+	layer      *ImageLayer
+	progress   ProgressFunc
+	downloaded int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.downloaded += int64(n)
+		p.progress(p.layer, p.downloaded, int64(p.layer.Size))
+	}
+	return n, err
+}
+
+// withProgress wraps the body of a layer download so that its progress is reported, if wanted
+func withProgress(r io.Reader, layer *ImageLayer, progress ProgressFunc) io.Reader {
+	return withProgressFrom(r, layer, progress, 0)
+}
+
+// withProgressFrom wraps the body of a layer download resumed after offset bytes
+func withProgressFrom(r io.Reader, layer *ImageLayer, progress ProgressFunc, offset int64) io.Reader {
+	if progress == nil {
+		return r
+	}
+	return &progressReader{r: r, layer: layer, progress: progress, downloaded: offset}
+}
+
+const (
+	// progressRedrawInterval limits how often the progress line is redrawn on a terminal
+	progressRedrawInterval = 100 * time.Millisecond
+	// progressLogInterval is how often progress is logged when not writing to a terminal, which
+	// is only shown with --verbose
+	progressLogInterval = 5 * time.Second
+)
+
+// progressReporter renders the combined download progress of an image's layers to w, as a single
+// line redrawn in place on a terminal or as a debug log line every progressLogInterval otherwise
+type progressReporter struct {
+	mu         sync.Mutex
+	w          *os.File
+	terminal   bool
+	downloaded map[string]int64
+	totals     map[string]int64
+	last       time.Time
+	drawn      bool
+}
+
+func newProgressReporter(w *os.File) *progressReporter {
+	// A redrawn line would break up the objects logged with --log-format json
+	terminal := false
+	if info, err := w.Stat(); err == nil && eventLogger == nil {
+		terminal = info.Mode()&os.ModeCharDevice != 0
+	}
+	return &progressReporter{
+		w:          w,
+		terminal:   terminal,
+		downloaded: make(map[string]int64),
+		totals:     make(map[string]int64),
+		last:       time.Now(),
+	}
+}
+
+// report is a ProgressFunc
+func (p *progressReporter) report(layer *ImageLayer, downloaded, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.downloaded[layer.Digest] = downloaded
+	p.totals[layer.Digest] = total
+
+	interval := progressLogInterval
+	if p.terminal {
+		interval = progressRedrawInterval
+	}
+	// Completed layers are always shown, so that the line ends on the final state
+	if time.Since(p.last) < interval && downloaded < total {
+		return
+	}
+	p.last = time.Now()
+
+	var sum, size int64
+	complete := 0
+	for digest, total := range p.totals {
+		sum += p.downloaded[digest]
+		size += total
+		if p.downloaded[digest] >= total {
+			complete++
+		}
+	}
+
+	if p.terminal {
+		fmt.Fprintf(p.w, "\rDownloading %d/%d layers: %s / %s", complete, len(p.totals), formatBytes(sum), formatBytes(size))
+		p.drawn = true
+	} else if downloaded < total {
+		logger.Debug("download progress", "layers", fmt.Sprintf("%d/%d", complete, len(p.totals)), "downloaded", formatBytes(sum), "total", formatBytes(size))
+	}
+}
+
+// downloading announces how much a pull is about to download, before its progress is shown
+func (p *progressReporter) downloading(layers int, size int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.terminal {
+		logger.Debug("downloading", "layers", layers, "size", formatBytes(size))
+		return
+	}
+	noun := "layers"
+	if layers == 1 {
+		noun = "layer"
+	}
+	fmt.Fprintf(p.w, "Downloading %d %s, %s\n", layers, noun, formatBytes(size))
+}
+
+// finish ends the progress line once the download is over
+func (p *progressReporter) finish() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.drawn {
+		fmt.Fprintln(p.w)
+		p.drawn = false
+	}
+}
+
+// formatBytes writes a size in bytes in binary units, such as 45.0 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestProgressReporterLogsAtDebug(t *testing.T) {
+	tests := []struct {
+		level slog.Level
+		want  []string
+	}{
+		{level: slog.LevelInfo},
+		{level: slog.LevelDebug, want: []string{"msg=downloading", "msg=\"download progress\""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level.String(), func(t *testing.T) {
+			logged := captureLog(t, tt.level)
+			out, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer out.Close()
+
+			progress := newProgressReporter(out)
+			var layer ImageLayer
+			layer.Digest, layer.Size = "sha256:aaaa", 2048
+			progress.downloading(1, 2048)
+			// Progress is only logged once progressLogInterval has passed
+			progress.last = time.Time{}
+			progress.report(&layer, 1024, 2048)
+			progress.report(&layer, 2048, 2048)
+			progress.finish()
+
+			lines := strings.Split(strings.TrimSpace(logged.String()), "\n")
+			if len(tt.want) == 0 && logged.Len() != 0 {
+				t.Errorf("logged %q, want nothing", logged)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(logged.String(), want) {
+					t.Errorf("log %q does not contain %s", lines, want)
+				}
+			}
+			if info, _ := out.Stat(); info.Size() != 0 {
+				t.Errorf("progress was drawn to a file that is not a terminal")
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// psCommandWidth is how much of a container's command ps shows, as docker does without --no-trunc
+const psCommandWidth = 20
+
+// psCommand lists the running containers, and with -a those which exited recently too.
+//
+// Usage: your_docker.sh ps [-a]
+func psCommand(arguments []string) {
+	flags := flag.NewFlagSet("ps", flag.ExitOnError)
+	all := flags.Bool("all", false, "also show containers which exited within the last hour")
+	flags.BoolVar(all, "a", false, "shorthand for --all")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() != 0 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+
+	containers, err := listContainers(*all)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONTAINER ID\tIMAGE\tCOMMAND\tCREATED\tSTATUS\tNAMES")
+	for _, container := range containers {
+		command := strings.Join(container.Command, " ")
+		if runes := []rune(command); len(runes) > psCommandWidth {
+			command = string(runes[:psCommandWidth-1]) + "…"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%q\t%s ago\t%s\t%s\n", shortContainerID(container.ID), container.Image, command,
+			humanDuration(now.Sub(container.Created)), container.status(now), container.Name)
+	}
+	w.Flush()
+}
+
+// status describes whether the container is running, and for how long, as docker ps does
+func (state *ContainerState) status(now time.Time) string {
+	if state.running() {
+		return "Up " + humanDuration(now.Sub(state.Created))
+	}
+	if state.FinishedAt == nil {
+		return "Exited"
+	}
+	return fmt.Sprintf("Exited (%d) %s ago", state.ExitCode, humanDuration(now.Sub(*state.FinishedAt)))
+}
+
+// humanDuration describes a duration roughly, in the largest unit that fits
+func humanDuration(d time.Duration) string {
+	switch seconds := int(d.Seconds()); {
+	case seconds < 1:
+		return "Less than a second"
+	case seconds == 1:
+		return "1 second"
+	case seconds < 60:
+		return fmt.Sprintf("%d seconds", seconds)
+	}
+	switch minutes := int(d.Minutes()); {
+	case minutes == 1:
+		return "About a minute"
+	case minutes < 60:
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+	switch hours := int(d.Round(time.Hour).Hours()); {
+	case hours == 1:
+		return "About an hour"
+	case hours < 48:
+		return fmt.Sprintf("%d hours", hours)
+	default:
+		return fmt.Sprintf("%d days", hours/24)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{d: 0, want: "Less than a second"},
+		{d: 999 * time.Millisecond, want: "Less than a second"},
+		{d: time.Second, want: "1 second"},
+		{d: 59 * time.Second, want: "59 seconds"},
+		{d: 90 * time.Second, want: "About a minute"},
+		{d: 59 * time.Minute, want: "59 minutes"},
+		{d: 80 * time.Minute, want: "About an hour"},
+		{d: 100 * time.Minute, want: "2 hours"},
+		{d: 47 * time.Hour, want: "47 hours"},
+		{d: 72 * time.Hour, want: "3 days"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.d.String(), func(t *testing.T) {
+			if got := humanDuration(tt.d); got != tt.want {
+				t.Errorf("humanDuration(%s) = %q, want %q", tt.d, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListContainers(t *testing.T) {
+	startTime, err := processStartTime(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		at := now.Add(-d)
+		return &at
+	}
+	// The test's own process stands in for a running container's init
+	states := []*ContainerState{
+		{ID: "running", Pid: os.Getpid(), StartTime: startTime, Created: now.Add(-3 * time.Minute)},
+		{ID: "exited", Pid: os.Getpid(), Created: now.Add(-2 * time.Minute), FinishedAt: ago(time.Minute), ExitCode: 3},
+		{ID: "died", Pid: os.Getpid(), StartTime: startTime + 1, Created: now.Add(-time.Minute)},
+		{ID: "expired", Pid: os.Getpid(), Created: now.Add(-3 * time.Hour), FinishedAt: ago(2 * time.Hour)},
+	}
+
+	tests := []struct {
+		name string
+		all  bool
+		// want are the IDs listed, newest first, and wantStatus their statuses
+		want       []string
+		wantStatus []string
+	}{
+		{name: "running", want: []string{"running"}, wantStatus: []string{"Up 3 minutes"}},
+		{
+			name:       "all",
+			all:        true,
+			want:       []string{"died", "exited", "running"},
+			wantStatus: []string{"Exited", "Exited (3) About a minute ago", "Up 3 minutes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useContainerState(t)
+			for _, state := range states {
+				if err := writeContainerState(state); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			containers, err := listContainers(tt.all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids, statuses []string
+			for _, container := range containers {
+				ids = append(ids, container.ID)
+				statuses = append(statuses, container.status(now))
+			}
+			if !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("listContainers(%t) = %q, want %q", tt.all, ids, tt.want)
+			}
+			if !reflect.DeepEqual(statuses, tt.wantStatus) {
+				t.Errorf("containers have statuses %q, want %q", statuses, tt.wantStatus)
+			}
+			if _, err := readContainerState("expired"); !os.IsNotExist(err) {
+				t.Errorf("the record of a container which exited long ago was not pruned: %v", err)
+			}
+		})
+	}
+}
+
+func TestPsCommand(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+	dir := t.TempDir()
+	var output strings.Builder
+	startTool(t, dir, &output, "--insecure-registry", registry.host, "run", "--name", "sleeper", ref, "/bin/probe", "sleep", "for", "a", "long", "while")
+	// The container which exits is run second, so that it is listed first
+	if stdout, stderr, code := tool(t, dir, "--insecure-registry", registry.host, "run", "--name", "done", ref, "/bin/probe", "exit", "3"); code != 3 {
+		t.Fatalf("run exited with %d, want 3: %s%s", code, stdout, stderr)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		// wantLines match the lines printed after the heading, in order
+		wantLines []string
+		wantCode  int
+	}{
+		{
+			name:      "running",
+			args:      []string{"ps"},
+			wantLines: []string{`^[0-9a-f]{12}  ` + regexp.QuoteMeta(ref) + `\s+"/bin/probe sleep fo…"\s+.* ago\s+Up .*\s+sleeper$`},
+		},
+		{
+			name: "all",
+			args: []string{"ps", "-a"},
+			wantLines: []string{
+				`^[0-9a-f]{12}  .*"/bin/probe exit 3"\s+.* ago\s+Exited \(3\) .* ago\s+done$`,
+				`^[0-9a-f]{12}  .*"/bin/probe sleep fo…"\s+.* ago\s+Up .*\s+sleeper$`,
+			},
+		},
+		{name: "arguments", args: []string{"ps", "sleeper"}, wantCode: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := tool(t, dir, tt.args...)
+			if code != tt.wantCode {
+				t.Fatalf("ps exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if code != 0 {
+				return
+			}
+			lines := strings.Split(strings.TrimSuffix(stdout, "\n"), "\n")
+			if !regexp.MustCompile(`^CONTAINER ID\s+IMAGE\s+COMMAND\s+CREATED\s+STATUS\s+NAMES$`).MatchString(lines[0]) {
+				t.Errorf("ps printed the heading %q", lines[0])
+			}
+			if len(lines)-1 != len(tt.wantLines) {
+				t.Fatalf("ps listed %d containers, want %d:\n%s", len(lines)-1, len(tt.wantLines), stdout)
+			}
+			for i, want := range tt.wantLines {
+				if !regexp.MustCompile(want).MatchString(lines[i+1]) {
+					t.Errorf("ps printed %q, want it to match %q", lines[i+1], want)
+				}
+			}
+		})
+	}
+}
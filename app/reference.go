@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	// maxReferenceNameLength is the longest repository name, including its registry, that the
+	// distribution specification allows registries to accept
+	maxReferenceNameLength = 255
+	// maxTagLength is the longest tag the distribution specification allows
+	maxTagLength = 128
+)
+
+// The grammar of image references, as implemented by docker's reference package
+var (
+	referenceDomain    = regexp.MustCompile(`^(?:(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])(?:\.(?:[a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9]))*|\[[a-fA-F0-9:]+\])(?::[0-9]+)?$`)
+	referenceComponent = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|[-]+)[a-z0-9]+)*$`)
+	referenceTag       = regexp.MustCompile(`^[\w][\w.-]*$`)
+	referenceDigest    = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*(?:[-_+.][A-Za-z][A-Za-z0-9]*)*:[0-9a-fA-F]{32,}$`)
+	referenceImageID   = regexp.MustCompile(`^[a-f0-9]{64}$`)
+)
+
+// legacyDefaultRegistry is the name docker.io went by before, which docker still accepts for it
+const legacyDefaultRegistry = "index.docker.io"
+
+// ImageReference is an image reference normalized the way docker does: images on docker.io
+// are given its name, official images their library/ namespace, and references with neither
+// tag nor digest the tag latest.
+type ImageReference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// parseReference normalizes ref, rejecting it if docker would not accept it as an image reference
+func parseReference(ref string) (*ImageReference, error) {
+	if ref == "" {
+		return nil, errors.New("image reference must not be empty")
+	}
+
+	var parsed ImageReference
+	name := ref
+	if i := strings.IndexRune(name, '@'); i != -1 {
+		name, parsed.Digest = name[:i], name[i+1:]
+		if !referenceDigest.MatchString(parsed.Digest) {
+			return nil, fmt.Errorf("invalid reference format: invalid digest %q", parsed.Digest)
+		}
+	}
+	// A colon after the last slash separates the tag, while one before it is a registry's port
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		name, parsed.Tag = name[:i], name[i+1:]
+		if !referenceTag.MatchString(parsed.Tag) {
+			return nil, fmt.Errorf("invalid reference format: invalid tag %q", parsed.Tag)
+		}
+	}
+
+	// The first component names a registry only if it could not be a repository: it holds a
+	// dot or a port, is localhost, or has upper case letters, which repositories may not
+	i := strings.IndexRune(name, '/')
+	if i == -1 || (!strings.ContainsAny(name[:i], ".:") && name[:i] != "localhost" && strings.ToLower(name[:i]) == name[:i]) {
+		parsed.Registry, parsed.Repository = DefaultRegistry, name
+	} else {
+		parsed.Registry, parsed.Repository = name[:i], name[i+1:]
+		if !referenceDomain.MatchString(parsed.Registry) {
+			return nil, fmt.Errorf("invalid reference format: invalid registry %q", parsed.Registry)
+		}
+	}
+	if parsed.Registry == legacyDefaultRegistry {
+		parsed.Registry = DefaultRegistry
+	}
+
+	if parsed.Repository == "" {
+		return nil, errors.New("invalid reference format: repository name must not be empty")
+	}
+	if strings.ToLower(parsed.Repository) != parsed.Repository {
+		return nil, errors.New("invalid reference format: repository name must be lowercase")
+	}
+	for _, component := range strings.Split(parsed.Repository, "/") {
+		if !referenceComponent.MatchString(component) {
+			return nil, fmt.Errorf("invalid reference format: invalid repository name %q", parsed.Repository)
+		}
+	}
+	if parsed.Registry == DefaultRegistry && !strings.ContainsRune(parsed.Repository, '/') {
+		if referenceImageID.MatchString(parsed.Repository) {
+			return nil, fmt.Errorf("invalid repository name (%s), cannot specify 64-byte hexadecimal strings", parsed.Repository)
+		}
+		parsed.Repository = "library/" + parsed.Repository
+	}
+
+	if parsed.Tag == "" && parsed.Digest == "" {
+		parsed.Tag = "latest"
+	}
+	return &parsed, nil
+}
+
+// String is the fully-qualified form of the reference
+func (ref *ImageReference) String() string {
+	s := ref.Registry + "/" + ref.Repository
+	if ref.Tag != "" {
+		s += ":" + ref.Tag
+	}
+	if ref.Digest != "" {
+		s += "@" + ref.Digest
+	}
+	return s
+}
+
+// familiarRepository is the repository as docker shows it, without the docker.io registry or
+// the library/ namespace of official images
+func (ref *ImageReference) familiarRepository() string {
+	if ref.Registry != DefaultRegistry {
+		return ref.Registry + "/" + ref.Repository
+	}
+	return strings.TrimPrefix(ref.Repository, "library/")
+}
+
+// manifestReference is what the image's manifest is requested by: its digest when it is pinned
+// to one, which takes precedence over its tag as it does for docker
+func (ref *ImageReference) manifestReference() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+	return ref.Tag
+}
+
+// validateReference rejects image references registries would refuse for their length, before
+// any request is made, so that the user is not left with an opaque 400 from the registry
+func validateReference(ref string) error {
+	if ref == "" {
+		return errors.New("image reference must not be empty")
+	}
+
+	name := ref
+	if i := strings.IndexRune(name, '@'); i != -1 {
+		name = name[:i]
+	}
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		if tag := name[i+1:]; len(tag) > maxTagLength {
+			return fmt.Errorf("image tag is %d characters long, but tags may be at most %d", len(tag), maxTagLength)
+		}
+		name = name[:i]
+	}
+
+	if len(name) > maxReferenceNameLength {
+		return fmt.Errorf("image name is %d characters long, but names may be at most %d", len(name), maxReferenceNameLength)
+	}
+	_, err := parseReference(ref)
+	return err
+}
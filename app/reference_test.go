@@ -0,0 +1,157 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateReference(t *testing.T) {
+	longest := strings.Repeat("a", maxReferenceNameLength-len("registry.example.com/")-len("x/")) + "/x"
+	tests := []struct {
+		name    string
+		ref     string
+		wantErr string
+	}{
+		{name: "short", ref: "alpine"},
+		{name: "tag", ref: "alpine:3.19"},
+		{name: "longest name", ref: "registry.example.com/" + longest + ":latest"},
+		{name: "longest tag", ref: "alpine:" + strings.Repeat("t", maxTagLength)},
+		{name: "port is not a tag", ref: "localhost:5000/" + strings.Repeat("a", maxTagLength+1)},
+		{name: "digest", ref: "alpine@sha256:" + strings.Repeat("0", 64)},
+		{name: "empty", ref: "", wantErr: "image reference must not be empty"},
+		{
+			name:    "long name",
+			ref:     "registry.example.com/" + longest + "a:latest",
+			wantErr: "image name is 256 characters long, but names may be at most 255",
+		},
+		{
+			name:    "long tag",
+			ref:     "alpine:" + strings.Repeat("t", maxTagLength+1),
+			wantErr: "image tag is 129 characters long, but tags may be at most 128",
+		},
+		{
+			name:    "long tag before digest",
+			ref:     "alpine:" + strings.Repeat("t", maxTagLength+1) + "@sha256:" + strings.Repeat("0", 64),
+			wantErr: "image tag is 129 characters long",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateReference(tt.ref)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("validateReference(%q): %v", tt.ref, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("validateReference(%q) returned %v, want %q", tt.ref, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0", 64)
+	tests := []struct {
+		ref string
+		// want is the normalized reference, or an error when wantErr is set
+		want    string
+		wantErr string
+	}{
+		{ref: "alpine", want: "docker.io/library/alpine:latest"},
+		{ref: "alpine:3.19", want: "docker.io/library/alpine:3.19"},
+		{ref: "library/alpine", want: "docker.io/library/alpine:latest"},
+		{ref: "docker.io/alpine", want: "docker.io/library/alpine:latest"},
+		{ref: "index.docker.io/library/alpine", want: "docker.io/library/alpine:latest"},
+		{ref: "bitnami/redis:7.2", want: "docker.io/bitnami/redis:7.2"},
+		{ref: "ghcr.io/owner/app", want: "ghcr.io/owner/app:latest"},
+		{ref: "localhost/app", want: "localhost/app:latest"},
+		{ref: "localhost:5000/app:v1", want: "localhost:5000/app:v1"},
+		{ref: "Registry/app", want: "Registry/app:latest"},
+		{ref: "[::1]:5000/app", want: "[::1]:5000/app:latest"},
+		{ref: "quay.io/org/team/app:1.0-rc.1", want: "quay.io/org/team/app:1.0-rc.1"},
+		{ref: "my_app/some-thing__x.y", want: "docker.io/my_app/some-thing__x.y:latest"},
+		{ref: "alpine@" + digest, want: "docker.io/library/alpine@" + digest},
+		{ref: "alpine:3.19@" + digest, want: "docker.io/library/alpine:3.19@" + digest},
+		{ref: "", wantErr: "image reference must not be empty"},
+		{ref: "Alpine", wantErr: "repository name must be lowercase"},
+		{ref: "alpine:", wantErr: `invalid tag ""`},
+		{ref: "alpine:-x", wantErr: `invalid tag "-x"`},
+		{ref: "alpine@sha256:abc", wantErr: `invalid digest "sha256:abc"`},
+		{ref: "bad_registry.io/app", wantErr: `invalid registry "bad_registry.io"`},
+		{ref: "ghcr.io/", wantErr: "repository name must not be empty"},
+		{ref: "app--/x", wantErr: `invalid repository name "app--/x"`},
+		{ref: "a//b", wantErr: `invalid repository name "a//b"`},
+		{ref: strings.Repeat("a", 64), wantErr: "cannot specify 64-byte hexadecimal strings"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			got, err := parseReference(tt.ref)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseReference(%q) returned %v, want %q", tt.ref, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseReference(%q): %v", tt.ref, err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("parseReference(%q) = %s, want %s", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestManifestReference(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("0", 64)
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "alpine", want: "latest"},
+		{ref: "alpine:3.19", want: "3.19"},
+		{ref: "alpine@" + digest, want: digest},
+		{ref: "alpine:3.19@" + digest, want: digest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			parsed, err := parseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parsed.manifestReference(); got != tt.want {
+				t.Errorf("manifestReference of %q = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFamiliarRepository(t *testing.T) {
+	tests := []struct {
+		ref  string
+		want string
+	}{
+		{ref: "alpine", want: "alpine"},
+		{ref: "docker.io/library/alpine:3.19", want: "alpine"},
+		{ref: "bitnami/redis", want: "bitnami/redis"},
+		{ref: "ghcr.io/owner/app", want: "ghcr.io/owner/app"},
+		{ref: "localhost:5000/library/app", want: "localhost:5000/library/app"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			parsed, err := parseReference(tt.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := parsed.familiarRepository(); got != tt.want {
+				t.Errorf("familiarRepository of %q = %q, want %q", tt.ref, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// hostResolvConfPaths are where the host's resolver configuration is read from, the second
+// being where systemd-resolved lists the upstream servers its local stub forwards to
+var hostResolvConfPaths = []string{"/etc/resolv.conf", "/run/systemd/resolve/resolv.conf"}
+
+// defaultNameservers are used when the host has none a container could reach, as docker does
+var defaultNameservers = []string{"8.8.8.8", "8.8.4.4"}
+
+// parseNameservers validates the addresses given with --dns
+func parseNameservers(addresses []string) ([]string, error) {
+	var nameservers []string
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid DNS server %q, expected an IP address", address)
+		}
+		nameservers = append(nameservers, ip.String())
+	}
+	return nameservers, nil
+}
+
+// setupResolvConf writes /etc/resolv.conf into the root filesystem at rootfs, listing
+// nameservers if any were given and otherwise those of the host. An image's own resolv.conf
+// is kept unless nameservers were given. A container with its own network namespace cannot
+// reach nameservers on the host's loopback, such as systemd-resolved's stub, so those are
+// left out unless the container shares the host's network.
+func setupResolvConf(rootfs string, nameservers []string, hostNetwork bool) error {
+	rootfs, err := filepath.EvalSymlinks(rootfs)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(rootfs, "etc/resolv.conf")
+	if len(nameservers) == 0 && shipsResolvConf(rootfs, path) {
+		logger.Debug("keeping the image's resolv.conf")
+		return nil
+	}
+
+	var content []byte
+	if len(nameservers) > 0 {
+		var b bytes.Buffer
+		for _, nameserver := range nameservers {
+			fmt.Fprintf(&b, "nameserver %s\n", nameserver)
+		}
+		content = b.Bytes()
+	} else if content, err = hostResolvConf(hostNetwork); err != nil {
+		return err
+	}
+
+	// The image could contain a symlink redirecting /etc outside of the root filesystem
+	etc := filepath.Join(rootfs, "etc")
+	if !resolvesWithin(rootfs, etc) {
+		return errors.New("/etc resolves outside of the container")
+	}
+	if err := os.MkdirAll(etc, 0755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("could not replace /etc/resolv.conf: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write /etc/resolv.conf: %w", err)
+	}
+	_, err = f.Write(content)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// shipsResolvConf reports whether the image has a resolv.conf of its own, rather than none or
+// a symlink to one created at runtime, such as systemd-resolved's
+func shipsResolvConf(rootfs, path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !resolvesWithin(rootfs, path) {
+			return false
+		}
+		if info, err = os.Stat(path); err != nil {
+			return false
+		}
+	}
+	return info.Mode().IsRegular()
+}
+
+// hostResolvConf returns the host's resolver configuration as a container should see it
+func hostResolvConf(hostNetwork bool) ([]byte, error) {
+	data, err := os.ReadFile(hostResolvConfPaths[0])
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read the host's resolv.conf: %w", err)
+	}
+	if hostNetwork {
+		return data, nil
+	}
+
+	for i, path := range hostResolvConfPaths {
+		upstream := data
+		if i > 0 {
+			if upstream, err = os.ReadFile(path); err != nil {
+				continue
+			}
+		}
+		if content, ok := withoutLoopbackNameservers(upstream); ok {
+			return content, nil
+		}
+	}
+
+	// The host's own search domains and options are kept alongside the default nameservers
+	logger.Debug("host has no nameservers reachable from the container, using defaults", "nameservers", defaultNameservers)
+	content, _ := withoutLoopbackNameservers(data)
+	for _, nameserver := range defaultNameservers {
+		content = append(content, "nameserver "+nameserver+"\n"...)
+	}
+	return content, nil
+}
+
+// withoutLoopbackNameservers removes nameservers on loopback addresses from a resolv.conf,
+// reporting whether any other nameservers remain
+func withoutLoopbackNameservers(data []byte) ([]byte, bool) {
+	var content bytes.Buffer
+	remaining := false
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[0] == "nameserver" {
+			if ip := net.ParseIP(fields[1]); ip != nil && ip.IsLoopback() {
+				continue
+			}
+			remaining = true
+		}
+		content.WriteString(line + "\n")
+	}
+	return content.Bytes(), remaining
+}
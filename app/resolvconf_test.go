@@ -0,0 +1,168 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseNameservers(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		want      []string
+		wantErr   string
+	}{
+		{name: "none"},
+		{name: "IPv4", addresses: []string{"1.1.1.1", "9.9.9.9"}, want: []string{"1.1.1.1", "9.9.9.9"}},
+		{name: "IPv6", addresses: []string{"2001:4860:4860:0:0:0:0:8888"}, want: []string{"2001:4860:4860::8888"}},
+		{name: "hostname", addresses: []string{"dns.google"}, wantErr: `invalid DNS server "dns.google", expected an IP address`},
+		{name: "with port", addresses: []string{"1.1.1.1:53"}, wantErr: `invalid DNS server "1.1.1.1:53"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNameservers(tt.addresses)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseNameservers(%q) returned %v, want %q", tt.addresses, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNameservers(%q) = %q, want %q", tt.addresses, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostResolvConf(t *testing.T) {
+	const (
+		stub     = "nameserver 127.0.0.53\noptions edns0\nsearch example.com\n"
+		upstream = "nameserver 192.0.2.53\nnameserver ::1\n"
+	)
+
+	tests := []struct {
+		name string
+		// host is the host's resolv.conf and resolved systemd-resolved's, each missing if empty
+		host, resolved string
+		hostNetwork    bool
+		want           string
+	}{
+		{name: "reachable", host: "nameserver 192.0.2.1\nsearch example.com\n", want: "nameserver 192.0.2.1\nsearch example.com\n"},
+		{name: "host network keeps loopback", host: stub, resolved: upstream, hostNetwork: true, want: stub},
+		{name: "stub replaced by upstream", host: stub, resolved: upstream, want: "nameserver 192.0.2.53\n"},
+		{name: "stub without upstream", host: stub, want: "options edns0\nsearch example.com\nnameserver 8.8.8.8\nnameserver 8.8.4.4\n"},
+		{name: "only loopback upstream", host: stub, resolved: "nameserver ::1\n", want: "options edns0\nsearch example.com\nnameserver 8.8.8.8\nnameserver 8.8.4.4\n"},
+		{name: "no resolv.conf", want: "nameserver 8.8.8.8\nnameserver 8.8.4.4\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			previous := hostResolvConfPaths
+			hostResolvConfPaths = []string{filepath.Join(dir, "resolv.conf"), filepath.Join(dir, "resolved.conf")}
+			t.Cleanup(func() { hostResolvConfPaths = previous })
+			for i, content := range []string{tt.host, tt.resolved} {
+				if content == "" {
+					continue
+				}
+				if err := os.WriteFile(hostResolvConfPaths[i], []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := hostResolvConf(tt.hostNetwork)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("hostResolvConf = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetupResolvConf(t *testing.T) {
+	outside := t.TempDir()
+	previous := hostResolvConfPaths
+	hostResolvConfPaths = []string{filepath.Join(outside, "resolv.conf")}
+	t.Cleanup(func() { hostResolvConfPaths = previous })
+	if err := os.WriteFile(hostResolvConfPaths[0], []byte("nameserver 192.0.2.1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		// entries make up the image's root filesystem
+		entries     []tarEntry
+		nameservers []string
+		want        string
+		wantErr     string
+	}{
+		{name: "no /etc", want: "nameserver 192.0.2.1\n"},
+		{name: "image has none", entries: []tarEntry{tarDir("etc/")}, want: "nameserver 192.0.2.1\n"},
+		{name: "image ships its own", entries: []tarEntry{tarDir("etc/"), tarFile("etc/resolv.conf", "nameserver 192.0.2.2\n")}, want: "nameserver 192.0.2.2\n"},
+		{
+			name:        "--dns replaces the image's",
+			entries:     []tarEntry{tarDir("etc/"), tarFile("etc/resolv.conf", "nameserver 192.0.2.2\n")},
+			nameservers: []string{"192.0.2.3", "192.0.2.4"},
+			want:        "nameserver 192.0.2.3\nnameserver 192.0.2.4\n",
+		},
+		{
+			name:    "symlink to a runtime file",
+			entries: []tarEntry{tarDir("etc/"), tarSymlink("etc/resolv.conf", "../run/systemd/resolve/stub-resolv.conf")},
+			want:    "nameserver 192.0.2.1\n",
+		},
+		{
+			name:    "symlink leaving the container",
+			entries: []tarEntry{tarDir("etc/"), tarSymlink("etc/resolv.conf", filepath.Join(outside, "resolv.conf"))},
+			want:    "nameserver 192.0.2.1\n",
+		},
+		{
+			name:        "/etc leaving the container",
+			entries:     []tarEntry{tarSymlink("etc", outside)},
+			nameservers: []string{"192.0.2.3"},
+			wantErr:     "/etc resolves outside of the container",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := t.TempDir()
+			if err := extractTar(rootfs, strings.NewReader(string(buildTar(t, tt.entries))), string(OCIImageTypeLayer), false); err != nil {
+				t.Fatal(err)
+			}
+
+			err := setupResolvConf(rootfs, tt.nameservers, false)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("setupResolvConf returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("setupResolvConf: %v", err)
+			}
+			info, err := os.Lstat(filepath.Join(rootfs, "etc/resolv.conf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(filepath.Join(rootfs, "etc/resolv.conf"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Mode().IsRegular() && string(data) != tt.want || !info.Mode().IsRegular() {
+				t.Errorf("resolv.conf is a %s holding %q, want a file holding %q", info.Mode().Type(), data, tt.want)
+			}
+			if host, _ := os.ReadFile(hostResolvConfPaths[0]); string(host) != "nameserver 192.0.2.1\n" {
+				t.Errorf("host resolv.conf was changed to %q", host)
+			}
+		})
+	}
+}
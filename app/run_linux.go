@@ -0,0 +1,639 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFlagConflicts are the pairs of run flags which cannot be used together
+var runFlagConflicts = []flagConflict{
+	{"stream", "squash"},
+	{"stream", "extract-concurrency"},
+	{"from-archive", "stream"},
+	{"from-archive", "digest-pin"},
+	{"dry-run", "from-archive"},
+	{"dry-run", "generate-spec"},
+	{"platform", "from-archive"},
+}
+
+// runCommand pulls an image and runs a command inside it in a new set of namespaces.
+//
+// Usage: your_docker.sh run [options] <image> [command] [arg1] [arg2] ...
+//
+//	your_docker.sh run --from-archive <path.tar> [--ref <image>] [options] [command] [arg1] ...
+//
+// With --generate-spec, the image is extracted into an OCI bundle and described by a runtime
+// spec instead, so that it can be run with `runc run --bundle <dir>`. With --dry-run, the image
+// is only resolved, and the layers running it would download are listed.
+func runCommand(ctx context.Context, arguments []string) {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	squash := flags.Bool("squash", false, "flatten all image layers into a single layer before running")
+	shellForm := flags.Bool("shell", false, "run the command through the image's configured shell")
+	entrypoint := flags.String("entrypoint", "", "override the image's entrypoint")
+	sequential := flags.Bool("sequential", false, "fetch layers one at a time in manifest order")
+	maxConcurrentDownloads := flags.Int("max-concurrent-downloads", defaultMaxConcurrentDownloads, "maximum number of layers to download at once")
+	preferOCI := flags.Bool("prefer-oci", false, "ask registries for OCI manifests ahead of docker manifest lists")
+	extractConcurrency := flags.Int("extract-concurrency", 1, "number of layers to extract concurrently once all are fetched")
+	stream := flags.Bool("stream", false, "extract layers directly from the registry without storing them")
+	cacheStreamed := flags.Bool("cache-streamed", false, "with --stream, also keep each layer in the layer store as it is extracted")
+	digestPin := flags.String("digest-pin", "", "path to a file pinning image references to the digests they must resolve to")
+	timeOffset := flags.Duration("time-offset", 0, "offset the container's monotonic and boot time clocks in a new time namespace")
+	workdir := flags.String("workdir", "", "working directory inside the container (defaults to the image's WorkingDir)")
+	user := flags.String("user", "", "user to run as, as user[:group] by name or id (defaults to the image's User)")
+	flags.StringVar(user, "u", "", "shorthand for --user")
+	tty := flags.Bool("tty", false, "allocate a pseudo-terminal for the container")
+	flags.BoolVar(tty, "t", false, "shorthand for --tty")
+	hostname := flags.String("hostname", "", "hostname for the container (defaults to the short container id)")
+	name := flags.String("name", "", "name for the container, by which exec can find it while it runs")
+	network := flags.String("network", networkNone, "network for the container: none, for its own network with only loopback, bridge or host")
+	var dns stringList
+	flags.Var(&dns, "dns", "DNS server for the container, replacing the image's and host's resolv.conf (repeatable)")
+	var publish stringList
+	flags.Var(&publish, "publish", "publish a container port on the host as [host-ip:]host-port:container-port[/tcp|udp], with --network bridge (repeatable)")
+	flags.Var(&publish, "p", "shorthand for --publish")
+	var envs stringList
+	flags.Var(&envs, "env", "set an environment variable in the container as KEY=VALUE (repeatable)")
+	flags.Var(&envs, "e", "shorthand for --env")
+	var volumes stringList
+	flags.Var(&volumes, "volume", "bind mount a host path into the container as host-path:container-path[:ro] (repeatable)")
+	flags.Var(&volumes, "v", "shorthand for --volume")
+	var injections stringList
+	flags.Var(&injections, "inject", "copy a host file into the container as host-path:container-path (repeatable)")
+	exposeCache := flags.String("expose-cache", "", "mount the layer cache read-only at this path in the container")
+	memory := flags.String("memory", "", "memory limit for the container, such as 512m or 1g")
+	cpus := flags.Float64("cpus", 0, "number of CPUs the container may use")
+	var capAdd, capDrop stringList
+	flags.Var(&capAdd, "cap-add", "add a capability, such as NET_ADMIN or ALL, to the container (repeatable)")
+	flags.Var(&capDrop, "cap-drop", "drop a capability, such as NET_RAW or ALL, from the container (repeatable)")
+	var securityOpts stringList
+	flags.Var(&securityOpts, "security-opt", "security option: seccomp=<profile.json>, seccomp=unconfined or no-new-privileges (repeatable)")
+	fromArchive := flags.String("from-archive", "", "run an image from the docker save tarball `file` instead of pulling it")
+	archiveRef := flags.String("ref", "", "the image to run from an archive holding more than one")
+	parentDeathSignal := flags.String("parent-death-signal", "SIGKILL", "signal sent to the container if this process dies, or none")
+	rootless := flags.Bool("rootless", false, "run in a user namespace mapping the container's root to the invoking user")
+	readOnly := flags.Bool("read-only", false, "mount the container's root filesystem read-only, with writable tmpfs mounts at /tmp and /run")
+	generateSpec := flags.String("generate-spec", "", "write an OCI bundle for runc or crun to this directory instead of running the container")
+	dryRun := flags.Bool("dry-run", false, "resolve the image and list the layers that would be downloaded, without downloading them or running anything")
+	var platform Platform
+	flags.Var(&platform, "platform", "pull the image for `os/arch[/variant]`, such as linux/arm64, rather than for this host")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, runFlagConflicts); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// An image from an archive is chosen with --ref, so every argument belongs to the command
+	var ref string
+	var userArgs []string
+	if *fromArchive != "" {
+		ref, userArgs = *archiveRef, flags.Args()
+	} else {
+		if flags.NArg() < 1 {
+			fmt.Println("Incorrect number of arguments specified.")
+			os.Exit(1)
+		}
+		ref, userArgs = flags.Arg(0), flags.Args()[1:]
+	}
+
+	if *preferOCI {
+		preferOCIManifests()
+	}
+
+	deathSignal, err := parseSignal(*parentDeathSignal)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if err := checkNetworkMode(*network); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if *network == networkBridge && *rootless {
+		fmt.Println("--network bridge needs root to set up the host's side of the network")
+		os.Exit(1)
+	}
+	ports, err := parsePortMappings(publish)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	nameservers, err := parseNameservers(dns)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if len(ports) > 0 && *network != networkBridge {
+		fmt.Println("publishing ports needs --network bridge")
+		os.Exit(1)
+	}
+	if *name != "" {
+		if err := checkContainerName(*name); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	}
+
+	var limits CgroupLimits
+	if *memory != "" {
+		memoryBytes, err := parseMemory(*memory)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		limits.MemoryBytes = memoryBytes
+	}
+	if *cpus < 0 {
+		fmt.Println("--cpus must not be negative")
+		os.Exit(1)
+	}
+	limits.CPUs = *cpus
+
+	// Containers start from docker's default capabilities, adjusted by --cap-add and --cap-drop
+	capabilities, err := capabilitySet(defaultCapabilities, capAdd, capDrop)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// The seccomp profile is compiled now, so that a bad profile is reported before pulling
+	security, err := parseSecurityOptions(securityOpts)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	var seccompFilter []unix.SockFilter
+	if security.Seccomp != nil {
+		seccompFilter, err = compileSeccomp(security.Seccomp, capabilities)
+		if err != nil {
+			fmt.Printf("invalid seccomp profile: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	var mounts []BindMount
+	for _, spec := range volumes {
+		mount, err := parseVolume(spec)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		mounts = append(mounts, *mount)
+	}
+	if *exposeCache != "" {
+		mount, err := cacheMount(*exposeCache)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		mounts = append(mounts, *mount)
+	}
+
+	var injected []Injection
+	for _, spec := range injections {
+		injection, err := parseInjection(spec)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		injected = append(injected, *injection)
+	}
+
+	containerID, err := newContainerID()
+	if err != nil {
+		fmt.Printf("could not generate container id: %s\n", err)
+		os.Exit(1)
+	}
+	if *hostname == "" {
+		*hostname = shortContainerID(containerID)
+	}
+
+	var uidMappings, gidMappings []syscall.SysProcIDMap
+	if *rootless {
+		uidMappings, gidMappings = rootlessIDMappings()
+		// Extracted files are owned by the host IDs the container's IDs map to
+		extractUIDMappings = toIDMappings(uidMappings)
+		extractGIDMappings = toIDMappings(gidMappings)
+	}
+
+	// A bundle's root filesystem is kept for another runtime to use, rather than removed on exit
+	var chdir string
+	cleanup := &runCleanup{}
+	if *generateSpec != "" {
+		chdir = filepath.Join(*generateSpec, "rootfs")
+		if err := createBundleRootfs(chdir); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	} else {
+		// TODO: Provide a better location than /tmp
+		chdir, err = ioutil.TempDir("/tmp/", "container.")
+		if err != nil {
+			fmt.Printf("Could not create temporary directory: %s\n", err)
+		}
+		cleanup.rootfs = chdir
+		// The temporary directory becomes /, which every user the command may run as must be
+		// able to search
+		if err := os.Chmod(chdir, 0755); err != nil {
+			fmt.Printf("Could not make temporary directory searchable: %s\n", err)
+			cleanup.exit(1)
+		}
+	}
+	cleanup.handleSignals()
+
+	// The name is taken before pulling, so that a duplicate is reported without waiting for it
+	if *name != "" && *generateSpec == "" {
+		reservation, err := reserveContainerName(*name)
+		if err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+		cleanup.setName(reservation)
+	}
+
+	if *extractConcurrency < 1 {
+		fmt.Println("--extract-concurrency must be at least 1")
+		cleanup.exit(1)
+	}
+	if *maxConcurrentDownloads < 1 {
+		fmt.Println("--max-concurrent-downloads must be at least 1")
+		cleanup.exit(1)
+	}
+	if *cacheStreamed && !*stream {
+		fmt.Println("--cache-streamed only applies with --stream")
+		cleanup.exit(1)
+	}
+	concurrentExtraction := *extractConcurrency > 1 && !*squash && !*stream
+
+	// Unless the layers are squashed or extracted concurrently afterwards, each layer is
+	// extracted as soon as it and the layers beneath it have been fetched.
+	var layerReady func(*ImageLayer) error
+	if !*squash && !*stream && !concurrentExtraction {
+		layerReady = func(layer *ImageLayer) error {
+			if err := extractLayer(chdir, layer); err != nil {
+				return fmt.Errorf("could not extract layer %s - %w", layer.Sha256Sum, err)
+			}
+			return nil
+		}
+	}
+
+	pullOptions := &PullOptions{
+		LayerReady:             layerReady,
+		Sequential:             *sequential,
+		MaxConcurrentDownloads: *maxConcurrentDownloads,
+		ExtractStreaming:       *stream,
+		ExtractTo:              chdir,
+		CacheStreamedLayers:    *cacheStreamed,
+		Platform:               platform,
+	}
+	if *digestPin != "" {
+		pins, err := loadDigestPins(*digestPin)
+		if err != nil {
+			fmt.Printf("could not load digest pins: %s\n", err)
+			cleanup.exit(1)
+		}
+		pinned, ok := pins[canonicalReference(ref)]
+		if !ok {
+			fmt.Printf("no pinned digest found for %s in %s\n", ref, *digestPin)
+			cleanup.exit(1)
+		}
+		pullOptions.PinnedDigest = pinned
+	}
+
+	// Pull the image down first before switching chroot
+	var layers *[]ImageLayer
+	var config *DockerImageConfig
+	// Images imported with load are run from the layer store, unless they must come from a
+	// registry to be streamed, checked against a pinned digest or pulled for another platform
+	var stored *StoredImage
+	if *fromArchive == "" && !*stream && *digestPin == "" && platform.Os == "" {
+		if stored, err = findImage(ref); err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+	}
+	if *dryRun {
+		if stored != nil {
+			fmt.Printf("%s is in the local image index, so nothing would be downloaded\n", ref)
+		} else if err := planPull(ctx, os.Stdout, ref, pullOptions); err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+		cleanup.exit(0)
+	}
+	if *fromArchive != "" || stored != nil {
+		if stored != nil {
+			var storedLayers []ImageLayer
+			storedLayers, err = stored.imageLayers()
+			layers, config = &storedLayers, &stored.Config
+		} else {
+			layers, config, err = loadArchive(*fromArchive, ref)
+		}
+		if err == nil && layerReady != nil {
+			for i := range *layers {
+				if err = layerReady(&(*layers)[i]); err != nil {
+					break
+				}
+			}
+		}
+	} else {
+		progress := newProgressReporter(os.Stderr)
+		pullOptions.Progress = progress.report
+		pullOptions.Downloading = progress.downloading
+		layers, config, err = pullImage(ctx, ref, nil, pullOptions)
+		progress.finish()
+	}
+	if err != nil {
+		fmt.Println(err)
+		cleanup.exit(1)
+	}
+
+	if concurrentExtraction {
+		if err := extractLayersConcurrently(chdir, layers, *extractConcurrency); err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+	}
+
+	if *squash {
+		if layers, err = extractSquashedLayers(chdir, layers); err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+	}
+
+	emitEvent("extract-complete", "layers", len(*layers), "rootfs", chdir)
+
+	argv, err := config.argv(*entrypoint, userArgs, *shellForm)
+	if err != nil {
+		fmt.Println(err)
+		cleanup.exit(1)
+	}
+	logger.Debug("effective command", "argv", argv)
+
+	if *workdir == "" && config != nil {
+		*workdir = config.Config.WorkingDir
+	}
+	if *user == "" && config != nil {
+		*user = config.Config.User
+	}
+	env := config.env(envs)
+
+	if *readOnly && config != nil {
+		if unwritable := unwritableVolumes(config.Config.Volumes, mounts); len(unwritable) > 0 {
+			fmt.Printf("the image expects %s to be writable, but the root filesystem is read-only; mount a volume there with -v\n", strings.Join(unwritable, ", "))
+			cleanup.exit(1)
+		}
+	}
+
+	if err := setupResolvConf(chdir, nameservers, *network == networkHost); err != nil {
+		fmt.Printf("could not set up /etc/resolv.conf: %v\n", err)
+		cleanup.exit(1)
+	}
+
+	for _, injection := range injected {
+		if err := injection.inject(chdir); err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+	}
+
+	if *generateSpec != "" {
+		spec, err := newRuntimeSpec(&InitConfig{
+			RootFS:           chdir,
+			Command:          argv[0],
+			Args:             argv[1:],
+			Hostname:         *hostname,
+			WorkingDir:       *workdir,
+			User:             *user,
+			Mounts:           mounts,
+			Capabilities:     capabilities,
+			ReadOnly:         *readOnly,
+			NoNewPrivileges:  security.NoNewPrivileges,
+			NetworkNamespace: *network != networkHost,
+		}, &SpecOptions{
+			Env:         env,
+			Terminal:    *tty,
+			Limits:      limits,
+			UIDMappings: uidMappings,
+			GIDMappings: gidMappings,
+			TimeOffset:  *timeOffset,
+			Seccomp:     security.Seccomp,
+		})
+		if err == nil {
+			err = writeRuntimeSpec(*generateSpec, spec)
+		}
+		if err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+		fmt.Printf("Wrote OCI bundle to %s\n", *generateSpec)
+		cleanup.exit(0)
+	}
+
+	// The command is started through an init process, which sets up the container from
+	// inside its namespaces before executing the command in its place.
+	cmd := exec.Command("/proc/self/exe", append(logFlags(), "init")...)
+
+	cmd.Env = env
+	if err := checkArgvSize(argv, cmd.Env); err != nil {
+		fmt.Println(err)
+		cleanup.exit(1)
+	}
+	cmd.Stdin = os.Stdin
+	cmd.Stderr = os.Stderr
+	cmd.Stdout = os.Stdout
+
+	// fmt.Printf("Available capabilities: %q\n", syscall.SysProcAttr{})
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUTS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNS,
+		// Stops the container from outliving this process should it die without cleaning up
+		Pdeathsig: deathSignal,
+	}
+	if *network != networkHost {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWNET
+	}
+	if *rootless {
+		cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER
+		cmd.SysProcAttr.UidMappings = uidMappings
+		cmd.SysProcAttr.GidMappings = gidMappings
+		// An unprivileged process may only write a GID mapping once setgroups is denied
+		cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+	}
+
+	// With a terminal, the container's standard streams are the slave of a pseudo-terminal which
+	// becomes its controlling terminal, and the host's streams are relayed through the master
+	var ptyMaster, ptySlave *os.File
+	if *tty {
+		var ptyPath string
+		ptyMaster, ptySlave, ptyPath, err = openPTY()
+		if err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = ptySlave, ptySlave, ptySlave
+		cmd.SysProcAttr.Setsid = true
+		cmd.SysProcAttr.Setctty = true
+		cmd.SysProcAttr.Ctty = 0
+		// The slave is mounted at the same path in the container, so that it can be found by name
+		mounts = append(mounts, BindMount{Source: ptyPath, Destination: ptyPath})
+	}
+
+	// Debug builds provide the challenge's docker-explorer binary in every container, if present
+	if debugCapabilities != "" {
+		explorer := Injection{Source: "/usr/local/bin/docker-explorer", Destination: "/usr/local/bin/docker-explorer"}
+		if err := explorer.inject(chdir); err != nil {
+			logger.Warn("could not provide docker-explorer", "error", err)
+		}
+	}
+
+	// The time namespace only applies to processes started afterwards from this thread
+	if *timeOffset != 0 {
+		if err := setupTimeNamespace(*timeOffset); err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+	}
+
+	// A container on the bridge network is given its address now, and connected to the bridge
+	// once init is running in the container's network namespace
+	var networkInterface *NetworkInterface
+	if *network == networkBridge {
+		if err := setupBridge(); err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+		lease, err := leaseAddress()
+		if err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+		cleanup.setLease(lease)
+		networkInterface = lease.networkInterface()
+		logger.Debug("leased network address", "address", lease.Address)
+
+		published, err := publishPorts(ports, lease.Address.IP)
+		if err != nil {
+			fmt.Println(err)
+			cleanup.exit(1)
+		}
+		cleanup.setPorts(published)
+	}
+
+	initConfig := &InitConfig{
+		RootFS:           chdir,
+		Command:          argv[0],
+		Args:             argv[1:],
+		Hostname:         *hostname,
+		WorkingDir:       *workdir,
+		User:             *user,
+		Mounts:           mounts,
+		Capabilities:     capabilities,
+		DeathSignal:      deathSignal,
+		MountNamespace:   cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWNS != 0,
+		NetworkNamespace: cmd.SysProcAttr.Cloneflags&syscall.CLONE_NEWNET != 0,
+		Interface:        networkInterface,
+		ReadOnly:         *readOnly,
+		Seccomp:          seccompFilter,
+		NoNewPrivileges:  security.NoNewPrivileges,
+	}
+
+	// The container is placed in its cgroup before init runs the command, so that every process
+	// in the container is subject to the limits. Without limits, a cgroup is still created where
+	// possible so that the container can be paused.
+	var cgroup *Cgroup
+	limited := limits.MemoryBytes > 0 || limits.CPUs > 0
+	if limited || cgroupsAvailable() {
+		cgroup, err = createCgroup(containerID, limits)
+		if err != nil && limited {
+			fmt.Printf("could not create cgroup: %v\n", err)
+			cleanup.exit(1)
+		}
+		if err != nil {
+			logger.Debug("running container without a cgroup", "error", err)
+		} else {
+			cleanup.setCgroup(cgroup)
+		}
+	}
+	started := func(pid int) error {
+		if cgroup != nil {
+			if err := cgroup.addProcess(pid); err != nil {
+				return err
+			}
+		}
+		if networkInterface != nil {
+			if err := connectToBridge(containerID, pid); err != nil {
+				return err
+			}
+		}
+		cleanup.started(cmd.Process)
+		return nil
+	}
+
+	// The parent death signal is sent when the thread that started the container exits, rather
+	// than this process, so the starting goroutine is kept on a thread that lives as long as run
+	runtime.LockOSThread()
+	err = startContainer(cmd, initConfig, started)
+	if err == nil {
+		emitEvent("container-started", "id", containerID, "pid", cmd.Process.Pid)
+		image := ref
+		if image == "" {
+			image = *fromArchive
+		}
+		state := &ContainerState{
+			ID:       containerID,
+			Name:     *name,
+			Pid:      cmd.Process.Pid,
+			Rootless: *rootless,
+			Image:    image,
+			Command:  argv,
+			Created:  time.Now(),
+			Env:      env,
+			Init:     initConfig,
+		}
+		if err := saveContainerState(state); err != nil {
+			logger.Warn("could not record container state, exec will not find it", "error", err)
+		} else {
+			cleanup.setState(containerID)
+		}
+		var output <-chan struct{}
+		if *tty {
+			ptySlave.Close()
+			if isTerminal(os.Stdin) {
+				if restore, err := makeRaw(os.Stdin); err == nil {
+					cleanup.setTerminal(restore)
+				}
+			}
+			output = proxyPTY(ptyMaster)
+		}
+
+		err = cmd.Wait()
+		cleanup.exited()
+		if output != nil {
+			<-output
+		}
+		if cmd.ProcessState != nil {
+			emitEvent("exited", "id", containerID, "code", cleanup.exitCode(cmd.ProcessState))
+		}
+	}
+
+	if err != nil {
+		fmt.Printf("error executing command: %v\n", err)
+		if exitError, ok := err.(*exec.ExitError); ok {
+			cleanup.exit(cleanup.exitCode(exitError.ProcessState))
+		}
+		cleanup.exit(1)
+	}
+	cleanup.exit(0)
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunExtractsPulledLayers(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.pushIndex(t, "layered", "latest", newFakeImage(t,
+		probeLayer(t),
+		buildLayer(t, []tarEntry{tarDir("etc/"), tarFile("etc/first", "first\n"), tarFile("etc/gone", "gone\n")}),
+		buildLayer(t, []tarEntry{tarFile("etc/second", "second\n"), tarFile("etc/.wh.gone", "")}),
+	))
+
+	tests := []struct {
+		name  string
+		flags []string
+	}{
+		{name: "default"},
+		{name: "sequential", flags: []string{"--sequential"}},
+		{name: "squash", flags: []string{"--squash"}},
+		{name: "stream", flags: []string{"--stream"}},
+		{name: "concurrent extraction", flags: []string{"--extract-concurrency", "3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--insecure-registry", registry.host, "run"}, tt.flags...)
+			args = append(args, ref, "/bin/probe", "ls", "/etc")
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			entries := make(map[string]bool)
+			for _, name := range strings.Fields(stdout) {
+				entries[name] = true
+			}
+			if !entries["first"] || !entries["second"] || entries["gone"] {
+				t.Errorf("/etc in the container holds %q, want first and second without gone", strings.Fields(stdout))
+			}
+		})
+	}
+}
+
+func TestRunCacheStreamed(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	layers := [][]byte{probeLayer(t), buildLayer(t, []tarEntry{tarFile("etc/streamed", "streamed\n")})}
+	ref := registry.push("streamed", "latest", newFakeImage(t, layers...))
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantCode   int
+		wantOutput string
+		wantCached bool
+	}{
+		{name: "streamed", flags: []string{"--stream"}},
+		{name: "streamed and cached", flags: []string{"--stream", "--cache-streamed"}, wantCached: true},
+		{name: "cached without streaming", flags: []string{"--cache-streamed"}, wantCode: 1, wantOutput: "--cache-streamed only applies with --stream"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			args := append([]string{"--insecure-registry", registry.host, "run"}, tt.flags...)
+			args = append(args, ref, "/bin/probe", "exit", "0")
+			stdout, stderr, code := tool(t, dir, args...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout+stderr, tt.wantOutput) {
+				t.Errorf("run wrote %q, want it to contain %q", stdout+stderr, tt.wantOutput)
+			}
+			for _, layer := range layers {
+				name := filepath.Join(dir, "layers", strings.TrimPrefix(digestOf(layer), "sha256:")+".tar.gz")
+				if _, err := os.Stat(name); (err == nil) != tt.wantCached {
+					t.Errorf("layer %s is in the layer store: %t, want %t", digestOf(layer), err == nil, tt.wantCached)
+				}
+			}
+		})
+	}
+}
+
+func TestRunCommandFromImage(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	probe := probeLayer(t)
+	withEntrypoint := registry.push("entrypoint", "latest", newFakeImageWith(t, OCIImageConfig{
+		Entrypoint: []string{"/bin/probe", "exit"},
+		Cmd:        []string{"3"},
+	}, probe))
+	withCmd := registry.push("cmd", "latest", newFakeImageWith(t, OCIImageConfig{Cmd: []string{"/bin/probe", "exit", "4"}}, probe))
+	withNothing := registry.push("nothing", "latest", newFakeImageWith(t, OCIImageConfig{}, probe))
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantOutput string
+	}{
+		{name: "image entrypoint and command", args: []string{withEntrypoint}, wantCode: 3},
+		{name: "arguments to the image entrypoint", args: []string{withEntrypoint, "7"}, wantCode: 7},
+		{name: "entrypoint given", args: []string{"--entrypoint", "/bin/probe", withEntrypoint, "exit", "5"}, wantCode: 5},
+		{name: "image command", args: []string{withCmd}, wantCode: 4},
+		{name: "command given", args: []string{withCmd, "/bin/probe", "exit", "6"}, wantCode: 6},
+		{name: "no command", args: []string{withNothing}, wantCode: 1, wantOutput: "no command specified"},
+		{name: "effective command reported", args: []string{withCmd}, wantCode: 4, wantOutput: `argv="[/bin/probe exit 4]"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"--verbose", "--insecure-registry", registry.host, "run"}, tt.args...)
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout+stderr, tt.wantOutput) {
+				t.Errorf("run wrote %q, want %q", stdout+stderr, tt.wantOutput)
+			}
+		})
+	}
+}
+
+func TestRunEnvironment(t *testing.T) {
+	requireContainers(t)
+
+	tests := []struct {
+		name  string
+		flags []string
+		want  []string
+	}{
+		{name: "image environment", want: []string{"PATH=/bin"}},
+		{name: "overridden", flags: []string{"-e", "PATH=/usr/bin", "--env", "GREETING=hello world"}, want: []string{"PATH=/usr/bin", "GREETING=hello world"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "env")
+			if code != 0 {
+				t.Fatalf("probe exited with %d: %s%s", code, stdout, stderr)
+			}
+			env := strings.Split(strings.TrimSpace(stdout), "\n")
+			for _, variable := range tt.want {
+				if !containsString(env, variable) {
+					t.Errorf("container environment is %q, want %s", env, variable)
+				}
+			}
+			// The tool itself runs with stateDirEnv set, which the container must not inherit
+			for _, variable := range env {
+				if strings.HasPrefix(variable, stateDirEnv+"=") {
+					t.Errorf("container inherited the host environment: %q", env)
+				}
+			}
+		})
+	}
+}
+
+func TestRunFromArchive(t *testing.T) {
+	requireContainers(t)
+	probe := probeLayer(t)
+	archive := writeArchive(t, archiveEntries(t,
+		archiveImage{[]string{"first:latest"}, newFakeImageWith(t, OCIImageConfig{Cmd: []string{"/bin/probe", "cat", "/name"}}, probe, buildLayer(t, []tarEntry{tarFile("name", "first\n")}))},
+		archiveImage{[]string{"second:latest"}, newFakeImageWith(t, OCIImageConfig{Cmd: []string{"/bin/probe", "cat", "/name"}}, probe, buildTar(t, []tarEntry{tarFile("name", "second\n")}))},
+	))
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "first", args: []string{"--ref", "first"}, wantStdout: "first\n"},
+		{name: "second", args: []string{"--ref", "second:latest"}, wantStdout: "second\n"},
+		{name: "command", args: []string{"--ref", "first", "/bin/probe", "pwd"}, wantStdout: "/\n"},
+		{name: "no ref", wantCode: 1, wantStdout: "archive contains 2 images, select one with --ref\n"},
+		{name: "unknown ref", args: []string{"--ref", "third"}, wantCode: 1, wantStdout: "archive does not contain an image tagged third\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append([]string{"run", "--from-archive", archive}, tt.args...)
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestRunArgumentListTooLong(t *testing.T) {
+	requireContainers(t)
+	// Strings this long cannot be passed to the tool itself, so they come from the image
+	long := strings.Repeat("1", maxArgStrlen)
+	tests := []struct {
+		name       string
+		settings   OCIImageConfig
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "fits", settings: OCIImageConfig{Cmd: []string{"/bin/probe", "exit", "0"}}},
+		{
+			name:       "long argument",
+			settings:   OCIImageConfig{Cmd: []string{"/bin/probe", "exit", long}},
+			wantCode:   1,
+			wantStdout: "argument list too long: a single argument or environment variable may be at most 131071 bytes\n",
+		},
+		{
+			name:       "long environment variable",
+			settings:   OCIImageConfig{Cmd: []string{"/bin/probe", "exit", "0"}, Env: []string{"LONG=" + long}},
+			wantCode:   1,
+			wantStdout: "argument list too long: a single argument or environment variable may be at most 131071 bytes\n",
+		},
+	}
+
+	registry := newFakeRegistry(t)
+	probe := probeLayer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ref := registry.push("long", "latest", newFakeImageWith(t, tt.settings, probe))
+			stdout, stderr, code := tool(t, t.TempDir(), "--insecure-registry", registry.host, "run", ref)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestRunVerbose(t *testing.T) {
+	requireContainers(t)
+	tests := []struct {
+		name  string
+		flags []string
+		// wantDebug is whether debugging output is logged, both by run and by the container's
+		// init process, which logs its working directory
+		wantDebug bool
+	}{
+		{name: "quiet"},
+		{name: "verbose", flags: []string{"--verbose"}, wantDebug: true},
+		{name: "shorthand", flags: []string{"-v"}, wantDebug: true},
+	}
+
+	registry := newFakeRegistry(t)
+	ref := registry.push("probe", "latest", newFakeImage(t, probeLayer(t)))
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(append([]string{"--insecure-registry", registry.host}, tt.flags...), "run", ref, "/bin/probe", "pwd")
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != 0 || stdout != "/\n" {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			for _, message := range []string{`msg="effective command"`, `msg="working directory"`} {
+				if got := strings.Contains(stderr, "level=DEBUG "+message); got != tt.wantDebug {
+					t.Errorf("logged %s: %t, want %t\n%s", message, got, tt.wantDebug, stderr)
+				}
+			}
+		})
+	}
+}
+
+func TestRunLoadedImage(t *testing.T) {
+	requireContainers(t)
+	probe := probeLayer(t)
+	archive := writeArchive(t, archiveEntries(t,
+		archiveImage{[]string{"first:latest"}, newFakeImageWith(t, OCIImageConfig{Cmd: []string{"/bin/probe", "cat", "/name"}}, probe, buildLayer(t, []tarEntry{tarFile("name", "first\n")}))},
+	))
+	registry := newFakeRegistry(t)
+
+	tests := []struct {
+		name       string
+		image      string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "by tag", image: "first", wantStdout: "first\n"},
+		{name: "by full reference", image: "docker.io/library/first:latest", wantStdout: "first\n"},
+		// An image which was not loaded is pulled from its registry
+		{name: "not loaded", image: registry.host + "/second", wantCode: 1, wantStdout: "manifest unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if stdout, stderr, code := tool(t, dir, "load", archive); code != 0 {
+				t.Fatalf("load exited with %d: %s%s", code, stdout, stderr)
+			}
+			stdout, stderr, code := tool(t, dir, "--insecure-registry", registry.host, "run", tt.image)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestRunInject(t *testing.T) {
+	requireContainers(t)
+	source := filepath.Join(t.TempDir(), "greeting")
+	if err := os.WriteFile(source, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "injected", flags: []string{"--inject", source + ":/etc/greeting"}, wantStdout: "hello\n"},
+		{name: "not injected", wantCode: 1},
+		{name: "invalid", flags: []string{"--inject", source}, wantCode: 1, wantStdout: "expected host-path:container-path"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "cat", "/etc/greeting")
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
+
+func TestRunDNS(t *testing.T) {
+	requireContainers(t)
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantCode   int
+		wantStdout string
+	}{
+		{name: "given nameservers", flags: []string{"--dns", "192.0.2.3", "--dns", "192.0.2.4"}, wantStdout: "nameserver 192.0.2.3\nnameserver 192.0.2.4\n"},
+		{name: "host's nameservers", wantStdout: "nameserver "},
+		{name: "invalid nameserver", flags: []string{"--dns", "dns.google"}, wantCode: 1, wantStdout: `invalid DNS server "dns.google"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "cat", "/etc/resolv.conf")
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantStdout) {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// runCommand reports that containers cannot be run here, as namespaces and the other
+// isolation primitives used by run only exist on Linux.
+func runCommand(ctx context.Context, arguments []string) {
+	fmt.Println("the container runtime requires Linux; only registry commands such as 'pull' are available on this platform")
+	os.Exit(1)
+}
+
+func initCommand() {
+	runCommand(context.Background(), nil)
+}
+
+func execCommand(arguments []string) {
+	runCommand(context.Background(), nil)
+}
+
+func psCommand(arguments []string) {
+	runCommand(context.Background(), nil)
+}
+
+func stopCommand(arguments []string) {
+	runCommand(context.Background(), nil)
+}
+
+func rmCommand(arguments []string) {
+	runCommand(context.Background(), nil)
+}
+
+func pauseCommand(arguments []string) {
+	runCommand(context.Background(), nil)
+}
+
+func unpauseCommand(arguments []string) {
+	runCommand(context.Background(), nil)
+}
@@ -0,0 +1,403 @@
+package main
+
+//go:generate sh mksyscalls.sh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// A seccomp profile in the JSON format docker uses, which lists the syscalls a container may or
+// may not make. Rules can be limited to containers holding certain capabilities, to particular
+// architectures or to newer kernels, and are checked in order, the first matching rule deciding
+// what happens to a syscall.
+type (
+	SeccompProfile struct {
+		DefaultAction   string        `json:"defaultAction"`
+		DefaultErrnoRet *uint         `json:"defaultErrnoRet,omitempty"`
+		Architectures   []string      `json:"architectures,omitempty"`
+		Syscalls        []SeccompRule `json:"syscalls"`
+	}
+	SeccompRule struct {
+		Names    []string      `json:"names,omitempty"`
+		Name     string        `json:"name,omitempty"`
+		Action   string        `json:"action"`
+		ErrnoRet *uint         `json:"errnoRet,omitempty"`
+		Args     []SeccompArg  `json:"args,omitempty"`
+		Includes SeccompFilter `json:"includes"`
+		Excludes SeccompFilter `json:"excludes"`
+	}
+	SeccompArg struct {
+		Index    uint   `json:"index"`
+		Value    uint64 `json:"value"`
+		ValueTwo uint64 `json:"valueTwo,omitempty"`
+		Op       string `json:"op"`
+	}
+	SeccompFilter struct {
+		Caps      []string `json:"caps,omitempty"`
+		Arches    []string `json:"arches,omitempty"`
+		MinKernel string   `json:"minKernel,omitempty"`
+	}
+)
+
+// loadSeccompProfile reads a seccomp profile from a JSON file
+func loadSeccompProfile(path string) (*SeccompProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read seccomp profile: %w", err)
+	}
+	var profile SeccompProfile
+	if err := json.Unmarshal(data, &profile); err != nil {
+		return nil, fmt.Errorf("could not parse seccomp profile %s: %w", path, err)
+	}
+	if profile.DefaultAction == "" {
+		return nil, fmt.Errorf("seccomp profile %s has no defaultAction", path)
+	}
+	return &profile, nil
+}
+
+// resolve returns the rules of the profile which apply to a container holding capabilities on
+// this machine, with every syscall they name gathered into Names
+func (p *SeccompProfile) resolve(capabilities []string) ([]SeccompRule, error) {
+	held := make(map[string]bool)
+	for _, name := range capabilities {
+		held[name] = true
+	}
+	kernel, err := kernelVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []SeccompRule
+	for _, rule := range p.Syscalls {
+		included, err := rule.Includes.matches(held, kernel, true)
+		if err != nil {
+			return nil, err
+		}
+		excluded, err := rule.Excludes.matches(held, kernel, false)
+		if err != nil {
+			return nil, err
+		}
+		if !included || excluded {
+			continue
+		}
+		if rule.Name != "" {
+			rule.Names = append([]string{rule.Name}, rule.Names...)
+			rule.Name = ""
+		}
+		rule.Includes, rule.Excludes = SeccompFilter{}, SeccompFilter{}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// matches reports whether a container holding the capabilities in held, running on a kernel
+// of the given version, meets the conditions of an includes filter, which must all be met, or
+// an excludes filter, of which any one is enough
+func (f *SeccompFilter) matches(held map[string]bool, kernel [2]int, all bool) (bool, error) {
+	var conditions []bool
+	for _, name := range f.Caps {
+		conditions = append(conditions, held[name])
+	}
+	if len(f.Arches) > 0 {
+		conditions = append(conditions, containsString(f.Arches, runtime.GOARCH))
+	}
+	if f.MinKernel != "" {
+		minimum, err := parseKernelVersion(f.MinKernel)
+		if err != nil {
+			return false, err
+		}
+		conditions = append(conditions, kernel[0] > minimum[0] || kernel[0] == minimum[0] && kernel[1] >= minimum[1])
+	}
+
+	for _, met := range conditions {
+		if met != all {
+			return !all, nil
+		}
+	}
+	return all, nil
+}
+
+// kernelVersion returns the major and minor version of the running kernel
+func kernelVersion() ([2]int, error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return [2]int{}, fmt.Errorf("could not determine kernel version: %w", err)
+	}
+	return parseKernelVersion(unix.ByteSliceToString(uname.Release[:]))
+}
+
+// parseKernelVersion parses the major and minor version from a kernel release such as 6.1.0-13-amd64
+func parseKernelVersion(release string) ([2]int, error) {
+	var version [2]int
+	parts := strings.SplitN(release, ".", 3)
+	if len(parts) < 2 {
+		return version, fmt.Errorf("invalid kernel version %q", release)
+	}
+	for i := range version {
+		digits := strings.IndexFunc(parts[i], func(r rune) bool { return r < '0' || r > '9' })
+		if digits == -1 {
+			digits = len(parts[i])
+		}
+		n, err := strconv.Atoi(parts[i][:digits])
+		if err != nil {
+			return version, fmt.Errorf("invalid kernel version %q", release)
+		}
+		version[i] = n
+	}
+	return version, nil
+}
+
+// seccompAction converts a profile's action into the value a filter returns for it
+func seccompAction(action string, errnoRet *uint) (uint32, error) {
+	errno := uint32(unix.EPERM)
+	if errnoRet != nil {
+		errno = uint32(*errnoRet)
+	}
+	switch action {
+	case "SCMP_ACT_ALLOW":
+		return unix.SECCOMP_RET_ALLOW, nil
+	case "SCMP_ACT_ERRNO":
+		return unix.SECCOMP_RET_ERRNO | errno&unix.SECCOMP_RET_DATA, nil
+	case "SCMP_ACT_TRACE":
+		return unix.SECCOMP_RET_TRACE | errno&unix.SECCOMP_RET_DATA, nil
+	case "SCMP_ACT_KILL", "SCMP_ACT_KILL_THREAD":
+		return unix.SECCOMP_RET_KILL_THREAD, nil
+	case "SCMP_ACT_KILL_PROCESS":
+		return unix.SECCOMP_RET_KILL_PROCESS, nil
+	case "SCMP_ACT_TRAP":
+		return unix.SECCOMP_RET_TRAP, nil
+	case "SCMP_ACT_LOG":
+		return unix.SECCOMP_RET_LOG, nil
+	}
+	return 0, fmt.Errorf("unsupported seccomp action %q", action)
+}
+
+// Offsets of the fields of the seccomp_data a filter examines
+const (
+	seccompDataNr   = 0
+	seccompDataArch = 4
+	seccompDataArgs = 16
+)
+
+// x32SyscallBit marks syscalls made through the x32 ABI on amd64, which share the architecture
+// of native syscalls but are numbered differently
+const x32SyscallBit = 0x40000000
+
+// seccompFailed stands in for the offset of the end of a block of filter instructions while the
+// block is being built, as the block's length is not known until then
+const seccompFailed = 0xff
+
+// compileSeccomp compiles the rules of a profile which apply to a container holding
+// capabilities into a BPF program for seccomp. Syscalls it names which do not exist on this
+// architecture are ignored, as profiles cover several architectures at once.
+func compileSeccomp(profile *SeccompProfile, capabilities []string) ([]unix.SockFilter, error) {
+	if seccompAuditArch == 0 {
+		return nil, fmt.Errorf("seccomp profiles are not supported on %s", runtime.GOARCH)
+	}
+	rules, err := profile.resolve(capabilities)
+	if err != nil {
+		return nil, err
+	}
+	defaultAction, err := seccompAction(profile.DefaultAction, profile.DefaultErrnoRet)
+	if err != nil {
+		return nil, err
+	}
+
+	// Syscalls made through another architecture's interface would be matched against the wrong
+	// numbers, so are refused outright
+	refused := unix.SECCOMP_RET_ERRNO | uint32(unix.ENOSYS)
+	program := []unix.SockFilter{
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, seccompAuditArch, 1, 0),
+		bpfStmt(unix.BPF_RET|unix.BPF_K, refused),
+		bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr),
+	}
+	if runtime.GOARCH == "amd64" {
+		program = append(program,
+			bpfJump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, 0, 1),
+			bpfStmt(unix.BPF_RET|unix.BPF_K, refused),
+		)
+	}
+
+	// Each syscall of each rule gets a block which returns the rule's action when the syscall
+	// and its arguments match, and otherwise falls through to the next block. The accumulator
+	// only needs reloading with the syscall number once a block has examined arguments.
+	loaded := true
+	for _, rule := range rules {
+		action, err := seccompAction(rule.Action, rule.ErrnoRet)
+		if err != nil {
+			return nil, err
+		}
+		alternatives, err := argumentChecks(rule.Args)
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range rule.Names {
+			nr, ok := syscallNumbers[name]
+			if !ok {
+				continue
+			}
+			for _, checks := range alternatives {
+				var block []unix.SockFilter
+				if !loaded {
+					block = append(block, bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNr))
+				}
+				block = append(block, bpfJump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, uint32(nr), 0, seccompFailed))
+				block = append(block, checks...)
+				block = append(block, bpfStmt(unix.BPF_RET|unix.BPF_K, action))
+				if err := resolveFailedJumps(block); err != nil {
+					return nil, fmt.Errorf("seccomp rule for %s: %w", name, err)
+				}
+				program = append(program, block...)
+				loaded = len(checks) == 0
+			}
+		}
+	}
+	program = append(program, bpfStmt(unix.BPF_RET|unix.BPF_K, defaultAction))
+
+	if len(program) > unix.BPF_MAXINSNS {
+		return nil, fmt.Errorf("seccomp profile compiles to %d instructions, more than the kernel's limit of %d", len(program), unix.BPF_MAXINSNS)
+	}
+	return program, nil
+}
+
+// argumentChecks compiles the argument conditions of a rule into lists of instructions which
+// jump to seccompFailed unless the arguments meet them. As docker does, conditions on distinct
+// arguments must all be met, but several conditions on the same argument are alternatives, each
+// of which is returned separately.
+func argumentChecks(args []SeccompArg) ([][]unix.SockFilter, error) {
+	indexes := make(map[uint]bool)
+	for _, arg := range args {
+		if arg.Index > 5 {
+			return nil, fmt.Errorf("seccomp argument index %d is out of range", arg.Index)
+		}
+		indexes[arg.Index] = true
+	}
+
+	var alternatives [][]unix.SockFilter
+	if len(indexes) == len(args) {
+		var checks []unix.SockFilter
+		for _, arg := range args {
+			check, err := argumentCheck(arg)
+			if err != nil {
+				return nil, err
+			}
+			checks = append(checks, check...)
+		}
+		return append(alternatives, checks), nil
+	}
+	for _, arg := range args {
+		check, err := argumentCheck(arg)
+		if err != nil {
+			return nil, err
+		}
+		alternatives = append(alternatives, check)
+	}
+	return alternatives, nil
+}
+
+// argumentCheck compiles a condition on one of a syscall's 64 bit arguments, which a filter
+// reads as two 32 bit halves, the high half deciding most comparisons
+func argumentCheck(arg SeccompArg) ([]unix.SockFilter, error) {
+	offset := uint32(seccompDataArgs + 8*arg.Index)
+	loadLow := bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offset)
+	loadHigh := bpfStmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, offset+4)
+	low, high := uint32(arg.Value), uint32(arg.Value>>32)
+	jump := func(op uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return bpfJump(unix.BPF_JMP|op|unix.BPF_K, k, jt, jf)
+	}
+
+	switch arg.Op {
+	case "SCMP_CMP_EQ":
+		return []unix.SockFilter{
+			loadHigh, jump(unix.BPF_JEQ, high, 0, seccompFailed),
+			loadLow, jump(unix.BPF_JEQ, low, 0, seccompFailed),
+		}, nil
+	case "SCMP_CMP_NE":
+		return []unix.SockFilter{
+			loadHigh, jump(unix.BPF_JEQ, high, 0, 2),
+			loadLow, jump(unix.BPF_JEQ, low, seccompFailed, 0),
+		}, nil
+	case "SCMP_CMP_MASKED_EQ":
+		// The value is the mask, and valueTwo what the masked argument must equal
+		return []unix.SockFilter{
+			loadHigh, bpfStmt(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, high), jump(unix.BPF_JEQ, uint32(arg.ValueTwo>>32), 0, seccompFailed),
+			loadLow, bpfStmt(unix.BPF_ALU|unix.BPF_AND|unix.BPF_K, low), jump(unix.BPF_JEQ, uint32(arg.ValueTwo), 0, seccompFailed),
+		}, nil
+	case "SCMP_CMP_GT", "SCMP_CMP_GE":
+		op := uint16(unix.BPF_JGT)
+		if arg.Op == "SCMP_CMP_GE" {
+			op = unix.BPF_JGE
+		}
+		return []unix.SockFilter{
+			loadHigh, jump(unix.BPF_JGT, high, 3, 0), jump(unix.BPF_JEQ, high, 0, seccompFailed),
+			loadLow, jump(op, low, 0, seccompFailed),
+		}, nil
+	case "SCMP_CMP_LT", "SCMP_CMP_LE":
+		// Less than fails where greater or equal holds, and less or equal where greater holds
+		op := uint16(unix.BPF_JGE)
+		if arg.Op == "SCMP_CMP_LE" {
+			op = unix.BPF_JGT
+		}
+		return []unix.SockFilter{
+			loadHigh, jump(unix.BPF_JGT, high, seccompFailed, 0), jump(unix.BPF_JEQ, high, 0, 2),
+			loadLow, jump(op, low, seccompFailed, 0),
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported seccomp comparison %q", arg.Op)
+}
+
+// resolveFailedJumps points the jumps of a block to seccompFailed at the instruction after it
+func resolveFailedJumps(block []unix.SockFilter) error {
+	for i := range block {
+		if block[i].Code&0x07 != unix.BPF_JMP {
+			continue
+		}
+		end := len(block) - i - 1
+		if end > 0xfe {
+			return errors.New("too many argument conditions")
+		}
+		if block[i].Jt == seccompFailed {
+			block[i].Jt = uint8(end)
+		}
+		if block[i].Jf == seccompFailed {
+			block[i].Jf = uint8(end)
+		}
+	}
+	return nil
+}
+
+func bpfStmt(code uint16, k uint32) unix.SockFilter {
+	return unix.SockFilter{Code: code, K: k}
+}
+
+func bpfJump(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+	return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+}
+
+// installSeccomp installs a seccomp filter on every thread of the calling process, to be
+// inherited by the command it executes. Without no_new_privs set, this needs CAP_SYS_ADMIN.
+func installSeccomp(filter []unix.SockFilter) error {
+	if len(filter) == 0 {
+		return nil
+	}
+	program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	thread, _, errno := unix.Syscall(unix.SYS_SECCOMP, unix.SECCOMP_SET_MODE_FILTER, unix.SECCOMP_FILTER_FLAG_TSYNC, uintptr(unsafe.Pointer(&program)))
+	runtime.KeepAlive(filter)
+	if errno != 0 {
+		return fmt.Errorf("could not install seccomp filter: %w", errno)
+	}
+	if thread != 0 {
+		return fmt.Errorf("could not install seccomp filter: thread %d could not be synchronised", thread)
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseKernelVersion(t *testing.T) {
+	tests := []struct {
+		release string
+		want    [2]int
+		wantErr bool
+	}{
+		{release: "6.1.0-13-amd64", want: [2]int{6, 1}},
+		{release: "5.15.0", want: [2]int{5, 15}},
+		{release: "4.8", want: [2]int{4, 8}},
+		{release: "6.18.44-fc-v130", want: [2]int{6, 18}},
+		{release: "3.10.0-1160.el7.x86_64", want: [2]int{3, 10}},
+		{release: "6", wantErr: true},
+		{release: "six.one", wantErr: true},
+		{release: "", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.release, func(t *testing.T) {
+			got, err := parseKernelVersion(tt.release)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseKernelVersion(%q) returned error %v, want error %t", tt.release, err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("parseKernelVersion(%q) = %v, want %v", tt.release, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeccompResolve(t *testing.T) {
+	tests := []struct {
+		name         string
+		rule         SeccompRule
+		capabilities []string
+		// wantNames are the syscalls of the rule once resolved, or nil when it does not apply
+		wantNames []string
+	}{
+		{name: "unconditional", rule: SeccompRule{Names: []string{"read", "write"}}, wantNames: []string{"read", "write"}},
+		{name: "single name", rule: SeccompRule{Name: "mount", Names: []string{"umount2"}}, wantNames: []string{"mount", "umount2"}},
+		{
+			name:         "capability held",
+			rule:         SeccompRule{Names: []string{"mount"}, Includes: SeccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+			capabilities: []string{"CAP_SYS_ADMIN"},
+			wantNames:    []string{"mount"},
+		},
+		{name: "capability missing", rule: SeccompRule{Names: []string{"mount"}, Includes: SeccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}}},
+		{
+			name:         "every capability needed",
+			rule:         SeccompRule{Names: []string{"mount"}, Includes: SeccompFilter{Caps: []string{"CAP_SYS_ADMIN", "CAP_SYS_BOOT"}}},
+			capabilities: []string{"CAP_SYS_ADMIN"},
+		},
+		{
+			name:         "excluded by capability",
+			rule:         SeccompRule{Names: []string{"clone"}, Excludes: SeccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}},
+			capabilities: []string{"CAP_SYS_ADMIN"},
+		},
+		{name: "not excluded", rule: SeccompRule{Names: []string{"clone"}, Excludes: SeccompFilter{Caps: []string{"CAP_SYS_ADMIN"}}}, wantNames: []string{"clone"}},
+		{name: "other architecture", rule: SeccompRule{Names: []string{"iopl"}, Includes: SeccompFilter{Arches: []string{"s390x"}}}},
+		{name: "old kernel", rule: SeccompRule{Names: []string{"ptrace"}, Includes: SeccompFilter{MinKernel: "2.6"}}, wantNames: []string{"ptrace"}},
+		{name: "future kernel", rule: SeccompRule{Names: []string{"ptrace"}, Includes: SeccompFilter{MinKernel: "99.0"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			profile := &SeccompProfile{DefaultAction: "SCMP_ACT_ERRNO", Syscalls: []SeccompRule{tt.rule}}
+			rules, err := profile.resolve(tt.capabilities)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, rule := range rules {
+				names = append(names, rule.Names...)
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("resolved rule names %q, want %q", names, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestCompileSeccomp(t *testing.T) {
+	if seccompAuditArch == 0 {
+		t.Skip("seccomp profiles are not supported on this architecture")
+	}
+	tests := []struct {
+		name    string
+		profile SeccompProfile
+		wantErr string
+	}{
+		{name: "default", profile: *defaultSeccompProfile()},
+		{name: "unknown syscalls", profile: SeccompProfile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompRule{{Names: []string{"no_such_syscall"}, Action: "SCMP_ACT_ERRNO"}}}},
+		{name: "unknown default action", profile: SeccompProfile{DefaultAction: "SCMP_ACT_BOGUS"}, wantErr: `unsupported seccomp action "SCMP_ACT_BOGUS"`},
+		{name: "unknown action", profile: SeccompProfile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompRule{{Names: []string{"read"}, Action: "SCMP_ACT_BOGUS"}}}, wantErr: "unsupported seccomp action"},
+		{
+			name: "argument out of range",
+			profile: SeccompProfile{DefaultAction: "SCMP_ACT_ALLOW", Syscalls: []SeccompRule{{
+				Names: []string{"socket"}, Action: "SCMP_ACT_ERRNO", Args: []SeccompArg{{Index: 6, Value: 1, Op: "SCMP_CMP_EQ"}},
+			}}},
+			wantErr: "6",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			program, err := compileSeccomp(&tt.profile, defaultCapabilities)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("compileSeccomp returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("compileSeccomp: %v", err)
+			}
+			if len(program) == 0 {
+				t.Error("compileSeccomp returned an empty program")
+			}
+		})
+	}
+}
+
+func TestRunSeccomp(t *testing.T) {
+	requireContainers(t)
+	if seccompAuditArch == 0 {
+		t.Skip("seccomp profiles are not supported on this architecture")
+	}
+	dir := t.TempDir()
+	profile := func(name, data string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	denyGetcwd := profile("deny.json", `{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["getcwd"],"action":"SCMP_ACT_ERRNO"}]}`)
+	denyGetcwdENOENT := profile("enoent.json", `{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["getcwd"],"action":"SCMP_ACT_ERRNO","errnoRet":2}]}`)
+	unlessAdmin := profile("admin.json", `{"defaultAction":"SCMP_ACT_ALLOW","syscalls":[{"names":["getcwd"],"action":"SCMP_ACT_ERRNO","excludes":{"caps":["CAP_SYS_ADMIN"]}}]}`)
+	invalid := profile("invalid.json", `{"syscalls":`)
+
+	tests := []struct {
+		name     string
+		flags    []string
+		wantCode int
+		// wantOutput is part of what the run writes to stdout and stderr
+		wantOutput string
+	}{
+		{name: "default profile", wantOutput: "/\n"},
+		{name: "unconfined", flags: []string{"--security-opt", "seccomp=unconfined"}, wantOutput: "/\n"},
+		{name: "syscall refused", flags: []string{"--security-opt", "seccomp=" + denyGetcwd}, wantCode: 1, wantOutput: "operation not permitted"},
+		{name: "errno given", flags: []string{"--security-opt", "seccomp=" + denyGetcwdENOENT}, wantCode: 1, wantOutput: "no such file or directory"},
+		{name: "rule excluded by capability", flags: []string{"--cap-add", "SYS_ADMIN", "--security-opt", "seccomp=" + unlessAdmin}, wantOutput: "/\n"},
+		{name: "rule not excluded", flags: []string{"--security-opt", "seccomp=" + unlessAdmin}, wantCode: 1, wantOutput: "operation not permitted"},
+		{name: "invalid profile", flags: []string{"--security-opt", "seccomp=" + invalid}, wantCode: 1, wantOutput: "could not parse seccomp profile"},
+		{name: "missing profile", flags: []string{"--security-opt", "seccomp=" + filepath.Join(dir, "missing.json")}, wantCode: 1, wantOutput: "could not read seccomp profile"},
+		{name: "no profile", flags: []string{"--security-opt", "seccomp"}, wantCode: 1, wantOutput: "--security-opt seccomp needs a profile or unconfined"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "pwd")
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if !strings.Contains(stdout+stderr, tt.wantOutput) {
+				t.Errorf("run printed %q, want %q", stdout+stderr, tt.wantOutput)
+			}
+		})
+	}
+}
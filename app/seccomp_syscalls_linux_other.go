@@ -0,0 +1,10 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package main
+
+// Seccomp filters are only compiled for the architectures mksyscalls.sh knows the syscall
+// numbers of. Elsewhere, containers run without one.
+const seccompAuditArch = 0
+
+var syscallNumbers map[string]uintptr
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// SecurityOptions are the settings given to run with --security-opt
+type SecurityOptions struct {
+	// Seccomp is the profile filtering the container's syscalls, or nil to leave them unfiltered
+	Seccomp *SeccompProfile
+	// NoNewPrivileges stops the container's processes gaining privileges through execve, such
+	// as by running setuid binaries
+	NoNewPrivileges bool
+}
+
+// parseSecurityOptions parses the --security-opt flags given to run, which take the same form
+// as docker's: seccomp=<profile.json>, seccomp=unconfined and no-new-privileges[=true|false]
+func parseSecurityOptions(options []string) (*SecurityOptions, error) {
+	security := &SecurityOptions{Seccomp: defaultSeccompProfile()}
+	if seccompAuditArch == 0 {
+		logger.Warn("seccomp filtering is not supported on this architecture; containers run unconfined", "arch", runtime.GOARCH)
+		security.Seccomp = nil
+	}
+
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "seccomp":
+			switch value {
+			case "":
+				return nil, errors.New("--security-opt seccomp needs a profile or unconfined")
+			case "unconfined":
+				security.Seccomp = nil
+			default:
+				profile, err := loadSeccompProfile(value)
+				if err != nil {
+					return nil, err
+				}
+				security.Seccomp = profile
+			}
+		case "no-new-privileges":
+			enabled := true
+			if value != "" {
+				var err error
+				if enabled, err = strconv.ParseBool(value); err != nil {
+					return nil, fmt.Errorf("invalid value for no-new-privileges: %q", value)
+				}
+			}
+			security.NoNewPrivileges = enabled
+		default:
+			return nil, fmt.Errorf("unknown security option %q", option)
+		}
+	}
+	return security, nil
+}
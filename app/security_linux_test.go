@@ -0,0 +1,106 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSecurityOptions(t *testing.T) {
+	profile := filepath.Join(t.TempDir(), "profile.json")
+	if err := os.WriteFile(profile, []byte(`{"defaultAction":"SCMP_ACT_LOG","syscalls":[]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options []string
+		// wantAction is the default action of the seccomp profile, or empty for none
+		wantAction string
+		wantErr    string
+	}{
+		{name: "default", wantAction: "SCMP_ACT_ERRNO"},
+		{name: "profile", options: []string{"seccomp=" + profile}, wantAction: "SCMP_ACT_LOG"},
+		{name: "unconfined", options: []string{"seccomp=unconfined"}},
+		{name: "last wins", options: []string{"seccomp=unconfined", "seccomp=" + profile}, wantAction: "SCMP_ACT_LOG"},
+		{name: "no profile", options: []string{"seccomp"}, wantErr: "--security-opt seccomp needs a profile or unconfined"},
+		{name: "missing profile", options: []string{"seccomp=" + profile + ".missing"}, wantErr: "could not read seccomp profile"},
+		{name: "unknown option", options: []string{"apparmor=unconfined"}, wantErr: `unknown security option "apparmor=unconfined"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if seccompAuditArch == 0 && tt.wantAction == "SCMP_ACT_ERRNO" {
+				tt.wantAction = ""
+			}
+			security, err := parseSecurityOptions(tt.options)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseSecurityOptions returned %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseSecurityOptions: %v", err)
+			}
+			var action string
+			if security.Seccomp != nil {
+				action = security.Seccomp.DefaultAction
+			}
+			if action != tt.wantAction {
+				t.Errorf("seccomp profile has default action %q, want %q", action, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestRunNoNewPrivileges(t *testing.T) {
+	requireContainers(t)
+
+	tests := []struct {
+		name  string
+		flags []string
+		// wantStatus are lines of the container's /proc/self/status, or wantOutput part of what
+		// the run prints when it fails
+		wantStatus []string
+		wantOutput string
+	}{
+		{name: "default", wantStatus: []string{"NoNewPrivs:\t0"}},
+		{name: "enabled", flags: []string{"--security-opt", "no-new-privileges"}, wantStatus: []string{"NoNewPrivs:\t1"}},
+		{name: "true", flags: []string{"--security-opt", "no-new-privileges=true"}, wantStatus: []string{"NoNewPrivs:\t1"}},
+		{name: "false", flags: []string{"--security-opt", "no-new-privileges=false"}, wantStatus: []string{"NoNewPrivs:\t0"}},
+		{
+			name:       "as another user",
+			flags:      []string{"--security-opt", "no-new-privileges", "--user", "1000:1000"},
+			wantStatus: []string{"NoNewPrivs:\t1", "Uid:\t1000\t1000\t1000\t1000"},
+		},
+		{
+			name:       "unconfined",
+			flags:      []string{"--security-opt", "no-new-privileges", "--security-opt", "seccomp=unconfined"},
+			wantStatus: []string{"NoNewPrivs:\t1", "Seccomp:\t0"},
+		},
+		{name: "invalid value", flags: []string{"--security-opt", "no-new-privileges=maybe"}, wantOutput: `invalid value for no-new-privileges: "maybe"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "cat", "/proc/self/status")
+			if tt.wantOutput != "" {
+				if code == 0 || !strings.Contains(stdout, tt.wantOutput) {
+					t.Errorf("run exited with %d, want it to fail with %q: %s%s", code, tt.wantOutput, stdout, stderr)
+				}
+				return
+			}
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			status := strings.Split(stdout, "\n")
+			for _, want := range tt.wantStatus {
+				if !containsString(status, want) {
+					t.Errorf("container's status has no line %q:\n%s", want, stdout)
+				}
+			}
+		})
+	}
+}
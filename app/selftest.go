@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// selftestImage is a small image known to provide /bin/echo
+const selftestImage = "busybox:latest"
+
+const selftestMarker = "selftest-ok"
+
+// selftestStep is one stage of the pipeline exercised by selftest
+type selftestStep struct {
+	name string
+	run  func() error
+}
+
+// selftestCommand pulls a small image and runs a trivial command in it, reporting which step of
+// the pipeline failed, if any.
+//
+// Usage: your_docker.sh selftest [--image <image>]
+func selftestCommand(ctx context.Context, arguments []string) {
+	flags := flag.NewFlagSet("selftest", flag.ExitOnError)
+	image := flags.String("image", selftestImage, "image to test with, which must provide echo")
+	flags.Parse(arguments)
+
+	steps := []selftestStep{
+		{"pull", func() error {
+			_, _, err := pullImage(ctx, *image, nil, nil)
+			return err
+		}},
+		{"run", func() error {
+			return selftestRun(*image)
+		}},
+	}
+
+	if err := runSelftest(steps); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("selftest passed")
+}
+
+// runSelftest runs each step in turn, stopping at and naming the first one to fail
+func runSelftest(steps []selftestStep) error {
+	for _, step := range steps {
+		fmt.Printf("selftest: %s... ", step.name)
+		if err := step.run(); err != nil {
+			fmt.Println("failed")
+			return fmt.Errorf("selftest failed at step %q: %w", step.name, err)
+		}
+		fmt.Println("ok")
+	}
+	return nil
+}
+
+// selftestRun runs echo in the image through a separate invocation of run, as a user would
+func selftestRun(image string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(executable, "run", image, "echo", selftestMarker)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%w\n%s", err, strings.TrimSpace(output.String()))
+	}
+
+	if !strings.Contains(output.String(), selftestMarker) {
+		return errors.New("unexpected output from container: " + strings.TrimSpace(output.String()))
+	}
+	return nil
+}
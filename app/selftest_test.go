@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRunSelftest(t *testing.T) {
+	failure := errors.New("boom")
+	tests := []struct {
+		name    string
+		failing string
+		wantRun []string
+		wantErr string
+	}{
+		{name: "all pass", wantRun: []string{"pull", "run"}},
+		{name: "pull fails", failing: "pull", wantRun: []string{"pull"}, wantErr: `selftest failed at step "pull": boom`},
+		{name: "run fails", failing: "run", wantRun: []string{"pull", "run"}, wantErr: `selftest failed at step "run": boom`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var ran []string
+			step := func(name string) selftestStep {
+				return selftestStep{name, func() error {
+					ran = append(ran, name)
+					if name == tt.failing {
+						return failure
+					}
+					return nil
+				}}
+			}
+			err := runSelftest([]selftestStep{step("pull"), step("run")})
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("runSelftest: %v", err)
+				}
+			} else {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("runSelftest returned %v, want %q", err, tt.wantErr)
+				}
+				if !errors.Is(err, failure) {
+					t.Errorf("runSelftest returned %v, which does not wrap the step's error", err)
+				}
+			}
+			if strings.Join(ran, ",") != strings.Join(tt.wantRun, ",") {
+				t.Errorf("runSelftest ran %v, want %v", ran, tt.wantRun)
+			}
+		})
+	}
+}
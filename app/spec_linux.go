@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// runtimeSpecVersion is the version of the OCI runtime specification generated bundles follow
+const runtimeSpecVersion = "1.0.2"
+
+// The subset of the OCI runtime specification's config.json needed to describe a container as
+// run would start it, so that runc or crun can run it instead
+type (
+	RuntimeSpec struct {
+		OCIVersion string      `json:"ociVersion"`
+		Process    SpecProcess `json:"process"`
+		Root       SpecRoot    `json:"root"`
+		Hostname   string      `json:"hostname,omitempty"`
+		Mounts     []SpecMount `json:"mounts"`
+		Linux      SpecLinux   `json:"linux"`
+	}
+	SpecProcess struct {
+		Terminal        bool              `json:"terminal,omitempty"`
+		User            SpecUser          `json:"user"`
+		Args            []string          `json:"args"`
+		Env             []string          `json:"env,omitempty"`
+		Cwd             string            `json:"cwd"`
+		Capabilities    *SpecCapabilities `json:"capabilities,omitempty"`
+		NoNewPrivileges bool              `json:"noNewPrivileges,omitempty"`
+	}
+	SpecUser struct {
+		UID            int   `json:"uid"`
+		GID            int   `json:"gid"`
+		AdditionalGids []int `json:"additionalGids,omitempty"`
+	}
+	SpecCapabilities struct {
+		Bounding  []string `json:"bounding"`
+		Effective []string `json:"effective"`
+		Permitted []string `json:"permitted"`
+	}
+	SpecRoot struct {
+		Path     string `json:"path"`
+		Readonly bool   `json:"readonly,omitempty"`
+	}
+	SpecMount struct {
+		Destination string   `json:"destination"`
+		Type        string   `json:"type,omitempty"`
+		Source      string   `json:"source,omitempty"`
+		Options     []string `json:"options,omitempty"`
+	}
+	SpecLinux struct {
+		Namespaces  []SpecNamespace           `json:"namespaces"`
+		UIDMappings []SpecIDMapping           `json:"uidMappings,omitempty"`
+		GIDMappings []SpecIDMapping           `json:"gidMappings,omitempty"`
+		TimeOffsets map[string]SpecTimeOffset `json:"timeOffsets,omitempty"`
+		Resources   *SpecResources            `json:"resources,omitempty"`
+		Seccomp     *SpecSeccomp              `json:"seccomp,omitempty"`
+	}
+	SpecNamespace struct {
+		Type string `json:"type"`
+	}
+	SpecIDMapping struct {
+		ContainerID int `json:"containerID"`
+		HostID      int `json:"hostID"`
+		Size        int `json:"size"`
+	}
+	SpecTimeOffset struct {
+		Secs     int64  `json:"secs"`
+		Nanosecs uint32 `json:"nanosecs"`
+	}
+	SpecResources struct {
+		Memory *SpecMemory `json:"memory,omitempty"`
+		CPU    *SpecCPU    `json:"cpu,omitempty"`
+	}
+	SpecMemory struct {
+		Limit int64 `json:"limit"`
+	}
+	SpecCPU struct {
+		Quota  int64  `json:"quota"`
+		Period uint64 `json:"period"`
+	}
+	SpecSeccomp struct {
+		DefaultAction   string               `json:"defaultAction"`
+		DefaultErrnoRet *uint                `json:"defaultErrnoRet,omitempty"`
+		Syscalls        []SpecSeccompSyscall `json:"syscalls,omitempty"`
+	}
+	SpecSeccompSyscall struct {
+		Names    []string     `json:"names"`
+		Action   string       `json:"action"`
+		ErrnoRet *uint        `json:"errnoRet,omitempty"`
+		Args     []SeccompArg `json:"args,omitempty"`
+	}
+)
+
+// SpecOptions are the parts of a container's configuration that are not in its InitConfig
+type SpecOptions struct {
+	Env         []string
+	Terminal    bool
+	Limits      CgroupLimits
+	UIDMappings []syscall.SysProcIDMap
+	GIDMappings []syscall.SysProcIDMap
+	TimeOffset  time.Duration
+	Seccomp     *SeccompProfile
+}
+
+// newRuntimeSpec describes the container run would start for config as an OCI runtime spec,
+// with the root filesystem in the rootfs directory beside it. The user is resolved against the
+// image's passwd and group files now, as the spec only holds numeric IDs.
+func newRuntimeSpec(config *InitConfig, options *SpecOptions) (*RuntimeSpec, error) {
+	spec := &RuntimeSpec{
+		OCIVersion: runtimeSpecVersion,
+		Process: SpecProcess{
+			Terminal: options.Terminal,
+			Args:     append([]string{config.Command}, config.Args...),
+			Env:      options.Env,
+			Cwd:      "/",
+			Capabilities: &SpecCapabilities{
+				Bounding:  config.Capabilities,
+				Effective: config.Capabilities,
+				Permitted: config.Capabilities,
+			},
+			NoNewPrivileges: config.NoNewPrivileges,
+		},
+		Root:     SpecRoot{Path: "rootfs", Readonly: config.ReadOnly},
+		Hostname: config.Hostname,
+		Mounts: []SpecMount{
+			{Destination: "/proc", Type: "proc", Source: "proc"},
+			{Destination: "/dev", Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "strictatime", "mode=755", "size=65536k"}},
+			{Destination: "/dev/pts", Type: "devpts", Source: "devpts", Options: []string{"nosuid", "noexec", "newinstance", "ptmxmode=0666", "mode=0620"}},
+			{Destination: "/dev/shm", Type: "tmpfs", Source: "shm", Options: []string{"nosuid", "noexec", "nodev", "mode=1777", "size=65536k"}},
+		},
+		Linux: SpecLinux{
+			Namespaces: []SpecNamespace{{Type: "pid"}, {Type: "uts"}, {Type: "mount"}},
+		},
+	}
+	if config.WorkingDir != "" {
+		spec.Process.Cwd = config.WorkingDir
+	}
+	// runc brings up loopback in a new network namespace itself
+	if config.NetworkNamespace {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, SpecNamespace{Type: "network"})
+	}
+
+	if config.User != "" {
+		user, err := resolveUser(config.User, filepath.Join(config.RootFS, "etc/passwd"), filepath.Join(config.RootFS, "etc/group"))
+		if err != nil {
+			return nil, err
+		}
+		spec.Process.User = SpecUser{UID: user.UID, GID: user.GID, AdditionalGids: user.Groups}
+	}
+
+	if config.ReadOnly {
+		for _, tmpfs := range readOnlyTmpfs {
+			if !hasMountAt(config.Mounts, tmpfs.path) {
+				spec.Mounts = append(spec.Mounts, SpecMount{Destination: tmpfs.path, Type: "tmpfs", Source: "tmpfs", Options: []string{"nosuid", "nodev", "mode=" + tmpfs.mode}})
+			}
+		}
+	}
+
+	for _, mount := range config.Mounts {
+		options := []string{"rbind", "rprivate"}
+		if mount.ReadOnly {
+			options = append(options, "ro")
+		}
+		spec.Mounts = append(spec.Mounts, SpecMount{Destination: mount.Destination, Type: "bind", Source: mount.Source, Options: options})
+	}
+
+	if len(options.UIDMappings) > 0 {
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, SpecNamespace{Type: "user"})
+		spec.Linux.UIDMappings = specIDMappings(options.UIDMappings)
+		spec.Linux.GIDMappings = specIDMappings(options.GIDMappings)
+	}
+
+	if options.TimeOffset != 0 {
+		secs, nsecs := splitTimeOffset(options.TimeOffset)
+		offset := SpecTimeOffset{Secs: secs, Nanosecs: uint32(nsecs)}
+		spec.Linux.Namespaces = append(spec.Linux.Namespaces, SpecNamespace{Type: "time"})
+		spec.Linux.TimeOffsets = map[string]SpecTimeOffset{"monotonic": offset, "boottime": offset}
+	}
+
+	if options.Limits.MemoryBytes > 0 || options.Limits.CPUs > 0 {
+		spec.Linux.Resources = &SpecResources{}
+		if options.Limits.MemoryBytes > 0 {
+			spec.Linux.Resources.Memory = &SpecMemory{Limit: options.Limits.MemoryBytes}
+		}
+		if options.Limits.CPUs > 0 {
+			spec.Linux.Resources.CPU = &SpecCPU{Quota: int64(options.Limits.CPUs * cpuPeriod), Period: cpuPeriod}
+		}
+	}
+
+	// The spec has no capability conditions, so only the rules applying to the container are kept
+	if options.Seccomp != nil {
+		rules, err := options.Seccomp.resolve(config.Capabilities)
+		if err != nil {
+			return nil, err
+		}
+		seccomp := &SpecSeccomp{DefaultAction: options.Seccomp.DefaultAction, DefaultErrnoRet: options.Seccomp.DefaultErrnoRet}
+		for _, rule := range rules {
+			seccomp.Syscalls = append(seccomp.Syscalls, SpecSeccompSyscall{Names: rule.Names, Action: rule.Action, ErrnoRet: rule.ErrnoRet, Args: rule.Args})
+		}
+		spec.Linux.Seccomp = seccomp
+	}
+	return spec, nil
+}
+
+func specIDMappings(mappings []syscall.SysProcIDMap) []SpecIDMapping {
+	var converted []SpecIDMapping
+	for _, mapping := range mappings {
+		converted = append(converted, SpecIDMapping{ContainerID: mapping.ContainerID, HostID: mapping.HostID, Size: mapping.Size})
+	}
+	return converted
+}
+
+// createBundleRootfs creates the directory a bundle's root filesystem is extracted into. As
+// it is not removed afterwards, an existing one is only reused if empty.
+func createBundleRootfs(rootfs string) error {
+	if err := os.MkdirAll(rootfs, 0755); err != nil {
+		return fmt.Errorf("could not create bundle: %w", err)
+	}
+	entries, err := os.ReadDir(rootfs)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("bundle root filesystem %s already exists and is not empty", rootfs)
+	}
+	return nil
+}
+
+// writeRuntimeSpec writes spec as the config.json of the bundle in dir
+func writeRuntimeSpec(dir string, spec *RuntimeSpec) error {
+	data, err := json.MarshalIndent(spec, "", "    ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), data, 0644); err != nil {
+		return fmt.Errorf("could not write runtime spec: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewRuntimeSpec(t *testing.T) {
+	rootfs := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(rootfs, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"etc/passwd": "root:x:0:0::/root:/bin/sh\napp:x:1000:1000::/home/app:/bin/sh\n",
+		"etc/group":  "root:x:0:\napp:x:1000:\nwheel:x:10:app\n",
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(rootfs, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mapping := []syscall.SysProcIDMap{{ContainerID: 0, HostID: 100000, Size: 65536}}
+
+	tests := []struct {
+		name    string
+		config  InitConfig
+		options SpecOptions
+		check   func(t *testing.T, spec *RuntimeSpec)
+		wantErr string
+	}{
+		{
+			name:   "command",
+			config: InitConfig{Command: "/bin/sh", Args: []string{"-c", "true"}, Hostname: "box"},
+			check: func(t *testing.T, spec *RuntimeSpec) {
+				if want := []string{"/bin/sh", "-c", "true"}; !reflect.DeepEqual(spec.Process.Args, want) {
+					t.Errorf("args = %q, want %q", spec.Process.Args, want)
+				}
+				if spec.Process.Cwd != "/" || spec.Hostname != "box" || spec.Root.Path != "rootfs" {
+					t.Errorf("cwd %q, hostname %q, root %q", spec.Process.Cwd, spec.Hostname, spec.Root.Path)
+				}
+				if !reflect.DeepEqual(spec.Process.User, SpecUser{}) {
+					t.Errorf("user = %+v, want root", spec.Process.User)
+				}
+				if want := []SpecNamespace{{Type: "pid"}, {Type: "uts"}, {Type: "mount"}}; !reflect.DeepEqual(spec.Linux.Namespaces, want) {
+					t.Errorf("namespaces = %v, want %v", spec.Linux.Namespaces, want)
+				}
+				if spec.Linux.Resources != nil || spec.Linux.TimeOffsets != nil {
+					t.Errorf("resources %+v and time offsets %+v set without limits or an offset", spec.Linux.Resources, spec.Linux.TimeOffsets)
+				}
+			},
+		},
+		{
+			name:    "working directory and environment",
+			config:  InitConfig{Command: "/app", WorkingDir: "/srv"},
+			options: SpecOptions{Env: []string{"A=1"}, Terminal: true},
+			check: func(t *testing.T, spec *RuntimeSpec) {
+				if spec.Process.Cwd != "/srv" || !reflect.DeepEqual(spec.Process.Env, []string{"A=1"}) || !spec.Process.Terminal {
+					t.Errorf("process = %+v", spec.Process)
+				}
+			},
+		},
+		{
+			name:   "user by name",
+			config: InitConfig{Command: "/app", RootFS: rootfs, User: "app"},
+			check: func(t *testing.T, spec *RuntimeSpec) {
+				if want := (SpecUser{UID: 1000, GID: 1000, AdditionalGids: []int{1000, 10}}); !reflect.DeepEqual(spec.Process.User, want) {
+					t.Errorf("user = %+v, want %+v", spec.Process.User, want)
+				}
+			},
+		},
+		{
+			name:    "unknown user",
+			config:  InitConfig{Command: "/app", RootFS: rootfs, User: "nobody"},
+			wantErr: "nobody",
+		},
+		{
+			name: "bind mounts",
+			config: InitConfig{Command: "/app", Mounts: []BindMount{
+				{Source: "/data", Destination: "/data"},
+				{Source: "/etc/config", Destination: "/config", ReadOnly: true},
+			}},
+			check: func(t *testing.T, spec *RuntimeSpec) {
+				want := []SpecMount{
+					{Destination: "/data", Type: "bind", Source: "/data", Options: []string{"rbind", "rprivate"}},
+					{Destination: "/config", Type: "bind", Source: "/etc/config", Options: []string{"rbind", "rprivate", "ro"}},
+				}
+				if got := spec.Mounts[len(spec.Mounts)-2:]; !reflect.DeepEqual(got, want) {
+					t.Errorf("bind mounts = %+v, want %+v", got, want)
+				}
+			},
+		},
+		{
+			name:    "user namespace",
+			config:  InitConfig{Command: "/app"},
+			options: SpecOptions{UIDMappings: mapping, GIDMappings: mapping},
+			check: func(t *testing.T, spec *RuntimeSpec) {
+				want := []SpecIDMapping{{ContainerID: 0, HostID: 100000, Size: 65536}}
+				if !reflect.DeepEqual(spec.Linux.UIDMappings, want) || !reflect.DeepEqual(spec.Linux.GIDMappings, want) {
+					t.Errorf("mappings = %+v, %+v, want %+v", spec.Linux.UIDMappings, spec.Linux.GIDMappings, want)
+				}
+				if last := spec.Linux.Namespaces[len(spec.Linux.Namespaces)-1]; last.Type != "user" {
+					t.Errorf("namespaces = %v, want a user namespace", spec.Linux.Namespaces)
+				}
+			},
+		},
+		{
+			name:    "time offset",
+			config:  InitConfig{Command: "/app"},
+			options: SpecOptions{TimeOffset: -1500 * time.Millisecond},
+			check: func(t *testing.T, spec *RuntimeSpec) {
+				offset := SpecTimeOffset{Secs: -2, Nanosecs: 500000000}
+				want := map[string]SpecTimeOffset{"monotonic": offset, "boottime": offset}
+				if !reflect.DeepEqual(spec.Linux.TimeOffsets, want) {
+					t.Errorf("time offsets = %+v, want %+v", spec.Linux.TimeOffsets, want)
+				}
+			},
+		},
+		{
+			name:    "limits",
+			config:  InitConfig{Command: "/app"},
+			options: SpecOptions{Limits: CgroupLimits{MemoryBytes: 64 << 20, CPUs: 0.5}},
+			check: func(t *testing.T, spec *RuntimeSpec) {
+				want := &SpecResources{Memory: &SpecMemory{Limit: 64 << 20}, CPU: &SpecCPU{Quota: 50000, Period: 100000}}
+				if !reflect.DeepEqual(spec.Linux.Resources, want) {
+					t.Errorf("resources = %+v, want %+v", spec.Linux.Resources, want)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := newRuntimeSpec(&tt.config, &tt.options)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("newRuntimeSpec returned error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newRuntimeSpec: %v", err)
+			}
+			tt.check(t, spec)
+		})
+	}
+}
+
+func TestCreateBundleRootfs(t *testing.T) {
+	tests := []struct {
+		name    string
+		setup   func(t *testing.T, rootfs string)
+		wantErr string
+	}{
+		{name: "new", setup: func(t *testing.T, rootfs string) {}},
+		{name: "empty", setup: func(t *testing.T, rootfs string) {
+			if err := os.MkdirAll(rootfs, 0755); err != nil {
+				t.Fatal(err)
+			}
+		}},
+		{name: "not empty", setup: func(t *testing.T, rootfs string) {
+			if err := os.MkdirAll(filepath.Join(rootfs, "bin"), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}, wantErr: "already exists and is not empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rootfs := filepath.Join(t.TempDir(), "bundle", "rootfs")
+			tt.setup(t, rootfs)
+			err := createBundleRootfs(rootfs)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("createBundleRootfs returned error %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("createBundleRootfs: %v", err)
+			}
+			if info, err := os.Stat(rootfs); err != nil || !info.IsDir() {
+				t.Errorf("rootfs was not created: %v", err)
+			}
+		})
+	}
+}
+
+func TestRunGenerateSpec(t *testing.T) {
+	requireContainers(t)
+	registry := newFakeRegistry(t)
+	ref := registry.push("app", "latest", newFakeImageWith(t, OCIImageConfig{Cmd: []string{"/bin/app"}, WorkingDir: "/srv"},
+		buildLayer(t, []tarEntry{tarDir("srv/"), tarFile("srv/data", "d")})))
+
+	tests := []struct {
+		name string
+		args []string
+		// existing is a file already in the bundle's rootfs
+		existing   string
+		wantCode   int
+		wantStdout string
+		wantArgs   []string
+	}{
+		{name: "image command", args: []string{ref}, wantArgs: []string{"/bin/app"}},
+		{name: "given command", args: []string{ref, "/bin/other", "x"}, wantArgs: []string{"/bin/other", "x"}},
+		{name: "existing rootfs", args: []string{ref}, existing: "bin", wantCode: 1, wantStdout: "already exists and is not empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bundle := t.TempDir()
+			if tt.existing != "" {
+				if err := os.MkdirAll(filepath.Join(bundle, "rootfs", tt.existing), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			args := append([]string{"--insecure-registry", registry.host, "run", "--generate-spec", bundle}, tt.args...)
+			stdout, stderr, code := tool(t, t.TempDir(), args...)
+			if code != tt.wantCode {
+				t.Fatalf("run exited with %d, want %d: %s%s", code, tt.wantCode, stdout, stderr)
+			}
+			if tt.wantCode != 0 {
+				if !strings.Contains(stdout, tt.wantStdout) {
+					t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+				}
+				return
+			}
+			if want := "Wrote OCI bundle to " + bundle + "\n"; !strings.HasSuffix(stdout, want) {
+				t.Errorf("run printed %q, want %q", stdout, want)
+			}
+
+			data, err := os.ReadFile(filepath.Join(bundle, "config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var spec RuntimeSpec
+			if err := json.Unmarshal(data, &spec); err != nil {
+				t.Fatal(err)
+			}
+			if spec.OCIVersion != runtimeSpecVersion || !reflect.DeepEqual(spec.Process.Args, tt.wantArgs) || spec.Process.Cwd != "/srv" {
+				t.Errorf("config.json has version %q, args %q and cwd %q, want %q, %q and /srv", spec.OCIVersion, spec.Process.Args, spec.Process.Cwd, runtimeSpecVersion, tt.wantArgs)
+			}
+			if got, err := os.ReadFile(filepath.Join(bundle, "rootfs", "srv", "data")); err != nil || string(got) != "d" {
+				t.Errorf("bundle rootfs holds %q, %v, want the image's files", got, err)
+			}
+		})
+	}
+}
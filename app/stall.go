@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// stallTimeout is how long a layer download may go without receiving any data before it is
+// abandoned and retried. A slow download is left alone for as long as data keeps arriving.
+var stallTimeout = 30 * time.Second
+
+// ErrStalled is returned when a layer download stops receiving data for stallTimeout
+var ErrStalled = errors.New("download stalled")
+
+// stallReader watches a response body for data arriving, cancelling its request once none has
+// arrived for stallTimeout, which unblocks any read waiting on the connection
+type stallReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	stalled atomic.Bool
+}
+
+// watchForStalls wraps the body of a request made with a context cancelled by cancel. The
+// returned reader's stop must be called once the body has been read.
+func watchForStalls(body io.Reader, cancel context.CancelFunc) *stallReader {
+	s := &stallReader{r: body}
+	if stallTimeout <= 0 {
+		return s
+	}
+	s.timer = time.AfterFunc(stallTimeout, func() {
+		s.stalled.Store(true)
+		cancel()
+	})
+	return s
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if s.stalled.Load() {
+		return n, fmt.Errorf("%w: no data received for %s", ErrStalled, stallTimeout)
+	}
+	if n > 0 && s.timer != nil {
+		s.timer.Reset(stallTimeout)
+	}
+	return n, err
+}
+
+// stop stops watching for stalls
+func (s *stallReader) stop() {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
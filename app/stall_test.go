@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStallReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		// pauses are how long each chunk of data takes to arrive
+		pauses  []time.Duration
+		wantErr bool
+	}{
+		{name: "steady", timeout: 100 * time.Millisecond, pauses: []time.Duration{40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond}},
+		{name: "stalled", timeout: 100 * time.Millisecond, pauses: []time.Duration{0, 300 * time.Millisecond}, wantErr: true},
+		{name: "no limit", timeout: 0, pauses: []time.Duration{0, 200 * time.Millisecond}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previous := stallTimeout
+			stallTimeout = tt.timeout
+			t.Cleanup(func() { stallTimeout = previous })
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			r, w := io.Pipe()
+			go func() {
+				for _, pause := range tt.pauses {
+					select {
+					case <-time.After(pause):
+					case <-ctx.Done():
+						w.CloseWithError(ctx.Err())
+						return
+					}
+					w.Write([]byte("data"))
+				}
+				w.Close()
+			}()
+
+			body := watchForStalls(r, cancel)
+			defer body.stop()
+			data, err := io.ReadAll(body)
+			if tt.wantErr {
+				if !errors.Is(err, ErrStalled) {
+					t.Fatalf("read returned %v, want %v", err, ErrStalled)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := strings.Repeat("data", len(tt.pauses)); string(data) != want {
+				t.Errorf("read %q, want %q", data, want)
+			}
+		})
+	}
+}
+
+func TestPullStalledLayer(t *testing.T) {
+	layer := buildLayer(t, []tarEntry{tarFile("a", noise(64*1024))})
+	image := newFakeImage(t, layer)
+
+	tests := []struct {
+		name string
+		// stalls is how many times the layer stops arriving part way through before it is served
+		stalls       int
+		wantErr      bool
+		wantRequests int
+	}{
+		{name: "never", stalls: 0, wantRequests: 1},
+		{name: "once", stalls: 1, wantRequests: 2},
+		{name: "every time", stalls: maxRetries, wantErr: true, wantRequests: maxRetries},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withoutBackoff(t)
+			useLayerStore(t)
+			previous := stallTimeout
+			stallTimeout = 100 * time.Millisecond
+			t.Cleanup(func() { stallTimeout = previous })
+
+			registry := newFakeRegistry(t)
+			ref := registry.pushIndex(t, "app", "latest", image)
+			var mu sync.Mutex
+			stalls := tt.stalls
+			registry.handle = func(w http.ResponseWriter, r *http.Request) bool {
+				mu.Lock()
+				stall := strings.HasSuffix(r.URL.Path, digestOf(layer)) && stalls > 0
+				if stall {
+					stalls--
+				}
+				mu.Unlock()
+				if !stall {
+					return false
+				}
+				w.Header().Set("Content-Length", strconv.Itoa(len(layer)))
+				w.Write(layer[:1024])
+				w.(http.Flusher).Flush()
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+				return true
+			}
+
+			start := time.Now()
+			_, _, err := pullImage(context.Background(), ref, nil, nil)
+			if tt.wantErr {
+				if err == nil || !strings.Contains(err.Error(), ErrStalled.Error()) {
+					t.Fatalf("pullImage returned %v, want %q", err, ErrStalled)
+				}
+			} else if err != nil {
+				t.Fatalf("pullImage: %v", err)
+			}
+			if elapsed := time.Since(start); elapsed > 4*time.Second {
+				t.Errorf("pull took %s", elapsed)
+			}
+			if got := registry.count("/blobs/" + digestOf(layer)); got != tt.wantRequests {
+				t.Errorf("layer was requested %d times, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
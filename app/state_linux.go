@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// containerStatePath holds a record of each container, written by run
+var containerStatePath = "/tmp/containers/state"
+
+// containerNamesPath holds a file for each name taken by a running container
+var containerNamesPath = "/tmp/containers/names"
+
+// validContainerName matches the names docker accepts for containers
+var validContainerName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// exitedContainerRetention is how long the record of an exited container is kept for ps -a
+// before it is pruned
+const exitedContainerRetention = time.Hour
+
+// ContainerState records a container, so that other commands can list it and find its
+// namespaces, which are those of its init process
+type ContainerState struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	Pid  int    `json:"pid"`
+	// StartTime is when the init process started, in clock ticks since boot, telling it apart
+	// from a later process reusing its pid
+	StartTime uint64 `json:"startTime"`
+	Rootless  bool   `json:"rootless,omitempty"`
+	// Image is the image the container was run from, as it was named to run
+	Image   string    `json:"image"`
+	Command []string  `json:"command"`
+	Created time.Time `json:"created"`
+	// FinishedAt is when the container exited, if run saw it exit, along with its exit code
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	ExitCode   int        `json:"exitCode,omitempty"`
+	// Env and Init are how the container's command was started, which exec starts others like
+	Env  []string    `json:"env"`
+	Init *InitConfig `json:"init"`
+}
+
+func containerStateFile(id string) string {
+	return filepath.Join(containerStatePath, id+".json")
+}
+
+// saveContainerState records a container once its init process is running
+func saveContainerState(state *ContainerState) error {
+	startTime, err := processStartTime(state.Pid)
+	if err != nil {
+		return err
+	}
+	state.StartTime = startTime
+	return writeContainerState(state)
+}
+
+// markContainerExited records that a container has exited with code, keeping its record for
+// ps -a until it is pruned
+func markContainerExited(id string, code int) error {
+	state, err := readContainerState(id)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	state.FinishedAt, state.ExitCode = &now, code
+	return writeContainerState(state)
+}
+
+// writeContainerState replaces a container's record, never leaving a partly written one behind
+func writeContainerState(state *ContainerState) error {
+	if err := os.MkdirAll(containerStatePath, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(state, "", "    ")
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(containerStatePath, ".state.*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), containerStateFile(state.ID))
+}
+
+func readContainerState(id string) (*ContainerState, error) {
+	data, err := os.ReadFile(containerStateFile(id))
+	if err != nil {
+		return nil, err
+	}
+	var state ContainerState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("could not parse state of container %s: %w", shortContainerID(id), err)
+	}
+	return &state, nil
+}
+
+// removeContainerState forgets a container
+func removeContainerState(id string) error {
+	if err := os.Remove(containerStateFile(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// findContainer finds a running container from its name, its ID, or an unambiguous prefix of
+// its ID. A name takes precedence over an ID prefix it happens to also be.
+func findContainer(id string) (*ContainerState, error) {
+	return lookupContainer(id, false)
+}
+
+// lookupContainer finds a container as findContainer does, and with all one which has exited
+// too. A name may have been used by several containers which have exited, in which case the
+// running container, or else the newest, is found.
+func lookupContainer(id string, all bool) (*ContainerState, error) {
+	if validContainerName.MatchString(id) {
+		containers, err := listContainers(all)
+		if err != nil {
+			return nil, err
+		}
+		var found *ContainerState
+		for _, container := range containers {
+			if container.Name != id {
+				continue
+			}
+			if container.running() {
+				return container, nil
+			}
+			if found == nil {
+				found = container
+			}
+		}
+		if found != nil {
+			return found, nil
+		}
+	}
+
+	entries, err := os.ReadDir(containerStatePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var matches []string
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".json")
+		if id != "" && name != entry.Name() && strings.HasPrefix(name, id) {
+			matches = append(matches, name)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("no such container: %s", id)
+	case 1:
+	default:
+		return nil, fmt.Errorf("container ID %s is ambiguous, it matches %d containers", id, len(matches))
+	}
+
+	state, err := readContainerState(matches[0])
+	if err != nil {
+		return nil, err
+	}
+	if !all && !state.running() {
+		return nil, fmt.Errorf("container %s is not running", shortContainerID(state.ID))
+	}
+	return state, nil
+}
+
+// listContainers returns the running containers, and with all those that exited within
+// exitedContainerRetention too, newest first. Records of containers which exited before that
+// are pruned.
+func listContainers(all bool) ([]*ContainerState, error) {
+	entries, err := os.ReadDir(containerStatePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	var containers []*ContainerState
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if id == entry.Name() {
+			continue
+		}
+		state, err := readContainerState(id)
+		if err != nil {
+			// The record may have been pruned by another listing since the directory was read
+			if !errors.Is(err, os.ErrNotExist) {
+				logger.Warn("skipping unreadable container state", "container", shortContainerID(id), "error", err)
+			}
+			continue
+		}
+		if !state.running() {
+			if time.Since(state.exitedAt()) > exitedContainerRetention {
+				if err := removeContainerState(id); err != nil {
+					logger.Warn("could not prune container state", "container", shortContainerID(id), "error", err)
+				}
+				continue
+			}
+			if !all {
+				continue
+			}
+		}
+		containers = append(containers, state)
+	}
+	sort.SliceStable(containers, func(i, j int) bool {
+		return containers[i].Created.After(containers[j].Created)
+	})
+	return containers, nil
+}
+
+// checkContainerName validates the name given with --name
+func checkContainerName(name string) error {
+	if !validContainerName.MatchString(name) {
+		return fmt.Errorf("invalid container name %q, only [a-zA-Z0-9][a-zA-Z0-9_.-] are allowed", name)
+	}
+	return nil
+}
+
+// NameReservation holds a container name for the run that took it, so that no other running
+// container is given the same name
+type NameReservation struct {
+	Name string
+	path string
+}
+
+// reserveContainerName takes name for this run. Like a network lease, the reservation holds the
+// pid of the run that took it, so that a name left behind by a run that died without releasing
+// it can be taken over.
+func reserveContainerName(name string) (*NameReservation, error) {
+	if err := os.MkdirAll(containerNamesPath, 0755); err != nil {
+		return nil, fmt.Errorf("could not create container name directory: %w", err)
+	}
+	dir, err := os.Open(containerNamesPath)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	if err := unix.Flock(int(dir.Fd()), unix.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("could not lock container names: %w", err)
+	}
+
+	path := filepath.Join(containerNamesPath, name)
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) && staleLease(path) && os.Remove(path) == nil {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return nil, fmt.Errorf("the container name %q is already in use by a running container", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not reserve container name: %w", err)
+	}
+	_, err = fmt.Fprintf(f, "%d\n", os.Getpid())
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("could not reserve container name: %w", err)
+	}
+	return &NameReservation{Name: name, path: path}, nil
+}
+
+// release frees the name for other containers
+func (r *NameReservation) release() error {
+	if err := os.Remove(r.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// running reports whether the container's init process is still alive, and not some other
+// process which has since been given its pid
+func (state *ContainerState) running() bool {
+	if state.FinishedAt != nil {
+		return false
+	}
+	startTime, err := processStartTime(state.Pid)
+	return err == nil && startTime == state.StartTime
+}
+
+// exitedAt is when an exited container finished, or, for one whose run died without recording
+// that, when it was created, the latest time known to be before it exited
+func (state *ContainerState) exitedAt() time.Time {
+	if state.FinishedAt != nil {
+		return *state.FinishedAt
+	}
+	return state.Created
+}
+
+// processStartTime reads when a process started from the 22nd field of /proc/<pid>/stat
+func processStartTime(pid int) (uint64, error) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name, the second field, is in parentheses and may hold spaces of its own
+	stat := string(data)
+	end := strings.LastIndexByte(stat, ')')
+	if end == -1 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useContainerState points the container state and name directories at directories removed
+// when the test ends
+func useContainerState(t *testing.T) {
+	t.Helper()
+	statePath, namesPath := containerStatePath, containerNamesPath
+	containerStatePath, containerNamesPath = t.TempDir(), t.TempDir()
+	t.Cleanup(func() { containerStatePath, containerNamesPath = statePath, namesPath })
+}
+
+func TestReserveContainerName(t *testing.T) {
+	useContainerState(t)
+
+	web, err := reserveContainerName("web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveContainerName("web"); err == nil || !strings.Contains(err.Error(), "already in use") {
+		t.Errorf("reserving a name in use gave %v", err)
+	}
+	if _, err := reserveContainerName("db"); err != nil {
+		t.Errorf("reserving another name gave %v", err)
+	}
+	if err := web.release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reserveContainerName("web"); err != nil {
+		t.Errorf("reserving a released name gave %v", err)
+	}
+
+	for _, name := range []string{"", "-web", "web/1", "we b"} {
+		if err := checkContainerName(name); err == nil {
+			t.Errorf("checkContainerName(%q) accepted an invalid name", name)
+		}
+	}
+}
+
+func TestLookupContainer(t *testing.T) {
+	useContainerState(t)
+	finished := time.Now().Add(-time.Minute)
+	containers := []*ContainerState{
+		{ID: "aaaa1111", Name: "web", Pid: os.Getpid(), Created: time.Now()},
+		{ID: "aaaa2222", Name: "web", Created: finished, FinishedAt: &finished},
+		{ID: "bbbb1111", Name: "db", Created: finished, FinishedAt: &finished},
+		{ID: "cccc1111", Name: "aaaa", Pid: os.Getpid(), Created: time.Now()},
+	}
+	for _, state := range containers {
+		save := writeContainerState
+		if state.FinishedAt == nil {
+			save = saveContainerState
+		}
+		if err := save(state); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		id      string
+		all     bool
+		want    string
+		wantErr string
+	}{
+		{id: "web", want: "aaaa1111"},
+		{id: "web", all: true, want: "aaaa1111"},
+		{id: "aaaa2", all: true, want: "aaaa2222"},
+		{id: "aaaa2", wantErr: "not running"},
+		{id: "aaaa", want: "cccc1111"},
+		{id: "aaaa1111", want: "aaaa1111"},
+		{id: "db", wantErr: "no such container"},
+		{id: "db", all: true, want: "bbbb1111"},
+		{id: "bbbb", all: true, want: "bbbb1111"},
+		{id: "a", wantErr: "ambiguous"},
+		{id: "dddd", all: true, wantErr: "no such container"},
+	}
+	for _, tt := range tests {
+		state, err := lookupContainer(tt.id, tt.all)
+		switch {
+		case tt.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("lookupContainer(%q, %t) gave %v, want an error containing %q", tt.id, tt.all, err, tt.wantErr)
+			}
+		case err != nil:
+			t.Errorf("lookupContainer(%q, %t) gave %v", tt.id, tt.all, err)
+		case state.ID != tt.want:
+			t.Errorf("lookupContainer(%q, %t) found %s, want %s", tt.id, tt.all, state.ID, tt.want)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"syscall"
+	"time"
+)
+
+// stopPollInterval is how often stop and rm check whether a container has exited
+const stopPollInterval = 100 * time.Millisecond
+
+// stopCommand sends SIGTERM to the command of each running container, then SIGKILL to those
+// still running after the grace period. A container is named by its name, its ID or a unique
+// prefix of its ID. The run that started the container tears it down once it exits.
+//
+// Usage: your_docker.sh stop [-t <seconds>] <container> [<container> ...]
+func stopCommand(arguments []string) {
+	flags := flag.NewFlagSet("stop", flag.ExitOnError)
+	grace := flags.Int("time", int(signalGracePeriod/time.Second), "seconds to wait for the container to exit before killing it")
+	flags.IntVar(grace, "t", int(signalGracePeriod/time.Second), "shorthand for --time")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+	if *grace < 0 {
+		fmt.Println("--time must not be negative")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, id := range flags.Args() {
+		state, err := findContainer(id)
+		if err == nil {
+			err = stopContainer(state, time.Duration(*grace)*time.Second)
+		}
+		if err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		fmt.Println(id)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// rmCommand forgets each exited container, so that it is no longer listed by ps -a. A running
+// container is only removed with --force, which kills it first.
+//
+// Usage: your_docker.sh rm [-f] <container> [<container> ...]
+func rmCommand(arguments []string) {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	force := flags.Bool("force", false, "kill a running container before removing it")
+	flags.BoolVar(force, "f", false, "shorthand for --force")
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() == 0 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+
+	failed := false
+	for _, id := range flags.Args() {
+		if err := removeContainer(id, *force); err != nil {
+			fmt.Println(err)
+			failed = true
+			continue
+		}
+		fmt.Println(id)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+func removeContainer(id string, force bool) error {
+	state, err := lookupContainer(id, true)
+	if err != nil {
+		return err
+	}
+	if state.running() {
+		if !force {
+			return fmt.Errorf("container %s is running, stop it first or remove it with --force", shortContainerID(state.ID))
+		}
+		if err := stopContainer(state, 0); err != nil {
+			return err
+		}
+	}
+	return removeContainerState(state.ID)
+}
+
+// stopContainer sends SIGTERM to a container's command, and SIGKILL if it has not exited after
+// grace, or straight away when grace is 0. As the command is pid 1 of its namespace, it is only
+// sent SIGTERM if it handles it.
+func stopContainer(state *ContainerState, grace time.Duration) error {
+	if grace > 0 {
+		if err := syscall.Kill(state.Pid, syscall.SIGTERM); err != nil {
+			return fmt.Errorf("could not stop container %s: %w", shortContainerID(state.ID), err)
+		}
+		if waitForExit(state, grace) {
+			return nil
+		}
+	}
+	if err := syscall.Kill(state.Pid, syscall.SIGKILL); err != nil && err != syscall.ESRCH {
+		return fmt.Errorf("could not kill container %s: %w", shortContainerID(state.ID), err)
+	}
+	if !waitForExit(state, signalGracePeriod) {
+		return fmt.Errorf("container %s did not exit after being killed", shortContainerID(state.ID))
+	}
+	return nil
+}
+
+// waitForExit waits up to timeout for a container to exit, reporting whether it has. It has
+// exited once the run that started it records its exit, or, should that run have died too, once
+// its process is gone by the time timeout is up.
+func waitForExit(state *ContainerState, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		current, err := readContainerState(state.ID)
+		if err != nil || current.FinishedAt != nil {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return !current.running()
+		}
+		time.Sleep(stopPollInterval)
+	}
+}
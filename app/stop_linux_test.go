@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRemoveContainer(t *testing.T) {
+	useContainerState(t)
+	finished := time.Now()
+	exited := &ContainerState{ID: "aaaa1111", Name: "web", Created: finished, FinishedAt: &finished}
+	running := &ContainerState{ID: "bbbb1111", Name: "db", Pid: os.Getpid(), Created: time.Now()}
+	if err := writeContainerState(exited); err != nil {
+		t.Fatal(err)
+	}
+	if err := saveContainerState(running); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := removeContainer("db", false); err == nil || !strings.Contains(err.Error(), "is running") {
+		t.Errorf("removing a running container gave %v", err)
+	}
+	if _, err := readContainerState(running.ID); err != nil {
+		t.Errorf("running container was removed: %v", err)
+	}
+
+	if err := removeContainer("web", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readContainerState(exited.ID); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("exited container was kept: %v", err)
+	}
+	if err := removeContainer("web", false); err == nil || !strings.Contains(err.Error(), "no such container") {
+		t.Errorf("removing a removed container gave %v", err)
+	}
+}
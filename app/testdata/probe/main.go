@@ -0,0 +1,161 @@
+// Command probe is run inside containers by the integration tests to report what it finds there.
+//
+// Usage: probe cat <file> ... | ls <dir> ... | write <file> <text> | stat <file> ... | pwd | env | hostname | id | tty | sleep | trap | ignore | serve <tcp|udp> <port> | exit <code>
+//
+// serve answers each TCP connection or UDP datagram sent to port with pong and what it was sent.
+// trap prints ready, then the name of the first SIGINT, SIGTERM or SIGHUP it receives, and exits.
+// ignore prints ready and sleeps, ignoring those signals.
+//
+// Installed as echo, it prints its arguments as echo does.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+func main() {
+	if filepath.Base(os.Args[0]) == "echo" {
+		fmt.Println(strings.Join(os.Args[1:], " "))
+		return
+	}
+	if len(os.Args) < 2 {
+		fmt.Fprintln(os.Stderr, "usage: probe <mode> [args]")
+		os.Exit(2)
+	}
+	args := os.Args[2:]
+	switch os.Args[1] {
+	case "cat":
+		for _, name := range args {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				fail(err)
+			}
+			os.Stdout.Write(data)
+		}
+	case "ls":
+		for _, name := range args {
+			entries, err := os.ReadDir(name)
+			if err != nil {
+				fail(err)
+			}
+			for _, entry := range entries {
+				fmt.Println(entry.Name())
+			}
+		}
+	case "write":
+		if err := os.WriteFile(args[0], []byte(args[1]), 0644); err != nil {
+			fail(err)
+		}
+	case "stat":
+		for _, name := range args {
+			var st syscall.Stat_t
+			if err := syscall.Lstat(name, &st); err != nil {
+				fail(err)
+			}
+			switch st.Mode & syscall.S_IFMT {
+			case syscall.S_IFCHR:
+				fmt.Printf("%s c %d %d\n", name, (st.Rdev>>8)&0xfff, st.Rdev&0xff|(st.Rdev>>12)&^0xff)
+			case syscall.S_IFLNK:
+				target, err := os.Readlink(name)
+				if err != nil {
+					fail(err)
+				}
+				fmt.Printf("%s -> %s\n", name, target)
+			case syscall.S_IFDIR:
+				fmt.Printf("%s d\n", name)
+			default:
+				fmt.Printf("%s %o\n", name, st.Mode&syscall.S_IFMT)
+			}
+		}
+	case "pwd":
+		dir, err := os.Getwd()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(dir)
+	case "env":
+		fmt.Println(strings.Join(os.Environ(), "\n"))
+	case "hostname":
+		name, err := os.Hostname()
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(name)
+	case "id":
+		fmt.Printf("pid=%d uid=%d gid=%d\n", os.Getpid(), os.Getuid(), os.Getgid())
+	case "tty":
+		fmt.Printf("stdin=%t stdout=%t\n", isTerminal(os.Stdin), isTerminal(os.Stdout))
+	case "sleep":
+		time.Sleep(time.Hour)
+	case "trap":
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		fmt.Println("ready")
+		fmt.Println(<-signals)
+	case "ignore":
+		signal.Ignore(syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+		fmt.Println("ready")
+		time.Sleep(time.Hour)
+	case "serve":
+		serve(args[0], args[1])
+	case "exit":
+		code, err := strconv.Atoi(args[0])
+		if err != nil {
+			fail(err)
+		}
+		os.Exit(code)
+	default:
+		fail(fmt.Errorf("unknown mode %q", os.Args[1]))
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	var termios syscall.Termios
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), syscall.TCGETS, uintptr(unsafe.Pointer(&termios)))
+	return errno == 0
+}
+
+func serve(protocol, port string) {
+	if protocol == "udp" {
+		conn, err := net.ListenPacket("udp", ":"+port)
+		if err != nil {
+			fail(err)
+		}
+		buf := make([]byte, 65535)
+		for {
+			n, client, err := conn.ReadFrom(buf)
+			if err != nil {
+				fail(err)
+			}
+			conn.WriteTo(append([]byte("pong "), buf[:n]...), client)
+		}
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		fail(err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fail(err)
+		}
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		fmt.Fprintf(conn, "pong %s", line)
+		conn.Close()
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
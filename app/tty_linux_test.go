@@ -0,0 +1,138 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestOpenPTY(t *testing.T) {
+	master, slave, path, err := openPTY()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	if slave.Name() != path {
+		t.Errorf("slave is %s, want %s", slave.Name(), path)
+	}
+	if _, err := slave.Write([]byte("out\n")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := master.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The slave's line discipline translates newlines on output
+	if got := string(buf[:n]); got != "out\r\n" {
+		t.Errorf("master read %q, want %q", got, "out\r\n")
+	}
+
+	pipeReader, pipeWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pipeReader.Close()
+	defer pipeWriter.Close()
+	tests := []struct {
+		name string
+		f    *os.File
+		want bool
+	}{
+		{name: "slave", f: slave, want: true},
+		{name: "master", f: master, want: true},
+		{name: "pipe", f: pipeReader, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isTerminal(tt.f); got != tt.want {
+				t.Errorf("isTerminal = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeRaw(t *testing.T) {
+	master, slave, _, err := openPTY()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	defer master.Close()
+	defer slave.Close()
+
+	termios := func() *unix.Termios {
+		t.Helper()
+		termios, err := unix.IoctlGetTermios(int(slave.Fd()), unix.TCGETS)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return termios
+	}
+	original := termios()
+	restore, err := makeRaw(slave)
+	if err != nil {
+		t.Fatalf("makeRaw: %v", err)
+	}
+
+	raw := termios()
+	tests := []struct {
+		name  string
+		flags uint32
+		bits  uint32
+		want  uint32
+	}{
+		{name: "no echo", flags: raw.Lflag, bits: unix.ECHO, want: 0},
+		{name: "not canonical", flags: raw.Lflag, bits: unix.ICANON, want: 0},
+		{name: "no signal characters", flags: raw.Lflag, bits: unix.ISIG, want: 0},
+		{name: "no output processing", flags: raw.Oflag, bits: unix.OPOST, want: 0},
+		{name: "no carriage return translation", flags: raw.Iflag, bits: unix.ICRNL, want: 0},
+		{name: "eight bit characters", flags: raw.Cflag, bits: unix.CSIZE, want: unix.CS8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.flags & tt.bits; got != tt.want {
+				t.Errorf("flags hold %#x, want %#x", got, tt.want)
+			}
+		})
+	}
+
+	restore()
+	if restored := termios(); *restored != *original {
+		t.Errorf("terminal settings are %+v after restoring, want %+v", restored, original)
+	}
+}
+
+func TestRunTTY(t *testing.T) {
+	requireContainers(t)
+	master, slave, _, err := openPTY()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err)
+	}
+	master.Close()
+	slave.Close()
+
+	tests := []struct {
+		name       string
+		flags      []string
+		wantStdout string
+	}{
+		{name: "without", wantStdout: "stdin=false stdout=false\n"},
+		{name: "tty", flags: []string{"--tty"}, wantStdout: "stdin=true stdout=true\r\n"},
+		{name: "shorthand", flags: []string{"-t"}, wantStdout: "stdin=true stdout=true\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runProbe(t, tt.flags, "tty")
+			if code != 0 {
+				t.Fatalf("run exited with %d: %s%s", code, stdout, stderr)
+			}
+			if stdout != tt.wantStdout {
+				t.Errorf("run printed %q, want %q", stdout, tt.wantStdout)
+			}
+		})
+	}
+}
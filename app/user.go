@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ContainerUser is the identity the container command runs as
+type ContainerUser struct {
+	UID    int
+	GID    int
+	Groups []int
+}
+
+// resolveUser resolves a user specification of the form user[:group], where each part is either
+// a name or a numeric ID, against the container's passwd and group files. Names must exist, while
+// numeric IDs are used as-is.
+func resolveUser(spec, passwdPath, groupPath string) (*ContainerUser, error) {
+	userPart, groupPart, hasGroup := strings.Cut(spec, ":")
+	if userPart == "" || (hasGroup && groupPart == "") {
+		return nil, fmt.Errorf("invalid user %q", spec)
+	}
+
+	passwd, err := readColonFile(passwdPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	groups, err := readColonFile(groupPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	user := &ContainerUser{}
+	userName := ""
+	if uid, err := strconv.Atoi(userPart); err == nil {
+		user.UID = uid
+		// Numeric users take their primary group from passwd when they have an entry
+		for _, entry := range passwd {
+			if len(entry) > 3 && entry[2] == userPart {
+				userName = entry[0]
+				user.GID, _ = strconv.Atoi(entry[3])
+				break
+			}
+		}
+	} else {
+		found := false
+		for _, entry := range passwd {
+			if len(entry) > 3 && entry[0] == userPart {
+				if user.UID, err = strconv.Atoi(entry[2]); err != nil {
+					return nil, fmt.Errorf("invalid uid for user %s in %s", userPart, passwdPath)
+				}
+				if user.GID, err = strconv.Atoi(entry[3]); err != nil {
+					return nil, fmt.Errorf("invalid gid for user %s in %s", userPart, passwdPath)
+				}
+				userName, found = userPart, true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unable to find user %s: no matching entries in passwd file", userPart)
+		}
+	}
+
+	if hasGroup {
+		if gid, err := strconv.Atoi(groupPart); err == nil {
+			user.GID = gid
+		} else {
+			found := false
+			for _, entry := range groups {
+				if len(entry) > 2 && entry[0] == groupPart {
+					if user.GID, err = strconv.Atoi(entry[2]); err != nil {
+						return nil, fmt.Errorf("invalid gid for group %s in %s", groupPart, groupPath)
+					}
+					found = true
+					break
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("unable to find group %s: no matching entries in group file", groupPart)
+			}
+		}
+	}
+
+	// Supplementary groups are those listing the user as a member
+	user.Groups = []int{user.GID}
+	if userName != "" {
+		for _, entry := range groups {
+			if len(entry) < 4 {
+				continue
+			}
+			for _, member := range strings.Split(entry[3], ",") {
+				if member != userName {
+					continue
+				}
+				if gid, err := strconv.Atoi(entry[2]); err == nil && gid != user.GID {
+					user.Groups = append(user.Groups, gid)
+				}
+			}
+		}
+	}
+	return user, nil
+}
+
+// readColonFile reads a colon separated database such as /etc/passwd, skipping comments
+func readColonFile(path string) ([][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, scanner.Err()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestResolveUser(t *testing.T) {
+	dir := t.TempDir()
+	passwd := filepath.Join(dir, "passwd")
+	group := filepath.Join(dir, "group")
+	if err := os.WriteFile(passwd, []byte(strings.Join([]string{
+		"# users",
+		"root:x:0:0:root:/root:/bin/sh",
+		"nginx:x:101:101:nginx:/var/cache/nginx:/sbin/nologin",
+		"dev:x:1000:1000::/home/dev:/bin/sh",
+		"broken:x:abc:1000::/:/bin/sh",
+	}, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(group, []byte(strings.Join([]string{
+		"root:x:0:",
+		"nginx:x:101:",
+		"dev:x:1000:",
+		"wheel:x:10:root,dev",
+		"docker:x:999:dev",
+	}, "\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec    string
+		missing bool
+		want    *ContainerUser
+		// wantErr is part of the error expected, if any
+		wantErr string
+	}{
+		{spec: "root", want: &ContainerUser{UID: 0, GID: 0, Groups: []int{0, 10}}},
+		{spec: "nginx", want: &ContainerUser{UID: 101, GID: 101, Groups: []int{101}}},
+		{spec: "dev", want: &ContainerUser{UID: 1000, GID: 1000, Groups: []int{1000, 10, 999}}},
+		{spec: "1000", want: &ContainerUser{UID: 1000, GID: 1000, Groups: []int{1000, 10, 999}}},
+		{spec: "4242", want: &ContainerUser{UID: 4242, GID: 0, Groups: []int{0}}},
+		{spec: "dev:docker", want: &ContainerUser{UID: 1000, GID: 999, Groups: []int{999, 10}}},
+		{spec: "nginx:50", want: &ContainerUser{UID: 101, GID: 50, Groups: []int{50}}},
+		{spec: "4242:4242", want: &ContainerUser{UID: 4242, GID: 4242, Groups: []int{4242}}},
+		{spec: "1000:1000", missing: true, want: &ContainerUser{UID: 1000, GID: 1000, Groups: []int{1000}}},
+		{spec: "nobody", wantErr: "unable to find user nobody"},
+		{spec: "dev:staff", wantErr: "unable to find group staff"},
+		{spec: "broken", wantErr: "invalid uid for user broken"},
+		{spec: "nobody", missing: true, wantErr: "unable to find user nobody"},
+		{spec: ":1000", wantErr: "invalid user"},
+		{spec: "dev:", wantErr: "invalid user"},
+	}
+
+	for _, tt := range tests {
+		name := tt.spec
+		if tt.missing {
+			name += " without passwd"
+		}
+		t.Run(name, func(t *testing.T) {
+			passwdPath, groupPath := passwd, group
+			if tt.missing {
+				passwdPath, groupPath = filepath.Join(dir, "missing"), filepath.Join(dir, "missing")
+			}
+			got, err := resolveUser(tt.spec, passwdPath, groupPath)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("resolveUser gave %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("resolveUser gave %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
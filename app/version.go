@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/debug"
+)
+
+// version and commit identify the build, and are set when building a release with
+// go build -ldflags "-X main.version=<version> -X main.commit=<commit>". Otherwise they are
+// taken from what the go command recorded in the binary, where it recorded anything.
+var (
+	version string
+	commit  string
+)
+
+// versionCommand prints which build of the tool is running
+//
+// Usage: your_docker.sh version
+func versionCommand(arguments []string) {
+	flags := flag.NewFlagSet("version", flag.ExitOnError)
+	flags.Parse(arguments)
+	if err := checkFlags(flags, arguments, nil); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if flags.NArg() != 0 {
+		fmt.Println("Incorrect number of arguments specified.")
+		os.Exit(1)
+	}
+
+	version, commit := buildVersion()
+	fmt.Printf("Version:     %s\n", version)
+	fmt.Printf("Git commit:  %s\n", commit)
+	fmt.Printf("Go version:  %s\n", runtime.Version())
+	fmt.Printf("OS/Arch:     %s/%s\n", runtime.GOOS, runtime.GOARCH)
+}
+
+// buildVersion returns the version and git commit of the running binary, preferring those set
+// with -ldflags over the module version and VCS revision the go command stamps into builds of
+// a package from within its repository. Builds from a list of files, as your_docker.sh makes,
+// carry neither, and are reported as development builds.
+func buildVersion() (string, string) {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+		if c == "" {
+			var modified bool
+			for _, setting := range info.Settings {
+				switch setting.Key {
+				case "vcs.revision":
+					c = setting.Value
+				case "vcs.modified":
+					modified = setting.Value == "true"
+				}
+			}
+			if c != "" && modified {
+				c += "-dirty"
+			}
+		}
+	}
+	if v == "" {
+		v = "(devel)"
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	return v, c
+}
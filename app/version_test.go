@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestBuildVersion(t *testing.T) {
+	tests := []struct {
+		name            string
+		version, commit string
+		// The test binary carries no module version or VCS revision to fall back to
+		wantVersion, wantCommit string
+	}{
+		{name: "set with -ldflags", version: "v1.2.3", commit: "0123abc", wantVersion: "v1.2.3", wantCommit: "0123abc"},
+		{name: "version only", version: "v1.2.3", wantVersion: "v1.2.3", wantCommit: "unknown"},
+		{name: "commit only", commit: "0123abc", wantVersion: "(devel)", wantCommit: "0123abc"},
+		{name: "development build", wantVersion: "(devel)", wantCommit: "unknown"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			previousVersion, previousCommit := version, commit
+			version, commit = tt.version, tt.commit
+			t.Cleanup(func() { version, commit = previousVersion, previousCommit })
+
+			gotVersion, gotCommit := buildVersion()
+			if gotVersion != tt.wantVersion || gotCommit != tt.wantCommit {
+				t.Errorf("buildVersion() = %q, %q, want %q, %q", gotVersion, gotCommit, tt.wantVersion, tt.wantCommit)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BindMount describes a host path made visible inside the container
+type BindMount struct {
+	Source      string
+	Destination string
+	ReadOnly    bool
+}
+
+// protectedHostPaths may not be bind mounted into a container, either exactly or, for those marked
+// as trees, anywhere beneath them
+var protectedHostPaths = map[string]bool{
+	"/":     false,
+	"/proc": true,
+	"/sys":  true,
+	"/dev":  true,
+	"/boot": true,
+	// The layer store can only be mounted read-only through --expose-cache
+	filepath.Dir(ImageLayersPath): true,
+}
+
+// parseVolume parses a host:container[:ro|rw] volume specification. The host path is canonicalised
+// with every symlink resolved, so that a symlink cannot be used to mount an unintended host directory.
+func parseVolume(spec string) (*BindMount, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("invalid volume %q, expected host-path:container-path[:ro]", spec)
+	}
+
+	readOnly := false
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			readOnly = true
+		case "rw":
+		default:
+			return nil, fmt.Errorf("invalid volume %q, unknown mode %q", spec, parts[2])
+		}
+	}
+
+	if !filepath.IsAbs(parts[1]) {
+		return nil, fmt.Errorf("invalid volume %q, the container path must be absolute", spec)
+	}
+
+	if _, err := os.Stat(parts[0]); os.IsNotExist(err) {
+		return nil, fmt.Errorf("invalid volume %q: host path %s does not exist", spec, parts[0])
+	}
+
+	source, err := canonicalHostPath(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid volume %q: %w", spec, err)
+	}
+	if source != filepath.Clean(parts[0]) {
+		logger.Debug("resolved volume source", "source", parts[0], "resolved", source)
+	}
+
+	return &BindMount{Source: source, Destination: filepath.Clean(parts[1]), ReadOnly: readOnly}, nil
+}
+
+// canonicalHostPath resolves path to an absolute path free of symlinks and rejects protected host paths
+func canonicalHostPath(path string) (string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return "", err
+	}
+
+	for protected, tree := range protectedHostPaths {
+		if resolved == protected || (tree && withinDir(protected, resolved)) {
+			if resolved != abs {
+				return "", fmt.Errorf("%s resolves to the protected host path %s", path, resolved)
+			}
+			return "", fmt.Errorf("%s is a protected host path", path)
+		}
+	}
+	return resolved, nil
+}
+
+// cacheMount exposes the layer store read-only at destination. It deliberately bypasses the
+// protected path check that would otherwise refuse the layer store.
+func cacheMount(destination string) (*BindMount, error) {
+	if !filepath.IsAbs(destination) {
+		return nil, fmt.Errorf("invalid cache path %q, the container path must be absolute", destination)
+	}
+	if err := os.MkdirAll(ImageLayersPath, 0600); err != nil {
+		return nil, err
+	}
+	return &BindMount{Source: ImageLayersPath, Destination: filepath.Clean(destination), ReadOnly: true}, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseVolume(t *testing.T) {
+	host := t.TempDir()
+	file := filepath.Join(host, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	linked := filepath.Join(t.TempDir(), "linked")
+	if err := os.Symlink(host, linked); err != nil {
+		t.Fatal(err)
+	}
+	toProc := filepath.Join(t.TempDir(), "proc")
+	if err := os.Symlink("/proc", toProc); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		spec string
+		want *BindMount
+		// wantErr is part of the error expected, if any
+		wantErr string
+	}{
+		{spec: host + ":/data", want: &BindMount{Source: host, Destination: "/data"}},
+		{spec: host + ":/data:ro", want: &BindMount{Source: host, Destination: "/data", ReadOnly: true}},
+		{spec: host + ":/data/../srv/:rw", want: &BindMount{Source: host, Destination: "/srv"}},
+		{spec: file + ":/etc/file", want: &BindMount{Source: file, Destination: "/etc/file"}},
+		{spec: linked + ":/data", want: &BindMount{Source: host, Destination: "/data"}},
+		{spec: host, wantErr: "expected host-path:container-path"},
+		{spec: ":/data", wantErr: "expected host-path:container-path"},
+		{spec: host + ":/data:ro:extra", wantErr: "expected host-path:container-path"},
+		{spec: host + ":/data:rx", wantErr: `unknown mode "rx"`},
+		{spec: host + ":data", wantErr: "must be absolute"},
+		{spec: filepath.Join(host, "missing") + ":/data", wantErr: "does not exist"},
+		{spec: "/:/host", wantErr: "is a protected host path"},
+		{spec: "/proc:/host/proc", wantErr: "is a protected host path"},
+		{spec: "/proc/self:/host/proc", wantErr: "protected host path"},
+		{spec: "/sys/kernel:/host/kernel", wantErr: "is a protected host path"},
+		{spec: toProc + ":/host/proc", wantErr: "resolves to the protected host path /proc"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseVolume(tt.spec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseVolume gave %v, want an error containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *got != *tt.want {
+				t.Errorf("parseVolume gave %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}
+
+func TestCacheMount(t *testing.T) {
+	useLayerStore(t)
+
+	tests := []struct {
+		destination string
+		want        *BindMount
+		wantErr     bool
+	}{
+		{destination: "/cache", want: &BindMount{Source: ImageLayersPath, Destination: "/cache", ReadOnly: true}},
+		{destination: "/var/cache/layers/", want: &BindMount{Source: ImageLayersPath, Destination: "/var/cache/layers", ReadOnly: true}},
+		{destination: "cache", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.destination, func(t *testing.T) {
+			got, err := cacheMount(tt.destination)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("cacheMount gave error %v, want error %t", err, tt.wantErr)
+			}
+			if err == nil && *got != *tt.want {
+				t.Errorf("cacheMount gave %+v, want %+v", *got, *tt.want)
+			}
+		})
+	}
+}